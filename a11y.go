@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// statusPhrases are the building blocks of a spoken status line in one language
+type statusPhrases struct {
+	speaking  string // %s is the active client
+	paused    string
+	elapsed   string // %s is a duration
+	remaining string
+	next      string // %s is the client up next
+	waiting   string
+	finished  string
+	minute    [2]string // singular, plural
+	second    [2]string
+}
+
+// statusLanguages are the languages a session can be narrated in, keyed by
+// the code sent in the settings
+var statusLanguages = map[string]statusPhrases{
+	"en": {
+		speaking: "%s speaking", paused: "%s paused",
+		elapsed: "%s elapsed", remaining: "%s remaining", next: "%s next",
+		waiting: "Waiting for participants", finished: "Session finished",
+		minute: [2]string{"minute", "minutes"}, second: [2]string{"second", "seconds"},
+	},
+	"it": {
+		speaking: "Parla %s", paused: "%s in pausa",
+		elapsed: "%s trascorsi", remaining: "%s rimanenti", next: "poi %s",
+		waiting: "In attesa dei partecipanti", finished: "Sessione terminata",
+		minute: [2]string{"minuto", "minuti"}, second: [2]string{"secondo", "secondi"},
+	},
+	"es": {
+		speaking: "Habla %s", paused: "%s en pausa",
+		elapsed: "%s transcurridos", remaining: "quedan %s", next: "después %s",
+		waiting: "Esperando participantes", finished: "Sesión terminada",
+		minute: [2]string{"minuto", "minutos"}, second: [2]string{"segundo", "segundos"},
+	},
+	"fr": {
+		speaking: "%s parle", paused: "%s en pause",
+		elapsed: "%s écoulées", remaining: "%s restantes", next: "ensuite %s",
+		waiting: "En attente des participants", finished: "Session terminée",
+		minute: [2]string{"minute", "minutes"}, second: [2]string{"seconde", "secondes"},
+	},
+	"de": {
+		speaking: "%s spricht", paused: "%s pausiert",
+		elapsed: "%s vergangen", remaining: "%s verbleibend", next: "danach %s",
+		waiting: "Warten auf Teilnehmende", finished: "Sitzung beendet",
+		minute: [2]string{"Minute", "Minuten"}, second: [2]string{"Sekunde", "Sekunden"},
+	},
+}
+
+// statusLine describes what a screen reader should announce for a state update
+type statusLine struct {
+	active    string
+	next      string
+	running   bool
+	finished  bool
+	elapsed   time.Duration
+	remaining time.Duration // only used with a countdown
+	countdown bool
+}
+
+// text renders the status in the given language, leaving the clock out when
+// withTime is false
+func (l statusLine) text(language string, withTime bool) string {
+	p, ok := statusLanguages[language]
+	if !ok {
+		p = statusLanguages["en"]
+	}
+	if l.finished {
+		return p.finished
+	}
+	if l.active == "" {
+		return p.waiting
+	}
+
+	parts := []string{}
+	if l.running {
+		parts = append(parts, fmt.Sprintf(p.speaking, l.active))
+	} else {
+		parts = append(parts, fmt.Sprintf(p.paused, l.active))
+	}
+	if withTime {
+		if l.countdown {
+			parts = append(parts, fmt.Sprintf(p.remaining, p.duration(l.remaining)))
+		} else {
+			parts = append(parts, fmt.Sprintf(p.elapsed, p.duration(l.elapsed)))
+		}
+	}
+	if l.next != "" && l.next != l.active {
+		parts = append(parts, fmt.Sprintf(p.next, l.next))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// duration spells d out in whole minutes and seconds, e.g. "1 minute 20 seconds"
+func (p statusPhrases) duration(d time.Duration) string {
+	total := int(d.Seconds())
+	minutes, seconds := total/60, total%60
+	unit := func(n int, names [2]string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, names[0])
+		}
+		return fmt.Sprintf("%d %s", n, names[1])
+	}
+	if minutes == 0 {
+		return unit(seconds, p.second)
+	}
+	if seconds == 0 {
+		return unit(minutes, p.minute)
+	}
+	return unit(minutes, p.minute) + " " + unit(seconds, p.second)
+}
+
+// statusLine describes the turn of active, stateMux must be held
+func (s *Session) statusLine(active, next string, elapsed time.Duration) statusLine {
+	status := statusLine{
+		active:   active,
+		next:     next,
+		running:  s.isRunning,
+		finished: s.finished,
+		elapsed:  elapsed,
+	}
+	if s.settings.CountdownMs > 0 {
+		status.countdown = true
+		status.remaining = max(time.Duration(s.settings.CountdownMs)*time.Millisecond-elapsed, 0)
+	}
+	return status
+}
+
+// statusText renders the session's status line on its own, for integrations
+func (s *Session) statusText() string {
+	s.clientsMux.Lock()
+	active, next := s.activeClientID, s.upNext()
+	s.clientsMux.Unlock()
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	elapsed := s.elapsed
+	if s.isRunning {
+		elapsed += time.Since(s.startTime)
+	}
+	return s.statusLine(active, next, elapsed).text(s.settings.Language, !s.clockHidden())
+}
+
+// upNext guesses who takes over after the active client, clientsMux must be held
+func (s *Session) upNext() string {
+	if len(s.claimQueue) > 0 {
+		return s.claimQueue[0]
+	}
+	for i, id := range s.clientOrder {
+		if id == s.activeClientID && len(s.clientOrder) > 1 {
+			return s.nextInOrder(i)
+		}
+	}
+	return ""
+}
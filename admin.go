@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The admin API lets operators look at the whole instance. It is off unless
+// PASTATIME_ADMIN_TOKEN is set, and every request must carry that token as
+// "Authorization: Bearer <token>".
+
+// adminToken is read once at startup, empty disables the admin API
+var adminToken string
+
+// SessionInfo is one session as the admin API lists it
+type SessionInfo struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Priority     string    `json:"priority"`
+	Tags         []string  `json:"tags,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	Clients      int       `json:"clients"` // connected participants and devices
+	Participants int       `json:"participants"`
+	ActiveClient string    `json:"activeClient,omitempty"`
+	Running      bool      `json:"running"`
+	Finished     bool      `json:"finished,omitempty"`
+	Round        int       `json:"round"`
+	Laps         int       `json:"laps"`
+	// Broadcasts counts the state and event broadcasts since the session
+	// was created, poll it twice for a rate
+	Broadcasts uint64    `json:"broadcasts"`
+	Resources  Resources `json:"resources"`
+}
+
+// InstanceInfo is the admin API's overview of the instance
+type InstanceInfo struct {
+	Now      time.Time     `json:"now"`
+	Panics   int64         `json:"panics"` // recovered since the server started
+	Loaded   bool          `json:"loaded"` // low-priority sessions are ticking slower
+	Limits   BreakerLimits `json:"limits"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// adminAuthorized checks the request's bearer token against adminToken
+func adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requireAdmin turns away requests without the admin token, reporting
+// whether the request may go on. Without a token configured the route
+// doesn't exist.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if !adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// info sums the session up for the admin API
+func (s *Session) info() SessionInfo {
+	info := SessionInfo{
+		ID:         s.ID,
+		CreatedAt:  s.createdAt,
+		Broadcasts: s.broadcasts.Load(),
+		Resources:  s.resourceUsage(),
+	}
+	s.clientsMux.Lock()
+	for _, client := range s.clients {
+		if !client.offline {
+			info.Clients++
+		}
+	}
+	info.Participants = s.participantCount()
+	info.ActiveClient = s.activeClientID
+	s.clientsMux.Unlock()
+
+	s.stateMux.Lock()
+	info.Title = s.title()
+	info.Priority = s.priority()
+	info.Tags = s.settings.Tags
+	info.Running = s.isRunning
+	info.Finished = s.finished
+	info.Round = s.currentRound()
+	info.Laps = s.lapCount()
+	s.stateMux.Unlock()
+	return info
+}
+
+// handleAdmin routes /admin/api/sessions, /admin/api/sessions/{id}/...,
+// /admin/api/diagnostics, /admin/api/drain, /admin/api/notice,
+// /admin/api/archive, /admin/api/deleted/... and /admin/api/templates/...
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin/api/")
+	if path == "sessions" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAdminSessions(w, r)
+		return
+	}
+	if path == "diagnostics" {
+		handleAdminDiagnostics(w, r)
+		return
+	}
+	if path == "drain" {
+		handleAdminDrain(w, r)
+		return
+	}
+	if path == "migration" {
+		handleAdminMigration(w, r)
+		return
+	}
+	if path == "archive" {
+		handleAdminArchiveExport(w, r)
+		return
+	}
+	if rest, ok := strings.CutPrefix(path, "deleted"); ok && (rest == "" || rest[0] == '/') {
+		handleAdminDeleted(w, r, strings.TrimPrefix(rest, "/"))
+		return
+	}
+	if path == "notice" {
+		handleAdminNotice(w, r)
+		return
+	}
+	if name, ok := strings.CutPrefix(path, "templates"); ok && (name == "" || name[0] == '/') {
+		handleAdminTemplates(w, r, strings.TrimPrefix(name, "/"))
+		return
+	}
+
+	// /admin/api/sessions/{id}/...
+	rest, ok := strings.CutPrefix(path, "sessions/")
+	sessionID, resource, _ := strings.Cut(rest, "/")
+	session, exists := sessionStore.Get(sessionID)
+	if !ok || !exists {
+		http.NotFound(w, r)
+		return
+	}
+	switch resource {
+	case "priority":
+		handleAdminPriority(w, r, session)
+	case "tags":
+		handleAdminTags(w, r, session)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAdminSessions serves GET /admin/api/sessions, newest session first,
+// only those with every ?tag= given
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	all := sessionStore.List()
+	tags := tagsFromQuery(r)
+	instance := InstanceInfo{Now: time.Now(), Panics: panics.Value(), Loaded: serverLoaded.Load(), Limits: breakerLimits, Sessions: make([]SessionInfo, 0, len(all))}
+	for _, session := range all {
+		if info := session.info(); hasTags(info.Tags, tags) {
+			instance.Sessions = append(instance.Sessions, info)
+		}
+	}
+	sort.Slice(instance.Sessions, func(i, j int) bool {
+		return instance.Sessions[i].CreatedAt.After(instance.Sessions[j].CreatedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(instance)
+}
+
+// adminTokenFromEnv reads PASTATIME_ADMIN_TOKEN
+func adminTokenFromEnv() string {
+	return os.Getenv("PASTATIME_ADMIN_TOKEN")
+}
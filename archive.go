@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions that finish, or expire unfinished, leave a summary in the
+// archive, which GET /history pages through newest first. The archive sits
+// next to the saved sessions when persistence is on and in memory otherwise.
+// It names every session on the server, and the IDs open them, so only
+// admins can read it.
+
+const (
+	// maxMemoryArchive is how many entries the in-memory archive keeps
+	maxMemoryArchive = 1000
+	// maxStoredArchive is how many entries a durable archive keeps
+	maxStoredArchive = 10000
+	defaultPerPage   = 20
+	maxPerPage       = 100
+)
+
+// ArchiveEntry sums up a past session
+type ArchiveEntry struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Template     string     `json:"template,omitempty"` // the session started from
+	CreatedAt    time.Time  `json:"createdAt"`
+	ArchivedAt   time.Time  `json:"archivedAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"` // nil when it expired
+	Reason       string     `json:"reason"`
+	DurationMs   int64      `json:"durationMs"`
+	ActiveMs     int64      `json:"activeMs"`
+	Participants []string   `json:"participants"`
+	Laps         int        `json:"laps"`
+	Rounds       int        `json:"rounds"`
+	Winners      []string   `json:"winners,omitempty"`
+}
+
+// History is a page of the archive
+type History struct {
+	Entries []ArchiveEntry `json:"entries"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"perPage"`
+	Total   int            `json:"total"`
+}
+
+// ArchiveQuery picks archive entries, what is left empty matches anything
+type ArchiveQuery struct {
+	Name        string   // part of the name, any case
+	Tags        []string // every one of them
+	Participant string   // one of the participants, any case
+	Template    string   // the template the session started from
+	From, To    time.Time
+	// Before only matches the entries archived after the end of a previous
+	// page, so paging goes on where it left off while sessions are archived
+	Before *ArchiveCursor
+}
+
+// ArchiveCursor is the place of an entry in the archive, which is ordered by
+// the millisecond it was archived and then by ID
+type ArchiveCursor struct {
+	ArchivedAt int64 // Unix milliseconds
+	ID         string
+}
+
+// cursor is where the entry sits in the archive
+func (entry ArchiveEntry) cursor() ArchiveCursor {
+	return ArchiveCursor{ArchivedAt: entry.ArchivedAt.UnixMilli(), ID: entry.ID}
+}
+
+// before reports whether c comes before other, newest first
+func (c ArchiveCursor) before(other ArchiveCursor) bool {
+	if c.ArchivedAt != other.ArchivedAt {
+		return c.ArchivedAt > other.ArchivedAt
+	}
+	return c.ID > other.ID
+}
+
+// String encodes the cursor for a URL, like "1767225600000.salty-penne-42"
+func (c ArchiveCursor) String() string {
+	return strconv.FormatInt(c.ArchivedAt, 10) + "." + c.ID
+}
+
+// parseArchiveCursor reads a cursor String wrote
+func parseArchiveCursor(value string) (*ArchiveCursor, error) {
+	at, id, ok := strings.Cut(value, ".")
+	archivedAt, err := strconv.ParseInt(at, 10, 64)
+	if !ok || err != nil || !validSessionID(id) {
+		return nil, errors.New("invalid cursor")
+	}
+	return &ArchiveCursor{ArchivedAt: archivedAt, ID: id}, nil
+}
+
+// matches reports whether the entry is one the query asks for
+func (q ArchiveQuery) matches(entry ArchiveEntry) bool {
+	if q.Name != "" && !strings.Contains(strings.ToLower(entry.Name), strings.ToLower(q.Name)) {
+		return false
+	}
+	if !hasTags(entry.Tags, q.Tags) {
+		return false
+	}
+	if q.Participant != "" && !slices.ContainsFunc(entry.Participants, func(name string) bool {
+		return strings.EqualFold(name, q.Participant)
+	}) {
+		return false
+	}
+	if q.Template != "" && entry.Template != q.Template {
+		return false
+	}
+	if !q.From.IsZero() && entry.CreatedAt.Before(q.From) {
+		return false
+	}
+	if q.Before != nil && !q.Before.before(entry.cursor()) {
+		return false
+	}
+	return q.To.IsZero() || entry.CreatedAt.Before(q.To)
+}
+
+// archiveStore keeps the archive
+type archiveStore interface {
+	archive(entry ArchiveEntry) error
+	// history returns up to limit entries matching query newest first, by
+	// their ArchiveCursor, after skipping offset, and how many match in all
+	history(query ArchiveQuery, offset int, limit int) ([]ArchiveEntry, int, error)
+}
+
+// archive is where finished sessions go, see main for the store it uses
+var archive archiveStore = &memoryArchive{}
+
+// memoryArchive keeps the newest maxMemoryArchive entries
+type memoryArchive struct {
+	mu      sync.Mutex
+	entries []ArchiveEntry // oldest first
+}
+
+func (a *memoryArchive) archive(entry ArchiveEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) >= maxMemoryArchive {
+		a.entries = append(a.entries[:0], a.entries[len(a.entries)-maxMemoryArchive+1:]...)
+	}
+	// Kept oldest first, sessions finishing together can be archived out of
+	// order
+	i := len(a.entries)
+	for i > 0 && a.entries[i-1].cursor().before(entry.cursor()) {
+		i--
+	}
+	a.entries = slices.Insert(a.entries, i, entry)
+	return nil
+}
+
+func (a *memoryArchive) history(query ArchiveQuery, offset int, limit int) ([]ArchiveEntry, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	page := []ArchiveEntry{}
+	total := 0
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		if !query.matches(a.entries[i]) {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, a.entries[i])
+		}
+		total++
+	}
+	return page, total, nil
+}
+
+// archiveEntry sums up the session once it finished, stateMux must be held
+func (s *Session) archiveEntry() ArchiveEntry {
+	entry := ArchiveEntry{
+		ID:         s.ID,
+		Name:       s.settings.Name,
+		Tags:       s.settings.Tags,
+		Template:   s.settings.Template,
+		CreatedAt:  s.createdAt,
+		ArchivedAt: time.Now(),
+		Laps:       s.lapCount(),
+		Rounds:     s.roundsDone,
+		Winners:    s.winners,
+	}
+	if summary := s.summary; summary != nil {
+		finishedAt := summary.FinishedAt
+		entry.FinishedAt = &finishedAt
+		entry.Reason = summary.Reason
+		entry.DurationMs = summary.DurationMs
+		entry.ActiveMs = summary.ActiveMs
+		entry.Participants = summaryParticipants(summary)
+	}
+	return entry
+}
+
+// summaryParticipants lists who attended, then anyone else with laps
+func summaryParticipants(summary *SessionSummary) []string {
+	seen := make(map[string]bool)
+	participants := []string{}
+	for _, attendance := range summary.Attendance {
+		if !seen[attendance.Client] {
+			seen[attendance.Client] = true
+			participants = append(participants, attendance.Client)
+		}
+	}
+	for _, stat := range summary.Participants {
+		if !seen[stat.Client] {
+			seen[stat.Client] = true
+			participants = append(participants, stat.Client)
+		}
+	}
+	return participants
+}
+
+// expiredEntry sums up a saved session that expired before it finished
+func expiredEntry(snapshot sessionSnapshot) ArchiveEntry {
+	entry := ArchiveEntry{
+		ID:           snapshot.ID,
+		Name:         snapshot.Settings.Name,
+		Tags:         snapshot.Settings.Tags,
+		Template:     snapshot.Settings.Template,
+		CreatedAt:    snapshot.CreatedAt,
+		ArchivedAt:   time.Now(),
+		Reason:       "expired",
+		ActiveMs:     snapshot.ActiveMs,
+		Participants: append([]string{}, snapshot.Settings.Participants...),
+		Laps:         snapshot.LapsDropped + len(snapshot.LapHistory),
+		Rounds:       snapshot.RoundsDone,
+		Winners:      snapshot.Winners,
+	}
+	if !snapshot.StartedAt.IsZero() {
+		entry.DurationMs = snapshot.ActiveMs + snapshot.PausedMs
+	}
+	seen := make(map[string]bool)
+	for _, name := range entry.Participants {
+		seen[name] = true
+	}
+	for _, client := range slices.Sorted(maps.Keys(snapshot.Dropped)) {
+		if !seen[client] {
+			seen[client] = true
+			entry.Participants = append(entry.Participants, client)
+		}
+	}
+	for _, lap := range snapshot.LapHistory {
+		if !seen[lap.Client] {
+			seen[lap.Client] = true
+			entry.Participants = append(entry.Participants, lap.Client)
+		}
+	}
+	return entry
+}
+
+// archiveSession adds entry to the archive, logging a failure
+func archiveSession(entry ArchiveEntry) {
+	if err := archive.archive(entry); err != nil {
+		log.Printf("Session %s: Archiving failed: %v\n", entry.ID, err)
+	}
+}
+
+// archiveExpired archives the saved sessions that expired unfinished before
+// cutoff, the finished ones were archived when they finished
+func (p *persister) archiveExpired(cutoff time.Time) {
+	all, err := p.store.loadSince(time.Time{})
+	if err != nil {
+		log.Printf("Loading expired sessions failed: %v\n", err)
+		return
+	}
+	live, err := p.store.loadSince(cutoff)
+	if err != nil {
+		log.Printf("Loading saved sessions failed: %v\n", err)
+		return
+	}
+	for sessionID, data := range all {
+		if _, ok := live[sessionID]; ok {
+			continue
+		}
+		var snapshot sessionSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil || snapshot.Finished {
+			continue
+		}
+		archiveSession(expiredEntry(snapshot))
+	}
+}
+
+// handleHistory serves GET /history?page=N&perPage=M to admins, only the
+// sessions with every ?tag= given
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	serveHistory(w, r, ArchiveQuery{Tags: tagsFromQuery(r)})
+}
+
+// pageFromQuery reads ?page=N&perPage=M, the first page of defaultPerPage
+// when they're left out
+func pageFromQuery(r *http.Request) (page int, perPage int, err error) {
+	values := r.URL.Query()
+	page, perPage = 1, defaultPerPage
+	if value := values.Get("page"); value != "" {
+		page, err = strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("page should be a number from 1")
+		}
+	}
+	if value := values.Get("perPage"); value != "" {
+		perPage, err = strconv.Atoi(value)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, errors.New("perPage should be a number from 1 to 100")
+		}
+	}
+	return page, perPage, nil
+}
+
+// serveHistory answers with the page of the entries matching query the
+// request asks for with ?page=N&perPage=M
+func serveHistory(w http.ResponseWriter, r *http.Request, query ArchiveQuery) {
+	page, perPage, err := pageFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, total, err := archive.history(query, (page-1)*perPage, perPage)
+	if err != nil {
+		log.Printf("Reading the history failed: %v\n", err)
+		http.Error(w, "Could not read the history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(History{Entries: entries, Page: page, PerPage: perPage, Total: total})
+}
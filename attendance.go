@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Attendance is when one participant was connected to the session
+type Attendance struct {
+	Client        string     `json:"client"`
+	FirstJoinedAt time.Time  `json:"firstJoinedAt"`
+	LastLeftAt    *time.Time `json:"lastLeftAt,omitempty"` // nil while still connected
+	PresentMs     int64      `json:"presentMs"`
+	// Late is set when they first joined after the timer had started
+	Late bool `json:"late"`
+
+	present  time.Duration // up to joinedAt
+	joinedAt time.Time     // start of the current stretch, zero while away
+}
+
+// markJoined starts an attendance stretch for a participant, stateMux must be held
+func (s *Session) markJoined(clientID string) {
+	now := time.Now()
+	a, exists := s.attendance[clientID]
+	if !exists {
+		a = &Attendance{
+			Client:        clientID,
+			FirstJoinedAt: now,
+			Late:          !s.startedAt.IsZero(),
+		}
+		s.attendance[clientID] = a
+	}
+	a.joinedAt = now
+}
+
+// markLeft closes a participant's attendance stretch, stateMux must be held
+func (s *Session) markLeft(clientID string) {
+	a, exists := s.attendance[clientID]
+	if !exists || a.joinedAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	a.LastLeftAt = &now
+	a.present += now.Sub(a.joinedAt)
+	a.joinedAt = time.Time{}
+}
+
+// attendanceReport lists everyone who joined, by client name, stateMux must be held
+func (s *Session) attendanceReport() []Attendance {
+	report := make([]Attendance, 0, len(s.attendance))
+	for _, a := range s.attendance {
+		record := *a
+		present := a.present
+		if !a.joinedAt.IsZero() {
+			present += time.Since(a.joinedAt)
+		}
+		record.PresentMs = present.Milliseconds()
+		report = append(report, record)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Client < report[j].Client
+	})
+	return report
+}
+
+// handleAttendanceCSV serves /s/{id}/attendance.csv, the attendance so far
+// with time present rounded for export
+func handleAttendanceCSV(w http.ResponseWriter, session *Session) {
+	session.stateMux.Lock()
+	report := session.attendanceReport()
+	settings := session.settings
+	session.stateMux.Unlock()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+session.ID+`-attendance.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"client", "firstJoinedAt", "lastLeftAt", "presentMs", "late"})
+	for _, a := range report {
+		lastLeft := ""
+		if a.LastLeftAt != nil {
+			lastLeft = a.LastLeftAt.Format(time.RFC3339)
+		}
+		out.Write([]string{
+			a.Client,
+			a.FirstJoinedAt.Format(time.RFC3339),
+			lastLeft,
+			strconv.FormatInt(settings.exportMs(time.Duration(a.PresentMs)*time.Millisecond), 10),
+			strconv.FormatBool(a.Late),
+		})
+	}
+	out.Flush()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// autoStartCountdown is the 3-2-1 before an automatic start
+const autoStartCountdown = 3 * time.Second
+
+// participantCount counts the connected clients taking turns, clientsMux must be held
+func (s *Session) participantCount() int {
+	count := 0
+	for _, client := range s.clients {
+		if !client.offline && !client.device {
+			count++
+		}
+	}
+	return count
+}
+
+// checkAutoStart counts down and starts the clock once AutoStartAt
+// participants have joined, and calls the countdown off if someone leaves
+// before it ends. It only applies before the clock first runs.
+func (s *Session) checkAutoStart() {
+	s.clientsMux.Lock()
+	participants := s.participantCount()
+	activeClientID := s.activeClientID
+	s.clientsMux.Unlock()
+	_, ready := s.inReadyCheck()
+
+	s.stateMux.Lock()
+	needed := s.settings.AutoStartAt
+	if needed == 0 || !s.startedAt.IsZero() || s.waiting() || s.finished {
+		s.stateMux.Unlock()
+		return
+	}
+	enough := participants >= needed && ready && activeClientID != ""
+
+	var event map[string]interface{}
+	switch {
+	case s.autoStartAt.IsZero() && enough:
+		s.autoStartAt = time.Now().Add(autoStartCountdown)
+		s.autoStartSecondsLeft = int(autoStartCountdown.Seconds())
+		log.Printf("Session %s: %d participants joined, starting in %v\n", s.ID, participants, autoStartCountdown)
+		event = map[string]interface{}{"type": "autoStartCountdown", "secondsLeft": s.autoStartSecondsLeft}
+	case s.autoStartAt.IsZero():
+	case !enough:
+		s.autoStartAt = time.Time{}
+		log.Printf("Session %s: Automatic start called off, %d of %d participants\n", s.ID, participants, needed)
+		event = map[string]interface{}{"type": "autoStartCancelled"}
+	case !time.Now().Before(s.autoStartAt):
+		s.autoStartAt = time.Time{}
+		s.startTime = time.Now()
+		s.isRunning = true
+		s.startedAt = s.startTime
+		log.Printf("Session %s: Started automatically for %s\n", s.ID, activeClientID)
+		event = map[string]interface{}{"type": "autoStarted", "client": activeClientID}
+	default:
+		secondsLeft := int(time.Until(s.autoStartAt).Seconds()) + 1
+		if secondsLeft < s.autoStartSecondsLeft {
+			s.autoStartSecondsLeft = secondsLeft
+			event = map[string]interface{}{"type": "autoStartCountdown", "secondsLeft": secondsLeft}
+		}
+	}
+	s.stateMux.Unlock()
+
+	if event != nil {
+		s.broadcastEvent(event)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// "pastatime backup" and "pastatime restore" copy the store the server is
+// configured with, SQLite or the checkpoint file, to and from a gzipped tar:
+//
+//	sessions/{id}.json  the saved snapshot of each session
+//	archive.ndjson      the archive, newest first, when the store keeps it
+//	templates.json      the templates by name, when the store keeps them
+//
+// Each part is read from the store in one go, so it is consistent even while
+// the server runs. Restore into the store of a stopped server: it loads the
+// sessions when it starts, and a running one would write its checkpoint over
+// them.
+
+// maxBackupEntry caps one file of a backup being restored
+const maxBackupEntry = 64 << 20
+
+// BackupCounts is what a backup holds, or what a restore brought back
+type BackupCounts struct {
+	Sessions  int
+	Archive   int
+	Templates int
+	Skipped   []string // already in the store or invalid, on restore
+}
+
+// runBackup is the "pastatime backup" subcommand
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "pastatime-backup.tar.gz", "file to write the backup to")
+	flags.Parse(args)
+
+	store := openStoreForCommand("backup")
+	var backup bytes.Buffer
+	counts, err := writeBackup(&backup, store)
+	if err == nil {
+		err = writeFileAtomic(*out, backup.Bytes())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pastatime backup: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backed up %d sessions, %d archive entries and %d templates to %s\n",
+		counts.Sessions, counts.Archive, counts.Templates, *out)
+}
+
+// runRestore is the "pastatime restore" subcommand
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "pastatime-backup.tar.gz", "backup to restore")
+	replace := flags.Bool("replace", false, "overwrite sessions and templates already in the store")
+	flags.Parse(args)
+
+	store := openStoreForCommand("restore")
+	file, err := os.Open(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pastatime restore: %v\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	counts, err := readBackup(file, store, *replace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pastatime restore: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %d sessions, %d archive entries and %d templates from %s\n",
+		counts.Sessions, counts.Archive, counts.Templates, *in)
+	if len(counts.Skipped) > 0 {
+		fmt.Printf("Skipped: %s\n", strings.Join(counts.Skipped, ", "))
+	}
+}
+
+// openStoreForCommand opens the store the server would, exiting when there
+// is none
+func openStoreForCommand(command string) snapshotStore {
+	loadConfigFile()
+	store, path, err := storeFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pastatime %s: opening %s failed: %v\n", command, path, err)
+		os.Exit(1)
+	}
+	if store == nil {
+		fmt.Fprintf(os.Stderr, "pastatime %s: set PASTATIME_SQLITE_PATH or PASTATIME_CHECKPOINT_PATH to the server's store\n", command)
+		os.Exit(2)
+	}
+	return store
+}
+
+// writeBackup writes everything store keeps to w
+func writeBackup(w io.Writer, store snapshotStore) (BackupCounts, error) {
+	var counts BackupCounts
+	zipped := gzip.NewWriter(w)
+	files := tar.NewWriter(zipped)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := files.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := files.Write(data)
+		return err
+	}
+
+	sessions, err := store.loadSince(time.Time{})
+	if err != nil {
+		return counts, fmt.Errorf("reading the sessions: %v", err)
+	}
+	for _, sessionID := range slices.Sorted(maps.Keys(sessions)) {
+		if err := add("sessions/"+sessionID+".json", sessions[sessionID]); err != nil {
+			return counts, err
+		}
+		counts.Sessions++
+	}
+
+	if archived, ok := store.(archiveStore); ok {
+		entries, _, err := archived.history(ArchiveQuery{}, 0, maxStoredArchive)
+		if err != nil {
+			return counts, fmt.Errorf("reading the archive: %v", err)
+		}
+		var lines bytes.Buffer
+		encoder := json.NewEncoder(&lines)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return counts, err
+			}
+		}
+		if err := add("archive.ndjson", lines.Bytes()); err != nil {
+			return counts, err
+		}
+		counts.Archive = len(entries)
+	}
+
+	if saved, ok := store.(templateStore); ok {
+		all, err := saved.templates()
+		if err != nil {
+			return counts, fmt.Errorf("reading the templates: %v", err)
+		}
+		raw := make(map[string]json.RawMessage, len(all))
+		for name, data := range all {
+			raw[name] = data
+		}
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return counts, err
+		}
+		if err := add("templates.json", data); err != nil {
+			return counts, err
+		}
+		counts.Templates = len(all)
+	}
+
+	if err := files.Close(); err != nil {
+		return counts, err
+	}
+	return counts, zipped.Close()
+}
+
+// readBackup writes a backup from r into store, keeping what the store
+// already has unless replace is set
+func readBackup(r io.Reader, store snapshotStore, replace bool) (BackupCounts, error) {
+	var counts BackupCounts
+	zipped, err := gzip.NewReader(r)
+	if err != nil {
+		return counts, fmt.Errorf("not a backup: %v", err)
+	}
+	existing, err := store.loadSince(time.Time{})
+	if err != nil {
+		return counts, fmt.Errorf("reading the sessions: %v", err)
+	}
+
+	files := tar.NewReader(zipped)
+	for {
+		header, err := files.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counts, fmt.Errorf("not a backup: %v", err)
+		}
+		if header.Size > maxBackupEntry {
+			return counts, fmt.Errorf("%s is too large", header.Name)
+		}
+		data, err := io.ReadAll(files)
+		if err != nil {
+			return counts, err
+		}
+
+		switch dir, name := path.Split(header.Name); {
+		case dir == "sessions/":
+			sessionID, _ := strings.CutSuffix(name, ".json")
+			var snapshot sessionSnapshot
+			// The ID names the session's event log file, it has to be one
+			// the server would make
+			if !validSessionID(sessionID) || json.Unmarshal(data, &snapshot) != nil || snapshot.ID != sessionID {
+				counts.Skipped = append(counts.Skipped, header.Name)
+				continue
+			}
+			if _, exists := existing[sessionID]; exists && !replace {
+				counts.Skipped = append(counts.Skipped, header.Name)
+				continue
+			}
+			if err := store.save(sessionID, data, time.Now()); err != nil {
+				return counts, fmt.Errorf("saving session %s: %v", sessionID, err)
+			}
+			counts.Sessions++
+		case header.Name == "archive.ndjson":
+			if err := restoreArchive(data, store, &counts); err != nil {
+				return counts, err
+			}
+		case header.Name == "templates.json":
+			if err := restoreTemplates(data, store, replace, &counts); err != nil {
+				return counts, err
+			}
+		default:
+			counts.Skipped = append(counts.Skipped, header.Name)
+		}
+	}
+
+	if flushing, ok := store.(flushingStore); ok {
+		if err := flushing.flush(); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// restoreArchive adds the archive entries the store doesn't have yet, oldest
+// first
+func restoreArchive(data []byte, store snapshotStore, counts *BackupCounts) error {
+	archived, ok := store.(archiveStore)
+	if !ok {
+		counts.Skipped = append(counts.Skipped, "archive.ndjson")
+		return nil
+	}
+	present, _, err := archived.history(ArchiveQuery{}, 0, maxStoredArchive)
+	if err != nil {
+		return fmt.Errorf("reading the archive: %v", err)
+	}
+	seen := make(map[ArchiveCursor]bool, len(present))
+	for _, entry := range present {
+		seen[entry.cursor()] = true
+	}
+	var entries []ArchiveEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var entry ArchiveEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("unreadable archive: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	for _, entry := range slices.Backward(entries) {
+		if seen[entry.cursor()] {
+			continue
+		}
+		if err := archived.archive(entry); err != nil {
+			return fmt.Errorf("archiving %s: %v", entry.ID, err)
+		}
+		counts.Archive++
+	}
+	return nil
+}
+
+// restoreTemplates saves the templates, keeping the ones the store has
+// unless replace is set
+func restoreTemplates(data []byte, store snapshotStore, replace bool, counts *BackupCounts) error {
+	saved, ok := store.(templateStore)
+	if !ok {
+		counts.Skipped = append(counts.Skipped, "templates.json")
+		return nil
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return fmt.Errorf("unreadable templates: %v", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(all)) {
+		if checkTemplateName(name) != nil {
+			counts.Skipped = append(counts.Skipped, "template "+name)
+			continue
+		}
+		err := saved.saveTemplate(name, all[name], replace)
+		if errors.Is(err, errTemplateExists) {
+			counts.Skipped = append(counts.Skipped, "template "+name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("saving template %s: %v", name, err)
+		}
+		counts.Templates++
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A checkpoint backed up and restored into another one has the same
+// sessions, leaving out the ones with an ID the server wouldn't make
+func TestCheckpointBackupRestore(t *testing.T) {
+	from, err := openCheckpointStore(filepath.Join(t.TempDir(), "from.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from.save("saved-penne-1", []byte(`{"id":"saved-penne-1","shortCode":"abc123"}`), time.Now())
+	from.save("kept-fusilli-2", []byte(`{"id":"kept-fusilli-2","shortCode":"def456"}`), time.Now())
+	from.save("../escaped", []byte(`{"id":"../escaped"}`), time.Now())
+
+	var backup bytes.Buffer
+	if _, err := writeBackup(&backup, from); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "to.json")
+	to, err := openCheckpointStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.save("kept-fusilli-2", []byte(`{"id":"kept-fusilli-2","shortCode":"ghi789"}`), time.Now())
+	counts, err := readBackup(&backup, to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Sessions != 1 || len(counts.Skipped) != 2 {
+		t.Errorf("restored %d sessions skipping %v, want 1 skipping the existing and the invalid one", counts.Sessions, counts.Skipped)
+	}
+
+	// The restore wrote the file the server will load
+	reopened, err := openCheckpointStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := reopened.loadSince(time.Time{})
+	if len(saved) != 2 || string(saved["kept-fusilli-2"]) != `{"id":"kept-fusilli-2","shortCode":"ghi789"}` {
+		t.Errorf("the checkpoint holds %v, want both sessions with the existing one kept", saved)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// badgeColors maps a session state to the background of its badge
+var badgeColors = map[string]string{
+	"running":  "#006400",
+	"paused":   "#8b0000",
+	"finished": "#696969",
+}
+
+// badgeSVG is a square icon, small enough to be used as a favicon
+const badgeSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="32" height="32" viewBox="0 0 32 32">
+<title>%s</title>
+<rect width="32" height="32" rx="6" fill="%s"/>
+<text x="16" y="22" font-family="Verdana,sans-serif" font-size="18" font-weight="bold" fill="#ffffff" text-anchor="middle">%s</text>
+</svg>
+`
+
+// badgeState returns the session state shown on the badge
+func (s *Session) badgeState() string {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	switch {
+	case s.finished:
+		return "finished"
+	case s.isRunning:
+		return "running"
+	default:
+		return "paused"
+	}
+}
+
+// initial returns the upper-cased first letter of a client name
+func initial(name string) string {
+	r, _ := utf8.DecodeRuneInString(name)
+	if r == utf8.RuneError {
+		return ""
+	}
+	return string(unicode.ToUpper(r))
+}
+
+// handleBadge renders the session state and the active speaker's initial as
+// an SVG, so it can be used as a dynamic favicon or an embedded status badge
+func handleBadge(w http.ResponseWriter, session *Session) {
+	session.clientsMux.Lock()
+	active := session.activeClientID
+	session.clientsMux.Unlock()
+
+	state := session.badgeState()
+	label := initial(active)
+	if label == "" || state == "finished" {
+		label = "-"
+	}
+
+	title := state
+	if active != "" && state != "finished" {
+		title = fmt.Sprintf("%s: %s", state, active)
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, badgeSVG, html.EscapeString(title), badgeColors[state], html.EscapeString(label))
+}
+
+// shieldSVG is a flat two-part badge in the style of shields.io
+const shieldSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20">
+<title>%[4]s: %[5]s</title>
+<rect width="%[2]d" height="20" fill="#555"/>
+<rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>
+<g fill="#fff" font-family="Verdana,sans-serif" font-size="11" text-anchor="middle">
+<text x="%[7]d" y="14">%[4]s</text>
+<text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`
+
+// shieldCacheSize bounds the rendered shields kept around, labels and
+// values come from a small set so it is rarely reached
+const shieldCacheSize = 256
+
+var (
+	shieldCache    = map[string][]byte{}
+	shieldCacheMux sync.Mutex
+)
+
+// shieldWidth estimates the width of text in 11px Verdana plus padding
+func shieldWidth(text string) int {
+	return utf8.RuneCountInString(text)*7 + 10
+}
+
+// renderShield returns the badge for label and value, rendering it only the
+// first time the combination is asked for
+func renderShield(label string, value string, color string) []byte {
+	key := label + "\x00" + value + "\x00" + color
+	shieldCacheMux.Lock()
+	defer shieldCacheMux.Unlock()
+
+	if svg, ok := shieldCache[key]; ok {
+		return svg
+	}
+	if len(shieldCache) >= shieldCacheSize {
+		shieldCache = map[string][]byte{}
+	}
+	left, right := shieldWidth(label), shieldWidth(value)
+	svg := []byte(fmt.Sprintf(shieldSVG, left+right, left, right,
+		html.EscapeString(label), html.EscapeString(value), color, left/2, left+right/2))
+	shieldCache[key] = svg
+	return svg
+}
+
+// writeShield sends a shield, letting dashboards cache it for a few seconds
+func writeShield(w http.ResponseWriter, label string, value string, color string) {
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "max-age=5")
+	w.Write(renderShield(label, value, color))
+}
+
+// activeSessionCount counts sessions that are not finished and have someone connected
+func activeSessionCount() int {
+	count := 0
+	for _, s := range sessionStore.List() {
+		s.clientsMux.Lock()
+		connected := s.connectedCount()
+		s.clientsMux.Unlock()
+		if connected > 0 && s.badgeState() != "finished" {
+			count++
+		}
+	}
+	return count
+}
+
+// handleSessionsBadge serves /badge/sessions.svg, the number of active sessions
+func handleSessionsBadge(w http.ResponseWriter, r *http.Request) {
+	count := activeSessionCount()
+	color := badgeColors["finished"]
+	if count > 0 {
+		color = badgeColors["running"]
+	}
+	writeShield(w, "sessions", strconv.Itoa(count), color)
+}
+
+// handleStatusBadge serves /s/{id}/status.svg, the session state and speaker
+func handleStatusBadge(w http.ResponseWriter, session *Session) {
+	session.clientsMux.Lock()
+	active := session.activeClientID
+	session.clientsMux.Unlock()
+
+	state := session.badgeState()
+	value := state
+	if active != "" && state != "finished" {
+		value = fmt.Sprintf("%s · %s", state, active)
+	}
+	writeShield(w, "pastatime", value, badgeColors[state])
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The bulk export, GET /admin/api/archive, hands the archive over for offline
+// analysis, newest first:
+//
+//	format        ndjson, one entry per line (the default), or csv
+//	from, to      when the session was created, as in /api/archives/search
+//	tag           a tag the sessions have, repeated for every one of them
+//	template      the template the sessions started from
+//	limit         entries in this response, defaultExportLimit by default
+//	cursor        where the previous response ended
+//
+// A response that didn't reach the end of the archive names the next one in
+// its Link header and its cursor in X-Next-Cursor.
+
+const (
+	defaultExportLimit = 1000
+	maxExportLimit     = maxStoredArchive
+)
+
+// exportColumns are the CSV header, lists are joined with exportListSeparator
+var exportColumns = []string{
+	"id", "name", "tags", "template", "createdAt", "archivedAt", "finishedAt", "reason",
+	"durationMs", "activeMs", "participants", "laps", "rounds", "winners",
+}
+
+const exportListSeparator = ";"
+
+// handleAdminArchiveExport serves GET /admin/api/archive
+func handleAdminArchiveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	format := values.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		http.Error(w, "format should be ndjson or csv", http.StatusBadRequest)
+		return
+	}
+	query := ArchiveQuery{Tags: tagsFromQuery(r), Template: values.Get("template")}
+	var err error
+	if query.From, err = searchTime(values.Get("from"), false); err != nil {
+		http.Error(w, "from should be a date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if query.To, err = searchTime(values.Get("to"), true); err != nil {
+		http.Error(w, "to should be a date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		if query.Before, err = parseArchiveCursor(cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultExportLimit
+	if value := values.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxExportLimit {
+			http.Error(w, "limit should be a number from 1 to "+strconv.Itoa(maxExportLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// One more than asked tells whether there is a next page
+	entries, _, err := archive.history(query, 0, limit+1)
+	if err != nil {
+		log.Printf("Exporting the archive failed: %v\n", err)
+		http.Error(w, "Could not read the archive", http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next := entries[limit-1].cursor().String()
+		values.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", `<`+(&url.URL{Path: r.URL.Path, RawQuery: values.Encode()}).String()+`>; rel="next"`)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="pastatime-archive.csv"`)
+		writeArchiveCSV(w, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="pastatime-archive.ndjson"`)
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return
+		}
+	}
+}
+
+// writeArchiveCSV writes the entries as CSV with exportColumns
+func writeArchiveCSV(w http.ResponseWriter, entries []ArchiveEntry) {
+	out := csv.NewWriter(w)
+	out.Write(exportColumns)
+	for _, entry := range entries {
+		finishedAt := ""
+		if entry.FinishedAt != nil {
+			finishedAt = entry.FinishedAt.Format(time.RFC3339)
+		}
+		out.Write([]string{
+			entry.ID,
+			entry.Name,
+			strings.Join(entry.Tags, exportListSeparator),
+			entry.Template,
+			entry.CreatedAt.Format(time.RFC3339),
+			entry.ArchivedAt.Format(time.RFC3339),
+			finishedAt,
+			entry.Reason,
+			strconv.FormatInt(entry.DurationMs, 10),
+			strconv.FormatInt(entry.ActiveMs, 10),
+			strings.Join(entry.Participants, exportListSeparator),
+			strconv.Itoa(entry.Laps),
+			strconv.Itoa(entry.Rounds),
+			strings.Join(entry.Winners, exportListSeparator),
+		})
+	}
+	out.Flush()
+}
@@ -0,0 +1,14 @@
+package main
+
+// chaosMonkey disturbs WebSocket traffic to exercise the reconnect and ack
+// handling. It only exists in builds with the chaos tag, see
+// chaos_enabled.go, so production binaries can't turn it on.
+type chaosMonkey interface {
+	// outgoing runs before a frame is written to c, an error drops it
+	outgoing(c *Client) error
+	// incoming runs after a frame is read from c, false drops it
+	incoming(c *Client) bool
+}
+
+// chaos is nil unless built with the chaos tag and PASTATIME_CHAOS is set
+var chaos chaosMonkey
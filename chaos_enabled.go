@@ -0,0 +1,78 @@
+//go:build chaos
+
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errChaos is returned for frames the chaos monkey dropped
+var errChaos = errors.New("dropped by chaos mode")
+
+// randomChaos delays frames by up to delay and drops them or kills their
+// connection with the given probabilities
+type randomChaos struct {
+	delay time.Duration
+	drop  float64
+	kill  float64
+}
+
+// init reads PASTATIME_CHAOS, e.g. "delay=300ms,drop=0.05,kill=0.01"
+func init() {
+	spec := os.Getenv("PASTATIME_CHAOS")
+	if spec == "" {
+		return
+	}
+	var monkey randomChaos
+	for _, option := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		var err error
+		switch key {
+		case "delay":
+			monkey.delay, err = time.ParseDuration(value)
+		case "drop":
+			monkey.drop, err = strconv.ParseFloat(value, 64)
+		case "kill":
+			monkey.kill, err = strconv.ParseFloat(value, 64)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			log.Fatalf("PASTATIME_CHAOS: %q: %v", option, err)
+		}
+	}
+	chaos = monkey
+	log.Printf("CHAOS MODE: delaying frames up to %v, dropping %.0f%%, killing connections %.0f%% of the time\n",
+		monkey.delay, monkey.drop*100, monkey.kill*100)
+}
+
+// disturb delays a frame and decides its fate
+func (m randomChaos) disturb(c *Client, direction string) error {
+	if m.delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(m.delay))))
+	}
+	switch roll := rand.Float64(); {
+	case roll < m.kill:
+		log.Printf("Chaos: killing the connection of %s on an %s frame\n", c.id, direction)
+		c.conn.Close()
+		return errChaos
+	case roll < m.kill+m.drop:
+		log.Printf("Chaos: dropping an %s frame for %s\n", direction, c.id)
+		return errChaos
+	}
+	return nil
+}
+
+func (m randomChaos) outgoing(c *Client) error {
+	return m.disturb(c, "outgoing")
+}
+
+func (m randomChaos) incoming(c *Client) bool {
+	return m.disturb(c, "incoming") == nil
+}
@@ -0,0 +1,271 @@
+//go:build chaos
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// scriptedChaos misbehaves only for the clients and moments a test picks,
+// where randomChaos rolls the dice on every frame
+type scriptedChaos struct {
+	mu      sync.Mutex
+	delay   time.Duration   // every frame, both ways
+	dropOut map[string]bool // client ID -> drop the frames sent to it
+	dropIn  map[string]bool // client ID -> drop the frames it sends
+	killIn  map[string]bool // client ID -> kill its connection on its next frame
+}
+
+// testChaos is installed once, the goroutines of an earlier test's
+// sessions may still read chaos, and each test resets it
+var (
+	testChaos     = &scriptedChaos{}
+	testChaosOnce sync.Once
+)
+
+// reset calms the monkey down, delaying every frame by delay
+func (m *scriptedChaos) reset(delay time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delay = delay
+	m.dropOut = make(map[string]bool)
+	m.dropIn = make(map[string]bool)
+	m.killIn = make(map[string]bool)
+}
+
+func (m *scriptedChaos) set(flags map[string]bool, clientID string, on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flags[clientID] = on
+}
+
+func (m *scriptedChaos) outgoing(c *Client) error {
+	m.mu.Lock()
+	delay, drop := m.delay, m.dropOut[c.id]
+	m.mu.Unlock()
+	time.Sleep(delay)
+	if drop {
+		return errChaos
+	}
+	return nil
+}
+
+func (m *scriptedChaos) incoming(c *Client) bool {
+	m.mu.Lock()
+	delay, drop, kill := m.delay, m.dropIn[c.id], m.killIn[c.id]
+	delete(m.killIn, c.id)
+	m.mu.Unlock()
+	time.Sleep(delay)
+	if kill {
+		c.conn.Close()
+		return false
+	}
+	return !drop
+}
+
+// chaosSession serves a new session with ann and bob on the roster, its
+// frames delayed by delay, and returns the monkey to disturb it further
+func chaosSession(t *testing.T, delay time.Duration) (*Session, *httptest.Server, *scriptedChaos) {
+	t.Helper()
+	testChaosOnce.Do(func() { chaos = testChaos })
+	testChaos.reset(delay)
+
+	var session *Session
+	for err := errSessionExists; errors.Is(err, errSessionExists); {
+		session, err = newSession(newSessionSlug(), newShortCode(), Settings{Participants: []string{"ann", "bob"}})
+		if err == nil {
+			err = session.registerSession()
+		}
+		if err != nil && !errors.Is(err, errSessionExists) {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(handleSession))
+	t.Cleanup(server.Close)
+	return session, server, testChaos
+}
+
+// chaosClient is a participant's connection, collecting the state updates
+type chaosClient struct {
+	conn    *websocket.Conn
+	updates chan map[string]interface{}
+}
+
+func dialChaosClient(t *testing.T, server *httptest.Server, session *Session, name string) *chaosClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/s/" + session.ID + "/ws?name=" + name
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("connecting %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &chaosClient{conn: conn, updates: make(chan map[string]interface{}, 1024)}
+	go func() {
+		defer close(c.updates)
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg["type"] == "update" {
+				c.updates <- msg
+			}
+		}
+	}()
+	return c
+}
+
+func (c *chaosClient) command(t *testing.T, command string) {
+	t.Helper()
+	if err := c.conn.WriteJSON(map[string]string{"type": "command", "command": command}); err != nil {
+		t.Fatalf("sending %s: %v", command, err)
+	}
+}
+
+// waitFor reads updates until one matches, the sends are concurrent so an
+// older state can arrive after a newer one
+func (c *chaosClient) waitFor(t *testing.T, what string, match func(map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.updates:
+			if !ok {
+				t.Fatalf("the connection closed waiting for %s", what)
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no update with %s", what)
+		}
+	}
+}
+
+// sawUpdate reports whether an update matching arrives within d
+func (c *chaosClient) sawUpdate(d time.Duration, match func(map[string]interface{}) bool) bool {
+	timeout := time.After(d)
+	for {
+		select {
+		case msg, ok := <-c.updates:
+			if ok && match(msg) {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func activeIs(clientID string) func(map[string]interface{}) bool {
+	return func(msg map[string]interface{}) bool { return msg["activeClient"] == clientID }
+}
+
+func lapsAre(count int) func(map[string]interface{}) bool {
+	return func(msg map[string]interface{}) bool {
+		laps, _ := msg["lapCount"].(float64)
+		return int(laps) == count
+	}
+}
+
+func isRunning(msg map[string]interface{}) bool {
+	running, _ := msg["running"].(bool)
+	return running
+}
+
+// A client whose updates were lost catches up with the next one, the state
+// is sent whole every time
+func TestChaosDroppedUpdatesCatchUp(t *testing.T) {
+	session, server, monkey := chaosSession(t, 0)
+	ann := dialChaosClient(t, server, session, "ann")
+	bob := dialChaosClient(t, server, session, "bob")
+	bob.waitFor(t, "ann up first", activeIs("ann"))
+
+	monkey.set(monkey.dropOut, "bob", true)
+	ann.command(t, "start")
+	ann.command(t, "next")
+	ann.waitFor(t, "bob's turn", activeIs("bob"))
+	if bob.sawUpdate(300*time.Millisecond, activeIs("bob")) {
+		t.Fatal("bob got an update while bob's frames were dropped")
+	}
+
+	monkey.set(monkey.dropOut, "bob", false)
+	msg := bob.waitFor(t, "bob's turn after the drops", activeIs("bob"))
+	if !lapsAre(1)(msg) || !isRunning(msg) {
+		t.Errorf("bob caught up with %v laps, running %v, want 1 lap and running", msg["lapCount"], msg["running"])
+	}
+}
+
+// A dropped command changes nothing and sending it again works
+func TestChaosDroppedCommandCanBeResent(t *testing.T) {
+	session, server, monkey := chaosSession(t, 0)
+	ann := dialChaosClient(t, server, session, "ann")
+	ann.waitFor(t, "ann up first", activeIs("ann"))
+
+	monkey.set(monkey.dropIn, "ann", true)
+	ann.command(t, "start")
+	if ann.sawUpdate(300*time.Millisecond, isRunning) {
+		t.Fatal("a dropped start started the clock")
+	}
+
+	monkey.set(monkey.dropIn, "ann", false)
+	ann.command(t, "start")
+	ann.waitFor(t, "the clock running", isRunning)
+}
+
+// A participant whose connection dies keeps their place and their running
+// turn, and rejoining under their name picks it up
+func TestChaosKilledConnectionRejoins(t *testing.T) {
+	session, server, monkey := chaosSession(t, 0)
+	ann := dialChaosClient(t, server, session, "ann")
+	bob := dialChaosClient(t, server, session, "bob")
+	ann.command(t, "start")
+	bob.waitFor(t, "ann's clock running", func(msg map[string]interface{}) bool {
+		return isRunning(msg) && msg["activeClient"] == "ann"
+	})
+
+	monkey.set(monkey.killIn, "ann", true)
+	ann.command(t, "pause")
+	bob.waitFor(t, "ann offline", func(msg map[string]interface{}) bool {
+		offline, _ := msg["offline"].([]interface{})
+		return len(offline) == 1 && offline[0] == "ann"
+	})
+
+	ann = dialChaosClient(t, server, session, "ann")
+	msg := ann.waitFor(t, "ann back", func(msg map[string]interface{}) bool { return msg["yourId"] == "ann" })
+	if msg["activeClient"] != "ann" || !isRunning(msg) {
+		t.Errorf("ann rejoined with %v active, running %v, want ann's turn still running", msg["activeClient"], msg["running"])
+	}
+}
+
+// Delayed frames slow a round down but it ends the same
+func TestChaosDelayedFramesConverge(t *testing.T) {
+	session, server, _ := chaosSession(t, 30*time.Millisecond)
+	clients := map[string]*chaosClient{
+		"ann": dialChaosClient(t, server, session, "ann"),
+		"bob": dialChaosClient(t, server, session, "bob"),
+	}
+	clients["ann"].waitFor(t, "ann up first", activeIs("ann"))
+	clients["ann"].command(t, "start")
+
+	// An older update can arrive late, the lap count tells them apart
+	turns := []string{"ann", "bob", "ann", "bob"}
+	for i, clientID := range turns {
+		next := turns[(i+1)%len(turns)]
+		clients[clientID].command(t, "next")
+		clients[next].waitFor(t, next+"'s turn", func(msg map[string]interface{}) bool {
+			return activeIs(next)(msg) && lapsAre(i+1)(msg)
+		})
+	}
+	for clientID, c := range clients {
+		c.waitFor(t, "all 4 laps for "+clientID, lapsAre(4))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Single-node deployments without SQLite can checkpoint their sessions to a
+// JSON file instead, set with PASTATIME_CHECKPOINT_PATH. The snapshots are
+// kept in memory and the whole file is rewritten every
+// PASTATIME_CHECKPOINT_INTERVAL, when something changed.
+
+// defaultCheckpointInterval is how often the checkpoint file is written
+const defaultCheckpointInterval = 30 * time.Second
+
+// checkpointFile is what the checkpoint file holds
+type checkpointFile struct {
+	WrittenAt time.Time                     `json:"writtenAt"`
+	Sessions  map[string]checkpointSnapshot `json:"sessions"`
+}
+
+type checkpointSnapshot struct {
+	SavedAt  time.Time       `json:"savedAt"`
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// checkpointStore is a snapshotStore backed by one file
+type checkpointStore struct {
+	path      string
+	mu        sync.Mutex
+	snapshots map[string]checkpointSnapshot
+	dirty     bool // changed since the file was last written
+}
+
+// openCheckpointStore loads the checkpoint file at path, a missing one is
+// an empty store
+func openCheckpointStore(path string) (*checkpointStore, error) {
+	store := &checkpointStore{path: path, snapshots: make(map[string]checkpointSnapshot)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file checkpointFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unreadable checkpoint: %v", err)
+	}
+	if file.Sessions != nil {
+		store.snapshots = file.Sessions
+	}
+	return store, nil
+}
+
+// checkpointIntervalFromEnv reads PASTATIME_CHECKPOINT_INTERVAL
+func checkpointIntervalFromEnv() time.Duration {
+	value := os.Getenv("PASTATIME_CHECKPOINT_INTERVAL")
+	if value == "" {
+		return defaultCheckpointInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < time.Second {
+		log.Printf("Ignoring PASTATIME_CHECKPOINT_INTERVAL=%q, it should be a duration of at least 1s\n", value)
+		return defaultCheckpointInterval
+	}
+	return interval
+}
+
+func (s *checkpointStore) save(sessionID string, data []byte, savedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[sessionID] = checkpointSnapshot{SavedAt: savedAt, Snapshot: data}
+	s.dirty = true
+	return nil
+}
+
+func (s *checkpointStore) loadSince(cutoff time.Time) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make(map[string][]byte)
+	for id, snapshot := range s.snapshots {
+		if !snapshot.SavedAt.Before(cutoff) {
+			saved[id] = snapshot.Snapshot
+		}
+	}
+	return saved, nil
+}
+
+func (s *checkpointStore) removeBefore(cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, snapshot := range s.snapshots {
+		if snapshot.SavedAt.Before(cutoff) {
+			delete(s.snapshots, id)
+			s.dirty = true
+		}
+	}
+	return nil
+}
+
+func (s *checkpointStore) remove(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snapshots[sessionID]; ok {
+		delete(s.snapshots, sessionID)
+		s.dirty = true
+	}
+	return nil
+}
+
+// ping checks the checkpoint's directory is still there
+func (s *checkpointStore) ping() error {
+	_, err := os.Stat(filepath.Dir(s.path))
+	return err
+}
+
+// flush writes the file if anything changed
+func (s *checkpointStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(checkpointFile{WrittenAt: time.Now(), Sessions: s.snapshots})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, through a temporary
+// file synced first so a crash halfway leaves the previous file in place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Chess-clock sessions give every client a time bank that only runs down
+// during their own turns. bankUsed holds what each client spent on finished
+// turns, the turn in progress is charged when it ends.
+
+// ClockSettings are a player's chess-clock options. The first DelayMs of each
+// turn are not charged to the bank, IncrementMs is added back after every turn.
+type ClockSettings struct {
+	TimeBankMs  int64 `json:"timeBankMs,omitempty"`
+	IncrementMs int64 `json:"incrementMs,omitempty"`
+	DelayMs     int64 `json:"delayMs,omitempty"`
+}
+
+// clockFor returns the clock of a client, with their own overrides applied, stateMux must be held
+func (s *Session) clockFor(clientID string) ClockSettings {
+	clock := ClockSettings{
+		TimeBankMs:  s.settings.TimeBankMs,
+		IncrementMs: s.settings.IncrementMs,
+		DelayMs:     s.settings.DelayMs,
+	}
+	if override, exists := s.settings.PlayerClocks[clientID]; exists {
+		if override.TimeBankMs > 0 {
+			clock.TimeBankMs = override.TimeBankMs
+		}
+		if override.IncrementMs > 0 {
+			clock.IncrementMs = override.IncrementMs
+		}
+		if override.DelayMs > 0 {
+			clock.DelayMs = override.DelayMs
+		}
+	}
+	return clock
+}
+
+// chargedTime is the part of a turn that counts against the bank, after the delay
+func (c ClockSettings) chargedTime(turn time.Duration) time.Duration {
+	return max(turn-time.Duration(c.DelayMs)*time.Millisecond, 0)
+}
+
+// chargeTimeBank adds a finished turn to the client's spent time, stateMux must be held
+func (s *Session) chargeTimeBank(clientID string, turn time.Duration) {
+	if s.settings.TimeBankMs == 0 {
+		return
+	}
+	clock := s.clockFor(clientID)
+	s.bankUsed[clientID] += clock.chargedTime(turn) - time.Duration(clock.IncrementMs)*time.Millisecond
+}
+
+// timeBankRemaining returns what is left of a client's bank, stateMux must be held
+func (s *Session) timeBankRemaining(clientID string, active bool) time.Duration {
+	clock := s.clockFor(clientID)
+	remaining := time.Duration(clock.TimeBankMs)*time.Millisecond - s.bankUsed[clientID]
+	if active {
+		remaining -= clock.chargedTime(s.currentTurn())
+	}
+	return max(remaining, 0)
+}
+
+// currentTurn returns the time on the clock for the turn in progress, stateMux must be held
+func (s *Session) currentTurn() time.Duration {
+	if s.isRunning {
+		return s.elapsed + time.Since(s.startTime)
+	}
+	return s.elapsed
+}
+
+// timeBankStates reports every participant's remaining bank, stateMux must be held
+func (s *Session) timeBankStates(clientIDs []string, activeClientID string) map[string]int64 {
+	banks := make(map[string]int64, len(clientIDs))
+	for _, id := range clientIDs {
+		banks[id] = s.timeBankRemaining(id, id == activeClientID).Milliseconds()
+	}
+	return banks
+}
+
+// checkTimeBanks announces when the active client's bank runs out
+func (s *Session) checkTimeBanks() {
+	s.clientsMux.Lock()
+	activeClientID := s.activeClientID
+	s.clientsMux.Unlock()
+
+	s.stateMux.Lock()
+	if s.settings.TimeBankMs == 0 || activeClientID == "" || s.bankExpired[activeClientID] {
+		s.stateMux.Unlock()
+		return
+	}
+	if s.timeBankRemaining(activeClientID, true) > 0 {
+		s.stateMux.Unlock()
+		return
+	}
+	s.bankExpired[activeClientID] = true
+	s.stateMux.Unlock()
+
+	log.Printf("Session %s: Time bank of %s ran out\n", s.ID, activeClientID)
+	s.broadcastEvent(map[string]interface{}{
+		"type":   "timeBankExpired",
+		"client": activeClientID,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// CloneRequest is the optional body of POST /s/{id}/clone
+type CloneRequest struct {
+	// Roster seeds the new session with this one's participants, each
+	// keeping their place until they join under the same name
+	Roster bool `json:"roster"`
+}
+
+// cloneRoster lists the session's participants: the turn order, then
+// anyone who came and left
+func (s *Session) cloneRoster() []string {
+	s.clientsMux.Lock()
+	members := s.lobbyRoster()
+	s.clientsMux.Unlock()
+	s.stateMux.Lock()
+	attendance := s.attendanceReport()
+	s.stateMux.Unlock()
+
+	seen := make(map[string]bool)
+	roster := []string{}
+	for _, member := range members {
+		seen[member.Name] = true
+		roster = append(roster, member.Name)
+	}
+	sort.SliceStable(attendance, func(i, j int) bool {
+		return attendance[i].FirstJoinedAt.Before(attendance[j].FirstJoinedAt)
+	})
+	for _, a := range attendance {
+		if !seen[a.Client] {
+			seen[a.Client] = true
+			roster = append(roster, a.Client)
+		}
+	}
+	return roster
+}
+
+// handleClone serves POST /s/{id}/clone, a fresh session with the same
+// settings and, when asked, the same roster
+func handleClone(w http.ResponseWriter, r *http.Request, session *Session) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectWhileDraining(w) {
+		return
+	}
+	if rejectAtSessionLimit(w) {
+		return
+	}
+	var request CloneRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSettingsSize)).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.stateMux.Lock()
+	current := session.settings
+	session.stateMux.Unlock()
+	// Same again is for the same people, so what names them comes along
+	settings := current.reusable()
+	settings.Name, settings.Tags, settings.PlayerClocks = current.Name, current.Tags, current.PlayerClocks
+	// A shared device keeps the roster it was created with unless asked
+	switch {
+	case request.Roster:
+		settings.Participants = session.cloneRoster()
+	case settings.SharedDevice:
+		settings.Participants = current.Participants
+	}
+	if err := settings.validate(); err != nil {
+		http.Error(w, "Cannot clone the session: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var clone *Session
+	var err error
+	for {
+		clone, err = newSession(newSessionSlug(), newShortCode(), settings)
+		if err != nil {
+			http.Error(w, "Invalid participants: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = clone.registerSession(); !errors.Is(err, errSessionExists) {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Cloning session %s failed: %v\n", session.ID, err)
+		http.Error(w, "Could not create the session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Cloned session %s as %s (short link /j/%s) with %d participants\n", session.ID, clone.ID, clone.shortCode, len(settings.Participants))
+
+	response := map[string]string{
+		"sessionId": clone.ID,
+		"shortLink": "/j/" + clone.shortCode,
+	}
+	if baseURL != "" {
+		response["url"] = baseURL + "/j/" + clone.shortCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// With PASTATIME_REDIS_ADDR set, several instances behind a load balancer
+// share their sessions through Redis. Each session runs on the instance that
+// created it, its owner, and the other instances relay the WebSockets of
+// their clients to it over pub/sub:
+//
+//	pastatime:owner:{session}      ID of the owner, expires unless it refreshes it
+//	pastatime:session:{session}    hash of the short code and latest snapshot
+//	pastatime:shortlink:{code}     ID of the session
+//	pastatime:instance:{instance}  channel of relayMessages for an instance
+//
+// When an owner goes away its sessions are adopted from their snapshots by
+// the next instance asked for them, paused as after a restart. The admin API
+// and badges only count the sessions an instance runs itself.
+
+const (
+	redisDialTimeout    = 5 * time.Second
+	redisReconnectDelay = 5 * time.Second
+	redisPingInterval   = 30 * time.Second
+	// ownerTTL is how long a session stays claimed after its owner stops
+	// refreshing it every clusterInterval
+	ownerTTL        = 15 * time.Second
+	clusterInterval = 5 * time.Second
+	relayBuffer     = 64 // frames waiting for a relayed client, on either instance
+	// relayOutbox is how many relay messages can wait to be published, more
+	// are dropped rather than hold up the sessions
+	relayOutbox = 1024
+	// relayBatch is how many queued messages go out in one round trip
+	relayBatch = 64
+)
+
+// relayMessage travels between instances on their pastatime:instance channel
+type relayMessage struct {
+	Op      string `json:"op"` // "connect", "frame" or "close"
+	Conn    string `json:"conn"`
+	From    string `json:"from,omitempty"`
+	Session string `json:"session,omitempty"` // connect only
+	Name    string `json:"name,omitempty"`    // connect only, as in ?name=
+	Data    []byte `json:"data,omitempty"`    // frame only
+}
+
+// redisError is an error reply from Redis, the connection is still fine
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisCluster is the SessionStore of an instance in a cluster. It keeps the
+// sessions it owns in memory and the rest in Redis.
+type redisCluster struct {
+	addr     string
+	password string
+	instance string
+	local    *memorySessionStore
+
+	mu   sync.Mutex // guards conn and r, the connection for commands
+	conn net.Conn
+	r    *bufio.Reader
+
+	outbox chan publication // relay messages for publish, which has its own connection
+
+	relaysMux sync.Mutex
+	relays    map[string]*relayConn // clients of sessions run here, connected elsewhere
+	tunnels   map[string]*tunnel    // clients connected here, of sessions run elsewhere
+
+	snapshotsMux sync.Mutex
+	snapshots    map[string][]byte // last snapshot saved per session owned here
+}
+
+// publication is a relay message waiting to be published
+type publication struct {
+	channel string
+	op      string
+	conn    string
+	data    string
+}
+
+var cluster *redisCluster
+
+// redisClusterFromEnv joins the cluster at PASTATIME_REDIS_ADDR (host:port)
+// if set, with the optional PASTATIME_REDIS_PASSWORD
+func redisClusterFromEnv() *redisCluster {
+	addr := os.Getenv("PASTATIME_REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	c := &redisCluster{
+		addr:      addr,
+		password:  os.Getenv("PASTATIME_REDIS_PASSWORD"),
+		instance:  "pastatime-" + hex.EncodeToString(buf),
+		local:     newMemorySessionStore(),
+		outbox:    make(chan publication, relayOutbox),
+		relays:    make(map[string]*relayConn),
+		tunnels:   make(map[string]*tunnel),
+		snapshots: make(map[string][]byte),
+	}
+	go c.subscribe()
+	go c.publish()
+	go c.run()
+	log.Printf("Sharing sessions through Redis at %s as %s\n", addr, c.instance)
+	return c
+}
+
+// dial opens an authenticated connection to Redis
+func (c *redisCluster) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, redisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if c.password != "" {
+		conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		err := writeRESP(conn, []string{"AUTH", c.password})
+		if err == nil {
+			_, err = readRESP(r)
+		}
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, r, nil
+}
+
+// do runs a command, connecting first if needed
+func (c *redisCluster) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, r, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, r
+	}
+	c.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	err := writeRESP(c.conn, args)
+	var reply interface{}
+	if err == nil {
+		reply, err = readRESP(c.r)
+	}
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// get runs GET, a missing key is an empty string
+func (c *redisCluster) get(key string) (string, error) {
+	reply, err := c.do("GET", key)
+	value, _ := reply.(string)
+	return value, err
+}
+
+// subscribe keeps listening on the instance's channel
+func (c *redisCluster) subscribe() {
+	channel := "pastatime:instance:" + c.instance
+	for {
+		err := c.listen(channel)
+		log.Printf("Redis: subscription lost: %v, retrying in %v\n", err, redisReconnectDelay)
+		time.Sleep(redisReconnectDelay)
+	}
+}
+
+// listen handles the relay messages of one subscription until it drops
+func (c *redisCluster) listen(channel string) error {
+	conn, r, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeRESP(conn, []string{"SUBSCRIBE", channel}); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(redisPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				writeRESP(conn, []string{"PING"})
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(redisPingInterval * 2))
+		reply, err := readRESP(r)
+		if err != nil {
+			return err
+		}
+		// Pushes are ["message", channel, payload], subscribe and pong replies are skipped
+		if push, _ := reply.([]interface{}); len(push) == 3 && push[0] == "message" {
+			payload, _ := push[2].(string)
+			c.handleRelay([]byte(payload))
+		}
+	}
+}
+
+// relay queues a message for another instance, false if the queue is full.
+// A message nobody receives closes the connection it was for.
+func (c *redisCluster) relay(instance string, msg relayMessage) bool {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	select {
+	case c.outbox <- publication{channel: "pastatime:instance:" + instance, op: msg.Op, conn: msg.Conn, data: string(data)}:
+		return true
+	default:
+		log.Printf("Redis: relay queue full, dropping a %s for connection %s\n", msg.Op, msg.Conn)
+		return false
+	}
+}
+
+// publish sends the queued relay messages on a connection of its own, so no
+// session waits for a round trip to Redis. What queued up meanwhile goes out
+// in one pipelined batch.
+func (c *redisCluster) publish() {
+	var conn net.Conn
+	var r *bufio.Reader
+	for first := range c.outbox {
+		batch := []publication{first}
+	fill:
+		for len(batch) < relayBatch {
+			select {
+			case next := <-c.outbox:
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+
+		var err error
+		if conn == nil {
+			conn, r, err = c.dial()
+		}
+		var b bytes.Buffer
+		for _, p := range batch {
+			writeRESP(&b, []string{"PUBLISH", p.channel, p.data})
+		}
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(redisDialTimeout))
+			_, err = conn.Write(b.Bytes())
+		}
+		delivered := 0
+		for ; err == nil && delivered < len(batch); delivered++ {
+			var receivers interface{}
+			receivers, err = readRESP(r)
+			if _, isReply := err.(redisError); isReply {
+				err = nil
+			}
+			if n, _ := receivers.(int64); err == nil && n == 0 {
+				c.undelivered(batch[delivered])
+			}
+		}
+		if err != nil {
+			log.Printf("Redis: relaying failed: %v\n", err)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			for _, p := range batch[delivered:] {
+				c.undelivered(p)
+			}
+		}
+	}
+}
+
+// undelivered closes this end of the connection a relay message was for,
+// the other end is gone
+func (c *redisCluster) undelivered(p publication) {
+	if p.op == "close" {
+		return
+	}
+	c.relaysMux.Lock()
+	rc := c.relays[p.conn]
+	tunnel := c.tunnels[p.conn]
+	c.relaysMux.Unlock()
+	if rc != nil || tunnel != nil {
+		log.Printf("Redis: nobody received a %s for connection %s, closing it\n", p.op, p.conn)
+	}
+	if rc != nil {
+		rc.Close()
+	}
+	if tunnel != nil {
+		tunnel.close()
+	}
+}
+
+// handleRelay dispatches a message from another instance
+func (c *redisCluster) handleRelay(payload []byte) {
+	var msg relayMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("Redis: unreadable relay message: %v\n", err)
+		return
+	}
+	c.relaysMux.Lock()
+	rc := c.relays[msg.Conn]
+	tunnel := c.tunnels[msg.Conn]
+	c.relaysMux.Unlock()
+
+	switch {
+	case msg.Op == "connect":
+		session, exists := c.local.Get(msg.Session)
+		if !exists {
+			c.relay(msg.From, relayMessage{Op: "close", Conn: msg.Conn})
+			return
+		}
+		rc := &relayConn{cluster: c, peer: msg.From, id: msg.Conn, incoming: make(chan []byte, relayBuffer), done: make(chan struct{})}
+		c.relaysMux.Lock()
+		c.relays[msg.Conn] = rc
+		c.relaysMux.Unlock()
+		log.Printf("Session %s: Client relayed from %s\n", session.ID, msg.From)
+		go serveClient(session, rc, msg.Name)
+	case msg.Op == "frame" && rc != nil:
+		rc.deliver(msg.Data)
+	case msg.Op == "frame" && tunnel != nil:
+		tunnel.deliver(msg.Data)
+	case msg.Op == "close" && rc != nil:
+		rc.Close()
+	case msg.Op == "close" && tunnel != nil:
+		tunnel.close()
+	}
+}
+
+// serveRemote handles a request for a session another instance runs, false
+// if it can't be served from here
+func (c *redisCluster) serveRemote(w http.ResponseWriter, r *http.Request, sessionID string, pathSegments []string) bool {
+	owner, err := c.get("pastatime:owner:" + sessionID)
+	if err != nil || owner == "" || owner == c.instance {
+		return false
+	}
+	if len(pathSegments) == 2 && pathSegments[1] == "ws" {
+		c.relayWS(w, r, sessionID, owner)
+		return true
+	}
+	if len(pathSegments) == 1 || (len(pathSegments) == 2 && pathSegments[1] == "") {
+		http.ServeFile(w, r, "./frontend/session.html")
+		return true
+	}
+	return false
+}
+
+// relayWS connects a client to a session another instance runs and passes
+// its frames both ways until either side closes
+func (c *redisCluster) relayWS(w http.ResponseWriter, r *http.Request, sessionID string, owner string) {
+	if !acquireConnection(w) {
+		return
+	}
+	defer releaseConnection()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Session %s: upgrade error: %v\n", sessionID, err)
+		return
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	connID := hex.EncodeToString(buf)
+	t := &tunnel{id: connID, conn: conn, out: make(chan []byte, relayBuffer), done: make(chan struct{})}
+	defer t.close()
+	go t.write()
+
+	c.relaysMux.Lock()
+	c.tunnels[connID] = t
+	c.relaysMux.Unlock()
+	defer func() {
+		c.relaysMux.Lock()
+		delete(c.tunnels, connID)
+		c.relaysMux.Unlock()
+	}()
+
+	connect := relayMessage{Op: "connect", Conn: connID, From: c.instance, Session: sessionID, Name: r.URL.Query().Get("name")}
+	if !c.relay(owner, connect) {
+		return
+	}
+	log.Printf("Session %s: Relaying a client to %s\n", sessionID, owner)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if !c.relay(owner, relayMessage{Op: "frame", Conn: connID, Data: data}) {
+			break
+		}
+	}
+	c.relay(owner, relayMessage{Op: "close", Conn: connID})
+}
+
+// refreshOwnerScript extends an owner key that still names this instance,
+// or claims it again if it expired with nobody adopting the session, and
+// returns the owner. Checking and extending in one step keeps an adoption
+// in between from being overwritten.
+const refreshOwnerScript = `
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+elseif not owner then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	owner = ARGV[1]
+end
+return owner`
+
+// refreshOwner keeps a session claimed, returning its owner
+func (c *redisCluster) refreshOwner(sessionID string) (string, error) {
+	reply, err := c.do("EVAL", refreshOwnerScript, "1", "pastatime:owner:"+sessionID, c.instance, strconv.FormatInt(ownerTTL.Milliseconds(), 10))
+	owner, _ := reply.(string)
+	return owner, err
+}
+
+// run keeps the owned sessions claimed and saves their snapshots
+func (c *redisCluster) run() {
+	for range time.Tick(clusterInterval) {
+		c.saveOwned()
+	}
+}
+
+// saveOwned refreshes the claim on each session run here and saves its
+// snapshot if it changed, dropping the sessions adopted elsewhere
+func (c *redisCluster) saveOwned() {
+	for _, session := range c.local.List() {
+		owner, err := c.refreshOwner(session.ID)
+		if err != nil {
+			log.Printf("Redis: %v\n", err)
+			return
+		}
+		if owner != c.instance {
+			// It expired while this instance was cut off and was adopted
+			log.Printf("Session %s: Taken over by %s\n", session.ID, owner)
+			c.local.Delete(session.ID)
+			c.forgetSnapshot(session.ID)
+			continue
+		}
+
+		data, err := json.Marshal(session.snapshot())
+		c.snapshotsMux.Lock()
+		saved := c.snapshots[session.ID]
+		c.snapshotsMux.Unlock()
+		if err != nil || bytes.Equal(data, saved) {
+			continue
+		}
+		sessionKey := "pastatime:session:" + session.ID
+		if _, err := c.do("HSET", sessionKey, "snapshot", string(data)); err != nil {
+			log.Printf("Session %s: Saving to Redis failed: %v\n", session.ID, err)
+			continue
+		}
+		ttl := strconv.FormatInt(defaultSessionTTL.Milliseconds(), 10)
+		c.do("PEXPIRE", sessionKey, ttl)
+		c.do("PEXPIRE", "pastatime:shortlink:"+session.shortCode, ttl)
+		c.snapshotsMux.Lock()
+		if _, owned := c.local.Get(session.ID); owned {
+			c.snapshots[session.ID] = data
+		}
+		c.snapshotsMux.Unlock()
+	}
+}
+
+// forgetSnapshot drops the last snapshot saved of a session no longer run here
+func (c *redisCluster) forgetSnapshot(sessionID string) {
+	c.snapshotsMux.Lock()
+	delete(c.snapshots, sessionID)
+	c.snapshotsMux.Unlock()
+}
+
+// adopt takes over a session whose owner went away, from its last snapshot
+func (c *redisCluster) adopt(sessionID string) (*Session, bool) {
+	reply, err := c.do("HGET", "pastatime:session:"+sessionID, "snapshot")
+	data, _ := reply.(string)
+	if err != nil || data == "" {
+		return nil, false
+	}
+	claimed, err := c.do("SET", "pastatime:owner:"+sessionID, c.instance, "NX", "PX", strconv.FormatInt(ownerTTL.Milliseconds(), 10))
+	if err != nil || claimed == nil {
+		// Another request may have just adopted it here
+		return c.local.Get(sessionID)
+	}
+
+	var snapshot sessionSnapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		log.Printf("Session %s: Snapshot in Redis is unreadable: %v\n", sessionID, err)
+		return nil, false
+	}
+	session, err := restoreSession(snapshot)
+	if err == nil {
+		err = c.local.Create(session)
+	}
+	if err != nil {
+		log.Printf("Session %s: Adopting failed: %v\n", sessionID, err)
+		return nil, false
+	}
+	session.startIntegrations()
+	log.Printf("Session %s: Adopted with %d laps\n", sessionID, len(session.lapHistory))
+	return session, true
+}
+
+func (c *redisCluster) Get(sessionID string) (*Session, bool) {
+	if session, exists := c.local.Get(sessionID); exists {
+		return session, true
+	}
+	owner, err := c.get("pastatime:owner:" + sessionID)
+	if err != nil || owner != "" {
+		return nil, false
+	}
+	return c.adopt(sessionID)
+}
+
+func (c *redisCluster) Create(session *Session) error {
+	sessionKey := "pastatime:session:" + session.ID
+	created, err := c.do("HSETNX", sessionKey, "shortCode", session.shortCode)
+	if err != nil {
+		return err
+	}
+	if created != int64(1) {
+		return errSessionExists
+	}
+	ttl := strconv.FormatInt(defaultSessionTTL.Milliseconds(), 10)
+	linked, err := c.do("SET", "pastatime:shortlink:"+session.shortCode, session.ID, "NX", "PX", ttl)
+	if err != nil || linked == nil {
+		c.do("DEL", sessionKey)
+		if err != nil {
+			return err
+		}
+		return errSessionExists
+	}
+	c.do("PEXPIRE", sessionKey, ttl)
+	if _, err := c.do("SET", "pastatime:owner:"+session.ID, c.instance, "PX", strconv.FormatInt(ownerTTL.Milliseconds(), 10)); err != nil {
+		return err
+	}
+	return c.local.Create(session)
+}
+
+func (c *redisCluster) Delete(sessionID string) {
+	if session, exists := c.local.Get(sessionID); exists {
+		c.do("DEL", "pastatime:shortlink:"+session.shortCode)
+	}
+	c.local.Delete(sessionID)
+	c.forgetSnapshot(sessionID)
+	c.do("DEL", "pastatime:owner:"+sessionID, "pastatime:session:"+sessionID)
+}
+
+func (c *redisCluster) List() []*Session {
+	return c.local.List()
+}
+
+func (c *redisCluster) Resolve(shortCode string) (string, bool) {
+	if sessionID, exists := c.local.Resolve(shortCode); exists {
+		return sessionID, true
+	}
+	sessionID, err := c.get("pastatime:shortlink:" + shortCode)
+	return sessionID, err == nil && sessionID != ""
+}
+
+// relayConn is a client of a session run here whose WebSocket is held by
+// another instance
+type relayConn struct {
+	cluster  *redisCluster
+	peer     string // instance holding the WebSocket
+	id       string
+	incoming chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// errRelayGone is returned when the instance holding the WebSocket is gone or
+// the relay can't keep up
+var errRelayGone = errors.New("relaying instance unreachable")
+
+// deliver queues a frame for the read loop, dropping it if the loop is
+// that far behind
+func (rc *relayConn) deliver(data []byte) {
+	select {
+	case rc.incoming <- data:
+	case <-rc.done:
+	default:
+		log.Printf("Redis: dropping a frame for relayed connection %s\n", rc.id)
+	}
+}
+
+func (rc *relayConn) ReadJSON(v interface{}) error {
+	select {
+	case data := <-rc.incoming:
+		return json.Unmarshal(data, v)
+	case <-rc.done:
+		return &websocket.CloseError{Code: websocket.CloseGoingAway}
+	}
+}
+
+func (rc *relayConn) WriteMessage(messageType int, data []byte) error {
+	if !rc.cluster.relay(rc.peer, relayMessage{Op: "frame", Conn: rc.id, Data: data}) {
+		return errRelayGone
+	}
+	return nil
+}
+
+// WriteControl only passes on close frames, the relaying instance closes the
+// WebSocket
+func (rc *relayConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		rc.cluster.relay(rc.peer, relayMessage{Op: "close", Conn: rc.id})
+	}
+	return nil
+}
+
+func (rc *relayConn) Close() error {
+	rc.once.Do(func() {
+		close(rc.done)
+		rc.cluster.relaysMux.Lock()
+		delete(rc.cluster.relays, rc.id)
+		rc.cluster.relaysMux.Unlock()
+		rc.cluster.relay(rc.peer, relayMessage{Op: "close", Conn: rc.id})
+	})
+	return nil
+}
+
+// tunnel is a client connected here to a session run elsewhere. The frames
+// relayed to it queue up for its own writer, so a slow client holds up no
+// other relay.
+type tunnel struct {
+	id   string
+	conn *websocket.Conn
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// deliver queues a frame for the client, closing a client that far behind
+func (t *tunnel) deliver(data []byte) {
+	select {
+	case t.out <- data:
+	case <-t.done:
+	default:
+		log.Printf("Redis: relayed connection %s is too far behind, closing it\n", t.id)
+		t.close()
+	}
+}
+
+// write sends the queued frames until the tunnel closes
+func (t *tunnel) write() {
+	for {
+		select {
+		case data := <-t.out:
+			t.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if err := t.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				t.close()
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *tunnel) close() {
+	t.once.Do(func() {
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+// writeRESP sends a command as an array of bulk strings
+func writeRESP(w io.Writer, args []string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// readRESP reads one reply: a string, an int64, nil, a redisError or a
+// []interface{} of those
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				if _, isReply := err.(redisError); !isReply {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
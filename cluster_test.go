@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteRESP(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeRESP(&b, []string{"SET", "key", "two\r\nlines", ""}); err != nil {
+		t.Fatal(err)
+	}
+	want := "*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$10\r\ntwo\r\nlines\r\n$0\r\n\r\n"
+	if b.String() != want {
+		t.Errorf("wrote %q, want %q", b.String(), want)
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   error
+	}{
+		{"simple string", "+OK\r\n", "OK", nil},
+		{"error", "-ERR wrong type\r\n", nil, redisError("ERR wrong type")},
+		{"integer", ":-42\r\n", int64(-42), nil},
+		{"bulk string", "$5\r\nhello\r\n", "hello", nil},
+		{"bulk string with a line break", "$4\r\na\r\nb\r\n", "a\r\nb", nil},
+		{"empty bulk string", "$0\r\n\r\n", "", nil},
+		{"missing key", "$-1\r\n", nil, nil},
+		{"array", "*3\r\n$7\r\nmessage\r\n+chan\r\n:1\r\n", []interface{}{"message", "chan", int64(1)}, nil},
+		{"nested array", "*2\r\n*1\r\n+a\r\n$-1\r\n", []interface{}{[]interface{}{"a"}, nil}, nil},
+		{"error in an array", "*2\r\n-ERR no\r\n:1\r\n", []interface{}{nil, int64(1)}, nil},
+		{"missing array", "*-1\r\n", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readRESP(bufio.NewReader(strings.NewReader(test.reply)))
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadRESPRejectsGarbage(t *testing.T) {
+	for _, reply := range []string{"\r\n", "?what\r\n", "$5\r\nhi\r\n", ":x\r\n"} {
+		if _, err := readRESP(bufio.NewReader(strings.NewReader(reply))); err == nil {
+			t.Errorf("read %q without an error", reply)
+		}
+	}
+}
+
+// A command is an array of bulk strings, the fake server below reads them
+// back with readRESP
+func TestRESPCommandRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	writeRESP(&b, []string{"HSET", "pastatime:session:a", "snapshot", `{"id":"a"}`})
+	got, err := readRESP(bufio.NewReader(&b))
+	want := []interface{}{"HSET", "pastatime:session:a", "snapshot", `{"id":"a"}`}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, %v, want %#v", got, err, want)
+	}
+}
+
+// fakeRedis speaks enough RESP for the cluster: plain keys, hashes, PUBLISH
+// and the owner refresh script, which it runs in Go. Expiry is left out, a
+// test deletes a key to expire it.
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	keys     map[string]string
+	hashes   map[string]map[string]string
+	commands []string // names of the commands run, in order
+	dropNext bool     // close the connection instead of answering
+	conns    int
+	// published counts the messages per channel, published to nobody
+	published    map[string]int
+	publishDelay time.Duration // before answering a PUBLISH
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, keys: make(map[string]string), hashes: make(map[string]map[string]string), published: make(map[string]int)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		command, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := command.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		f.mu.Lock()
+		drop := f.dropNext
+		f.dropNext = false
+		reply := ""
+		if !drop {
+			reply = f.run(args)
+		}
+		delay := f.publishDelay
+		f.mu.Unlock()
+		if args[0] == "PUBLISH" {
+			time.Sleep(delay)
+		}
+		if drop {
+			return
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+// run answers one command, f.mu must be held
+func (f *fakeRedis) run(args []string) string {
+	f.commands = append(f.commands, args[0])
+	bulk := func(value string, ok bool) string {
+		if !ok {
+			return "$-1\r\n"
+		}
+		var b bytes.Buffer
+		writeRESP(&b, []string{value})
+		return strings.TrimPrefix(b.String(), "*1\r\n")
+	}
+	switch args[0] {
+	case "GET":
+		value, ok := f.keys[args[1]]
+		return bulk(value, ok)
+	case "SET":
+		_, exists := f.keys[args[1]]
+		if exists && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+		f.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(f.keys, key)
+			delete(f.hashes, key)
+		}
+		return ":1\r\n"
+	case "PEXPIRE":
+		return ":1\r\n"
+	case "HSETNX", "HSET":
+		hash := f.hashes[args[1]]
+		if hash == nil {
+			hash = make(map[string]string)
+			f.hashes[args[1]] = hash
+		}
+		if _, exists := hash[args[2]]; exists && args[0] == "HSETNX" {
+			return ":0\r\n"
+		}
+		hash[args[2]] = args[3]
+		return ":1\r\n"
+	case "HGET":
+		value, ok := f.hashes[args[1]][args[2]]
+		return bulk(value, ok)
+	case "PUBLISH":
+		f.published[args[1]]++
+		return ":0\r\n"
+	case "EVAL":
+		if args[1] != refreshOwnerScript {
+			return "-ERR unknown script\r\n"
+		}
+		key, instance := args[3], args[4]
+		owner, ok := f.keys[key]
+		if !ok {
+			f.keys[key], owner = instance, instance
+		}
+		return bulk(owner, true)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) get(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.keys[key]
+}
+
+func (f *fakeRedis) set(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[key] = value
+}
+
+func (f *fakeRedis) del(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keys, key)
+}
+
+func testCluster(f *fakeRedis, instance string) *redisCluster {
+	return &redisCluster{
+		addr:      f.listener.Addr().String(),
+		instance:  instance,
+		local:     newMemorySessionStore(),
+		outbox:    make(chan publication, relayOutbox),
+		relays:    make(map[string]*relayConn),
+		tunnels:   make(map[string]*tunnel),
+		snapshots: make(map[string][]byte),
+	}
+}
+
+func createClusterSession(t *testing.T, c *redisCluster, sessionID string) *Session {
+	t.Helper()
+	session, err := newSession(sessionID, newShortCode(), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(session); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// The owner refresh keeps a session another instance adopted with that
+// instance, and drops it here
+func TestClusterOwnerRefresh(t *testing.T) {
+	f := newFakeRedis(t)
+	c := testCluster(f, "pastatime-a")
+	createClusterSession(t, c, "kept-penne-10")
+	createClusterSession(t, c, "adopted-penne-11")
+	createClusterSession(t, c, "expired-penne-12")
+
+	f.set("pastatime:owner:adopted-penne-11", "pastatime-b")
+	f.del("pastatime:owner:expired-penne-12")
+	c.saveOwned()
+
+	for sessionID, want := range map[string]string{
+		"kept-penne-10":    "pastatime-a",
+		"adopted-penne-11": "pastatime-b",
+		"expired-penne-12": "pastatime-a",
+	} {
+		if owner := f.get("pastatime:owner:" + sessionID); owner != want {
+			t.Errorf("%s is owned by %q, want %q", sessionID, owner, want)
+		}
+		if _, here := c.local.Get(sessionID); here != (want == "pastatime-a") {
+			t.Errorf("%s is run here: %v, want %v", sessionID, here, want == "pastatime-a")
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, command := range f.commands {
+		if command == "GET" {
+			t.Error("the owner was read apart from refreshing it")
+		}
+	}
+	if f.hashes["pastatime:session:kept-penne-10"]["snapshot"] == "" {
+		t.Error("the snapshot of a session run here wasn't saved")
+	}
+	if f.hashes["pastatime:session:adopted-penne-11"]["snapshot"] != "" {
+		t.Error("the snapshot of an adopted session was overwritten")
+	}
+	if _, kept := c.snapshots["adopted-penne-11"]; kept {
+		t.Error("the last snapshot of a session taken over is still kept")
+	}
+}
+
+// Only the sessions run here keep their last snapshot in memory
+func TestClusterDeleteForgetsSnapshot(t *testing.T) {
+	f := newFakeRedis(t)
+	c := testCluster(f, "pastatime-a")
+	createClusterSession(t, c, "gone-penne-13")
+	c.saveOwned()
+	if _, saved := c.snapshots["gone-penne-13"]; !saved {
+		t.Fatal("the snapshot wasn't saved")
+	}
+	c.Delete("gone-penne-13")
+	if _, kept := c.snapshots["gone-penne-13"]; kept {
+		t.Error("the snapshot of a deleted session is still kept")
+	}
+}
+
+// Relaying doesn't wait for Redis, and a message nobody receives closes the
+// connection it was for
+func TestClusterRelayIsQueued(t *testing.T) {
+	f := newFakeRedis(t)
+	f.publishDelay = 200 * time.Millisecond
+	c := testCluster(f, "pastatime-a")
+	// Like the instance's, the publisher runs for good
+	go c.publish()
+	rc := &relayConn{cluster: c, peer: "pastatime-gone", id: "conn-1", incoming: make(chan []byte, relayBuffer), done: make(chan struct{})}
+	c.relays[rc.id] = rc
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := rc.WriteMessage(1, []byte(`{"type":"update"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("relaying waited %v for Redis", waited)
+	}
+	select {
+	case <-rc.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection stayed open with nobody receiving its frames")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.published["pastatime:instance:pastatime-gone"] == 0 {
+		t.Error("nothing was published")
+	}
+}
+
+// Another instance adopts a session from its snapshot once the owner key is
+// gone, and only one of two instances gets it
+func TestClusterAdoptsOnce(t *testing.T) {
+	f := newFakeRedis(t)
+	a, b, d := testCluster(f, "pastatime-a"), testCluster(f, "pastatime-b"), testCluster(f, "pastatime-d")
+	createClusterSession(t, a, "lonely-ziti-20")
+	a.saveOwned()
+	f.del("pastatime:owner:lonely-ziti-20")
+
+	if _, ok := b.Get("lonely-ziti-20"); !ok {
+		t.Fatal("the session wasn't adopted")
+	}
+	if _, ok := d.Get("lonely-ziti-20"); ok {
+		t.Error("a second instance adopted the session too")
+	}
+	if owner := f.get("pastatime:owner:lonely-ziti-20"); owner != "pastatime-b" {
+		t.Errorf("owned by %q, want pastatime-b", owner)
+	}
+}
+
+// An error reply keeps the connection, a broken one is dialed again
+func TestClusterReconnects(t *testing.T) {
+	f := newFakeRedis(t)
+	c := testCluster(f, "pastatime-a")
+	if _, err := c.do("BROKEN"); !errors.As(err, new(redisError)) {
+		t.Fatalf("got %v, want a redisError", err)
+	}
+	if _, err := c.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.dropNext = true
+	f.mu.Unlock()
+	if _, err := c.do("GET", "k"); err == nil {
+		t.Fatal("a dropped connection gave no error")
+	}
+	if value, err := c.get("k"); err != nil || value != "v" {
+		t.Fatalf("got %q, %v after reconnecting, want v", value, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 2 {
+		t.Errorf("dialed %d times, want 2", f.conns)
+	}
+}
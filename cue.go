@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Cue tells every client how to present an event, so alerts look and sound
+// the same everywhere instead of being hard-coded in the page
+type Cue struct {
+	Sound string `json:"sound,omitempty"` // one of the bundled soundFiles
+	Flash string `json:"flash,omitempty"` // background color, #rrggbb
+}
+
+// cueEvents are the alert and turn-change events a cue can be attached to
+var cueEvents = map[string]bool{
+	"warning":            true,
+	"overtime":           true,
+	"timeExpired":        true,
+	"timeBankExpired":    true,
+	"turnLimitReached":   true,
+	"finishWarning":      true,
+	"timerExpired":       true,
+	"phaseChanged":       true,
+	"turnChanged":        true,
+	"turnPassed":         true,
+	"autoStartCountdown": true,
+	"autoStarted":        true,
+	"yourTurnPending":    true,
+	"handoffExpired":     true,
+	"roundComplete":      true,
+	"sessionFinished":    true,
+}
+
+// alertEvents get the session's alert sound when their cue doesn't name one
+var alertEvents = map[string]bool{
+	"warning":          true,
+	"overtime":         true,
+	"timeExpired":      true,
+	"timeBankExpired":  true,
+	"turnLimitReached": true,
+	"finishWarning":    true,
+	"timerExpired":     true,
+}
+
+var flashColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// validateCues checks the cues chosen for a session
+func validateCues(cues map[string]Cue) error {
+	for event, cue := range cues {
+		if !cueEvents[event] {
+			return fmt.Errorf("cues: %q is not an alert or turn-change event", event)
+		}
+		if cue.Sound != "" && soundFiles[cue.Sound] == nil {
+			return fmt.Errorf("cues: unknown sound %q for %s", cue.Sound, event)
+		}
+		if cue.Flash != "" && !flashColor.MatchString(cue.Flash) {
+			return fmt.Errorf("cues: flash for %s must be a #rrggbb color", event)
+		}
+	}
+	return nil
+}
+
+// withCue attaches the session's cue for the event type, if there is one
+func (s *Session) withCue(event map[string]interface{}) map[string]interface{} {
+	eventType, _ := event["type"].(string)
+	s.stateMux.Lock()
+	cue, ok := s.settings.Cues[eventType]
+	if alertEvents[eventType] && cue.Sound == "" && s.settings.AlertSound != "" {
+		cue.Sound = s.settings.AlertSound
+		ok = true
+	}
+	s.stateMux.Unlock()
+	if ok {
+		event["cue"] = cue
+	}
+	return event
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A retired session isn't gone at once: its export stays in the trash for
+// PASTATIME_RESTORE_WINDOW, where an admin can download it or bring the
+// session back paused, as an import would. The trash is kept in memory, a
+// restart empties it.
+//
+//	GET  /admin/api/deleted               the trash, newest first
+//	GET  /admin/api/deleted/{id}          the export of a deleted session
+//	POST /admin/api/deleted/{id}/restore  recreate it, under a new ID if
+//	                                      another session took the old one
+
+const (
+	// defaultRestoreWindow is how long a retired session can be restored
+	defaultRestoreWindow = 24 * time.Hour
+	// maxDeletedSessions is how many sessions the trash holds, the oldest
+	// go first
+	maxDeletedSessions = 1000
+)
+
+// restoreWindow is how long a retired session can be restored, 0 deletes
+// sessions for good when they are retired
+var restoreWindow = defaultRestoreWindow
+
+// restoreWindowFromEnv reads PASTATIME_RESTORE_WINDOW
+func restoreWindowFromEnv() time.Duration {
+	value := os.Getenv("PASTATIME_RESTORE_WINDOW")
+	if value == "" {
+		return restoreWindow
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		log.Printf("Ignoring PASTATIME_RESTORE_WINDOW=%q, it should be a duration like 24h or 0 to delete sessions for good\n", value)
+		return restoreWindow
+	}
+	return window
+}
+
+// DeletedSession is a retired session in the trash
+type DeletedSession struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Reason       string    `json:"reason"` // why it was retired, like "idle" or "lifetime"
+	DeletedAt    time.Time `json:"deletedAt"`
+	RestoreUntil time.Time `json:"restoreUntil"`
+
+	bundle SessionExport
+}
+
+var (
+	trashMux sync.Mutex // guards trash
+	trash    []DeletedSession
+)
+
+// softDelete puts a retired session in the trash
+func (s *Session) softDelete(reason string) {
+	if restoreWindow == 0 {
+		return
+	}
+	bundle := s.export()
+	s.stateMux.Lock()
+	title := s.title()
+	s.stateMux.Unlock()
+
+	now := time.Now()
+	trashMux.Lock()
+	defer trashMux.Unlock()
+	pruneTrash(now)
+	if len(trash) >= maxDeletedSessions {
+		trash = slices.Delete(trash, 0, len(trash)-maxDeletedSessions+1)
+	}
+	trash = append(trash, DeletedSession{
+		ID:           s.ID,
+		Title:        title,
+		Reason:       reason,
+		DeletedAt:    now,
+		RestoreUntil: now.Add(restoreWindow),
+		bundle:       bundle,
+	})
+}
+
+// pruneTrash drops the sessions past their restore window, trashMux must be
+// held
+func pruneTrash(now time.Time) {
+	trash = slices.DeleteFunc(trash, func(deleted DeletedSession) bool {
+		return !now.Before(deleted.RestoreUntil)
+	})
+}
+
+// deletedSession finds a session in the trash, the latest if the ID was
+// retired more than once, and its index. trashMux must be held.
+func deletedSession(sessionID string) (DeletedSession, int) {
+	pruneTrash(time.Now())
+	for i := len(trash) - 1; i >= 0; i-- {
+		if trash[i].ID == sessionID {
+			return trash[i], i
+		}
+	}
+	return DeletedSession{}, -1
+}
+
+// handleAdminDeleted serves /admin/api/deleted/...
+func handleAdminDeleted(w http.ResponseWriter, r *http.Request, path string) {
+	sessionID, action, _ := strings.Cut(path, "/")
+	switch {
+	case sessionID == "" && r.Method == http.MethodGet:
+		trashMux.Lock()
+		pruneTrash(time.Now())
+		list := make([]DeletedSession, 0, len(trash))
+		for i := len(trash) - 1; i >= 0; i-- {
+			list = append(list, trash[i])
+		}
+		trashMux.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(list)
+	case sessionID != "" && action == "" && r.Method == http.MethodGet:
+		trashMux.Lock()
+		deleted, i := deletedSession(sessionID)
+		trashMux.Unlock()
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+sessionID+`-export.json"`)
+		json.NewEncoder(w).Encode(deleted.bundle)
+	case sessionID != "" && action == "restore" && r.Method == http.MethodPost:
+		restoreDeleted(w, r, sessionID)
+	case action == "" || action == "restore":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// restoreDeleted brings a session back from the trash
+func restoreDeleted(w http.ResponseWriter, r *http.Request, sessionID string) {
+	trashMux.Lock()
+	deleted, i := deletedSession(sessionID)
+	if i >= 0 && deleted.Reason != "lifetime" {
+		// Taken out so two restores can't both bring it back
+		trash = slices.Delete(trash, i, i+1)
+	}
+	trashMux.Unlock()
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if deleted.Reason == "lifetime" {
+		// It would be retired again at once, its export can still be imported
+		http.Error(w, "The session outlived PASTATIME_SESSION_LIFETIME, download its export instead", http.StatusConflict)
+		return
+	}
+
+	session, err := importSession(deleted.bundle)
+	if err != nil {
+		trashMux.Lock()
+		trash = slices.Insert(trash, min(i, len(trash)), deleted)
+		trashMux.Unlock()
+		log.Printf("Session %s: Restoring from the trash failed: %v\n", sessionID, err)
+		http.Error(w, "Could not restore the session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Session %s: Restored from the trash as %s\n", sessionID, session.ID)
+	response := map[string]string{
+		"sessionId": session.ID,
+		"shortLink": "/j/" + session.shortCode,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
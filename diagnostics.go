@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// diagnosticTimeout bounds each check, they all run at once
+	diagnosticTimeout = 3 * time.Second
+	// maxClockDrift is how far the wall clock may have moved away from the
+	// monotonic one since startup, more means it was set or is jumping
+	maxClockDrift = 2 * time.Second
+	// minFreeDisk is the free space a directory the server writes to needs
+	minFreeDisk = 100 << 20
+)
+
+// serverStarted is compared with the current time by the clock check
+var serverStarted = time.Now()
+
+// earliestSaneTime is before any clock that is actually set
+var earliestSaneTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Check is the outcome of one diagnostic
+type Check struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Diagnostics is what GET /admin/api/diagnostics returns, OK only if every
+// check passed
+type Diagnostics struct {
+	OK     bool      `json:"ok"`
+	At     time.Time `json:"at"`
+	Checks []Check   `json:"checks"`
+}
+
+// diagnostic runs one check, an error fails it and the detail explains a pass
+type diagnostic struct {
+	name string
+	run  func() (detail string, err error)
+}
+
+// diagnostics lists the checks that apply to this server's configuration
+func diagnostics() []diagnostic {
+	checks := []diagnostic{{"clock", checkClock}, {"storage", checkStorage}}
+	if cluster != nil {
+		checks = append(checks, diagnostic{"redis", func() (string, error) {
+			_, err := cluster.do("PING")
+			return "answering at " + cluster.addr, err
+		}})
+	}
+
+	// The services the integrations call out to
+	if target := os.Getenv("PASTATIME_TTS_URL"); target != "" && speech != nil {
+		checks = append(checks, reachable("tts", hostPort(target)))
+	}
+	if mqtt != nil {
+		checks = append(checks, reachable("mqtt", mqtt.broker))
+	}
+	if twitch != nil {
+		checks = append(checks, reachable("twitch", twitchServer))
+	}
+	for _, host := range strings.Split(os.Getenv("PASTATIME_LIGHT_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			checks = append(checks, reachable("light "+host, hostPort("http://"+host)))
+		}
+	}
+
+	for _, dir := range dataDirectories() {
+		checks = append(checks, diagnostic{"disk " + dir, func() (string, error) { return checkDisk(dir) }})
+	}
+	return checks
+}
+
+// runDiagnostics runs every check at once
+func runDiagnostics() Diagnostics {
+	all := diagnostics()
+	result := Diagnostics{OK: true, At: time.Now(), Checks: make([]Check, len(all))}
+	var wg sync.WaitGroup
+	for i, d := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			detail, err := d.run()
+			check := Check{Name: d.name, OK: err == nil, Detail: detail, DurationMs: time.Since(started).Milliseconds()}
+			if err != nil {
+				check.Detail = err.Error()
+			}
+			result.Checks[i] = check
+		}()
+	}
+	wg.Wait()
+	for _, check := range result.Checks {
+		result.OK = result.OK && check.OK
+	}
+	return result
+}
+
+// checkClock catches an unset clock and one that was changed while the
+// server ran, both throw the timers off
+func checkClock() (string, error) {
+	now := time.Now()
+	if now.Before(earliestSaneTime) {
+		return "", fmt.Errorf("the clock says %s, it is not set", now.Format(time.RFC3339))
+	}
+	// Round(0) drops the monotonic reading, leaving the wall clock
+	drift := now.Round(0).Sub(serverStarted.Round(0)) - now.Sub(serverStarted)
+	if drift > maxClockDrift || drift < -maxClockDrift {
+		return "", fmt.Errorf("the wall clock moved %v since startup, check NTP", drift.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s, within %v since startup", now.UTC().Format(time.RFC3339), maxClockDrift), nil
+}
+
+// checkStorage pings the store sessions are saved to
+func checkStorage() (string, error) {
+	if persistence == nil {
+		return "sessions are kept in memory only", nil
+	}
+	if err := persistence.store.ping(); err != nil {
+		return "", err
+	}
+	return "saving sessions to " + os.Getenv("PASTATIME_SQLITE_PATH"), nil
+}
+
+// reachable checks that a TCP connection to address opens
+func reachable(name string, address string) diagnostic {
+	return diagnostic{name, func() (string, error) {
+		conn, err := net.DialTimeout("tcp", address, diagnosticTimeout)
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return address + " is reachable", nil
+	}}
+}
+
+// hostPort is the host:port a URL connects to
+func hostPort(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	if parsed.Port() != "" {
+		return parsed.Host
+	}
+	if parsed.Scheme == "https" {
+		return net.JoinHostPort(parsed.Hostname(), "443")
+	}
+	return net.JoinHostPort(parsed.Hostname(), "80")
+}
+
+// dataDirectories are where the server writes files, the SQLite database or
+// the checkpoint file
+func dataDirectories() []string {
+	var dirs []string
+	for _, name := range []string{"PASTATIME_SQLITE_PATH", "PASTATIME_CHECKPOINT_PATH"} {
+		if path := os.Getenv(name); path != "" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	return dirs
+}
+
+// checkDisk checks that dir is writable and has minFreeDisk left
+func checkDisk(dir string) (string, error) {
+	file, err := os.CreateTemp(dir, ".pastatime-diagnostics-*")
+	if err != nil {
+		return "", fmt.Errorf("not writable: %v", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return "writable, free space unknown: " + err.Error(), nil
+	}
+	if free < minFreeDisk {
+		return "", fmt.Errorf("only %d MiB free", free>>20)
+	}
+	return fmt.Sprintf("writable, %d MiB free", free>>20), nil
+}
+
+// handleAdminDiagnostics serves GET /admin/api/diagnostics
+func handleAdminDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(runDiagnostics())
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// freeDiskSpace is only implemented where statfs is available
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
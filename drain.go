@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Draining gets an instance ready to be replaced without cutting sessions
+// short: it stops taking new sessions, waits for the active ones to finish
+// or empty out, up to a timeout, saves them and exits. Operators start it
+// with POST /admin/api/drain and can call it off with DELETE until then.
+
+const (
+	defaultDrainTimeout = 30 * time.Minute
+	maxDrainTimeout     = 24 * time.Hour
+	// drainPollInterval is how often the active sessions are counted
+	drainPollInterval = 5 * time.Second
+	// shutdownTimeout bounds the requests still being served on exit
+	shutdownTimeout = 10 * time.Second
+)
+
+// server is the instance's HTTP server, drain shuts it down
+var server *http.Server
+
+// drained is closed once a drain shut the server down, main then returns
+var drained = make(chan struct{})
+
+// drain is the instance's drain, if one was started
+var drain struct {
+	sync.Mutex
+	started  time.Time
+	deadline time.Time
+	cancel   chan struct{}
+	exiting  bool // past the point of calling it off
+}
+
+// DrainStatus is what the drain endpoint returns
+type DrainStatus struct {
+	Draining       bool       `json:"draining"`
+	Exiting        bool       `json:"exiting,omitempty"`
+	Started        *time.Time `json:"started,omitempty"`
+	Deadline       *time.Time `json:"deadline,omitempty"`
+	ActiveSessions int        `json:"activeSessions"`
+	// Migration is set when the drain was started with {"migrate": true}
+	Migration *Migration `json:"migration,omitempty"`
+}
+
+// draining reports whether new sessions are turned away
+func draining() bool {
+	drain.Lock()
+	defer drain.Unlock()
+	return drain.cancel != nil
+}
+
+// rejectWhileDraining answers 503 and returns true while draining, for the
+// handlers that create sessions
+func rejectWhileDraining(w http.ResponseWriter) bool {
+	if !draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, "This server is about to restart and takes no new sessions", http.StatusServiceUnavailable)
+	return true
+}
+
+// active reports whether the session is still in use: somebody is connected
+// and it hasn't finished or been migrated
+func (s *Session) active() bool {
+	s.clientsMux.Lock()
+	connected := s.connectedCount()
+	s.clientsMux.Unlock()
+	if connected == 0 {
+		return false
+	}
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	return !s.finished && !s.migrated
+}
+
+// activeSessions counts the sessions a drain waits for
+func activeSessions() int {
+	count := 0
+	for _, session := range sessionStore.List() {
+		if session.active() {
+			count++
+		}
+	}
+	return count
+}
+
+// startDrain turns new sessions away and exits once no session is active or
+// the timeout passed, false if a drain is already going
+func startDrain(timeout time.Duration) bool {
+	drain.Lock()
+	defer drain.Unlock()
+	if drain.cancel != nil {
+		return false
+	}
+	drain.started = time.Now()
+	drain.deadline = drain.started.Add(timeout)
+	drain.cancel = make(chan struct{})
+	log.Printf("Draining: no new sessions, exiting once the active ones are done or at %s\n", drain.deadline.Format(time.RFC3339))
+
+	for _, session := range sessionStore.List() {
+		go session.broadcastEvent(map[string]interface{}{
+			"type":     "serverDraining",
+			"deadline": drain.deadline.UnixMilli(),
+		})
+	}
+	go waitForDrain(drain.deadline, drain.cancel)
+	return true
+}
+
+// stopDrain calls a drain off, false if none was going or it is exiting
+func stopDrain() bool {
+	drain.Lock()
+	defer drain.Unlock()
+	if drain.cancel == nil || drain.exiting {
+		return false
+	}
+	close(drain.cancel)
+	drain.cancel = nil
+	log.Println("Draining called off, taking new sessions again")
+	return true
+}
+
+// waitForDrain polls the active sessions until there are none or the
+// deadline, then saves the sessions and shuts the server down
+func waitForDrain(deadline time.Time, cancel chan struct{}) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		active := activeSessions()
+		if active == 0 {
+			log.Println("Draining: no active sessions left")
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Draining: timed out with %d active sessions\n", active)
+			break
+		}
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	drain.Lock()
+	if drain.cancel != cancel {
+		drain.Unlock()
+		return
+	}
+	drain.exiting = true
+	drain.Unlock()
+
+	if persistence != nil {
+		persistence.saveChanged()
+	}
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Draining: shutting the server down: %v\n", err)
+	}
+	close(drained)
+}
+
+// handleAdminDrain serves /admin/api/drain: GET for the status, POST with
+// an optional {"timeout": "30m"} to start draining and DELETE to stop. With
+// {"migrate": true} the sessions are handed over instead, see migrate.go;
+// stopping unfreezes them.
+func handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	var migration *Migration
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		timeout := defaultDrainTimeout
+		var body struct {
+			Timeout string `json:"timeout"`
+			Migrate bool   `json:"migrate"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+		if body.Timeout != "" {
+			parsed, err := time.ParseDuration(body.Timeout)
+			if err != nil || parsed < 0 || parsed > maxDrainTimeout {
+				http.Error(w, "timeout should be a duration like 30m, at most 24h", http.StatusBadRequest)
+				return
+			}
+			timeout = parsed
+		}
+		if draining() {
+			http.Error(w, "Already draining", http.StatusConflict)
+			return
+		}
+		if body.Migrate && migrationPath == "" && persistence == nil {
+			http.Error(w, "Migrating needs PASTATIME_MIGRATION_PATH or saved sessions, the answer alone could get lost", http.StatusConflict)
+			return
+		}
+		// Frozen first so the drain doesn't wait for them
+		if body.Migrate {
+			exported := migrateSessions(time.Now().Add(timeout))
+			if migrationPath != "" {
+				if err := writeMigration(exported); err != nil {
+					log.Printf("Writing the migration failed: %v\n", err)
+					unfreezeSessions()
+					http.Error(w, "Could not write the migration", http.StatusInternalServerError)
+					return
+				}
+			}
+			migration = &exported
+		}
+		if !startDrain(timeout) {
+			if migration != nil {
+				unfreezeSessions()
+			}
+			http.Error(w, "Already draining", http.StatusConflict)
+			return
+		}
+	case http.MethodDelete:
+		if !stopDrain() {
+			http.Error(w, "Not draining, or already exiting", http.StatusConflict)
+			return
+		}
+		unfreezeSessions()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	drain.Lock()
+	status := DrainStatus{Draining: drain.cancel != nil, Exiting: drain.exiting}
+	if status.Draining {
+		started, deadline := drain.started, drain.deadline
+		status.Started, status.Deadline = &started, &deadline
+	}
+	drain.Unlock()
+	status.ActiveSessions = activeSessions()
+	status.Migration = migration
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every session keeps an append-only log of the commands it received, the
+// events it broadcast and the transitions of its state: started, paused,
+// turns, laps and finishing. Clients that reconnect can catch up from the
+// last sequence number they saw, with GET /api/sessions/{id}/log?since=N.
+
+// maxLogEntries bounds the log kept in memory, the oldest entries go first.
+// The file sink, if any, keeps everything it keeps up with.
+const maxLogEntries = 5000
+
+const (
+	// eventLogBuffer is how many lines can wait for the file, more are
+	// dropped rather than hold up the session
+	eventLogBuffer = 1024
+	// eventLogIdle is how long the file stays open without lines to write
+	eventLogIdle = 10 * time.Second
+)
+
+// unloggedEvents are too chatty to be worth keeping
+var unloggedEvents = map[string]bool{"presence": true}
+
+// eventLogDir is set with PASTATIME_EVENT_LOG_DIR, each session then also
+// appends its log to {dir}/{session}.jsonl
+var eventLogDir string
+
+// LogEntry is one line of a session's event log
+type LogEntry struct {
+	Seq    uint64      `json:"seq"`
+	At     time.Time   `json:"at"`
+	Kind   string      `json:"kind"` // "command", "event" or "transition"
+	Client string      `json:"client,omitempty"`
+	Type   string      `json:"type"`           // the command, event type or transition
+	Data   interface{} `json:"data,omitempty"` // command argument, event or details
+}
+
+// EventLogPage is what the log endpoint returns. Complete is false when
+// entries after since were already dropped from memory.
+type EventLogPage struct {
+	Entries  []LogEntry `json:"entries"`
+	LastSeq  uint64     `json:"lastSeq"`
+	Complete bool       `json:"complete"`
+}
+
+// eventLog has its own lock so it can be appended to whatever the caller
+// holds
+type eventLog struct {
+	mu        sync.Mutex
+	sessionID string
+	entries   []LogEntry
+	seq       uint64
+	lines     chan []byte // to the file, written by write
+	writing   bool        // write is running
+
+	// The state last seen by observe
+	observed     bool
+	running      bool
+	finished     bool
+	activeClient string
+	laps         int
+}
+
+func newEventLog(sessionID string) *eventLog {
+	return &eventLog{sessionID: sessionID}
+}
+
+// eventLogDirFromEnv reads PASTATIME_EVENT_LOG_DIR
+func eventLogDirFromEnv() string {
+	dir := os.Getenv("PASTATIME_EVENT_LOG_DIR")
+	if dir == "" {
+		return ""
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Printf("Ignoring PASTATIME_EVENT_LOG_DIR=%q, it should be an existing directory\n", dir)
+		return ""
+	}
+	log.Printf("Writing session event logs to %s\n", dir)
+	return dir
+}
+
+// append adds an entry, l.mu must be held
+func (l *eventLog) append(kind string, client string, entryType string, data interface{}) {
+	l.seq++
+	entry := LogEntry{Seq: l.seq, At: time.Now(), Kind: kind, Client: client, Type: entryType, Data: data}
+	if len(l.entries) >= maxLogEntries {
+		l.entries = append(l.entries[:0], l.entries[len(l.entries)-maxLogEntries+1:]...)
+	}
+	l.entries = append(l.entries, entry)
+
+	if eventLogDir == "" {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// Callers can hold stateMux, the file is written by its own goroutine
+	if l.lines == nil {
+		l.lines = make(chan []byte, eventLogBuffer)
+	}
+	if !l.writing {
+		l.writing = true
+		go l.write()
+	}
+	select {
+	case l.lines <- append(line, '\n'):
+	default:
+		log.Printf("Session %s: The event log file is behind, dropping entry %d\n", l.sessionID, entry.Seq)
+	}
+}
+
+// write appends the queued lines to {dir}/{session}.jsonl, keeping the file
+// open until no line came for eventLogIdle
+func (l *eventLog) write() {
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	for {
+		select {
+		case line := <-l.lines:
+			if file == nil {
+				var err error
+				file, err = os.OpenFile(filepath.Join(eventLogDir, l.sessionID+".jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+				if err != nil {
+					log.Printf("Session %s: Writing the event log failed: %v\n", l.sessionID, err)
+					continue
+				}
+			}
+			if _, err := file.Write(line); err != nil {
+				log.Printf("Session %s: Writing the event log failed: %v\n", l.sessionID, err)
+				file.Close()
+				file = nil
+			}
+		case <-time.After(eventLogIdle):
+			l.mu.Lock()
+			if len(l.lines) > 0 {
+				l.mu.Unlock()
+				continue
+			}
+			l.writing = false
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// command logs a command as the client sent it, e.g. "deleteLap:2"
+func (l *eventLog) command(clientID string, cmd string) {
+	name, arg, _ := strings.Cut(cmd, ":")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if arg == "" {
+		l.append("command", clientID, name, nil)
+	} else {
+		l.append("command", clientID, name, arg)
+	}
+}
+
+// event logs a broadcast event as data, the JSON clients got
+func (l *eventLog) event(event map[string]interface{}, data []byte) {
+	eventType, _ := event["type"].(string)
+	if unloggedEvents[eventType] {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.append("event", "", eventType, json.RawMessage(data))
+}
+
+// observe logs how the broadcast state msg differs from the last one seen.
+// The first state seen is only remembered.
+func (l *eventLog) observe(msg map[string]interface{}) {
+	running, _ := msg["running"].(bool)
+	finished, _ := msg["finished"].(bool)
+	activeClient, _ := msg["activeClient"].(string)
+	// The state only carries the latest laps, lapCount tells how many there are
+	laps, _ := msg["lapHistory"].([]Lap)
+	lapCount, _ := msg["lapCount"].(int)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.observed {
+		l.observed = true
+		l.running, l.finished, l.activeClient, l.laps = running, finished, activeClient, lapCount
+		return
+	}
+
+	switch {
+	case lapCount > l.laps:
+		for _, lap := range laps[max(len(laps)-(lapCount-l.laps), 0):] {
+			l.append("transition", lap.Client, "lap", lap)
+		}
+	case lapCount == 0 && l.laps > 0:
+		l.append("transition", "", "reset", nil)
+	case lapCount < l.laps:
+		l.append("transition", "", "lapsEdited", map[string]int{"laps": lapCount})
+	}
+	if running != l.running {
+		if running {
+			l.append("transition", activeClient, "started", nil)
+		} else {
+			l.append("transition", activeClient, "paused", nil)
+		}
+	}
+	if activeClient != l.activeClient {
+		l.append("transition", activeClient, "turn", map[string]string{"from": l.activeClient, "to": activeClient})
+	}
+	if finished && !l.finished {
+		l.append("transition", "", "finished", nil)
+	}
+	l.running, l.finished, l.activeClient, l.laps = running, finished, activeClient, lapCount
+}
+
+// since returns the entries after seq
+func (l *eventLog) since(seq uint64) EventLogPage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Seq > seq })
+	return EventLogPage{
+		Entries:  append([]LogEntry{}, l.entries[start:]...),
+		LastSeq:  l.seq,
+		Complete: len(l.entries) == 0 || l.entries[0].Seq <= seq+1,
+	}
+}
+
+// handleEventLog serves /api/sessions/{id}/log?since=N
+func handleEventLog(w http.ResponseWriter, r *http.Request, session *Session) {
+	var since uint64
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "since should be a sequence number", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(session.events.since(since))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exportVersion is bumped when SessionExport changes incompatibly
+const exportVersion = 1
+
+// maxImportSize caps the body of an import, long sessions have many laps
+const maxImportSize = 8 << 20
+
+// SessionExport is the bundle GET /s/{id}/export returns and POST
+// /import-session takes back, on this server or another one. Integrations
+// are left out, they hold credentials and depend on the server.
+type SessionExport struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Session    sessionSnapshot `json:"session"`
+	// Roster is the turn order when exported, participants only
+	Roster []string `json:"roster"`
+}
+
+// export bundles the session up
+func (s *Session) export() SessionExport {
+	bundle := SessionExport{Version: exportVersion, ExportedAt: time.Now(), Session: s.snapshot()}
+	bundle.Session.Settings.Integrations = nil
+	s.clientsMux.Lock()
+	bundle.Roster = append([]string{}, s.clientOrder...)
+	s.clientsMux.Unlock()
+	return bundle
+}
+
+// handleExport serves /s/{id}/export as a download
+func handleExport(w http.ResponseWriter, session *Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+session.ID+`-export.json"`)
+	json.NewEncoder(w).Encode(session.export())
+}
+
+// importSession recreates an exported session, paused, under its old ID and
+// short link when they are free here
+func importSession(bundle SessionExport) (*Session, error) {
+	if bundle.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", bundle.Version)
+	}
+	snapshot := bundle.Session
+	snapshot.Settings.Integrations = nil
+	// A start that has passed was the exporting server's to keep, the
+	// session has started or opens as soon as it's back
+	if snapshot.StartAt.IsZero() || !time.Now().Before(snapshot.StartAt) {
+		snapshot.Settings.StartAt = nil
+	}
+	if err := snapshot.Settings.validate(); err != nil {
+		return nil, err
+	}
+	if !validSessionID(snapshot.ID) || !validShortCode(snapshot.ShortCode) {
+		snapshot.ID, snapshot.ShortCode = newSessionSlug(), newShortCode()
+	}
+
+	for {
+		session, err := restoreSession(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if err := session.restoreRoster(bundle.Roster); err != nil {
+			return nil, err
+		}
+		err = session.registerSession()
+		if !errors.Is(err, errSessionExists) {
+			return session, err
+		}
+		snapshot.ID, snapshot.ShortCode = newSessionSlug(), newShortCode()
+	}
+}
+
+// restoreRoster brings back the turn order of an exported or migrated
+// session. People who joined without being on the roster keep their place
+// as roster slots they can claim again.
+func (s *Session) restoreRoster(roster []string) error {
+	for _, name := range roster {
+		s.clientsMux.Lock()
+		_, exists := s.clients[name]
+		s.clientsMux.Unlock()
+		if !exists {
+			if err := s.addOfflineClient(name, true); err != nil {
+				return err
+			}
+		}
+	}
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+	order := make([]string, 0, len(s.clientOrder))
+	for _, name := range roster {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	for _, name := range s.clientOrder {
+		if !slices.Contains(order, name) {
+			order = append(order, name)
+		}
+	}
+	s.clientOrder = order
+	if len(order) > 0 {
+		s.activeClientID = order[0]
+	}
+	return nil
+}
+
+// validSessionID accepts IDs like generateName makes them
+func validSessionID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validShortCode accepts codes like newShortCode makes them, and the
+// mixed-case ones it used to make
+func validShortCode(code string) bool {
+	if len(code) != shortCodeLength {
+		return false
+	}
+	for _, r := range code {
+		if !strings.ContainsRune(legacyShortCodeAlphabet, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleImportSession serves POST /import-session with a SessionExport body
+func handleImportSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectWhileDraining(w) {
+		return
+	}
+	if rejectAtSessionLimit(w) {
+		return
+	}
+	var bundle SessionExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&bundle); err != nil {
+		http.Error(w, "Invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if bundle.Session.Settings.Priority == priorityHigh && (adminToken == "" || !adminAuthorized(r)) {
+		http.Error(w, "Only admins can create high-priority sessions", http.StatusForbidden)
+		return
+	}
+
+	session, err := importSession(bundle)
+	if err != nil {
+		http.Error(w, "Invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Imported session: %s (short link /j/%s) with %d laps\n", session.ID, session.shortCode, len(session.lapHistory))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"sessionId": session.ID,
+		"shortLink": "/j/" + session.shortCode,
+	})
+}
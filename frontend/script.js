@@ -1,20 +1,103 @@
 // Wait for the DOM to be fully loaded before accessing elements
 document.addEventListener("DOMContentLoaded", () => {
   const newSessionButton = document.getElementById("newSessionButton");
+  const sessionNameInput = document.getElementById("sessionName");
+  const slugInput = document.getElementById("slug");
+  const templateInput = document.getElementById("template");
+  const guessTargetInput = document.getElementById("guessTarget");
+  const proxyControlInput = document.getElementById("proxyControl");
+  const sharedDeviceInput = document.getElementById("sharedDevice");
+  const selfOrderingInput = document.getElementById("selfOrdering");
+  const individualTimersInput = document.getElementById("individualTimers");
+  const simultaneousInput = document.getElementById("simultaneous");
+  const lateJoinersSkipInput = document.getElementById("lateJoinersSkip");
+  const announcementsInput = document.getElementById("announcements");
+  const languageInput = document.getElementById("language");
+  const startAtInput = document.getElementById("startAt");
+  const lobbyInput = document.getElementById("lobby");
+  const participantsInput = document.getElementById("participants");
+
+  // Offer the saved templates, if there are any, and the private one a
+  // host's link names
+  if (templateInput) {
+    const linked = new URLSearchParams(window.location.search).get("template");
+    fetch("/api/templates")
+      .then((response) => (response.ok ? response.json() : {}))
+      .then((templates) => {
+        const names = Object.keys(templates).sort();
+        if (linked && !names.includes(linked)) names.unshift(linked);
+        names.forEach((name) => {
+          const option = document.createElement("option");
+          option.value = name;
+          option.textContent = name;
+          templateInput.appendChild(option);
+        });
+        templateInput.hidden = names.length === 0;
+        if (linked) templateInput.value = linked;
+      })
+      .catch((error) => console.error("Error loading templates:", error));
+  }
+
+  // Collect the session options chosen on the landing page
+  const sessionSettings = () => {
+    const settings = {
+      sessionName: sessionNameInput ? sessionNameInput.value.trim() : "",
+      proxyControl: proxyControlInput ? proxyControlInput.checked : false,
+      sharedDevice: sharedDeviceInput ? sharedDeviceInput.checked : false,
+      selfOrdering: selfOrderingInput ? selfOrderingInput.checked : false,
+      individualTimers: individualTimersInput
+        ? individualTimersInput.checked
+        : false,
+      simultaneous: simultaneousInput ? simultaneousInput.checked : false,
+      lateJoiners:
+        lateJoinersSkipInput && lateJoinersSkipInput.checked ? "skip" : "insert",
+      announcements: announcementsInput ? announcementsInput.checked : false,
+      language: languageInput ? languageInput.value : "en",
+    };
+    if (templateInput && templateInput.value) {
+      settings.template = templateInput.value;
+    }
+    if (slugInput && slugInput.value.trim()) {
+      settings.slug = slugInput.value.trim().toLowerCase();
+    }
+    const guessTarget = guessTargetInput ? parseFloat(guessTargetInput.value) : 0;
+    if (guessTarget > 0) settings.guessTargetMs = Math.round(guessTarget * 1000);
+    // datetime-local is in local time, the server wants an absolute timestamp
+    if (startAtInput && startAtInput.value) {
+      settings.startAt = new Date(startAtInput.value).toISOString();
+    }
+    if (lobbyInput && lobbyInput.checked) settings.lobby = true;
+    // Joining clients claim these names, taking turns in this order
+    if (participantsInput) {
+      const participants = participantsInput.value
+        .split("\n")
+        .map((name) => name.trim())
+        .filter((name) => name);
+      if (participants.length > 0) settings.participants = participants;
+    }
+    return settings;
+  };
 
   if (newSessionButton) {
     newSessionButton.addEventListener("click", async () => {
       try {
         // Make a request to the backend to create a new session
         // Assuming your backend has an endpoint like /new-session that returns a JSON object with a 'sessionId' field
+        const settings = sessionSettings();
         const response = await fetch("/new-session", {
           method: "POST", // Or GET, depending on your backend design
           headers: {
             "Content-Type": "application/json",
           },
-          // body: JSON.stringify({}) // Send body if needed by backend
+          body: JSON.stringify(settings),
         });
 
+        // A recurring group's session is still going on, join it instead
+        if (response.status === 409 && settings.slug) {
+          window.location.href = `/s/${settings.slug}`;
+          return;
+        }
+
         if (response.status >= 200 && response.status < 300) {
           const data = await response.json();
           const sessionId = data.sessionId; // Assuming the backend returns { "sessionId": "some-uuid" }
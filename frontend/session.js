@@ -22,10 +22,135 @@ document.addEventListener("DOMContentLoaded", () => {
   const clientNameDisplayElement = document.getElementById("clientNameDisplay"); // Added client name
   const startButton = document.getElementById("start");
   const pauseButton = document.getElementById("pause");
+  const pauseReasonInput = document.getElementById("pauseReason");
   const resetButton = document.getElementById("reset");
   const nextButton = document.getElementById("next");
+  const skipButton = document.getElementById("skip");
+  const splitButton = document.getElementById("split");
+  const claimNextButton = document.getElementById("claimNext");
   const asciiLoadingBarElement = document.getElementById("asciiLoadingBar"); // Get the ASCII loading bar element
   const clientListElement = document.getElementById("clientList"); // Get the client list element
+  const noticeElement = document.getElementById("notice");
+  const serverNoticeElement = document.getElementById("serverNotice");
+  const lobbyElement = document.getElementById("lobby");
+  const lobbyRosterElement = document.getElementById("lobbyRoster");
+  const openSessionButton = document.getElementById("openSession");
+
+  // Show a one-off server notice, hidden again after a while
+  const showNotice = (text, durationMs = 10000) => {
+    if (!noticeElement) return;
+    noticeElement.textContent = text;
+    noticeElement.hidden = false;
+    clearTimeout(noticeElement.hideTimer);
+    noticeElement.hideTimer = setTimeout(() => {
+      noticeElement.hidden = true;
+    }, durationMs);
+  };
+  const showServerNotice = (notice) => {
+    if (!serverNoticeElement) return;
+    serverNoticeElement.hidden = !notice;
+    if (!notice) return;
+    let text = `📢 ${notice.message}`;
+    if (notice.shutdownInMs) {
+      const minutes = Math.ceil(notice.shutdownInMs / 60000);
+      text += ` (restarting in ${minutes} min)`;
+    }
+    serverNoticeElement.textContent = text;
+  };
+  const expiryNoticeElement = document.getElementById("expiryNotice");
+  // Counts down to the expiry of an unused session, any click or key press
+  // keeps it. null hides the countdown.
+  let expiryTimer = null;
+  const keepAlive = () => {
+    socket.send(JSON.stringify({ type: "keepAlive" }));
+  };
+  const showExpiry = (expiresInMs) => {
+    clearInterval(expiryTimer);
+    document.removeEventListener("pointerdown", keepAlive);
+    document.removeEventListener("keydown", keepAlive);
+    if (!expiryNoticeElement) return;
+    expiryNoticeElement.hidden = expiresInMs === null;
+    if (expiresInMs === null) return;
+    const expiresAt = Date.now() + expiresInMs;
+    const render = () => {
+      const seconds = Math.max(0, Math.ceil((expiresAt - Date.now()) / 1000));
+      const minutes = Math.floor(seconds / 60);
+      expiryNoticeElement.textContent = `⏳ Nobody has used this session for a while, it closes in ${minutes}:${String(seconds % 60).padStart(2, "0")}. Click or press any key to keep it.`;
+    };
+    render();
+    expiryTimer = setInterval(render, 1000);
+    document.addEventListener("pointerdown", keepAlive, { once: true });
+    document.addEventListener("keydown", keepAlive, { once: true });
+  };
+  const readOnlyNoticeElement = document.getElementById("readOnlyNotice");
+  const showExpired = (reason) => {
+    showExpiry(null);
+    const notices = {
+      lifetime: "This session was removed after reaching its maximum age",
+      replaced: "This session finished and its link now opens a new one",
+    };
+    showNotice(
+      notices[reason] || "This session expired after going unused",
+      3600000,
+    );
+  };
+  // A migrated session comes back on the new instance, the page reloads once
+  // it answers
+  const migratingNoticeElement = document.getElementById("migratingNotice");
+  let migrating = false;
+  const showMigrating = () => {
+    migrating = true;
+    if (migratingNoticeElement) migratingNoticeElement.hidden = false;
+  };
+  const reloadWhenBack = () => {
+    fetch(`/s/${sessionId}`, { method: "HEAD", cache: "no-store" })
+      .then((response) => {
+        if (!response.ok) throw new Error(response.statusText);
+        // The turn order comes over as roster slots, claimed back by name
+        const url = new URL(window.location.href);
+        if (yourId) url.searchParams.set("name", yourId);
+        window.location.replace(url.toString());
+      })
+      .catch(() => setTimeout(reloadWhenBack, 2000));
+  };
+  const confirmationElement = document.getElementById("confirmation");
+  const confirmationTextElement = document.getElementById("confirmationText");
+  const confirmButton = document.getElementById("confirm");
+  const readyButton = document.getElementById("ready");
+  const readyCheckButton = document.getElementById("readyCheck");
+  const voteSkipButton = document.getElementById("voteSkip");
+  const timerListElement = document.getElementById("timerList");
+  const timerNameInput = document.getElementById("timerName");
+  const timerMinutesInput = document.getElementById("timerMinutes");
+  const addTimerButton = document.getElementById("addTimer");
+  const cancelButton = document.getElementById("cancel");
+  const hostControlsElement = document.getElementById("hostControls");
+  const participantNameInput = document.getElementById("participantName");
+  const addParticipantButton = document.getElementById("addParticipant");
+  const focusElement = document.getElementById("focus");
+  const focusMinutesInput = document.getElementById("focusMinutes");
+  const focusGoalInput = document.getElementById("focusGoal");
+  const setGoalButton = document.getElementById("setGoal");
+  const focusCheckInElement = document.getElementById("focusCheckIn");
+  const focusHostElement = document.getElementById("focusHost");
+  const focusSummaryElement = document.getElementById("focusSummary");
+  const inviteElement = document.getElementById("invite");
+  const attendanceLinkElement = document.getElementById("attendanceLink");
+  const lapsLinkElement = document.getElementById("lapsLink");
+  const templateNameInput = document.getElementById("templateName");
+  const saveTemplateButton = document.getElementById("saveTemplate");
+  const cloneSessionButton = document.getElementById("cloneSession");
+  const handicapClientInput = document.getElementById("handicapClient");
+  const handicapSecondsInput = document.getElementById("handicapSeconds");
+  const setHandicapButton = document.getElementById("setHandicap");
+  const inviteLinkElement = document.getElementById("inviteLink");
+  const statusTextElement = document.getElementById("statusText");
+  const glanceElement = document.getElementById("glance");
+  const glanceLinkElement = document.getElementById("glanceLink");
+  let spokenStatus = "";
+  const passControlsElement = document.getElementById("passControls");
+  const passTargetElement = document.getElementById("passTarget");
+  const passButton = document.getElementById("pass");
 
   // Extract session ID from the URL
   const pathSegments = window.location.pathname.split("/");
@@ -33,8 +158,50 @@ document.addEventListener("DOMContentLoaded", () => {
 
   // Connect to the WebSocket endpoint for this specific session
   const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-  const socketUrl = `${protocol}//${window.location.host}/s/${sessionId}/ws`;
+  // Pass ?name= through so a pre-registered participant claims their slot
+  const name = new URLSearchParams(window.location.search).get("name");
+  const query = name ? `?name=${encodeURIComponent(name)}` : "";
+  const socketUrl = `${protocol}//${window.location.host}/s/${sessionId}/ws${query}`;
   const socket = new WebSocket(socketUrl);
+  // Pre-registered names nobody claimed yet, offered to whoever joined
+  // without one. Slots are claimed on connecting, so picking one reloads.
+  const claimElement = document.getElementById("claim");
+  const claimListElement = document.getElementById("claimList");
+  let claimKey = "";
+  function showClaimable(unclaimed, yourId, sharedDevice) {
+    if (!claimElement) return;
+    const claimable = sharedDevice || yourId === name ? [] : unclaimed;
+    const key = claimable.join("\n");
+    if (key === claimKey) return;
+    claimKey = key;
+    claimElement.hidden = claimable.length === 0;
+    claimListElement.innerHTML = "";
+    claimable.forEach((slot) => {
+      const li = document.createElement("li");
+      const button = document.createElement("button");
+      button.textContent = slot;
+      button.addEventListener("click", () => {
+        const url = new URL(window.location.href);
+        url.searchParams.set("name", slot);
+        window.location.href = url.toString();
+      });
+      li.appendChild(button);
+      claimListElement.appendChild(li);
+    });
+  }
+  if (attendanceLinkElement)
+    attendanceLinkElement.href = `/s/${sessionId}/attendance.csv`;
+  if (lapsLinkElement) lapsLinkElement.href = `/s/${sessionId}/laps.csv`;
+
+  // The favicon mirrors the badge, refetched only when what it shows changes
+  const faviconElement = document.getElementById("favicon");
+  let faviconKey = "";
+  function updateFavicon(msg) {
+    const key = `${msg.running}|${msg.finished}|${msg.activeClient}`;
+    if (!faviconElement || key === faviconKey) return;
+    faviconKey = key;
+    faviconElement.href = `/s/${sessionId}/badge.svg?v=${encodeURIComponent(key)}`;
+  }
 
   // Check if the loading bar element was found
   if (!asciiLoadingBarElement) {
@@ -49,9 +216,46 @@ document.addEventListener("DOMContentLoaded", () => {
 
   let currentTime = 0;
   let yourId = null;
+  let individualTimers = false;
+  let simultaneous = false;
+  let countdownMs = 0;
+  let targetMs = 0;
+  // Red once the turn runs past its target, or once the countdown hits zero
+  const isOverTime = (time) =>
+    countdownMs ? time <= 0 : time >= (targetMs || oneMinuteInMs);
+  const presence = {}; // client -> { status, until }
+  const presenceTimeout = 3000;
   const oneMinuteInMs = 60000; // 1 minute in milliseconds
   const totalLoadingTime = oneMinuteInMs; // The time it takes for the loading bar to fill
 
+  // Cues come from the session settings, sounds are served by the backend
+  const cueSounds = {};
+  function playCue(cue) {
+    if (cue.sound) {
+      cueSounds[cue.sound] =
+        cueSounds[cue.sound] || new Audio(`/sounds/${cue.sound}.wav`);
+      cueSounds[cue.sound].currentTime = 0;
+      // Browsers refuse to play before the first user interaction
+      cueSounds[cue.sound].play().catch(() => {});
+    }
+    if (cue.flash) {
+      document.body.style.backgroundColor = cue.flash;
+      setTimeout(() => (document.body.style.backgroundColor = ""), 400);
+    }
+  }
+
+  // Announcements are spoken by the backend when it has a TTS provider
+  function playAnnouncement(announcement) {
+    if (!announcement.audioUrl) return;
+    new Audio(announcement.audioUrl).play().catch(() => {});
+  }
+
+  // The socket of an expired session can close before sessionExpired arrives
+  socket.onclose = (event) => {
+    if (event.reason === "session expired") showExpired(null);
+    else if (migrating) reloadWhenBack();
+  };
+
   socket.onmessage = (event) => {
     let msg = {};
     try {
@@ -60,15 +264,250 @@ document.addEventListener("DOMContentLoaded", () => {
       console.error("Bad JSON:", event.data);
       return;
     }
+    if (msg.cue) playCue(msg.cue);
+    if (msg.announcement) playAnnouncement(msg.announcement);
+
+    // Presence indicators are transient, they fade after a few seconds
+    if (msg.type === "presence") {
+      if (msg.status === "idle") {
+        delete presence[msg.client];
+      } else {
+        presence[msg.client] = {
+          status: msg.status,
+          until: Date.now() + presenceTimeout,
+        };
+      }
+      return;
+    }
+
+    if (msg.type === "finishWarning") {
+      showNotice(
+        `The session ends in ${Math.ceil(msg.remainingMs / 1000)} seconds`,
+      );
+      return;
+    }
+    if (msg.type === "warning" || msg.type === "overtime") {
+      showNotice(
+        msg.type === "warning"
+          ? `${msg.client}, time to wrap up!`
+          : `${msg.client} is over time!`,
+        3000,
+      );
+      return;
+    }
+    if (msg.type === "clientJoined" || msg.type === "clientLeft") {
+      if (msg.client !== yourId && msg.role !== "device") {
+        showNotice(
+          msg.type === "clientJoined"
+            ? `${msg.client} joined 👋`
+            : `${msg.client} left${msg.reason === "connectionLost" ? " (connection lost)" : ""}`,
+          3000,
+        );
+      }
+      return;
+    }
+    if (msg.type === "yourTurnPending") {
+      showNotice(
+        `You're up! Press ready within ${Math.ceil(msg.expiresInMs / 1000)} seconds`,
+        msg.expiresInMs,
+      );
+      return;
+    }
+    if (msg.type === "autoStartCountdown") {
+      showNotice(`Starting in ${msg.secondsLeft}…`, 1000);
+      return;
+    }
+    if (msg.type === "autoStartCancelled") {
+      showNotice("Someone left, waiting for more people", 3000);
+      return;
+    }
+    if (msg.type === "autoStarted") {
+      showNotice(`Go, ${msg.client}!`, 2000);
+      return;
+    }
+    if (msg.type === "sessionStarted") {
+      showNotice(
+        msg.client ? `We're live! ${msg.client} goes first` : "We're live!",
+        3000,
+      );
+      return;
+    }
+    if (msg.type === "timerExpired") {
+      showNotice(`${msg.timer} is done! ⏰`, 5000);
+      return;
+    }
+    if (msg.type === "turnSkippedByVote") {
+      showNotice(`The group voted to move on from ${msg.client}`, 3000);
+      return;
+    }
+    if (msg.type === "handoffExpired") {
+      showNotice(`${msg.client} wasn't ready, moving on`, 3000);
+      return;
+    }
+    if (msg.type === "turnLimitReached") {
+      showNotice(`Time's up for ${msg.client}! ⏰`, 3000);
+      return;
+    }
+    if (msg.type === "turnPassed") {
+      showNotice(`${msg.from} passed the turn to ${msg.to}`, 3000);
+      return;
+    }
+    if (
+      msg.type === "ack" &&
+      msg.status === "ok" &&
+      msg.command.startsWith("saveTemplate:")
+    ) {
+      // Private templates aren't listed, the link is the way back to them
+      showNotice(
+        `Template saved, new sessions can start from it at ${window.location.origin}/?template=${msg.template}`,
+        60000,
+      );
+      return;
+    }
+    if (msg.type === "ack" && msg.status === "rejected") {
+      showNotice(`Couldn't ${msg.command}: ${msg.reason}`, 3000);
+      return;
+    }
+    if (msg.type === "winner") {
+      showNotice(
+        msg.winners.length
+          ? `🏆 ${msg.winners.join(" & ")} won!`
+          : "Nobody scored, no winner",
+        15000,
+      );
+      return;
+    }
+    if (msg.type === "roundRanking") {
+      const podium = msg.ranking
+        .slice(0, 3)
+        .map((result) => `${result.rank}. ${result.client}`)
+        .join("  ");
+      showNotice(
+        `Closest to ${(msg.targetMs / 1000).toFixed(1)} s: ${podium}`,
+        8000,
+      );
+      return;
+    }
+    if (msg.type === "roundComplete") {
+      showNotice(`Round ${msg.round} done!`, 3000);
+      return;
+    }
+    if (msg.type === "phaseChanged") {
+      showNotice(
+        msg.phase === "break" ? "Break time! ☕" : "Back to work! 🍝",
+        5000,
+      );
+      return;
+    }
+    if (msg.type === "timeBankExpired") {
+      showNotice(`${msg.client} is out of time!`, 5000);
+      return;
+    }
+    if (msg.type === "timeExpired") {
+      showNotice(`Time's up for ${msg.client}!`, 3000);
+      return;
+    }
+    // Operators' banner for every session, e.g. before a restart
+    if (msg.type === "serverNotice" || msg.type === "serverNoticeCleared") {
+      showServerNotice(msg.serverNotice);
+    }
+
+    if (msg.type === "expiringSoon") {
+      showExpiry(msg.expiresInMs);
+      return;
+    }
+    if (msg.type === "expiryCancelled") {
+      showExpiry(null);
+      return;
+    }
+    if (msg.type === "sessionExpired") {
+      showExpired(msg.reason);
+      return;
+    }
+    if (msg.type === "serverMigrating") {
+      showMigrating();
+      return;
+    }
+    if (msg.type === "serverMigrationCancelled") {
+      migrating = false;
+      if (migratingNoticeElement) migratingNoticeElement.hidden = true;
+      return;
+    }
+
+    // Expired sessions are told apart with sessionExpired
+    if (msg.type === "sessionFinished" && msg.summary.reason !== "expired") {
+      showNotice("The session is finished", 60000);
+      return;
+    }
 
     if (msg.type === "update") {
-      const newTime = msg.time;
+      showServerNotice(msg.serverNotice);
+      if (readOnlyNoticeElement) readOnlyNoticeElement.hidden = !msg.readOnly;
+      if (msg.migrating) showMigrating();
+
+      // With individual timers each client watches their own stopwatch
+      const personalTimers = msg.personalTimers || null;
+      const ownTimer = personalTimers && personalTimers[msg.yourId];
+      // Simultaneous sessions report a timer per client too, but only to stop
+      simultaneous = !!(msg.settings && msg.settings.simultaneous);
+      individualTimers = personalTimers !== null && !simultaneous;
+      if (nextButton)
+        nextButton.textContent = individualTimers
+          ? "Lap"
+          : simultaneous
+            ? "Stop"
+            : "Next";
+      if (skipButton) skipButton.hidden = individualTimers || simultaneous;
+      if (splitButton) splitButton.hidden = individualTimers || simultaneous;
+      // Countdown sessions show the time left in the turn instead
+      countdownMs = (msg.settings && msg.settings.countdownMs) || 0;
+      targetMs = (msg.settings && msg.settings.targetMs) || 0;
+      const elapsedTime = personalTimers
+        ? ownTimer
+          ? ownTimer.timeMs
+          : simultaneous
+            ? msg.time
+            : 0
+        : msg.time;
+      // Below zero once the turn runs past the countdown
+      const newTime = countdownMs ? msg.signedRemainingMs : elapsedTime;
       const lapTime = msg.lapTime; // Still exists in msg, but not used
       const lastLapClient = msg.lastLapClient; // Still exists in msg, but not used
       const lapHistory = msg.lapHistory;
       const activeClient = msg.activeClient;
       const clients = msg.clients; // Get the list of clients
+      const host = msg.host;
+      const offline = msg.offline || [];
+      const unclaimed = msg.unclaimed || [];
+      const claimQueue = msg.claimQueue || [];
+      const sittingOut = msg.sittingOut || [];
       yourId = msg.yourId;
+      showClaimable(
+        unclaimed,
+        yourId,
+        !!(msg.settings && msg.settings.sharedDevice),
+      );
+      if (msg.title && document.title !== msg.title) document.title = msg.title;
+      updateFavicon(msg);
+      updateNamedTimers(msg.timers || {});
+      if (glanceElement && msg.glanceToken && glanceElement.hidden) {
+        glanceLinkElement.href = `/api/sessions/${sessionId}/glance?token=${msg.glanceToken}`;
+        glanceElement.hidden = false;
+      }
+      // The status is announced when it changes, not on every clock tick
+      if (statusTextElement && msg.statusText) {
+        const withoutClock = msg.statusText.replace(/\d+/g, "");
+        if (withoutClock !== spokenStatus) {
+          spokenStatus = withoutClock;
+          statusTextElement.textContent = msg.statusText;
+        }
+        timerElement.setAttribute("aria-label", msg.statusText);
+      }
+      if (inviteElement && msg.shortLink && inviteElement.hidden) {
+        inviteLinkElement.href = msg.shortLink;
+        inviteLinkElement.textContent = `Invite: ${window.location.host}${msg.shortLink}`;
+        inviteElement.hidden = false;
+      }
 
       // Update client name display
       if (clientNameDisplayElement) {
@@ -83,7 +522,31 @@ document.addEventListener("DOMContentLoaded", () => {
         const sortedClients = [...clients].sort(); // Create a copy and sort it
         sortedClients.forEach((client) => {
           const li = document.createElement("li");
-          li.textContent = client;
+          li.textContent = client === host ? `${client} (host)` : client;
+          const queued = claimQueue.indexOf(client);
+          if (queued !== -1) li.textContent += ` (up next #${queued + 1})`;
+          if (personalTimers && personalTimers[client]) {
+            const personal = personalTimers[client];
+            li.textContent += ` ${(personal.timeMs / 1000).toFixed(1)} s`;
+            if (!personal.running) li.textContent += " (paused)";
+          }
+          if (msg.scores && msg.scores[client])
+            li.textContent += ` 🏆 ${msg.scores[client]}`;
+          if (msg.timeBanks && client in msg.timeBanks) {
+            li.textContent += ` ⏳ ${(msg.timeBanks[client] / 1000).toFixed(1)} s`;
+          }
+          const indicator = presence[client];
+          if (indicator && indicator.until > Date.now()) {
+            li.textContent += indicator.status === "speaking" ? " 🎙️" : " ✍️";
+          }
+          if (sittingOut.includes(client)) li.textContent += " (joins next round)";
+          // Time spent past the countdown, over the whole session
+          const overtime = msg.overtimeMs && msg.overtimeMs[client];
+          if (overtime) li.textContent += ` (+${(overtime / 1000).toFixed(0)} s over)`;
+          if (msg.readyCheck && msg.readyCheck.ready.includes(client))
+            li.textContent += " ✅";
+          if (unclaimed.includes(client)) li.textContent += " (not joined yet)";
+          else if (offline.includes(client)) li.textContent += " (offline)";
           // Highlight the active client
           if (client === activeClient) {
             li.style.fontWeight = "bold";
@@ -100,7 +563,11 @@ document.addEventListener("DOMContentLoaded", () => {
       }
 
       // Calculate loading percentage
-      const loadingPercentage = Math.min(newTime / totalLoadingTime, 1) * 100;
+      const loadingPercentage =
+        Math.min(
+          elapsedTime / (countdownMs || targetMs || totalLoadingTime),
+          1,
+        ) * 100;
 
       // Update Unicode loading bar
       if (asciiLoadingBarElement) {
@@ -112,7 +579,10 @@ document.addEventListener("DOMContentLoaded", () => {
       }
 
       // Update timer text and color
-      if (typeof anime !== "undefined") {
+      // In the guessing game the speaker plays blind
+      if (msg.timeHidden) {
+        if (timerElement) timerElement.textContent = "??.?";
+      } else if (typeof anime !== "undefined") {
         anime({
           targets: { val: currentTime },
           val: newTime,
@@ -128,7 +598,7 @@ document.addEventListener("DOMContentLoaded", () => {
             // Change timer color based on time
             if (timerElement) {
               // Added check
-              if (currentTime >= oneMinuteInMs) {
+              if (isOverTime(currentTime)) {
                 timerElement.classList.remove("timer-green");
                 timerElement.classList.add("timer-red");
               } else {
@@ -146,7 +616,7 @@ document.addEventListener("DOMContentLoaded", () => {
           timerElement.textContent = (currentTime / 1000).toFixed(1);
 
           // Change timer color based on time (fallback)
-          if (currentTime >= oneMinuteInMs) {
+          if (isOverTime(currentTime)) {
             timerElement.style.color = "#8b0000"; // Dark red
           } else {
             timerElement.style.color = "#006400"; // Dark green
@@ -154,31 +624,271 @@ document.addEventListener("DOMContentLoaded", () => {
         }
       }
 
+      // Splits are listed under the turn they were taken in
+      const splitsHTML = (splits) =>
+        splits && splits.length > 0
+          ? "<ol class=\"splits\">" +
+            splits
+              .map(
+                (split) =>
+                  `<li>${(split.timeMs / 1000).toFixed(1)} s${split.label ? ` ${escapeHTML(split.label)}` : ""}</li>`,
+              )
+              .join("") +
+            "</ol>"
+          : "";
+
       // Update lap history display
       let historyHTML = "<ul>";
+      // The state only carries the latest laps
+      const earlierLaps = (msg.lapCount || 0) - (lapHistory ? lapHistory.length : 0);
+      if (earlierLaps > 0) {
+        historyHTML += `<li>… ${earlierLaps} earlier ${earlierLaps === 1 ? "lap" : "laps"}</li>`;
+      }
       if (lapHistory && lapHistory.length > 0) {
         lapHistory.forEach((lap) => {
-          historyHTML += `<li>${lap.client}: ${(lap.timeMs / 1000).toFixed(1)} s</li>`;
+          if (lap.skipped) {
+            historyHTML += `<li>${escapeHTML(lap.client)}: skipped</li>`;
+            return;
+          }
+          let flags = lap.edited ? " (edited)" : "";
+          if (lap.accidental) flags += " (accidental?)";
+          if (lap.forced) flags += " (timed out)";
+          if (lap.skippedByVote) flags += " (voted out)";
+          if (lap.overtimeMs) flags += ` (+${(lap.overtimeMs / 1000).toFixed(1)} s)`;
+          if (lap.deltaMs !== undefined)
+            flags += ` (${lap.deltaMs >= 0 ? "+" : ""}${(lap.deltaMs / 1000).toFixed(2)} s)`;
+          if (lap.handicapMs)
+            flags += ` (adjusted ${(lap.adjustedTimeMs / 1000).toFixed(1)} s)`;
+          historyHTML += `<li>${escapeHTML(lap.client)}: ${(lap.timeMs / 1000).toFixed(1)} s${flags}${splitsHTML(lap.splits)}</li>`;
         });
-      } else {
+      } else if (!msg.splits) {
         historyHTML += "<li>No standups yet</li>";
       }
+      if (msg.splits) {
+        historyHTML += `<li>${escapeHTML(activeClient)}: in progress${splitsHTML(msg.splits)}</li>`;
+      }
       historyHTML += "</ul>";
+      // Who paused, why and for how long
+      if (msg.pauses && msg.pauses.length > 0) {
+        historyHTML += "<h4>Pauses</h4><ul>";
+        msg.pauses.forEach((pause) => {
+          const who = pause.by ? escapeHTML(pause.by) : "Pastatime";
+          const why = pause.reason ? ` (${escapeHTML(pause.reason)})` : "";
+          const length = `${(pause.durationMs / 1000).toFixed(0)} s${pause.ongoing ? " so far" : ""}`;
+          historyHTML += `<li>${who}${why}: ${length}</li>`;
+        });
+        historyHTML += "</ul>";
+      }
       if (lapHistoryElement) {
         // Added check
         lapHistoryElement.innerHTML = historyHTML;
       }
 
+      // Only the host can answer a pending destructive command
+      const pending = msg.pendingConfirmation;
+      if (confirmationElement) {
+        if (pending) {
+          confirmationElement.hidden = false;
+          confirmationTextElement.textContent =
+            yourId === host
+              ? `${pending.requestedBy} wants to ${pending.command}. Confirm?`
+              : `Waiting for ${host} to confirm ${pending.command}...`;
+          confirmButton.hidden = yourId !== host;
+          cancelButton.hidden = yourId !== host;
+        } else {
+          confirmationElement.hidden = true;
+        }
+      }
+
+      // Before the first turn everyone says they're ready
+      if (readyCheckButton) {
+        const check = msg.readyCheck;
+        readyCheckButton.hidden = !check;
+        if (check) {
+          const youReady = check.ready.includes(yourId);
+          readyCheckButton.textContent = youReady ? "Not ready" : "I'm ready";
+          readyCheckButton.dataset.command = youReady ? "notReady" : "ready";
+        }
+      }
+
+      // Everyone but the speaker can vote to move the turn on
+      if (voteSkipButton) {
+        const tally = msg.skipVotes;
+        voteSkipButton.hidden =
+          !tally || tally.client === yourId || !msg.running;
+        if (tally) {
+          const voted = tally.votes.includes(yourId);
+          voteSkipButton.disabled = voted;
+          voteSkipButton.textContent =
+            `${voted ? "Voted" : "Vote"} to skip ` +
+            `(${tally.votes.length}/${tally.needed})`;
+        }
+      }
+
+      // A handed-off turn starts once its new speaker, or the host, is ready
+      if (readyButton) {
+        const handoff = msg.handoff;
+        readyButton.hidden =
+          !handoff || (handoff.client !== yourId && yourId !== host);
+        if (handoff) {
+          readyButton.textContent =
+            handoff.client === yourId
+              ? `I'm ready (${Math.ceil(handoff.expiresInMs / 1000)}s)`
+              : `Start for ${handoff.client}`;
+        }
+      }
+
+      if (hostControlsElement) hostControlsElement.hidden = yourId !== host;
+
+      // Focus blocks: goals while the block runs, then a check-in and summary
+      if (focusElement) {
+        focusElement.hidden = !individualTimers;
+        const checkingIn = msg.focusPhase === "checkIn";
+        focusCheckInElement.hidden =
+          !checkingIn || !ownTimer || !ownTimer.goal || !!ownTimer.checkIn;
+        focusHostElement.hidden = yourId !== host;
+        focusSummaryElement.innerHTML = "";
+        if (msg.focusSummary) {
+          msg.focusSummary.results.forEach((result) => {
+            const li = document.createElement("li");
+            li.textContent = `${result.client}: ${result.goal} (${result.checkIn || "no answer"})`;
+            focusSummaryElement.appendChild(li);
+          });
+        }
+      }
+
+      // In self-ordering sessions anyone but the speaker can queue up
+      if (claimNextButton) {
+        const selfOrdering = msg.settings && msg.settings.selfOrdering;
+        claimNextButton.hidden = !selfOrdering || yourId === activeClient;
+        claimNextButton.textContent = claimQueue.includes(yourId)
+          ? "Never mind"
+          : "I'll go next";
+      }
+
       // Update controller display and button states
-      if (activeClient) {
+      if (msg.phase === "break") {
+        showNotice(
+          `Break, back in ${Math.ceil(msg.phaseRemainingMs / 1000)} s ☕`,
+          1000,
+        );
+      }
+      if (msg.idlePaused) {
+        showNotice("Paused while everyone was away, press start to resume");
+      }
+
+      // Who is expected at a scheduled start, and who is here already. In
+      // the lobby the host arranges the order and opens the session.
+      const arranging =
+        !!(msg.lobby && msg.lobby.waitingForHost) && yourId === host;
+      if (lobbyElement) {
+        lobbyElement.hidden = !msg.lobby;
+        if (msg.lobby && lobbyRosterElement) {
+          lobbyRosterElement.innerHTML = "";
+          const roster = msg.lobby.roster;
+          roster.forEach((member, i) => {
+            const li = document.createElement("li");
+            li.textContent = `${member.present ? "✅" : "⏳"} ${member.name}`;
+            if (arranging) {
+              [
+                ["↑", i],
+                ["↓", i + 2],
+              ].forEach(([label, position]) => {
+                const button = document.createElement("button");
+                button.textContent = label;
+                button.disabled = position < 1 || position > roster.length;
+                button.onclick = () =>
+                  sendUnchecked(`moveParticipant:${member.name}:${position}`);
+                li.appendChild(button);
+              });
+            }
+            lobbyRosterElement.appendChild(li);
+          });
+        }
+      }
+      if (openSessionButton) openSessionButton.hidden = !arranging;
+
+      if (msg.waiting && msg.lobby && msg.lobby.waitingForHost) {
+        if (controllerElement) {
+          const name = (msg.lobby && msg.lobby.name) || "The session";
+          controllerElement.textContent = `${name} opens when the host is ready`;
+        }
+        if (startButton) startButton.disabled = true;
+        if (nextButton) nextButton.disabled = true;
+        if (skipButton) skipButton.disabled = true;
+        if (splitButton) splitButton.disabled = true;
+      } else if (msg.waiting) {
+        // Nothing can start before the scheduled time
+        if (controllerElement) {
+          const seconds = Math.ceil(msg.startsInMs / 1000);
+          const minutes = Math.floor(seconds / 60);
+          const name = (msg.lobby && msg.lobby.name) || "Session";
+          controllerElement.textContent = `${name} starts in ${minutes}:${String(seconds % 60).padStart(2, "0")}`;
+        }
+        if (startButton) startButton.disabled = true;
+        if (nextButton) nextButton.disabled = true;
+        if (skipButton) skipButton.disabled = true;
+        if (splitButton) splitButton.disabled = true;
+      } else if (msg.finished) {
         if (controllerElement) {
-          controllerElement.textContent = `Controller: ${activeClient}`;
+          controllerElement.textContent = "Session finished";
         }
-        const isYou = yourId === activeClient;
+        if (startButton) startButton.disabled = true;
+        if (pauseButton) pauseButton.disabled = true;
+        if (resetButton) resetButton.disabled = true;
+        if (nextButton) nextButton.disabled = true;
+        if (skipButton) skipButton.disabled = true;
+        if (splitButton) splitButton.disabled = true;
+      } else if (activeClient) {
+        if (controllerElement) {
+          const rounds = msg.settings && msg.settings.rounds;
+          const round = rounds ? ` · round ${msg.round}/${rounds}` : "";
+          const check = msg.readyCheck;
+          let paused = msg.pausedBy ? ` by ${msg.pausedBy}` : "";
+          if (msg.pauseReason) paused += `: ${msg.pauseReason}`;
+          controllerElement.textContent =
+            check && !check.met
+              ? `Waiting for everyone to be ready: ${check.ready.length}/${check.needed}`
+              : paused
+                ? `Controller: ${activeClient} (paused${paused})${round}`
+                : `Controller: ${activeClient}${round}`;
+        }
+        // The host presses the buttons for offline participants, or for
+        // everyone in proxy-control mode
+        const settings = msg.settings || {};
+        const isYou = settings.sharedDevice || settings.individualTimers
+          ? true
+          : settings.proxyControl
+            ? yourId === host
+            : yourId === activeClient ||
+              (yourId === host && offline.includes(activeClient));
         if (startButton) startButton.disabled = !isYou;
         if (pauseButton) pauseButton.disabled = !isYou;
         if (resetButton) resetButton.disabled = !isYou;
         if (nextButton) nextButton.disabled = !isYou;
+        if (skipButton) skipButton.disabled = !isYou;
+        if (splitButton) splitButton.disabled = !isYou;
+        // The host starts everyone's clock, then each client stops their own
+        if (simultaneous) {
+          const started = Object.keys(personalTimers).length > 0;
+          if (controllerElement) {
+            controllerElement.textContent = started
+              ? "Everyone's clock is running"
+              : `Waiting for ${host} to start`;
+          }
+          if (startButton) startButton.disabled = yourId !== host || started;
+          if (pauseButton) pauseButton.disabled = true;
+          if (resetButton) resetButton.disabled = true;
+          if (nextButton) nextButton.disabled = !(ownTimer && ownTimer.running);
+        }
+        // The speaker, or the host, can hand the turn to anyone
+        if (passControlsElement) {
+          passControlsElement.hidden =
+            settings.individualTimers ||
+            simultaneous ||
+            !(isYou || yourId === host);
+          updatePassTargets(clients.filter((c) => c !== activeClient));
+        }
       } else {
         if (controllerElement) {
           controllerElement.textContent = "No active controller";
@@ -187,13 +897,87 @@ document.addEventListener("DOMContentLoaded", () => {
         if (pauseButton) pauseButton.disabled = true;
         if (resetButton) resetButton.disabled = true;
         if (nextButton) nextButton.disabled = true;
+        if (skipButton) skipButton.disabled = true;
+        if (splitButton) splitButton.disabled = true;
       }
     }
   };
 
+  // Named timers are updated in place so their buttons survive every tick
+  const timerRows = {};
+  function updateNamedTimers(timers) {
+    if (!timerListElement) return;
+    Object.keys(timerRows).forEach((id) => {
+      if (!(id in timers)) {
+        timerRows[id].remove();
+        delete timerRows[id];
+      }
+    });
+    Object.keys(timers)
+      .sort()
+      .forEach((id) => {
+        const timer = timers[id];
+        let row = timerRows[id];
+        if (!row) {
+          row = document.createElement("li");
+          row.appendChild(document.createElement("span"));
+          ["start", "pause", "reset"].forEach((action) => {
+            const button = document.createElement("button");
+            button.textContent = action[0].toUpperCase() + action.slice(1);
+            button.onclick = () =>
+              socket.send(
+                JSON.stringify({ type: "command", command: `timer:${id}:${action}` }),
+              );
+            row.appendChild(button);
+          });
+          const remove = document.createElement("button");
+          remove.textContent = "✕";
+          remove.onclick = () =>
+            socket.send(
+              JSON.stringify({ type: "command", command: `removeTimer:${id}` }),
+            );
+          row.appendChild(remove);
+          timerListElement.appendChild(row);
+          timerRows[id] = row;
+        }
+        const shownMs =
+          timer.remainingMs !== undefined ? timer.remainingMs : timer.elapsedMs;
+        row.firstChild.textContent = `${id}: ${(shownMs / 1000).toFixed(1)} s `;
+        row.classList.toggle("expired", !!timer.expired);
+      });
+  }
+
+  // Client names can come from join links, so they never go in as markup
+  function escapeHTML(text) {
+    const span = document.createElement("span");
+    span.textContent = text;
+    return span.innerHTML;
+  }
+
+  // Rebuilt only when the candidates change so an open dropdown stays put
+  let passTargets = "";
+  function updatePassTargets(candidates) {
+    const key = candidates.join("\n");
+    if (!passTargetElement || key === passTargets) return;
+    passTargets = key;
+    const selected = passTargetElement.value;
+    passTargetElement.innerHTML = "";
+    candidates.forEach((client) => {
+      const option = document.createElement("option");
+      option.value = client;
+      option.textContent = client;
+      passTargetElement.appendChild(option);
+    });
+    if (candidates.includes(selected)) passTargetElement.value = selected;
+  }
+
   const sendCommand = (cmd) => {
     // Check if buttons exist before checking disabled property
-    if ((startButton && !startButton.disabled) || cmd === "next") {
+    if (
+      (startButton && !startButton.disabled) ||
+      cmd === "next" ||
+      cmd === "stop"
+    ) {
       socket.send(JSON.stringify({ type: "command", command: cmd }));
     } else {
       console.log("Not the active controller.");
@@ -202,15 +986,122 @@ document.addEventListener("DOMContentLoaded", () => {
 
   // Add event listeners only after buttons are confirmed to exist
   if (startButton) startButton.onclick = () => sendCommand("start");
-  if (pauseButton) pauseButton.onclick = () => sendCommand("pause");
+  if (pauseButton)
+    pauseButton.onclick = () => {
+      const reason = pauseReasonInput ? pauseReasonInput.value.trim() : "";
+      sendCommand(reason ? `pause:${reason}` : "pause");
+      if (pauseReasonInput) pauseReasonInput.value = "";
+    };
   if (resetButton) resetButton.onclick = () => sendCommand("reset");
-  if (nextButton) nextButton.onclick = () => sendCommand("next");
+  // With individual timers "next" records a personal lap instead
+  if (nextButton)
+    nextButton.onclick = () =>
+      sendCommand(individualTimers ? "lap" : simultaneous ? "stop" : "next");
+  if (skipButton) skipButton.onclick = () => sendCommand("skip");
+  if (splitButton) splitButton.onclick = () => sendCommand("split");
+  const sendUnchecked = (cmd) => {
+    socket.send(JSON.stringify({ type: "command", command: cmd }));
+  };
+  if (confirmButton) confirmButton.onclick = () => sendUnchecked("confirm");
+  if (openSessionButton)
+    openSessionButton.onclick = () => sendUnchecked("openSession");
+  if (readyButton) readyButton.onclick = () => sendUnchecked("ready");
+  if (voteSkipButton) voteSkipButton.onclick = () => sendUnchecked("voteSkip");
+  if (readyCheckButton)
+    readyCheckButton.onclick = () =>
+      sendUnchecked(readyCheckButton.dataset.command || "ready");
+  if (addTimerButton)
+    addTimerButton.onclick = () => {
+      const id = timerNameInput.value.trim();
+      if (!id) return;
+      const minutes = parseFloat(timerMinutesInput.value) || 0;
+      sendUnchecked(
+        minutes > 0 ? `addTimer:${id}:${Math.round(minutes * 60000)}` : `addTimer:${id}`,
+      );
+      timerNameInput.value = "";
+      timerMinutesInput.value = "";
+    };
+  // Seconds in the form, milliseconds on the wire, 0 clears the handicap
+  if (setHandicapButton)
+    setHandicapButton.onclick = () => {
+      const client = handicapClientInput.value.trim();
+      const seconds = parseFloat(handicapSecondsInput.value);
+      if (client && !isNaN(seconds))
+        sendUnchecked(`handicap:${client}:${Math.round(seconds * 1000)}`);
+    };
+  if (passButton)
+    passButton.onclick = () => {
+      if (passTargetElement.value) sendUnchecked(`pass:${passTargetElement.value}`);
+    };
+  if (cancelButton) cancelButton.onclick = () => sendUnchecked("cancel");
+  if (claimNextButton)
+    claimNextButton.onclick = () =>
+      sendUnchecked(
+        claimNextButton.textContent === "Never mind"
+          ? "withdrawClaim"
+          : "claimNext",
+      );
+  const speakingButton = document.getElementById("speaking");
+  if (speakingButton)
+    speakingButton.onclick = () =>
+      socket.send(JSON.stringify({ type: "presence", status: "speaking" }));
+  if (setGoalButton)
+    setGoalButton.onclick = () => {
+      const goal = focusGoalInput.value.trim();
+      if (goal) sendUnchecked(`goal:${focusMinutesInput.value}:${goal}`);
+    };
+  document.querySelectorAll("[data-check-in]").forEach((button) => {
+    button.onclick = () => sendUnchecked(`checkIn:${button.dataset.checkIn}`);
+  });
+  const endBlockButton = document.getElementById("endBlock");
+  const startBlockButton = document.getElementById("startBlock");
+  if (endBlockButton) endBlockButton.onclick = () => sendUnchecked("endBlock");
+  if (startBlockButton)
+    startBlockButton.onclick = () => sendUnchecked("startBlock");
+  if (addParticipantButton)
+    addParticipantButton.onclick = () => {
+      const name = participantNameInput.value.trim();
+      if (name) sendUnchecked(`addParticipant:${name}`);
+      participantNameInput.value = "";
+    };
+
+  if (saveTemplateButton)
+    saveTemplateButton.onclick = () => {
+      const name = templateNameInput.value.trim().toLowerCase();
+      if (name) sendUnchecked(`saveTemplate:${name}`);
+      templateNameInput.value = "";
+    };
+
+  // Start a new session like this one, with everyone keeping their place
+  if (cloneSessionButton)
+    cloneSessionButton.onclick = async () => {
+      try {
+        const response = await fetch(`/s/${sessionId}/clone`, {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ roster: true }),
+        });
+        if (!response.ok) {
+          showNotice(
+            `Couldn't clone the session: ${await response.text()}`,
+            3000,
+          );
+          return;
+        }
+        const data = await response.json();
+        window.location.href = `/s/${data.sessionId}`;
+      } catch (error) {
+        console.error("Error cloning session:", error);
+      }
+    };
 
   // Disable buttons initially and set initial timer color
   if (startButton) startButton.disabled = true;
   if (pauseButton) pauseButton.disabled = true;
   if (resetButton) resetButton.disabled = true;
   if (nextButton) nextButton.disabled = true;
+  if (skipButton) skipButton.disabled = true;
+  if (splitButton) splitButton.disabled = true;
   // Set initial timer color to green
   if (timerElement) {
     // Added check
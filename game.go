@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// hiddenTimeKeys are left out of the state sent to a player guessing the time
+var hiddenTimeKeys = []string{"time", "activeMs", "wallClockMs", "remainingMs", "signedRemainingMs"}
+
+// clockHidden reports whether the views anyone can open, like the glance,
+// the overlay, the time stream or the Twitch status, leave the clock out so
+// the player guessing can't read it there. stateMux must be held.
+func (s *Session) clockHidden() bool {
+	return s.settings.GuessTargetMs > 0
+}
+
+// GuessResult is one player's attempt at the target time in a round
+type GuessResult struct {
+	Rank    int    `json:"rank"`
+	Client  string `json:"client"`
+	TimeMs  int64  `json:"timeMs"`
+	DeltaMs int64  `json:"deltaMs"` // negative when they stopped early
+}
+
+// personalState copies the shared state for one client, hiding the clock
+// from the player who is trying to hit the target time
+func personalState(base map[string]interface{}, clientID string) map[string]interface{} {
+	msg := make(map[string]interface{}, len(base)+1)
+	for k, v := range base {
+		msg[k] = v
+	}
+	msg["yourId"] = clientID
+	if hiddenFrom, _ := base["hiddenFrom"].(string); hiddenFrom == clientID {
+		for _, key := range hiddenTimeKeys {
+			delete(msg, key)
+		}
+		msg["timeHidden"] = true
+		msg["statusText"] = base["hiddenStatusText"]
+	}
+	delete(msg, "hiddenFrom")
+	delete(msg, "hiddenStatusText")
+	if tokens, _ := base["glanceTokens"].(map[string]string); tokens[clientID] != "" {
+		msg["glanceToken"] = tokens[clientID]
+	}
+	delete(msg, "glanceTokens")
+	return msg
+}
+
+// setGuessDelta records how far a lap landed from the target, stateMux must be held
+func (s *Session) setGuessDelta(lap *Lap) {
+	if s.settings.GuessTargetMs == 0 || lap.Skipped {
+		return
+	}
+	delta := lap.TimeMs - s.settings.GuessTargetMs
+	lap.DeltaMs = &delta
+}
+
+// rankRound orders the laps of the round that just ended by how close they
+// came to the target and announces the result, stateMux must be held
+func (s *Session) rankRound() {
+	if s.settings.GuessTargetMs == 0 {
+		return
+	}
+	ranking := []GuessResult{}
+	for _, lap := range s.lapHistory[min(s.roundStartLap, len(s.lapHistory)):] {
+		if lap.DeltaMs == nil {
+			continue
+		}
+		ranking = append(ranking, GuessResult{Client: lap.Client, TimeMs: lap.TimeMs, DeltaMs: *lap.DeltaMs})
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return abs(ranking[i].DeltaMs) < abs(ranking[j].DeltaMs)
+	})
+	for i := range ranking {
+		ranking[i].Rank = i + 1
+	}
+	s.ranking = ranking
+	log.Printf("Session %s: Round ranking: %v\n", s.ID, ranking)
+	go s.broadcastEvent(map[string]interface{}{
+		"type":     "roundRanking",
+		"targetMs": s.settings.GuessTargetMs,
+		"ranking":  ranking,
+	})
+}
+
+// abs returns the absolute value of n
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
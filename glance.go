@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Glance is the compact session summary polled by watch complications
+type Glance struct {
+	Speaker     string `json:"speaker"`
+	Running     bool   `json:"running"`
+	Finished    bool   `json:"finished,omitempty"`
+	ElapsedMs   *int64 `json:"elapsedMs,omitempty"`   // unset in the guessing game
+	RemainingMs *int64 `json:"remainingMs,omitempty"` // with a countdown or turn limit
+	You         string `json:"you,omitempty"`
+	Position    *int   `json:"position,omitempty"` // turns before yours, 0 while you speak
+}
+
+// issueGlanceToken gives a participant the token their watch polls with,
+// keeping the one they had if they reconnect. clientsMux must be held.
+func (s *Session) issueGlanceToken(clientID string) {
+	if s.glanceTokens[clientID] != "" {
+		return
+	}
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	s.glanceTokens[clientID] = hex.EncodeToString(buf)
+}
+
+// glanceClient finds the participant a token was issued to, clientsMux must be held
+func (s *Session) glanceClient(token string) (string, bool) {
+	for clientID, issued := range s.glanceTokens {
+		if issued == token {
+			return clientID, true
+		}
+	}
+	return "", false
+}
+
+// turnsUntil counts the turns before clientID speaks, -1 if they are not in
+// the rotation. clientsMux must be held.
+func (s *Session) turnsUntil(clientID string) int {
+	if clientID == s.activeClientID {
+		return 0
+	}
+	for i, id := range s.claimQueue {
+		if id == clientID {
+			return i + 1
+		}
+	}
+	current := -1
+	for i, id := range s.clientOrder {
+		if id == s.activeClientID {
+			current = i
+		}
+	}
+	if current == -1 {
+		return -1
+	}
+	for steps := 1; steps < len(s.clientOrder); steps++ {
+		next := s.nextInOrder(current)
+		if next == clientID {
+			return steps
+		}
+		for i, id := range s.clientOrder {
+			if id == next {
+				current = i
+			}
+		}
+	}
+	return -1
+}
+
+// glance sums up the session for anyone, without a participant's place
+func (s *Session) glance() Glance {
+	var glance Glance
+	s.clientsMux.Lock()
+	glance.Speaker = s.activeClientID
+	s.clientsMux.Unlock()
+
+	s.stateMux.Lock()
+	elapsed := s.elapsed
+	if s.isRunning {
+		elapsed += time.Since(s.startTime)
+	}
+	glance.Running = s.isRunning
+	glance.Finished = s.finished
+	limitMs := s.settings.CountdownMs
+	if limitMs == 0 {
+		limitMs = s.settings.TurnLimitMs
+	}
+	hidden := s.clockHidden()
+	s.stateMux.Unlock()
+	if hidden {
+		return glance
+	}
+	elapsedMs := elapsed.Milliseconds()
+	glance.ElapsedMs = &elapsedMs
+	if limitMs > 0 {
+		remaining := max(limitMs-elapsedMs, 0)
+		glance.RemainingMs = &remaining
+	}
+	return glance
+}
+
+// handleGlance serves GET /api/sessions/{id}/glance[?token=...], the token
+// is the glanceToken from the participant's state and adds their place in
+// the queue
+func handleGlance(w http.ResponseWriter, r *http.Request, session *Session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	glance := session.glance()
+	if token := r.URL.Query().Get("token"); token != "" {
+		session.clientsMux.Lock()
+		clientID, ok := session.glanceClient(token)
+		if ok {
+			glance.You = clientID
+			if position := session.turnsUntil(clientID); position >= 0 {
+				glance.Position = &position
+			}
+		}
+		session.clientsMux.Unlock()
+		if !ok {
+			http.Error(w, "Unknown token", http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(glance)
+}
+
+// handleAPI routes /api/sessions/{id}/...
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	sessionID, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/")
+	// IDs are lowercase, as in handleSession
+	sessionID = strings.ToLower(sessionID)
+
+	session, exists := sessionStore.Get(sessionID)
+	if !exists {
+		log.Printf("API: Session not found: %s\n", sessionID)
+		http.NotFound(w, r)
+		return
+	}
+
+	switch resource {
+	case "glance":
+		handleGlance(w, r, session)
+	case "log":
+		handleEventLog(w, r, session)
+	case "timeline":
+		handleTimeline(w, session)
+	case "laps":
+		handleLaps(w, r, session)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHandicap bounds a handicap either way, anything bigger is a typo
+const maxHandicap = time.Hour
+
+// setHandicap parses "<client>:<ms>" and sets that client's handicap, a
+// handicap of 0 removes it. stateMux must not be held.
+func (s *Session) setHandicap(arg string) error {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return errors.New("expected <client>:<ms>")
+	}
+	clientID, value := arg[:i], arg[i+1:]
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid handicap %q", value)
+	}
+	handicap := time.Duration(ms) * time.Millisecond
+	if handicap > maxHandicap || handicap < -maxHandicap {
+		return fmt.Errorf("handicap cannot be more than %v either way", maxHandicap)
+	}
+
+	s.clientsMux.Lock()
+	_, exists := s.clients[clientID]
+	s.clientsMux.Unlock()
+	if !exists {
+		return fmt.Errorf("%q is not in this session", clientID)
+	}
+
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	if handicap == 0 {
+		delete(s.handicaps, clientID)
+	} else {
+		s.handicaps[clientID] = handicap
+	}
+	log.Printf("Session %s: Handicap for %s set to %v\n", s.ID, clientID, handicap)
+	return nil
+}
+
+// applyHandicap fills in the adjusted time of a lap from its client's
+// handicap, laps of clients without one have none. stateMux must be held.
+func (s *Session) applyHandicap(lap *Lap) {
+	handicap, ok := s.handicaps[lap.Client]
+	if !ok || lap.Skipped {
+		lap.HandicapMs = 0
+		lap.AdjustedTime = 0
+		lap.AdjustedTimeMs = 0
+		return
+	}
+	lap.HandicapMs = handicap.Milliseconds()
+	lap.AdjustedTime = max(lap.Time+handicap, 0)
+	lap.AdjustedTimeMs = lap.AdjustedTime.Milliseconds()
+}
+
+// handicapStates reports the handicaps in milliseconds, stateMux must be held
+func (s *Session) handicapStates() map[string]int64 {
+	states := make(map[string]int64, len(s.handicaps))
+	for id, handicap := range s.handicaps {
+		states[id] = handicap.Milliseconds()
+	}
+	return states
+}
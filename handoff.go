@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Handoff is a turn waiting for the incoming client to say they are ready
+type Handoff struct {
+	Client      string `json:"client"`
+	ExpiresInMs int64  `json:"expiresInMs"`
+	expiresAt   time.Time
+}
+
+// handoffPauseReason is why the clock stopped after a round of missed handoffs
+const handoffPauseReason = "nobody took their turn"
+
+// offerHandoff holds the clock until the incoming client acks with "ready",
+// stateMux must be held. Once a whole round has gone by without an ack the
+// session pauses on clientID's turn instead, until someone starts it again.
+func (s *Session) offerHandoff(clientID string) {
+	window := time.Duration(s.settings.HandoffConfirmMs) * time.Millisecond
+	s.closeSegment()
+	s.isRunning = false
+	s.elapsed = 0
+	if s.handoffMisses >= len(s.clientOrder) {
+		s.handoffMisses = 0
+		if s.pausedAt.IsZero() {
+			s.pauseReason = handoffPauseReason
+			s.pausedBy = ""
+			s.pausedAt = time.Now()
+		}
+		log.Printf("Session %s: Nobody took their turn for a whole round, pausing on %s\n", s.ID, clientID)
+		return
+	}
+	s.handoff = &Handoff{Client: clientID, expiresAt: time.Now().Add(window)}
+	log.Printf("Session %s: Waiting %v for %s to take the turn\n", s.ID, window, clientID)
+	event := map[string]interface{}{
+		"type":        "yourTurnPending",
+		"expiresInMs": window.Milliseconds(),
+	}
+	// withCue takes stateMux, so it runs once this caller has let go of it
+	go func() { s.sendEvent(clientID, s.withCue(event)) }()
+}
+
+// acceptHandoff starts the clock for the client who acked their turn, the
+// host may ack for them
+func (s *Session) acceptHandoff(clientID string, isHost bool) {
+	s.stateMux.Lock()
+	handoff := s.handoff
+	if handoff == nil || (handoff.Client != clientID && !isHost) {
+		s.stateMux.Unlock()
+		log.Printf("Session %s: %s is ready but no turn is waiting for them\n", s.ID, clientID)
+		return
+	}
+	s.handoff = nil
+	s.handoffMisses = 0
+	s.endPause()
+	s.startTime = time.Now()
+	s.isRunning = true
+	s.stateMux.Unlock()
+
+	log.Printf("Session %s: %s took the turn\n", s.ID, handoff.Client)
+	go s.broadcastState()
+}
+
+// expireHandoff passes the turn on when the incoming client never acked it,
+// their turn is recorded as skipped and counted towards offerHandoff's pause
+func (s *Session) expireHandoff() {
+	s.stateMux.Lock()
+	handoff := s.handoff
+	if handoff == nil || time.Now().Before(handoff.expiresAt) {
+		s.stateMux.Unlock()
+		return
+	}
+	s.handoff = nil
+	s.handoffMisses++
+	s.stateMux.Unlock()
+
+	log.Printf("Session %s: %s did not take the turn in time, passing it on\n", s.ID, handoff.Client)
+	s.broadcastEvent(map[string]interface{}{
+		"type":   "handoffExpired",
+		"client": handoff.Client,
+	})
+	s.advanceTurn(handoff.Client, "", endSkip)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Sessions nobody has used for PASTATIME_IDLE_TTL, when it's set, are finished
+// and dropped.
+// expiryWarning before that connected clients get an expiringSoon message
+// with a countdown, and any message from one of them keeps the session.
+// Sessions kept for too long are retired too, see lifetime.go.
+
+const (
+	expiryWarning = 5 * time.Minute
+	reapInterval  = 10 * time.Second
+)
+
+// idleTTL is how long an unused session is kept, 0 keeps it forever and is
+// the default
+var idleTTL time.Duration
+
+// idleTTLFromEnv reads PASTATIME_IDLE_TTL
+func idleTTLFromEnv() time.Duration {
+	value := os.Getenv("PASTATIME_IDLE_TTL")
+	if value == "" {
+		return idleTTL
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		log.Printf("Ignoring PASTATIME_IDLE_TTL=%q, it should be a duration like 24h or 0 to keep sessions\n", value)
+		return idleTTL
+	}
+	return ttl
+}
+
+// reapSessions retires the sessions that went unused or outlived
+// sessionLifetime, until the server stops
+func reapSessions() {
+	if idleTTL == 0 && sessionLifetime == 0 {
+		return
+	}
+	for range time.Tick(reapInterval) {
+		for _, session := range sessionStore.List() {
+			if !session.checkLifetime() {
+				session.checkIdle()
+			}
+		}
+	}
+}
+
+// touch notes that a client used the session, calling off its expiry
+func (s *Session) touch() {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	s.lastActivity = time.Now()
+	if s.expiryWarned {
+		s.expiryWarned = false
+		log.Printf("Session %s: Kept alive\n", s.ID)
+		go s.broadcastEvent(map[string]interface{}{"type": "expiryCancelled"})
+	}
+}
+
+// checkIdle warns the clients of a session nobody used for a while, then
+// expires it. A running clock counts as use.
+func (s *Session) checkIdle() {
+	if idleTTL == 0 {
+		return
+	}
+	s.stateMux.Lock()
+	if s.isRunning {
+		s.lastActivity = time.Now()
+		s.stateMux.Unlock()
+		return
+	}
+	expiresAt := s.lastActivity.Add(idleTTL)
+	remaining := time.Until(expiresAt)
+	warn := remaining > 0 && remaining <= expiryWarning && !s.expiryWarned
+	if warn {
+		s.expiryWarned = true
+	}
+	s.stateMux.Unlock()
+
+	if remaining <= 0 {
+		s.expire()
+		return
+	}
+	if warn {
+		log.Printf("Session %s: Expiring in %v unless somebody uses it\n", s.ID, remaining.Round(time.Second))
+		s.broadcastEvent(map[string]interface{}{
+			"type":        "expiringSoon",
+			"expiresAt":   expiresAt,
+			"expiresInMs": remaining.Milliseconds(),
+		})
+	}
+}
+
+// expire finishes the session, archiving it, and retires it
+func (s *Session) expire() {
+	s.stateMux.Lock()
+	s.finish("expired")
+	s.stateMux.Unlock()
+	log.Printf("Session %s: Expired after %v without use\n", s.ID, idleTTL)
+	s.retire("idle")
+}
+
+// retire disconnects the session's clients, telling them why, and forgets
+// the session, keeping it in the trash for restoreWindow
+func (s *Session) retire(reason string) {
+	s.broadcastEvent(map[string]interface{}{"type": "sessionExpired", "reason": reason})
+	s.clientsMux.Lock()
+	for _, client := range s.clients {
+		if client.conn != nil {
+			client.close(websocket.CloseGoingAway, "session expired")
+		}
+	}
+	s.clientsMux.Unlock()
+
+	if current, _ := sessionStore.Get(s.ID); current == s {
+		s.softDelete(reason)
+		sessionStore.Delete(s.ID)
+		s.stopIntegrations()
+	}
+	if persistence != nil {
+		persistence.forget(s.ID)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// A session keeps its last maxLaps laps, the oldest are dropped as new ones
+// come in. Dropped laps are gone, only their count and each participant's
+// totals are kept, so the summary and the archive still add them up. The
+// state goes out ten times a second, so it only carries the last stateLaps of
+// the laps kept; GET /api/sessions/{id}/laps pages through all of them.
+
+// defaultMaxLaps is how many laps a session keeps
+const defaultMaxLaps = 1000
+
+// stateLaps is how many of the latest laps the state carries
+const stateLaps = 20
+
+// maxLaps is how many laps a session keeps, set with PASTATIME_MAX_LAPS. 0
+// keeps them all.
+var maxLaps = defaultMaxLaps
+
+// maxLapsFromEnv reads PASTATIME_MAX_LAPS
+func maxLapsFromEnv() int {
+	value := os.Getenv("PASTATIME_MAX_LAPS")
+	if value == "" {
+		return maxLaps
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring PASTATIME_MAX_LAPS=%q, it should be a number of at least 0\n", value)
+		return maxLaps
+	}
+	return n
+}
+
+// recordLap adds lap to the history, stateMux must be held
+func (s *Session) recordLap(lap Lap) {
+	s.lapHistory = append(s.lapHistory, lap)
+	s.trimLaps()
+}
+
+// LapTotals sums up a participant's laps as the summary counts them:
+// accidental laps are left out and skipped turns are only counted
+type LapTotals struct {
+	Laps            int   `json:"laps"`
+	Skips           int   `json:"skips,omitempty"`
+	TotalMs         int64 `json:"totalMs"`
+	AdjustedTotalMs int64 `json:"adjustedTotalMs"` // handicaps included
+	Handicapped     bool  `json:"handicapped,omitempty"`
+}
+
+// add counts one lap in the totals
+func (t *LapTotals) add(lap Lap) {
+	switch {
+	case lap.Accidental:
+	case lap.Skipped:
+		t.Skips++
+	default:
+		t.Laps++
+		t.TotalMs += lap.TimeMs
+		if lap.HandicapMs != 0 {
+			t.AdjustedTotalMs += lap.AdjustedTimeMs
+			t.Handicapped = true
+		} else {
+			t.AdjustedTotalMs += lap.TimeMs
+		}
+	}
+}
+
+// trimLaps drops the oldest laps past maxLaps, adding them to droppedTotals,
+// stateMux must be held
+func (s *Session) trimLaps() {
+	if over := len(s.lapHistory) - maxLaps; maxLaps > 0 && over > 0 {
+		if s.droppedTotals == nil {
+			s.droppedTotals = make(map[string]LapTotals)
+		}
+		for _, lap := range s.lapHistory[:over] {
+			if lap.Accidental {
+				continue
+			}
+			totals := s.droppedTotals[lap.Client]
+			totals.add(lap)
+			s.droppedTotals[lap.Client] = totals
+		}
+		// Appending reallocates once the capacity runs out, copying only the
+		// laps kept, so the dropped ones don't pile up behind the slice
+		s.lapHistory = s.lapHistory[over:]
+		s.lapsDropped += over
+		s.roundStartLap = max(s.roundStartLap-over, 0)
+	}
+}
+
+// lapCount is how many laps were recorded since the last reset, dropped ones
+// included, stateMux must be held
+func (s *Session) lapCount() int {
+	return s.lapsDropped + len(s.lapHistory)
+}
+
+// recentLaps copies the laps the state carries, stateMux must be held
+func (s *Session) recentLaps() []Lap {
+	return append([]Lap{}, s.lapHistory[max(len(s.lapHistory)-stateLaps, 0):]...)
+}
+
+// LapPage is a page of the laps a session keeps, oldest first. The laps
+// dropped before them can't be paged back.
+type LapPage struct {
+	Laps []Lap `json:"laps"`
+	// Offset is the index of the first lap, for editLap and deleteLap
+	Offset  int `json:"offset"`
+	Page    int `json:"page"`
+	PerPage int `json:"perPage"`
+	Total   int `json:"total"`
+	// Dropped laps came before the ones kept, past PASTATIME_MAX_LAPS
+	Dropped int `json:"dropped"`
+}
+
+// handleLaps serves GET /api/sessions/{id}/laps?page=N&perPage=M
+func handleLaps(w http.ResponseWriter, r *http.Request, session *Session) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, perPage, err := pageFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.stateMux.Lock()
+	total := len(session.lapHistory)
+	offset := min((page-1)*perPage, total)
+	laps := append([]Lap{}, session.lapHistory[offset:min(offset+perPage, total)]...)
+	dropped := session.lapsDropped
+	session.stateMux.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(LapPage{Laps: laps, Offset: offset, Page: page, PerPage: perPage, Total: total, Dropped: dropped})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Late joiner policies, how someone joining mid-rotation is fitted in
+const (
+	lateJoinersInsert = "insert" // added to the end of the current round
+	lateJoinersSkip   = "skip"   // sits out until the next round starts
+)
+
+// LateArrival records someone joining after the rotation had started
+type LateArrival struct {
+	Client   string    `json:"client"`
+	At       time.Time `json:"at"`
+	Round    int       `json:"round"`
+	Inserted bool      `json:"inserted"` // false if they sat the round out
+}
+
+// noteLateArrival fits a participant who joined mid-rotation into the turn
+// order according to the session's policy, clientsMux must be held
+func (s *Session) noteLateArrival(clientID string) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if s.startedAt.IsZero() || s.finished {
+		return
+	}
+	arrival := LateArrival{
+		Client:   clientID,
+		At:       time.Now(),
+		Round:    s.currentRound(),
+		Inserted: s.settings.LateJoiners != lateJoinersSkip,
+	}
+	s.lateArrivals = append(s.lateArrivals, arrival)
+	if !arrival.Inserted {
+		s.sittingOut[clientID] = true
+		s.missedTurns[clientID]++
+	}
+	log.Printf("Session %s: %s joined late in round %d, inserted: %v\n", s.ID, clientID, arrival.Round, arrival.Inserted)
+}
+
+// nextInOrder returns who follows position i in clientOrder, passing over
+// anyone sitting out the round. clientsMux must be held.
+func (s *Session) nextInOrder(i int) string {
+	for step := 1; step <= len(s.clientOrder); step++ {
+		id := s.clientOrder[(i+step)%len(s.clientOrder)]
+		if !s.sittingOut[id] {
+			return id
+		}
+	}
+	return s.clientOrder[(i+1)%len(s.clientOrder)]
+}
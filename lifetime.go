@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// When PASTATIME_SESSION_LIFETIME is set, every session is retired once it is
+// that old, however much it is used, so a forgotten tab can't keep it forever. It is finished,
+// which archives it, and stays read-only for readOnlyGrace first so whoever
+// is still there can look at and download the results.
+
+// readOnlyGrace is how long an outlived session stays read-only
+const readOnlyGrace = time.Hour
+
+// sessionLifetime is how long a session is kept at most, 0 keeps it as long
+// as it is used and is the default
+var sessionLifetime time.Duration
+
+// sessionLifetimeFromEnv reads PASTATIME_SESSION_LIFETIME
+func sessionLifetimeFromEnv() time.Duration {
+	value := os.Getenv("PASTATIME_SESSION_LIFETIME")
+	if value == "" {
+		return sessionLifetime
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime < 0 {
+		log.Printf("Ignoring PASTATIME_SESSION_LIFETIME=%q, it should be a duration like 168h or 0 for no limit\n", value)
+		return sessionLifetime
+	}
+	return lifetime
+}
+
+// checkLifetime makes a session that outlived sessionLifetime read-only and
+// retires it readOnlyGrace later, reporting whether it did
+func (s *Session) checkLifetime() bool {
+	if sessionLifetime == 0 {
+		return false
+	}
+	s.stateMux.Lock()
+	readOnlyAt := s.createdAt.Add(sessionLifetime)
+	lockDown := !s.readOnly && !time.Now().Before(readOnlyAt)
+	if lockDown {
+		s.readOnly = true
+		s.finish("lifetime")
+	}
+	s.stateMux.Unlock()
+
+	removedAt := readOnlyAt.Add(readOnlyGrace)
+	if lockDown {
+		log.Printf("Session %s: Read-only after %v, removed at %s\n", s.ID, sessionLifetime, removedAt.Format(time.RFC3339))
+		s.broadcastEvent(map[string]interface{}{
+			"type":      "sessionReadOnly",
+			"removedAt": removedAt,
+		})
+		s.broadcastState()
+	}
+	if time.Now().Before(removedAt) {
+		return false
+	}
+	log.Printf("Session %s: Removed after %v\n", s.ID, sessionLifetime+readOnlyGrace)
+	s.retire("lifetime")
+	return true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	lightHue  = "hue"
+	lightWLED = "wled"
+	// maxLights caps the lights one session drives
+	maxLights = 5
+)
+
+// lightClient calls the light controllers, they sit on the LAN and answer
+// fast. Redirects are not followed, only the allowed hosts are called.
+var lightClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Integrations connect a session to things outside Pastatime
+type Integrations struct {
+	Lights  []LightIntegration  `json:"lights,omitempty"`
+	Twitch  *TwitchIntegration  `json:"twitch,omitempty"`
+	Webhook *WebhookIntegration `json:"webhook,omitempty"`
+}
+
+// LightIntegration sets a Philips Hue group or a WLED controller to a scene
+// when an event happens, e.g. red on overtime
+type LightIntegration struct {
+	Type     string `json:"type"`               // "hue" or "wled"
+	Host     string `json:"host"`               // bridge or controller, host[:port]
+	Username string `json:"username,omitempty"` // Hue application key
+	Group    string `json:"group,omitempty"`    // Hue group, "0" (all lights) by default
+	// Scenes map an alert or turn-change event to the state sent to the
+	// light, e.g. {"overtime": {"on": true, "hue": 0, "sat": 254}} for Hue or
+	// {"overtime": {"on": true, "ps": 2}} for WLED
+	Scenes map[string]json.RawMessage `json:"scenes"`
+}
+
+// lightHostAllowed reports whether the server lets sessions drive lights at
+// host, PASTATIME_LIGHT_HOSTS lists them separated by commas. Sessions are
+// created by anyone, so nothing is allowed unless the operator says so.
+func lightHostAllowed(host string) bool {
+	for _, allowed := range strings.Split(os.Getenv("PASTATIME_LIGHT_HOSTS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == host {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted copies the integrations without their credentials
+func (i *Integrations) redacted() *Integrations {
+	if i == nil {
+		return nil
+	}
+	lights := make([]LightIntegration, len(i.Lights))
+	for n, light := range i.Lights {
+		light.Username = ""
+		lights[n] = light
+	}
+	redacted := &Integrations{Lights: lights, Twitch: i.Twitch}
+	if i.Webhook != nil {
+		webhook := *i.Webhook
+		webhook.Secret = ""
+		redacted.Webhook = &webhook
+	}
+	return redacted
+}
+
+// validateIntegrations checks the integrations block of the settings
+func validateIntegrations(integrations *Integrations) error {
+	if integrations == nil {
+		return nil
+	}
+	if len(integrations.Lights) > maxLights {
+		return fmt.Errorf("integrations: no more than %d lights", maxLights)
+	}
+	for _, light := range integrations.Lights {
+		switch light.Type {
+		case lightHue:
+			if light.Username == "" || strings.ContainsAny(light.Username+light.Group, "/?#") {
+				return fmt.Errorf("integrations: hue light at %q needs a valid username", light.Host)
+			}
+		case lightWLED:
+		default:
+			return fmt.Errorf("integrations: unknown light type %q", light.Type)
+		}
+		if !lightHostAllowed(light.Host) {
+			return fmt.Errorf("integrations: light host %q is not allowed on this server", light.Host)
+		}
+		for event, scene := range light.Scenes {
+			if !cueEvents[event] {
+				return fmt.Errorf("integrations: %q is not an alert or turn-change event", event)
+			}
+			var state map[string]interface{}
+			if err := json.Unmarshal(scene, &state); err != nil {
+				return fmt.Errorf("integrations: scene for %s must be a JSON object", event)
+			}
+		}
+	}
+	if err := validateWebhook(integrations.Webhook); err != nil {
+		return err
+	}
+	return validateTwitch(integrations.Twitch)
+}
+
+// request builds the call that puts the light in scene
+func (l LightIntegration) request(scene json.RawMessage) (*http.Request, error) {
+	if l.Type == lightHue {
+		group := l.Group
+		if group == "" {
+			group = "0"
+		}
+		target := url.URL{Scheme: "http", Host: l.Host, Path: "/api/" + l.Username + "/groups/" + group + "/action"}
+		return http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(scene))
+	}
+	target := url.URL{Scheme: "http", Host: l.Host, Path: "/json/state"}
+	return http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(scene))
+}
+
+// triggerLights sets the scenes configured for an event, without waiting for
+// the lights. stateMux must not be held.
+func (s *Session) triggerLights(eventType string) {
+	s.stateMux.Lock()
+	var lights []LightIntegration
+	if s.settings.Integrations != nil {
+		lights = s.settings.Integrations.Lights
+	}
+	s.stateMux.Unlock()
+
+	for _, light := range lights {
+		scene, ok := light.Scenes[eventType]
+		if !ok {
+			continue
+		}
+		go func(light LightIntegration) {
+			req, err := light.request(scene)
+			if err != nil {
+				log.Printf("Session %s: Bad %s light request: %v\n", s.ID, light.Type, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := lightClient.Do(req)
+			if err != nil {
+				log.Printf("Session %s: %s light at %s unreachable: %v\n", s.ID, light.Type, light.Host, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Printf("Session %s: %s light at %s answered %s\n", s.ID, light.Type, light.Host, resp.Status)
+			}
+		}(light)
+	}
+}
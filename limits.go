@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// ServerLimits cap what one instance takes on, so a small deployment can't
+// be run out of memory by somebody scripting sessions or sockets. 0 leaves
+// that one unchecked. They are set with PASTATIME_MAX_SESSIONS and
+// PASTATIME_MAX_CONNECTIONS.
+type ServerLimits struct {
+	Sessions    int64 `json:"sessions"`
+	Connections int64 `json:"connections"`
+}
+
+var serverLimits ServerLimits
+
+// openConnections counts the WebSockets this instance holds, relayed ones
+// included
+var openConnections atomic.Int64
+
+// serverLimitsFromEnv reads the limits, by default there are none
+func serverLimitsFromEnv() ServerLimits {
+	limits := serverLimits
+	for name, limit := range map[string]*int64{
+		"PASTATIME_MAX_SESSIONS":    &limits.Sessions,
+		"PASTATIME_MAX_CONNECTIONS": &limits.Connections,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring %s=%q, it should be a number of at least 0\n", name, value)
+			continue
+		}
+		*limit = n
+	}
+	return limits
+}
+
+// LimitReached is the body of the 503 sent when a limit is hit
+type LimitReached struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Limit   int64  `json:"limit"`
+	// RetryAfterSec repeats the Retry-After header for scripts
+	RetryAfterSec int `json:"retryAfterSec"`
+}
+
+// limitRetryAfter is how long clients are told to wait before trying again
+const limitRetryAfter = 60
+
+// writeLimitReached answers 503 with reached
+func writeLimitReached(w http.ResponseWriter, reached LimitReached) {
+	reached.RetryAfterSec = limitRetryAfter
+	w.Header().Set("Retry-After", strconv.Itoa(limitRetryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(reached)
+}
+
+// rejectAtSessionLimit answers 503 and returns true when the instance holds
+// as many sessions as it may, for the handlers that create sessions.
+// Finished sessions count until they expire.
+func rejectAtSessionLimit(w http.ResponseWriter) bool {
+	if serverLimits.Sessions == 0 || int64(len(sessionStore.List())) < serverLimits.Sessions {
+		return false
+	}
+	log.Printf("Refusing a new session, the limit of %d is reached\n", serverLimits.Sessions)
+	writeLimitReached(w, LimitReached{
+		Error:   "tooManySessions",
+		Message: "This server is running as many sessions as it can, please try again in a little while",
+		Limit:   serverLimits.Sessions,
+	})
+	return true
+}
+
+// acquireConnection takes a slot for a WebSocket before it is upgraded. When
+// none are left it answers 503 and returns false, otherwise the caller hands
+// the slot back with releaseConnection once the socket closes.
+func acquireConnection(w http.ResponseWriter) bool {
+	if n := openConnections.Add(1); serverLimits.Connections == 0 || n <= serverLimits.Connections {
+		return true
+	}
+	openConnections.Add(-1)
+	log.Printf("Refusing a connection, the limit of %d is reached\n", serverLimits.Connections)
+	writeLimitReached(w, LimitReached{
+		Error:   "tooManyConnections",
+		Message: "This server has as many people connected as it can, please try again in a little while",
+		Limit:   serverLimits.Connections,
+	})
+	return false
+}
+
+// releaseConnection hands back a slot taken with acquireConnection
+func releaseConnection() {
+	openConnections.Add(-1)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A session created with "lobby" set waits in a lobby until its host sends
+// openSession. Joins are announced as usual and the host can rearrange the
+// turn order with moveParticipant, but no clock runs: the timer loop only
+// starts once the session is open.
+
+// openSession ends the wait for a scheduled start or the host, and starts
+// the first client's clock if somebody has joined by then and any
+// ready-check is met
+func (s *Session) openSession(reason string) {
+	s.stateMux.Lock()
+	if !s.waiting() {
+		s.stateMux.Unlock()
+		return
+	}
+	s.startAt = time.Time{}
+	s.inLobby = false
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	activeClientID := s.activeClientID
+	if s.connectedCount() > 0 {
+		s.startTimerLoop()
+	}
+	s.clientsMux.Unlock()
+	// A ready-check still has the last word on the first turn
+	_, ready := s.inReadyCheck()
+
+	s.stateMux.Lock()
+	if activeClientID != "" && ready && !s.isRunning {
+		s.startTime = time.Now()
+		s.isRunning = true
+		if s.startedAt.IsZero() {
+			s.startedAt = s.startTime
+		}
+	}
+	s.stateMux.Unlock()
+
+	log.Printf("Session %s: %s, first up: %q\n", s.ID, reason, activeClientID)
+	s.broadcastEvent(map[string]interface{}{
+		"type":   "sessionStarted",
+		"client": activeClientID,
+	})
+}
+
+// moveParticipant moves someone to another place in the turn order while
+// the session is in the lobby. The argument is "<name>:<position>", counting
+// from 1.
+func (s *Session) moveParticipant(arg string) error {
+	name, positionArg, _ := strings.Cut(arg, ":")
+	position, err := strconv.Atoi(positionArg)
+	if err != nil {
+		return fmt.Errorf("invalid position %q", positionArg)
+	}
+
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+	s.stateMux.Lock()
+	inLobby := s.inLobby
+	s.stateMux.Unlock()
+	if !inLobby {
+		return errors.New("the turn order is arranged in the lobby")
+	}
+	from := slices.Index(s.clientOrder, name)
+	if from < 0 {
+		return fmt.Errorf("no participant %q", name)
+	}
+	if position < 1 || position > len(s.clientOrder) {
+		return fmt.Errorf("position should be between 1 and %d", len(s.clientOrder))
+	}
+	s.clientOrder = slices.Insert(slices.Delete(s.clientOrder, from, from+1), position-1, name)
+	// Whoever is first goes first once the session opens
+	s.activeClientID = s.clientOrder[0]
+	log.Printf("Session %s: %s moved to position %d\n", s.ID, name, position)
+	return nil
+}
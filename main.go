@@ -1,53 +1,228 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/goombaio/namegenerator"
 	"github.com/gorilla/websocket"
 )
 
 type Session struct {
-	ID             string
-	clients        map[string]*Client
-	clientOrder    []string
-	clientsMux     sync.Mutex
-	activeClientID string
-	turnsCompleted int
-	isRunning      bool
-	startTime      time.Time
-	elapsed        time.Duration
-	lastLapTime    time.Duration
-	lastLapClient  string
-	lapHistory     []Lap
-	stateMux       sync.Mutex
+	ID                   string
+	createdAt            time.Time
+	broadcasts           atomic.Uint64 // state and event broadcasts, for the admin API
+	resources            sessionResources
+	stopLoop             context.CancelFunc // stops the timer loop, nil while it isn't running; guarded by clientsMux
+	loopDone             chan struct{}      // closed once the last timer loop has returned
+	abandoned            atomic.Bool        // a panic left a lock held, see checkLocksAfterPanic
+	conns                sync.Map           // clientConn -> struct{}, every connection being served, read without the locks
+	shortCode            string             // for the /j/ short link, set at creation
+	clients              map[string]*Client
+	clientOrder          []string
+	clientsMux           sessionMutex
+	activeClientID       string
+	hostClientID         string
+	claimQueue           []string
+	sittingOut           map[string]bool   // late joiners waiting for the next round, guarded by clientsMux
+	glanceTokens         map[string]string // client ID -> token for the glance API, guarded by clientsMux
+	ready                map[string]bool   // ready-check answers, guarded by clientsMux
+	skipVotes            map[string]bool   // votes against skipVotesFor's turn, guarded by clientsMux
+	skipVotesFor         string
+	turnsCompleted       int
+	roundsDone           int
+	roundStartLap        int            // index in lapHistory of the current round's first lap
+	ranking              []GuessResult  // of the last round, in the guessing game
+	scores               map[string]int // best-of-N points, kept across resets
+	scoredRounds         int
+	winners              []string // set once the best-of-N is decided
+	isRunning            bool
+	startedAt            time.Time // first time the timer ran
+	finished             bool
+	finishWarned         bool
+	timeExpired          bool // the countdown of the current turn reached zero
+	targetAlerts         int  // warning and overtime events sent for the current turn
+	overtimeHooked       bool // the overtime webhook was called for the current turn
+	idlePaused           bool // paused because every client disconnected
+	pauseReason          string
+	pausedBy             string    // client who paused, empty when the server did
+	pauses               []Pause   // ended pauses, oldest first
+	pausedAt             time.Time // zero unless the timer was paused with pauseTimer
+	lastActivity         time.Time // last message from a client or the clock running, see checkIdle
+	expiryWarned         bool      // expiringSoon was sent since lastActivity
+	readOnly             bool      // outlived sessionLifetime, every command is refused
+	migrated             bool      // handed to another instance, every command is refused
+	pausedTotal          time.Duration
+	activeTotal          time.Duration // time the clock actually ran, up to startTime
+	phase                string        // pomodoro phase, empty unless WorkMs is set
+	phaseStartedAt       time.Time
+	bankUsed             map[string]time.Duration
+	bankExpired          map[string]bool
+	overtime             map[string]time.Duration // past the countdown, per client over the session
+	handicaps            map[string]time.Duration // added to laps, set by the host
+	lateArrivals         []LateArrival
+	missedTurns          map[string]int
+	summary              *SessionSummary
+	startTime            time.Time
+	elapsed              time.Duration
+	lastLapTime          time.Duration
+	lastLapClient        string
+	lastNextAt           time.Time
+	lapHistory           []Lap
+	lapsDropped          int                  // from the front of lapHistory, past maxLaps
+	droppedTotals        map[string]LapTotals // of the dropped laps, per client
+	lapEdits             []LapEdit
+	splits               []Split // of the current turn, moved into its lap
+	pending              *PendingAction
+	handoff              *Handoff // turn waiting for the incoming client's ack
+	handoffMisses        int      // handoffs in a row that expired without an ack
+	timers               map[string]*NamedTimer
+	mqttState            mqttState // last state published to the MQTT bridge
+	startAt              time.Time // scheduled start, zero once the session is open
+	inLobby              bool      // waiting for the host to open the session
+	autoStartAt          time.Time // end of the automatic start countdown, zero unless counting
+	autoStartSecondsLeft int       // last countdown second announced
+	personalTimers       map[string]*PersonalTimer
+	attendance           map[string]*Attendance
+	focusPhase           string
+	focusSummary         *FocusSummary
+	events               *eventLog
+	settings             Settings
+	stateMux             sessionMutex
+}
+
+// clientConn is a client's WebSocket, or a connection relayed from another
+// instance, see cluster.go
+type clientConn interface {
+	ReadJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
 }
 
 type Client struct {
-	id   string
-	conn *websocket.Conn
+	id       string
+	conn     clientConn
+	writeMux sync.Mutex
+	offline  bool // placeholder added by the host, with no connection
+	device   bool // connection driving a shared device, not a participant
+	// rosterSlot is a participant registered at creation, their place in the
+	// turn order is kept while they are not connected
+	rosterSlot bool
+	// lastPresence is only touched by the client's own read loop
+	lastPresence time.Time
+	// protocol is the version agreed in the hello handshake, 0 means v1
+	protocol atomic.Int32
 }
 
 type Lap struct {
 	Client string        `json:"client"`
 	Time   time.Duration `json:"time"`
 	TimeMs int64         `json:"timeMs"`
+	Edited bool          `json:"edited,omitempty"`
+	// Accidental marks laps shorter than the session's minimum lap duration
+	Accidental bool `json:"accidental,omitempty"`
+	// OvertimeMs is how far the lap ran past the session's target turn length
+	OvertimeMs int64 `json:"overtimeMs,omitempty"`
+	// Skipped marks a turn given up without speaking, it has no duration
+	Skipped bool `json:"skipped,omitempty"`
+	// HandicapMs is the client's handicap when the lap was recorded, and
+	// AdjustedTime is Time plus that handicap. Both are unset without one.
+	HandicapMs     int64         `json:"handicapMs,omitempty"`
+	AdjustedTime   time.Duration `json:"adjustedTime,omitempty"`
+	AdjustedTimeMs int64         `json:"adjustedTimeMs,omitempty"`
+	// DeltaMs is how far the lap landed from the target in the guessing game
+	DeltaMs *int64 `json:"deltaMs,omitempty"`
+	// Forced marks a lap the server ended because the turn ran out of time
+	Forced bool `json:"forced,omitempty"`
+	// VotedOut marks a lap the other participants voted to skip
+	VotedOut bool `json:"skippedByVote,omitempty"`
+	// Splits are the intermediate times recorded during the turn
+	Splits []Split `json:"splits,omitempty"`
 }
 
-var (
-	sessions    = make(map[string]*Session)
-	sessionsMux sync.Mutex
-	upgrader    = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
-)
+// Pause is one stretch the clock was paused for
+type Pause struct {
+	By         string    `json:"by,omitempty"` // empty when the server paused, e.g. while idle
+	Reason     string    `json:"reason,omitempty"`
+	At         time.Time `json:"at"`
+	DurationMs int64     `json:"durationMs"`
+	Ongoing    bool      `json:"ongoing,omitempty"` // still paused, DurationMs is so far
+}
+
+// LapEdit records a host correction to the lap history
+type LapEdit struct {
+	Action   string    `json:"action"`
+	Index    int       `json:"index"`
+	By       string    `json:"by"`
+	Original Lap       `json:"original"`
+	At       time.Time `json:"at"`
+}
+
+// PendingAction is a destructive command waiting for the host to confirm it
+type PendingAction struct {
+	Command     string `json:"command"`
+	RequestedBy string `json:"requestedBy"`
+	ExpiresInMs int64  `json:"expiresInMs"`
+	expiresAt   time.Time
+}
+
+// confirmWindow is how long the host has to confirm a destructive command
+const confirmWindow = 10 * time.Second
+
+// presenceInterval is the minimum gap between relayed presence events from one client
+const presenceInterval = 300 * time.Millisecond
+
+// presenceStatuses are the transient indicators a client can relay
+var presenceStatuses = map[string]bool{"speaking": true, "typing": true, "idle": true}
+
+// turnCommands start a clock or move the turn, so they wait out a pomodoro
+// break and a session that hasn't opened yet
+var turnCommands = map[string]bool{
+	"start":    true,
+	"next":     true,
+	"skip":     true,
+	"pass":     true,
+	"voteSkip": true,
+	"timer":    true,
+}
+
+// hostCommands can only be sent by the session host, whoever holds the timer
+var hostCommands = map[string]bool{
+	"confirm":           true,
+	"cancel":            true,
+	"editLap":           true,
+	"reassignLap":       true,
+	"deleteLap":         true,
+	"addParticipant":    true,
+	"removeParticipant": true,
+	"proxyControl":      true,
+	"startBlock":        true,
+	"endBlock":          true,
+	"closeCheckIn":      true,
+	"handicap":          true,
+	"saveTemplate":      true,
+	"openSession":       true,
+	"moveParticipant":   true,
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
 
 func generateName() string {
 	seed := time.Now().UTC().UnixNano()
@@ -83,18 +258,121 @@ func serveFiles(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	// The timerLoop will now be started per session
+	// Each session ticks in its own timerLoop while clients are connected
+
+	// "pastatime top" and "pastatime soak" watch a running server instead
+	// of being one
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		runTop(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		runSoak(os.Args[2:])
+		return
+	}
+	// "pastatime backup" and "pastatime restore" copy its store
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		runBackup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+	// "pastatime --migrate-only" brings the store's schema up to date, for
+	// deploys that migrate before the new version starts
+	if len(os.Args) > 1 && os.Args[1] == "--migrate-only" {
+		runMigrateOnly()
+		return
+	}
+
+	// The config file fills in what the environment doesn't set, a fresh
+	// instance without one serves the setup page
+	loadConfigFile()
+	baseURL = baseURLFromEnv()
+	eventLogDir = eventLogDirFromEnv()
+	http.HandleFunc("/setup", handleSetupPage)
+	http.HandleFunc("/setup/api", handleSetupAPI)
+
+	// Several instances can share their sessions through Redis
+	if cluster = redisClusterFromEnv(); cluster != nil {
+		sessionStore = cluster
+	}
+
+	// Sessions saved before a restart come back under the same links, once
+	// the bridges and limits below are set up
+	if persistence = persisterFromEnv(); persistence != nil {
+		// Past sessions and templates are kept next to the saved sessions
+		if store, ok := persistence.store.(archiveStore); ok {
+			archive = store
+		}
+		if store, ok := persistence.store.(templateStore); ok {
+			templates = store
+		}
+	}
+	// Sessions nobody uses expire after a warning, every session once it
+	// outlived its lifetime
+	idleTTL = idleTTLFromEnv()
+	sessionLifetime = sessionLifetimeFromEnv()
+	restoreWindow = restoreWindowFromEnv()
+	go reapSessions()
+	// Event logs go once they're past the retention, the archive keeps the
+	// summaries
+	retention = retentionFromEnv()
+	go purgeEventLogs()
 
 	// Handler for the landing page
 	http.HandleFunc("/", handleIndex)
 
 	// Handler to create a new session
 	http.HandleFunc("/new-session", handleNewSession)
+	// Sessions exported from /s/{id}/export, here or on another server
+	http.HandleFunc("/import-session", handleImportSession)
+	// Finished sessions, newest first, for admins
+	http.HandleFunc("/history", handleHistory)
+	http.HandleFunc("/api/archives/search", handleArchiveSearch)
+	// Saved settings new sessions can start from
+	http.HandleFunc("/api/templates", handleTemplates)
 
 	// Refined routing using a simple multiplexer or check in handler
 	// Let's check the path in a single handler for /s/
 	http.HandleFunc("/s/", handleSession)
 
+	// Compact links to a session, for chat messages and QR codes
+	http.HandleFunc("/j/", handleShortLink)
+
+	// Bundled alert sounds, so clients need no external assets
+	http.HandleFunc("/sounds/", handleSound)
+
+	// Spoken turn announcements, when a TTS provider is configured
+	speech = speechProviderFromEnv()
+	http.HandleFunc("/tts/", handleTTS)
+
+	// Home automation, when an MQTT broker is configured
+	mqtt = mqttBridgeFromEnv()
+	// Chat commands, when a Twitch bot account is configured
+	twitch = twitchBridgeFromEnv()
+
+	// Compact JSON for watches and other clients that can't hold a socket
+	http.HandleFunc("/api/sessions/", handleAPI)
+
+	// Operator view of every session, when an admin token is configured
+	adminToken = adminTokenFromEnv()
+	migrationPath = os.Getenv("PASTATIME_MIGRATION_PATH")
+	breakerLimits = breakerLimitsFromEnv()
+	serverLimits = serverLimitsFromEnv()
+	loadGoroutines = loadGoroutinesFromEnv()
+	maxLaps = maxLapsFromEnv()
+	go watchLoad()
+	if persistence != nil {
+		persistence.restore()
+		go persistence.run()
+	}
+	http.HandleFunc("/admin/api/", handleAdmin)
+
+	// Status badges for READMEs and dashboards
+	http.HandleFunc("/badge/sessions.svg", handleSessionsBadge)
+
 	// Serve static files using a custom handler
 	fileServer := http.HandlerFunc(serveFiles)
 	// Apply the setContentType middleware
@@ -106,7 +384,13 @@ func main() {
 	http.Handle("/session.js", wrappedFileServer)
 
 	log.Println("Server running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server = &http.Server{Addr: ":8080", Handler: recoverHTTP(http.DefaultServeMux)}
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Shut down by a drain, see drain.go
+	<-drained
+	log.Println("Drained, exiting")
 }
 
 // handleIndex serves the landing page (index.html)
@@ -125,16 +409,70 @@ func handleNewSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if rejectWhileDraining(w) {
+		return
+	}
+	if rejectAtSessionLimit(w) {
+		return
+	}
+
+	settings, err := parseSettings(r)
+	if err != nil {
+		http.Error(w, "Invalid session settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.Priority == priorityHigh && (adminToken == "" || !adminAuthorized(r)) {
+		http.Error(w, "Only admins can create high-priority sessions", http.StatusForbidden)
+		return
+	}
 
-	sessionsMux.Lock()
-	defer sessionsMux.Unlock()
+	// Generate session IDs until one is free, a requested slug is tried a
+	// few times in case its short code was taken
+	var session *Session
+	for attempt := 1; ; attempt++ {
+		sessionID := settings.Slug
+		if sessionID == "" {
+			sessionID = newSessionSlug()
+		}
+		session, err = newSession(sessionID, newShortCode(), settings)
+		if err != nil {
+			http.Error(w, "Invalid participants: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = session.registerSession(); !errors.Is(err, errSessionExists) {
+			break
+		}
+		if settings.Slug != "" && (!releaseSlug(settings.Slug) || attempt == maxSlugAttempts) {
+			http.Error(w, "The slug "+settings.Slug+" is taken by a session still going on", http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Creating session %s failed: %v\n", session.ID, err)
+		http.Error(w, "Could not create the session", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created new session: %s (short link /j/%s)\n", session.ID, session.shortCode)
 
-	// Generate a unique session ID
-	sessionID := generateName()
+	// Return the new session ID
+	response := map[string]string{
+		"sessionId": session.ID,
+		"shortLink": "/j/" + session.shortCode,
+	}
+	if baseURL != "" {
+		response["url"] = baseURL + "/j/" + session.shortCode
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	// Create a new session state
+// newSession builds the state of a session with its roster of participants
+func newSession(sessionID string, shortCode string, settings Settings) (*Session, error) {
 	session := &Session{
 		ID:             sessionID,
+		createdAt:      time.Now(),
+		lastActivity:   time.Now(),
+		shortCode:      shortCode,
 		clients:        make(map[string]*Client),
 		clientOrder:    []string{},
 		activeClientID: "",
@@ -144,17 +482,65 @@ func handleNewSession(w http.ResponseWriter, r *http.Request) {
 		lastLapTime:    0,
 		lastLapClient:  "",
 		lapHistory:     []Lap{},
+		personalTimers: make(map[string]*PersonalTimer),
+		attendance:     make(map[string]*Attendance),
+		bankUsed:       make(map[string]time.Duration),
+		bankExpired:    make(map[string]bool),
+		overtime:       make(map[string]time.Duration),
+		handicaps:      make(map[string]time.Duration),
+		sittingOut:     make(map[string]bool),
+		glanceTokens:   make(map[string]string),
+		ready:          make(map[string]bool),
+		skipVotes:      make(map[string]bool),
+		scores:         make(map[string]int),
+		missedTurns:    make(map[string]int),
+		timers:         newNamedTimers(settings.Timers),
+		events:         newEventLog(sessionID),
+		settings:       settings,
 	}
 
-	sessions[sessionID] = session
-	log.Printf("Created new session: %s\n", sessionID)
+	if settings.StartAt != nil {
+		session.startAt = *settings.StartAt
+	}
+	session.inLobby = settings.Lobby
 
-	// Start the timer loop for this specific session
-	go session.timerLoop()
+	for _, name := range settings.Participants {
+		if err := session.addOfflineClient(name, true); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
 
-	// Return the new session ID
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"sessionId": sessionID})
+// registerSession makes the session reachable by its ID and short link and
+// hands it to the integrations
+func (s *Session) registerSession() error {
+	if err := sessionStore.Create(s); err != nil {
+		return err
+	}
+	s.startIntegrations()
+	return nil
+}
+
+// startIntegrations announces the session to the MQTT and Twitch bridges
+func (s *Session) startIntegrations() {
+	if mqtt != nil {
+		mqtt.announceSession(s)
+	}
+	if integrations := s.settings.Integrations; twitch != nil && integrations != nil && integrations.Twitch != nil {
+		twitch.join(integrations.Twitch.Channel, s.ID)
+	}
+}
+
+// stopIntegrations lets go of what startIntegrations set up, once the
+// session is retired
+func (s *Session) stopIntegrations() {
+	if mqtt != nil {
+		mqtt.forgetSession(s)
+	}
+	if integrations := s.settings.Integrations; twitch != nil && integrations != nil && integrations.Twitch != nil {
+		twitch.leave(integrations.Twitch.Channel, s.ID)
+	}
 }
 
 // handleSession routes requests based on the path after /s/
@@ -168,12 +554,14 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	sessionID := pathSegments[0]
+	// IDs are lowercase, phones like to capitalize the first letter
+	sessionID := strings.ToLower(pathSegments[0])
 
 	// Check if the session exists
-	sessionsMux.Lock()
-	session, exists := sessions[sessionID]
-	sessionsMux.Unlock()
+	session, exists := sessionStore.Get(sessionID)
+	if !exists && cluster != nil && cluster.serveRemote(w, r, sessionID, pathSegments) {
+		return
+	}
 
 	if !exists {
 		log.Printf("Session not found: %s\n", sessionID)
@@ -185,6 +573,24 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 	if len(pathSegments) == 2 && pathSegments[1] == "ws" {
 		// This is a WebSocket request for a specific session
 		handleSessionWS(session, w, r)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "badge.svg" {
+		handleBadge(w, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "status.svg" {
+		handleStatusBadge(w, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "attendance.csv" {
+		handleAttendanceCSV(w, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "laps.csv" {
+		handleLapsCSV(w, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "clone" {
+		handleClone(w, r, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "export" {
+		handleExport(w, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "time" {
+		handleTimeStream(w, r, session)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "overlay" {
+		handleOverlay(w, r)
+	} else if len(pathSegments) == 2 && pathSegments[1] == "overlay.json" {
+		handleOverlayJSON(w, session)
 	} else if len(pathSegments) == 1 || (len(pathSegments) == 2 && pathSegments[1] == "") {
 		// This is a request for the session HTML page
 		handleSessionPage(w, r, session)
@@ -195,54 +601,214 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 
 // handleSessionPage serves the session HTML page (session.html) for a specific session
 func handleSessionPage(w http.ResponseWriter, r *http.Request, session *Session) {
-	// Serve the session HTML file
-	http.ServeFile(w, r, "./frontend/session.html")
+	page, err := os.ReadFile("./frontend/session.html")
+	if err != nil {
+		log.Println("Error:", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// Put the session name in the title so tabs can be told apart
+	session.stateMux.Lock()
+	title := session.title()
+	session.stateMux.Unlock()
+	page = bytes.Replace(page, []byte(defaultPageTitle), []byte("<title>"+html.EscapeString(title)+"</title>"), 1)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
 }
 
-// handleSessionWS handles WebSocket connections for a specific session
-func (s *Session) timerLoop() {
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+// defaultPageTitle is the title tag in session.html replaced by handleSessionPage
+const defaultPageTitle = "<title>Pastatime - Session</title>"
 
-	for range ticker.C {
-		s.clientsMux.Lock()
-		numClients := len(s.clients)
-		s.clientsMux.Unlock()
+// title is the page title for the session, stateMux must be held
+func (s *Session) title() string {
+	title := "Pastatime - " + s.ID
+	if s.settings.Name != "" {
+		title = s.settings.Name + " - Pastatime"
+	}
+	if s.settings.Emoji != "" {
+		title = s.settings.Emoji + " " + title
+	}
+	return title
+}
 
-		if numClients == 0 {
-			continue
+// startTimerLoop starts ticking when the first client connects, clientsMux
+// must be held. A loop that was just stopped is let finish first, so only
+// one ever runs.
+func (s *Session) startTimerLoop() {
+	if s.stopLoop != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	previous := s.loopDone
+	done := make(chan struct{})
+	s.stopLoop = cancel
+	s.loopDone = done
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		s.timerLoop(ctx)
+	}()
+	log.Printf("Session %s: Timer loop started\n", s.ID)
+}
+
+// stopTimerLoop stops ticking once the last client has left, so abandoned
+// sessions cost nothing. clientsMux must be held.
+func (s *Session) stopTimerLoop() {
+	if s.stopLoop == nil {
+		return
+	}
+	s.stopLoop()
+	s.stopLoop = nil
+	log.Printf("Session %s: Timer loop stopped, nobody is connected\n", s.ID)
+}
+
+// timerLoop runs the session's checks and sends its state until ctx is done
+func (s *Session) timerLoop(ctx context.Context) {
+	s.resources.goroutines.Add(1)
+	defer s.resources.goroutines.Add(-1)
+	interval := tickInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.abandoned.Load() {
+			return
 		}
-		s.broadcastState()
+		// A panicking tick is logged and skipped, the next one tries again
+		s.safely("timer loop", "", s.tick)
+		// A session using too much slows down rather than the whole server,
+		// and under load the less important sessions slow down first
+		if next := max(s.checkBreaker(), s.priorityInterval()); next != interval {
+			interval = next
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// tick runs the timer loop's checks once and sends out the state
+func (s *Session) tick() {
+	s.checkScheduledStart()
+	s.checkAutoStart()
+	s.checkMaxDuration()
+	s.checkCountdown()
+	s.checkTurnLimit()
+	s.checkTarget()
+	s.checkOvertimeWebhook()
+	s.checkTimeBanks()
+	s.checkPomodoro()
+	s.checkNamedTimers()
+	s.publishMQTTState()
+
+	s.clientsMux.Lock()
+	numClients := len(s.clients)
+	s.clientsMux.Unlock()
+
+	if numClients == 0 {
+		return
 	}
+	s.expirePending()
+	s.expireHandoff()
+	s.broadcastState()
 }
 
 func handleSessionWS(session *Session, w http.ResponseWriter, r *http.Request) {
+	if !acquireConnection(w) {
+		return
+	}
+	defer releaseConnection()
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Session %s: upgrade error: %v\n", session.ID, err)
 		return
 	}
+	serveClient(session, conn, r.URL.Query().Get("name"))
+}
+
+// serveClient adds the client on conn to the session and handles its
+// messages until it disconnects
+func serveClient(session *Session, conn clientConn, name string) {
+	session.resources.goroutines.Add(1)
+	defer session.resources.goroutines.Add(-1)
+	session.conns.Store(conn, struct{}{})
+	defer session.conns.Delete(conn)
+	if session.abandoned.Load() {
+		conn.Close()
+		return
+	}
+
+	session.stateMux.Lock()
+	sharedDevice := session.settings.SharedDevice
+	session.stateMux.Unlock()
 
 	// Add client to the session
 	session.clientsMux.Lock()
 	var clientID string
-	for {
-		clientID = generateName()
-		_, existsInSession := session.clients[clientID]
-		if !existsInSession {
-			break
+	var client *Client
+	joinReason := "connected"
+	if slot, ok := session.clients[name]; ok && slot.rosterSlot && slot.offline && !sharedDevice {
+		// Claim the roster slot, it already has its place in clientOrder
+		joinReason = "claimedSlot"
+		clientID = name
+		client = &Client{id: clientID, conn: conn, rosterSlot: true}
+		session.clients[clientID] = client
+		log.Printf("Session %s: Roster slot claimed: %s\n", session.ID, clientID)
+	} else {
+		// Invite links can preset the name, otherwise one is made up
+		clientID = session.presetClientID(name)
+		for clientID == "" {
+			clientID = generateName()
+			if _, existsInSession := session.clients[clientID]; existsInSession {
+				clientID = ""
+			}
 		}
-	}
-	client := &Client{id: clientID, conn: conn}
+		client = &Client{id: clientID, conn: conn, device: sharedDevice}
 
-	session.clients[clientID] = client
-	session.clientOrder = append(session.clientOrder, clientID)
+		session.clients[clientID] = client
+		if !client.device {
+			session.clientOrder = append(session.clientOrder, clientID)
+			session.noteLateArrival(clientID)
+		}
+	}
 
 	if session.activeClientID == "" && len(session.clientOrder) > 0 {
 		session.activeClientID = session.clientOrder[0]
 		log.Printf("Session %s: Setting initial active client: %s\n", session.ID, session.activeClientID)
 	}
+	if session.hostClientID == "" {
+		session.hostClientID = clientID
+		log.Printf("Session %s: Setting host: %s\n", session.ID, session.hostClientID)
+	}
+	if !client.device {
+		session.issueGlanceToken(clientID)
+	}
+	joined := session.membershipEvent("clientJoined", client, joinReason)
+	// Nothing ticks in the lobby, opening the session starts the loop
+	session.stateMux.Lock()
+	inLobby := session.inLobby
+	session.stateMux.Unlock()
+	if !inLobby {
+		session.startTimerLoop()
+	}
 	session.clientsMux.Unlock()
+	session.broadcastEvent(joined)
+
+	if !client.device {
+		session.stateMux.Lock()
+		session.markJoined(clientID)
+		session.stateMux.Unlock()
+	}
+
+	session.resumeAfterIdle()
+	session.touch()
 
 	log.Printf("Session %s: Client connected: %s\n", session.ID, clientID)
 	log.Printf("Session %s: Current client order: %v\n", session.ID, session.clientOrder)
@@ -251,34 +817,65 @@ func handleSessionWS(session *Session, w http.ResponseWriter, r *http.Request) {
 	session.sendStateToClient(client)
 	session.broadcastState()
 
+	leaveReason := "left"
 	for {
 		var data struct {
-			Type    string `json:"type"`
-			Command string `json:"command"`
+			Type     string `json:"type"`
+			Command  string `json:"command"`
+			Status   string `json:"status"`
+			Protocol int    `json:"protocol"`
 		}
 		if err := conn.ReadJSON(&data); err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Session %s: read error for client %s: %v\n", session.ID, clientID, err)
+				leaveReason = "connectionLost"
 			}
 			break
 		}
 
-		if data.Type == "command" {
-			session.handleCommand(clientID, data.Command)
+		if chaos != nil && !chaos.incoming(client) {
+			continue
+		}
+		// Any message keeps the session from expiring, keepAlive does nothing else
+		session.touch()
+
+		// A message that panics closes this connection, not the server
+		err := session.safely("message "+data.Type, clientID, func() {
+			if data.Type == "command" {
+				session.handleCommand(clientID, data.Command)
+			} else if data.Type == "presence" {
+				session.relayPresence(client, data.Status)
+			} else if data.Type == "hello" {
+				session.hello(client, data.Protocol)
+			}
+		})
+		if err != nil {
+			leaveReason = "error"
+			client.close(websocket.CloseInternalServerErr, "internal error")
+			break
 		}
 	}
 
 	session.clientsMux.Lock()
-	delete(session.clients, clientID)
+	left := session.membershipEvent("clientLeft", client, leaveReason)
+	session.withdrawClaim(clientID)
+	delete(session.sittingOut, clientID)
+	delete(session.ready, clientID)
+	if client.rosterSlot {
+		// Keep the slot and its turn so they can rejoin
+		session.clients[clientID] = &Client{id: clientID, offline: true, rosterSlot: true}
+	} else {
+		delete(session.clients, clientID)
 
-	for i, id := range session.clientOrder {
-		if id == clientID {
-			session.clientOrder = append(session.clientOrder[:i], session.clientOrder[i+1:]...)
-			break
+		for i, id := range session.clientOrder {
+			if id == clientID {
+				session.clientOrder = append(session.clientOrder[:i], session.clientOrder[i+1:]...)
+				break
+			}
 		}
 	}
 
-	if session.activeClientID == clientID {
+	if session.activeClientID == clientID && !client.rosterSlot {
 		if len(session.clientOrder) > 0 {
 			session.activeClientID = session.clientOrder[0]
 			log.Printf("Session %s: Active client disconnected, passing control to: %s\n", session.ID, session.activeClientID)
@@ -287,9 +884,31 @@ func handleSessionWS(session *Session, w http.ResponseWriter, r *http.Request) {
 			session.activeClientID = ""
 			log.Printf("Session %s: Last client disconnected, no active client.\n", session.ID)
 		}
-		session.broadcastState()
+	}
+	if session.hostClientID == clientID {
+		session.hostClientID = session.nextHost()
+		log.Printf("Session %s: Host disconnected, new host: %s\n", session.ID, session.hostClientID)
+	}
+	nobodyLeft := session.connectedCount() == 0
+	if nobodyLeft {
+		session.stopTimerLoop()
 	}
 	session.clientsMux.Unlock()
+	session.broadcastEvent(left)
+
+	if nobodyLeft {
+		session.pauseWhenIdle()
+	}
+	session.stateMux.Lock()
+	session.markLeft(clientID)
+	if session.settings.Simultaneous {
+		// Leaving counts as stopping, so the others can still finish
+		session.stopSimultaneous(clientID)
+	} else if !client.rosterSlot {
+		delete(session.personalTimers, clientID)
+	}
+	session.stateMux.Unlock()
+	go session.broadcastState()
 
 	conn.Close()
 	log.Printf("Session %s: Client disconnected: %s\n", session.ID, clientID)
@@ -297,179 +916,1068 @@ func handleSessionWS(session *Session, w http.ResponseWriter, r *http.Request) {
 	log.Printf("Session %s: Active client: %s\n", session.ID, session.activeClientID)
 }
 
-// handleCommand now operates on the Session instance
-func (s *Session) handleCommand(clientID string, cmd string) {
-	s.clientsMux.Lock()
-	if clientID != s.activeClientID {
-		log.Printf("Session %s: Client %s is not the active client. Ignoring command: %s\n", s.ID, clientID, cmd)
-		s.clientsMux.Unlock()
-		return
+// membershipEvent builds a clientJoined or clientLeft event, clientsMux must be held
+func (s *Session) membershipEvent(eventType string, c *Client, reason string) map[string]interface{} {
+	role := "participant"
+	if c.id == s.hostClientID {
+		role = "host"
+	} else if c.device {
+		role = "device"
 	}
-	s.clientsMux.Unlock()
+	return map[string]interface{}{
+		"type":   eventType,
+		"client": c.id,
+		"role":   role,
+		"reason": reason,
+	}
+}
 
-	if cmd == "next" {
-		s.stateMux.Lock()
-		var currentLap time.Duration
-		if s.isRunning {
-			currentLap = s.elapsed + time.Since(s.startTime)
-		} else {
-			currentLap = s.elapsed
+// nextHost picks the connected client who takes over as host, clientsMux must be held
+func (s *Session) nextHost() string {
+	for _, id := range s.clientOrder {
+		if !s.clients[id].offline {
+			return id
 		}
-		s.lastLapTime = currentLap
-		s.lastLapClient = clientID
-
-		s.turnsCompleted++
-		fmt.Printf("Session %s: Turns completed: %d\n", s.ID, s.turnsCompleted)
-
-		s.lapHistory = append(s.lapHistory, Lap{Client: clientID, Time: currentLap, TimeMs: currentLap.Milliseconds()})
-		log.Printf("Session %s: Lap added to history. Current lapHistory: %v\n", s.ID, s.lapHistory)
-
-		s.isRunning = true
-		s.startTime = time.Now()
-		s.elapsed = 0
-
-		s.stateMux.Unlock()
+	}
+	for id, client := range s.clients {
+		if client.device {
+			return id
+		}
+	}
+	return ""
+}
 
-		s.clientsMux.Lock()
-		if len(s.clientOrder) > 1 {
-			if s.turnsCompleted >= len(s.clientOrder) {
-				s.isRunning = false
-				s.elapsed = 0
-				s.lastLapTime = 0
-				s.lastLapClient = ""
-				s.turnsCompleted = 0
-				log.Printf("Session %s: All clients have had their turn. Timer stopped.\n", s.ID)
-			} else {
-				currentIndex := -1
-				for i, id := range s.clientOrder {
-					if id == s.activeClientID {
-						currentIndex = i
-						break
-					}
-				}
+// relayPresence forwards a speaking/typing indicator to the session without storing it
+func (s *Session) relayPresence(c *Client, status string) {
+	if !presenceStatuses[status] {
+		return
+	}
+	// Drop indicators sent faster than presenceInterval
+	if time.Since(c.lastPresence) < presenceInterval {
+		return
+	}
+	c.lastPresence = time.Now()
+	s.broadcastEvent(map[string]interface{}{
+		"type":   "presence",
+		"client": c.id,
+		"status": status,
+	})
+}
 
-				if currentIndex != -1 {
-					nextIndex := (currentIndex + 1) % len(s.clientOrder)
-					s.activeClientID = s.clientOrder[nextIndex]
-					log.Printf("Session %s: Control passed to next client: %s\n", s.ID, s.activeClientID)
-				} else {
-					log.Printf("Session %s: Active client ID not found in client order list.\n", s.ID)
-					if len(s.clientOrder) > 0 {
-						s.activeClientID = s.clientOrder[0]
-					} else {
-						s.activeClientID = ""
-					}
-				}
-			}
-		} else {
-			log.Printf("Session %s: Only one client connected, cannot pass control.\n", s.ID)
-			s.stateMux.Lock()
-			s.isRunning = true
-			s.startTime = time.Now()
-			s.elapsed = 0
-			s.lastLapTime = 0
-			s.lastLapClient = ""
-			s.turnsCompleted = 0
-			s.stateMux.Unlock()
+// connectedCount returns how many clients have a live connection, clientsMux must be held
+func (s *Session) connectedCount() int {
+	count := 0
+	for _, client := range s.clients {
+		if !client.offline {
+			count++
 		}
-		s.clientsMux.Unlock()
+	}
+	return count
+}
 
-		go s.broadcastState()
+// pauseWhenIdle pauses a running timer once nobody is connected, so it doesn't run overnight
+func (s *Session) pauseWhenIdle() {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if !s.isRunning {
 		return
 	}
+	s.pauseTimer("", "idle")
+	s.idlePaused = true
+	log.Printf("Session %s: Every client disconnected, timer paused at %v\n", s.ID, s.elapsed)
+}
 
+// resumeAfterIdle restarts a timer paused by pauseWhenIdle if the session auto-resumes
+func (s *Session) resumeAfterIdle() {
 	s.stateMux.Lock()
 	defer s.stateMux.Unlock()
 
-	log.Printf("Session %s: Active client %s processing command: %s\n", s.ID, clientID, cmd)
-
-	switch cmd {
-	case "start":
-		if !s.isRunning {
-			s.startTime = time.Now()
-			s.isRunning = true
-		}
-	case "pause":
-		if s.isRunning {
-			s.elapsed += time.Since(s.startTime)
-			s.isRunning = false
-		}
-	case "reset":
-		s.isRunning = false
-		s.elapsed = 0
-		s.lastLapTime = 0
-		s.lastLapClient = ""
-		s.lapHistory = []Lap{}
-		s.turnsCompleted = 0
+	if !s.idlePaused || !s.settings.AutoResume {
+		return
 	}
-	go s.broadcastState()
+	s.idlePaused = false
+	s.endPause()
+	s.startTime = time.Now()
+	s.isRunning = true
+	log.Printf("Session %s: Client reconnected, timer resumed\n", s.ID)
 }
 
-// broadcastState sends the current timer value, active client ID, lap time, and own client ID to all clients in this session
-func (s *Session) broadcastState() {
+// handleCommand now operates on the Session instance
+func (s *Session) handleCommand(clientID string, cmd string) {
+	s.events.command(clientID, cmd)
+
+	// clientID may be swapped for the active client below, acks go to the sender
+	senderID := clientID
+
 	s.clientsMux.Lock()
-	currentClients := make(map[string]*Client, len(s.clients))
-	for id, client := range s.clients {
-		currentClients[id] = client
-	}
+	isHost := clientID == s.hostClientID
+	isActive := clientID == s.activeClientID
+	activeClientID := s.activeClientID
+	active := s.clients[activeClientID]
+	activeOffline := active != nil && active.offline
 	s.clientsMux.Unlock()
 
 	s.stateMux.Lock()
-	var total time.Duration
-	if s.isRunning {
-		total = s.elapsed + time.Since(s.startTime)
-	} else {
-		total = s.elapsed
-	}
-	ms := total.Milliseconds()
-	lapMs := s.lastLapTime.Milliseconds()
-	lapClient := s.lastLapClient
-	history := s.lapHistory
+	proxyControl := s.settings.ProxyControl
+	sharedDevice := s.settings.SharedDevice
+	selfOrdering := s.settings.SelfOrdering
+	individualTimers := s.settings.IndividualTimers
+	simultaneous := s.settings.Simultaneous
+	readOnly := s.readOnly || s.migrated
 	s.stateMux.Unlock()
 
-	clientIDs := make([]string, 0, len(currentClients))
-	for id := range currentClients {
-		clientIDs = append(clientIDs, id)
-	}
-
-	baseMsg := map[string]interface{}{
-		"type":          "update",
-		"time":          ms,
-		"lapTime":       lapMs,
-		"lastLapClient": lapClient,
-		"lapHistory":    history,
-		"activeClient":  s.activeClientID,
-		"clients":       clientIDs,
+	if readOnly {
+		log.Printf("Session %s: Session is read-only. Ignoring command from %s: %s\n", s.ID, clientID, cmd)
+		return
 	}
 
-	for id, c := range currentClients {
-		personalMsg := make(map[string]interface{}, len(baseMsg)+1)
-		for k, v := range baseMsg {
-			personalMsg[k] = v
-		}
-		personalMsg["yourId"] = id
-
-		data, err := json.Marshal(personalMsg)
-		if err != nil {
-			log.Printf("Session %s: json marshal error for client %s: %v\n", s.ID, id, err)
-			continue
+	// Commands may carry an argument, e.g. "deleteLap:2"
+	name, arg, _ := strings.Cut(cmd, ":")
+	if hostCommands[name] {
+		if !isHost {
+			log.Printf("Session %s: Client %s is not the host. Ignoring command: %s\n", s.ID, clientID, cmd)
+			return
 		}
-
-		go func(conn *websocket.Conn, data []byte) {
-			err := conn.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				//log.Printf("Session %s: write error for client %s: %v\n", s.ID, id, err)
-			}
-		}(c.conn, data)
+		s.handleHostCommand(clientID, name, arg)
+		return
 	}
-}
 
-// sendStateToClient sends the current timer value, active client ID, lap time, and own client ID to a specific client in this session
-func (s *Session) sendStateToClient(c *Client) {
-	s.clientsMux.Lock()
-	currentClients := make(map[string]*Client, len(s.clients))
-	for id, client := range s.clients {
-		currentClients[id] = client
+	s.stateMux.Lock()
+	finished := s.finished
+	onBreak := s.phase == phaseBreak
+	waiting := s.waiting()
+	s.stateMux.Unlock()
+	if finished {
+		log.Printf("Session %s: Session is finished. Ignoring command from %s: %s\n", s.ID, clientID, cmd)
+		return
+	}
+	if onBreak && turnCommands[name] {
+		log.Printf("Session %s: Pomodoro break, ignoring command from %s: %s\n", s.ID, clientID, cmd)
+		return
+	}
+	if waiting && turnCommands[name] {
+		log.Printf("Session %s: Waiting for the session to open, ignoring command from %s: %s\n", s.ID, clientID, cmd)
+		return
+	}
+
+	// Named timers belong to the whole session, not to the active client
+	if name == "addTimer" || name == "removeTimer" || name == "timer" {
+		s.handleTimerCommand(clientID, name, arg)
+		return
+	}
+
+	// Before the first turn "ready" answers the ready-check, afterwards it
+	// acks a handed-off turn, which starts the incoming client's clock
+	readyCheck, readyMet := s.inReadyCheck()
+	if readyCheck && (name == "ready" || name == "notReady") {
+		s.setReady(clientID, name == "ready")
+		return
+	}
+	if name == "ready" {
+		s.acceptHandoff(clientID, isHost)
+		return
+	}
+	if readyCheck && !readyMet && (name == "start" || name == "next" || name == "skip" || name == "pass") {
+		log.Printf("Session %s: Not everyone is ready, ignoring command from %s: %s\n", s.ID, clientID, cmd)
+		go s.sendEvent(senderID, map[string]interface{}{
+			"type":    "ack",
+			"command": cmd,
+			"status":  "rejected",
+			"reason":  "waiting for everyone to be ready",
+		})
+		return
+	}
+
+	// Everyone but the speaker can vote their turn away
+	if name == "voteSkip" {
+		s.voteSkip(clientID)
+		return
+	}
+
+	// Anyone can queue up to speak next, it doesn't touch the timer
+	if selfOrdering && (name == "claimNext" || name == "withdrawClaim") {
+		s.clientsMux.Lock()
+		if name == "claimNext" {
+			s.claimNext(clientID)
+		} else {
+			s.withdrawClaim(clientID)
+		}
+		s.clientsMux.Unlock()
+		go s.broadcastState()
+		return
+	}
+
+	// Everyone drives their own timer, there is no turn to check
+	if individualTimers {
+		s.handlePersonalCommand(clientID, name, arg)
+		return
+	}
+	if simultaneous {
+		s.handleSimultaneousCommand(clientID, isHost, name)
+		return
+	}
+
+	if sharedDevice {
+		// Whoever holds the shared device presses the buttons for the roster
+		clientID = activeClientID
+	} else if proxyControl {
+		// In proxy-control mode the host presses every button
+		if !isHost {
+			log.Printf("Session %s: Client %s is not the host in proxy-control mode. Ignoring command: %s\n", s.ID, clientID, cmd)
+			return
+		}
+		clientID = activeClientID
+	} else if !isActive {
+		// The host drives the turn of participants who are not connected,
+		// and can hand anyone's turn to someone else
+		if !isHost || (!activeOffline && name != "pass") {
+			log.Printf("Session %s: Client %s is not the active client. Ignoring command: %s\n", s.ID, clientID, cmd)
+			return
+		}
+		log.Printf("Session %s: Host %s acting for client %s\n", s.ID, clientID, activeClientID)
+		clientID = activeClientID
+	}
+
+	if name == "pass" {
+		if err := s.checkPassTarget(clientID, arg); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, cmd, err)
+			go s.sendEvent(senderID, map[string]interface{}{
+				"type":    "ack",
+				"command": cmd,
+				"status":  "rejected",
+				"reason":  err.Error(),
+			})
+			return
+		}
+	}
+
+	if cmd == "next" || cmd == "skip" || name == "pass" {
+		s.stateMux.Lock()
+		// Coalesce double clicks instead of recording a bogus short lap
+		debounce := time.Duration(s.settings.NextDebounceMs) * time.Millisecond
+		if sinceLast := time.Since(s.lastNextAt); sinceLast < debounce {
+			s.stateMux.Unlock()
+			log.Printf("Session %s: next from %s suppressed, %v after the previous one\n", s.ID, senderID, sinceLast)
+			go s.sendEvent(senderID, map[string]interface{}{
+				"type":      "ack",
+				"command":   cmd,
+				"status":    "suppressed",
+				"retryInMs": (debounce - sinceLast).Milliseconds(),
+			})
+			return
+		}
+		s.lastNextAt = time.Now()
+		go s.sendEvent(senderID, map[string]interface{}{
+			"type":    "ack",
+			"command": cmd,
+			"status":  "ok",
+		})
+		s.stateMux.Unlock()
+
+		// arg is empty unless passing, then it names the target client
+		ending := endNext
+		if cmd == "skip" {
+			ending = endSkip
+		}
+		s.advanceTurn(clientID, arg, ending)
+		return
+	}
+
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	log.Printf("Session %s: Active client %s processing command: %s\n", s.ID, clientID, cmd)
+
+	switch name {
+	case "start":
+		// Starting the clock also takes a turn that was waiting for an ack
+		s.handoff = nil
+		s.handoffMisses = 0
+		if !s.isRunning {
+			s.endPause()
+			s.startTime = time.Now()
+			s.isRunning = true
+			s.idlePaused = false
+			if s.startedAt.IsZero() {
+				s.startedAt = s.startTime
+			}
+		}
+	case "pause":
+		// An optional reason may follow, e.g. "pause:break"
+		s.pauseTimer(clientID, arg)
+	case "split":
+		// An optional label may follow, e.g. "split:drain the pasta"
+		s.recordSplit(clientID, arg)
+	case "reset":
+		// Reset wipes every lap, so it only runs once the host confirms it
+		s.pending = &PendingAction{
+			Command:     cmd,
+			RequestedBy: clientID,
+			expiresAt:   time.Now().Add(confirmWindow),
+		}
+		log.Printf("Session %s: %s requested by %s, waiting for host confirmation\n", s.ID, cmd, clientID)
+		go s.broadcastEvent(map[string]interface{}{
+			"type":        "confirmationPending",
+			"command":     cmd,
+			"requestedBy": clientID,
+			"expiresInMs": confirmWindow.Milliseconds(),
+		})
+	}
+	go s.broadcastState()
+}
+
+// claimNext queues a client to speak after the active one, clientsMux must be held.
+// Claims are served in the order they reach the server, so the first one wins.
+func (s *Session) claimNext(clientID string) {
+	if clientID == s.activeClientID {
+		log.Printf("Session %s: Active client %s cannot claim the next turn\n", s.ID, clientID)
+		return
+	}
+	for _, id := range s.claimQueue {
+		if id == clientID {
+			return
+		}
+	}
+	s.claimQueue = append(s.claimQueue, clientID)
+	log.Printf("Session %s: %s claimed a turn, queue: %v\n", s.ID, clientID, s.claimQueue)
+}
+
+// withdrawClaim removes a client from the claim queue, clientsMux must be held
+func (s *Session) withdrawClaim(clientID string) {
+	for i, id := range s.claimQueue {
+		if id == clientID {
+			s.claimQueue = append(s.claimQueue[:i:i], s.claimQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+// handleHostCommand runs a command reserved to the session host
+func (s *Session) handleHostCommand(hostID string, name string, arg string) {
+	log.Printf("Session %s: Host %s processing command: %s %s\n", s.ID, hostID, name, arg)
+
+	switch name {
+	case "confirm", "cancel":
+		s.resolvePending(hostID, name == "confirm")
+	case "editLap", "reassignLap", "deleteLap":
+		if err := s.editLap(hostID, name, arg); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, name, err)
+			return
+		}
+		go s.broadcastState()
+	case "addParticipant":
+		if err := s.addOfflineClient(arg, false); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, name, err)
+			return
+		}
+		go s.broadcastState()
+	case "removeParticipant":
+		if err := s.removeOfflineClient(arg); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, name, err)
+			return
+		}
+		go s.broadcastState()
+	case "handicap":
+		if err := s.setHandicap(arg); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, name, err)
+			return
+		}
+		go s.broadcastState()
+	case "saveTemplate":
+		s.saveAsTemplate(hostID, arg)
+	case "openSession":
+		s.openSession("Opened by the host")
+		go s.broadcastState()
+	case "moveParticipant":
+		if err := s.moveParticipant(arg); err != nil {
+			log.Printf("Session %s: %s rejected: %v\n", s.ID, name, err)
+			return
+		}
+		go s.broadcastState()
+	case "proxyControl":
+		s.stateMux.Lock()
+		s.settings.ProxyControl = arg == "on"
+		s.stateMux.Unlock()
+		go s.broadcastState()
+	case "startBlock", "endBlock", "closeCheckIn":
+		s.stateMux.Lock()
+		defer s.stateMux.Unlock()
+		if !s.settings.IndividualTimers {
+			log.Printf("Session %s: %s needs individual timers\n", s.ID, name)
+			return
+		}
+		switch name {
+		case "startBlock":
+			s.startFocusBlock()
+		case "endBlock":
+			s.endFocusBlock()
+		case "closeCheckIn":
+			// Summarize without waiting for the stragglers
+			s.summarizeFocusBlock()
+		}
+		go s.broadcastState()
+	}
+}
+
+// maxClientNameLength caps names chosen through ?name= in the join link
+const maxClientNameLength = 40
+
+// presetClientID turns a name from the join link into a free client ID, with a
+// numeric suffix if the name is taken. It returns "" for names that can't be
+// used. clientsMux must be held.
+func (s *Session) presetClientID(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxClientNameLength {
+		return ""
+	}
+	id := name
+	for n := 2; s.clients[id] != nil; n++ {
+		id = fmt.Sprintf("%s-%d", name, n)
+	}
+	return id
+}
+
+// addOfflineClient adds a placeholder participant who takes turns without being connected
+func (s *Session) addOfflineClient(name string, rosterSlot bool) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("missing participant name")
+	}
+
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	if _, exists := s.clients[name]; exists {
+		return fmt.Errorf("participant %q already exists", name)
+	}
+	client := &Client{id: name, offline: true, rosterSlot: rosterSlot}
+	s.clients[name] = client
+	s.clientOrder = append(s.clientOrder, name)
+	if s.activeClientID == "" {
+		s.activeClientID = name
+	}
+	log.Printf("Session %s: Offline participant added: %s\n", s.ID, name)
+	go s.broadcastEvent(s.membershipEvent("clientJoined", client, "added"))
+	return nil
+}
+
+// removeOfflineClient removes a placeholder participant added with addOfflineClient
+func (s *Session) removeOfflineClient(name string) error {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	client, exists := s.clients[name]
+	if !exists || !client.offline {
+		return fmt.Errorf("no offline participant %q", name)
+	}
+	left := s.membershipEvent("clientLeft", client, "removed")
+	delete(s.clients, name)
+	for i, id := range s.clientOrder {
+		if id == name {
+			s.clientOrder = append(s.clientOrder[:i], s.clientOrder[i+1:]...)
+			break
+		}
+	}
+	if s.activeClientID == name {
+		if len(s.clientOrder) > 0 {
+			s.activeClientID = s.clientOrder[0]
+		} else {
+			s.activeClientID = ""
+		}
+	}
+	log.Printf("Session %s: Offline participant removed: %s\n", s.ID, name)
+	go s.broadcastEvent(left)
+	return nil
+}
+
+// editLap applies a host correction to a recorded lap, keeping the original in lapEdits.
+// The argument is "<index>:<ms>" for editLap, "<index>:<clientID>" for reassignLap and "<index>" for deleteLap.
+func (s *Session) editLap(hostID string, action string, arg string) error {
+	indexArg, value, _ := strings.Cut(arg, ":")
+	index, err := strconv.Atoi(indexArg)
+	if err != nil {
+		return fmt.Errorf("invalid lap index %q", indexArg)
+	}
+
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if index < 0 || index >= len(s.lapHistory) {
+		return fmt.Errorf("lap %d does not exist", index)
+	}
+	original := s.lapHistory[index]
+
+	switch action {
+	case "editLap":
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("invalid lap duration %q", value)
+		}
+		lap := &s.lapHistory[index]
+		lap.Time = time.Duration(ms) * time.Millisecond
+		lap.TimeMs = ms
+		lap.Edited = true
+		s.applyHandicap(lap)
+		s.setGuessDelta(lap)
+	case "reassignLap":
+		if value == "" {
+			return errors.New("missing client to reassign the lap to")
+		}
+		lap := &s.lapHistory[index]
+		lap.Client = value
+		lap.Edited = true
+		s.applyHandicap(lap)
+	case "deleteLap":
+		s.lapHistory = append(s.lapHistory[:index:index], s.lapHistory[index+1:]...)
+		// The current round starts a lap earlier if one before it went
+		if index < s.roundStartLap {
+			s.roundStartLap--
+		}
+	}
+
+	s.lapEdits = append(s.lapEdits, LapEdit{
+		Action:   action,
+		Index:    index,
+		By:       hostID,
+		Original: original,
+		At:       time.Now(),
+	})
+	log.Printf("Session %s: Lap %d %s by %s, original: %v\n", s.ID, index, action, hostID, original)
+	return nil
+}
+
+// turnEnding is how a turn came to an end
+type turnEnding int
+
+const (
+	endNext   turnEnding = iota // the speaker, or someone for them, pressed next
+	endSkip                     // given up without speaking
+	endForced                   // the server ended it when time ran out
+	endVote                     // the other participants voted to skip it
+)
+
+// advanceTurn records the lap of the client whose turn it was and passes control
+// on, to passTo when it is set or else to whoever is next. A skipped turn is
+// recorded without a duration.
+func (s *Session) advanceTurn(clientID string, passTo string, ending turnEnding) {
+	skip := ending == endSkip
+	s.stateMux.Lock()
+	s.handoff = nil
+	var currentLap time.Duration
+	if skip {
+		// Nothing was said, so nothing is timed or charged
+	} else if s.isRunning {
+		currentLap = s.elapsed + time.Since(s.startTime)
+	} else {
+		currentLap = s.elapsed
+	}
+	s.lastLapTime = currentLap
+	s.lastLapClient = clientID
+	if !skip {
+		s.chargeTimeBank(clientID, currentLap)
+	}
+
+	s.turnsCompleted++
+	fmt.Printf("Session %s: Turns completed: %d\n", s.ID, s.turnsCompleted)
+
+	minLap := time.Duration(s.settings.MinLapMs) * time.Millisecond
+	lap := Lap{
+		Client:     clientID,
+		Time:       currentLap,
+		TimeMs:     currentLap.Milliseconds(),
+		Accidental: !skip && currentLap < minLap,
+		Skipped:    skip,
+		Forced:     ending == endForced,
+		VotedOut:   ending == endVote,
+		Splits:     s.splits,
+	}
+	s.splits = nil
+	if s.settings.TargetMs > 0 {
+		lap.OvertimeMs = max(lap.TimeMs-s.settings.TargetMs, 0)
+	}
+	if overtime := s.countdownOvertime(currentLap); overtime > 0 {
+		s.overtime[clientID] += overtime
+	}
+	s.applyHandicap(&lap)
+	s.setGuessDelta(&lap)
+	s.recordLap(lap)
+	log.Printf("Session %s: Lap added to history for %s, %d laps\n", s.ID, lap.Client, s.lapCount())
+
+	s.endPause()
+	s.closeSegment()
+	s.isRunning = true
+	s.startTime = time.Now()
+	s.elapsed = 0
+	s.timeExpired = false
+	s.targetAlerts = 0
+	s.overtimeHooked = false
+	if s.startedAt.IsZero() {
+		s.startedAt = s.startTime
+	}
+
+	selfOrdering := s.settings.SelfOrdering
+	announcements := s.settings.Announcements
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	// Votes only ever count against the turn they were cast in
+	clear(s.skipVotes)
+	// The target may have left since the pass was checked
+	if _, ok := s.clients[passTo]; !ok {
+		passTo = ""
+	}
+	if len(s.clientOrder) > 1 {
+		s.stateMux.Lock()
+		roundDone := s.turnsCompleted >= len(s.clientOrder)-len(s.sittingOut)
+		if roundDone {
+			s.rankRound()
+			s.scoreRound()
+			s.roundStartLap = len(s.lapHistory)
+			s.closeSegment()
+			s.isRunning = false
+			s.elapsed = 0
+			s.lastLapTime = 0
+			s.lastLapClient = ""
+			s.turnsCompleted = 0
+			s.roundsDone++
+			go s.broadcastEvent(map[string]interface{}{
+				"type":  "roundComplete",
+				"round": s.roundsDone,
+			})
+			if s.settings.Rounds > 0 && s.roundsDone >= s.settings.Rounds {
+				s.finish("rounds")
+			}
+		}
+		s.stateMux.Unlock()
+
+		if roundDone {
+			// Late joiners who sat this round out take part in the next one
+			clear(s.sittingOut)
+		}
+		if passTo != "" {
+			s.activeClientID = passTo
+			s.withdrawClaim(passTo)
+			delete(s.sittingOut, passTo)
+			log.Printf("Session %s: Control passed by %s to %s\n", s.ID, clientID, passTo)
+			go s.broadcastEvent(map[string]interface{}{
+				"type": "turnPassed",
+				"from": clientID,
+				"to":   passTo,
+			})
+		} else if roundDone {
+			// The next round starts from the top of the order
+			s.activeClientID = s.clientOrder[0]
+			log.Printf("Session %s: All clients have had their turn. Timer stopped.\n", s.ID)
+		} else if selfOrdering && len(s.claimQueue) > 0 {
+			s.activeClientID = s.claimQueue[0]
+			s.claimQueue = s.claimQueue[1:]
+			log.Printf("Session %s: Control passed to first claimant: %s\n", s.ID, s.activeClientID)
+		} else {
+			currentIndex := -1
+			for i, id := range s.clientOrder {
+				if id == s.activeClientID {
+					currentIndex = i
+					break
+				}
+			}
+
+			if currentIndex != -1 {
+				s.activeClientID = s.nextInOrder(currentIndex)
+				log.Printf("Session %s: Control passed to next client: %s\n", s.ID, s.activeClientID)
+			} else {
+				log.Printf("Session %s: Active client ID not found in client order list.\n", s.ID)
+				if len(s.clientOrder) > 0 {
+					s.activeClientID = s.clientOrder[0]
+				} else {
+					s.activeClientID = ""
+				}
+			}
+		}
+		if s.activeClientID != clientID {
+			event := map[string]interface{}{
+				"type": "turnChanged",
+				"from": clientID,
+				"to":   s.activeClientID,
+			}
+			if announcements && s.activeClientID != "" {
+				event["announcement"] = announce("Next up: " + s.activeClientID)
+			}
+			go s.broadcastEvent(event)
+
+			s.stateMux.Lock()
+			if s.settings.HandoffConfirmMs > 0 && !roundDone && !s.finished {
+				s.offerHandoff(s.activeClientID)
+			}
+			s.stateMux.Unlock()
+		}
+	} else {
+		log.Printf("Session %s: Only one client connected, cannot pass control.\n", s.ID)
+		s.stateMux.Lock()
+		s.closeSegment()
+		s.isRunning = true
+		s.startTime = time.Now()
+		s.elapsed = 0
+		s.lastLapTime = 0
+		s.lastLapClient = ""
+		s.turnsCompleted = 0
+		s.stateMux.Unlock()
+	}
+	s.clientsMux.Unlock()
+
+	go s.broadcastState()
+}
+
+// remoteCommand runs a command from an integration as if the active client,
+// or the host in proxy-control mode, had sent it
+func (s *Session) remoteCommand(source string, command string) {
+	s.stateMux.Lock()
+	proxyControl := s.settings.ProxyControl
+	s.stateMux.Unlock()
+	s.clientsMux.Lock()
+	clientID := s.activeClientID
+	if proxyControl {
+		clientID = s.hostClientID
+	}
+	s.clientsMux.Unlock()
+	if clientID == "" {
+		return
+	}
+	log.Printf("Session %s: %s sent %s on behalf of %s\n", s.ID, source, command, clientID)
+	s.handleCommand(clientID, command)
+}
+
+// checkPassTarget reports whether the turn of clientID can be handed to target
+func (s *Session) checkPassTarget(clientID string, target string) error {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	c, ok := s.clients[target]
+	switch {
+	case target == "":
+		return errors.New("no client to pass to")
+	case !ok || c.device:
+		return fmt.Errorf("%q is not in this session", target)
+	case target == clientID:
+		return fmt.Errorf("%q already has the turn", target)
+	}
+	return nil
+}
+
+// maxPauseReason caps the length of a pause reason, in characters
+const maxPauseReason = 100
+
+// pauseTimer stops the clock and remembers why, stateMux must be held
+func (s *Session) pauseTimer(by string, reason string) {
+	if !s.isRunning {
+		return
+	}
+	s.closeSegment()
+	s.elapsed += time.Since(s.startTime)
+	s.isRunning = false
+
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxPauseReason {
+		reason = string([]rune(reason)[:maxPauseReason])
+	}
+	s.pauseReason = reason
+	s.pausedBy = by
+	s.pausedAt = time.Now()
+	log.Printf("Session %s: Timer paused by %q, reason: %q\n", s.ID, by, reason)
+}
+
+// endPause adds the pause that is ending to the paused total, stateMux must be held
+func (s *Session) endPause() {
+	if s.pausedAt.IsZero() {
+		return
+	}
+	s.pausedTotal += time.Since(s.pausedAt)
+	s.pauses = append(s.pauses, Pause{
+		By:         s.pausedBy,
+		Reason:     s.pauseReason,
+		At:         s.pausedAt,
+		DurationMs: time.Since(s.pausedAt).Milliseconds(),
+	})
+	s.pausedAt = time.Time{}
+	s.pauseReason = ""
+	s.pausedBy = ""
+}
+
+// pauseHistory lists every pause, the one in progress last, stateMux must be held
+func (s *Session) pauseHistory() []Pause {
+	pauses := append([]Pause{}, s.pauses...)
+	if !s.pausedAt.IsZero() {
+		pauses = append(pauses, Pause{
+			By:         s.pausedBy,
+			Reason:     s.pauseReason,
+			At:         s.pausedAt,
+			DurationMs: time.Since(s.pausedAt).Milliseconds(),
+			Ongoing:    true,
+		})
+	}
+	return pauses
+}
+
+// closeSegment adds the running stretch since startTime to activeTotal, stateMux must be held.
+// Call it before startTime moves or the timer stops.
+func (s *Session) closeSegment() {
+	if s.isRunning {
+		s.activeTotal += time.Since(s.startTime)
+	}
+}
+
+// activeTime returns how long the clock has been running in total, stateMux must be held
+func (s *Session) activeTime() time.Duration {
+	if s.isRunning {
+		return s.activeTotal + time.Since(s.startTime)
+	}
+	return s.activeTotal
+}
+
+// wallClockTime returns the time since the timer first started, stateMux must be held
+func (s *Session) wallClockTime() time.Duration {
+	if s.startedAt.IsZero() {
+		return 0
+	}
+	if s.finished {
+		return s.summary.FinishedAt.Sub(s.startedAt)
+	}
+	return time.Since(s.startedAt)
+}
+
+// pausedTime returns the total time spent paused so far, stateMux must be held
+func (s *Session) pausedTime() time.Duration {
+	if s.pausedAt.IsZero() {
+		return s.pausedTotal
+	}
+	return s.pausedTotal + time.Since(s.pausedAt)
+}
+
+// targetWarningRatio is the share of the target turn length that triggers a warning
+const targetWarningRatio = 0.8
+
+// checkTarget warns the session when the active client nears and then passes
+// the target turn length
+func (s *Session) checkTarget() {
+	s.stateMux.Lock()
+	target := time.Duration(s.settings.TargetMs) * time.Millisecond
+	if target == 0 || !s.isRunning || s.targetAlerts == 2 {
+		s.stateMux.Unlock()
+		return
+	}
+	turn := s.currentTurn()
+	var eventType string
+	switch {
+	case s.targetAlerts == 0 && turn >= time.Duration(float64(target)*targetWarningRatio) && turn < target:
+		eventType = "warning"
+		s.targetAlerts = 1
+	case turn >= target:
+		eventType = "overtime"
+		s.targetAlerts = 2
+	default:
+		s.stateMux.Unlock()
+		return
+	}
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	activeClientID := s.activeClientID
+	s.clientsMux.Unlock()
+
+	s.broadcastEvent(map[string]interface{}{
+		"type":      eventType,
+		"client":    activeClientID,
+		"elapsedMs": turn.Milliseconds(),
+		"targetMs":  target.Milliseconds(),
+	})
+}
+
+// currentRound returns the 1-based round in progress, stateMux must be held
+func (s *Session) currentRound() int {
+	if s.settings.Rounds > 0 {
+		return min(s.roundsDone+1, s.settings.Rounds)
+	}
+	return s.roundsDone + 1
+}
+
+// resetTimer clears the timer and lap history, stateMux must be held.
+// Best-of-N scores are kept, they span the whole session.
+func (s *Session) resetTimer() {
+	s.endPause()
+	s.closeSegment()
+	s.isRunning = false
+	s.elapsed = 0
+	s.lastLapTime = 0
+	s.lastLapClient = ""
+	s.lapHistory = []Lap{}
+	s.lapsDropped = 0
+	s.droppedTotals = nil
+	s.lapEdits = nil
+	s.splits = nil
+	s.handoff = nil
+	s.handoffMisses = 0
+	s.turnsCompleted = 0
+	s.roundsDone = 0
+	s.roundStartLap = 0
+	s.ranking = nil
+	s.timeExpired = false
+	s.targetAlerts = 0
+	s.overtimeHooked = false
+	s.idlePaused = false
+	s.bankUsed = make(map[string]time.Duration)
+	s.bankExpired = make(map[string]bool)
+	s.overtime = make(map[string]time.Duration)
+}
+
+// checkCountdown announces when the active client's countdown runs out and
+// passes the turn on if the session auto-advances
+func (s *Session) checkCountdown() {
+	s.stateMux.Lock()
+	countdown := time.Duration(s.settings.CountdownMs) * time.Millisecond
+	if countdown == 0 || !s.isRunning || s.timeExpired || s.finished {
+		s.stateMux.Unlock()
+		return
+	}
+	if s.elapsed+time.Since(s.startTime) < countdown {
+		s.stateMux.Unlock()
+		return
+	}
+	s.timeExpired = true
+	autoAdvance := s.settings.AutoAdvance
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	activeClientID := s.activeClientID
+	s.clientsMux.Unlock()
+
+	log.Printf("Session %s: Time expired for %s\n", s.ID, activeClientID)
+	s.broadcastEvent(map[string]interface{}{
+		"type":   "timeExpired",
+		"client": activeClientID,
+	})
+	if autoAdvance && activeClientID != "" {
+		s.advanceTurn(activeClientID, "", endForced)
+	}
+}
+
+// checkTurnLimit ends the active client's turn once it runs past the hard
+// turn limit, so a distracted speaker can't stall the table
+func (s *Session) checkTurnLimit() {
+	s.stateMux.Lock()
+	limit := time.Duration(s.settings.TurnLimitMs) * time.Millisecond
+	if limit == 0 || !s.isRunning || s.finished {
+		s.stateMux.Unlock()
+		return
+	}
+	if s.elapsed+time.Since(s.startTime) < limit {
+		s.stateMux.Unlock()
+		return
+	}
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	activeClientID := s.activeClientID
+	s.clientsMux.Unlock()
+	if activeClientID == "" {
+		return
+	}
+
+	log.Printf("Session %s: Turn limit reached for %s, advancing\n", s.ID, activeClientID)
+	s.broadcastEvent(map[string]interface{}{
+		"type":    "turnLimitReached",
+		"client":  activeClientID,
+		"limitMs": limit.Milliseconds(),
+	})
+	s.advanceTurn(activeClientID, "", endForced)
+}
+
+// resolvePending executes or discards the command waiting for confirmation
+func (s *Session) resolvePending(hostID string, confirmed bool) {
+	s.stateMux.Lock()
+	pending := s.pending
+	s.pending = nil
+	if pending == nil {
+		s.stateMux.Unlock()
+		log.Printf("Session %s: Host %s answered but nothing is pending\n", s.ID, hostID)
+		return
+	}
+	if confirmed {
+		switch pending.Command {
+		case "reset":
+			s.resetTimer()
+		}
+		log.Printf("Session %s: Host %s confirmed %s\n", s.ID, hostID, pending.Command)
+	} else {
+		log.Printf("Session %s: Host %s cancelled %s\n", s.ID, hostID, pending.Command)
+	}
+	s.stateMux.Unlock()
+
+	event := map[string]interface{}{
+		"type":      "confirmationResolved",
+		"command":   pending.Command,
+		"confirmed": confirmed,
+	}
+	go s.broadcastEvent(event)
+	go s.broadcastState()
+}
+
+// expirePending drops a pending command the host did not answer in time
+func (s *Session) expirePending() {
+	s.stateMux.Lock()
+	pending := s.pending
+	if pending == nil || time.Now().Before(pending.expiresAt) {
+		s.stateMux.Unlock()
+		return
+	}
+	s.pending = nil
+	s.stateMux.Unlock()
+
+	log.Printf("Session %s: Confirmation for %s expired\n", s.ID, pending.Command)
+	s.broadcastEvent(map[string]interface{}{
+		"type":      "confirmationResolved",
+		"command":   pending.Command,
+		"confirmed": false,
+		"expired":   true,
+	})
+}
+
+// stateMessage builds the update payload shared by every client in this session
+func (s *Session) stateMessage() map[string]interface{} {
+	s.clientsMux.Lock()
+	clientIDs := make([]string, 0, len(s.clients))
+	offlineIDs := []string{}
+	for id, client := range s.clients {
+		if client.device {
+			continue
+		}
+		clientIDs = append(clientIDs, id)
+		if client.offline {
+			offlineIDs = append(offlineIDs, id)
+		}
+	}
+	// Unclaimed slots are listed in turn order, the order they were registered in
+	unclaimedIDs := []string{}
+	for _, id := range s.clientOrder {
+		if client, ok := s.clients[id]; ok && client.offline && client.rosterSlot {
+			unclaimedIDs = append(unclaimedIDs, id)
+		}
+	}
+	activeClient := s.activeClientID
+	host := s.hostClientID
+	claimQueue := append([]string{}, s.claimQueue...)
+	upNext := s.upNext()
+	roster := s.lobbyRoster()
+	s.stateMux.Lock()
+	readyCheck := s.readyCheck()
+	skipVotes := s.skipVoteTally()
+	s.stateMux.Unlock()
+	glanceTokens := make(map[string]string, len(s.glanceTokens))
+	for id, token := range s.glanceTokens {
+		glanceTokens[id] = token
+	}
+	sittingOut := make([]string, 0, len(s.sittingOut))
+	for id := range s.sittingOut {
+		sittingOut = append(sittingOut, id)
 	}
 	s.clientsMux.Unlock()
 
@@ -482,34 +1990,226 @@ func (s *Session) sendStateToClient(c *Client) {
 	} else {
 		total = s.elapsed
 	}
-	ms := total.Milliseconds()
-	lapMs := s.lastLapTime.Milliseconds()
-	lapClient := s.lastLapClient
-	history := s.lapHistory
-
-	clientIDs := make([]string, 0, len(currentClients))
-	for id := range currentClients {
-		clientIDs = append(clientIDs, id)
-	}
 
 	msg := map[string]interface{}{
 		"type":          "update",
-		"time":          ms,
-		"lapTime":       lapMs,
-		"lastLapClient": lapClient,
-		"lapHistory":    history,
-		"activeClient":  s.activeClientID,
-		"yourId":        c.id,
+		"time":          total.Milliseconds(),
+		"lapTime":       s.lastLapTime.Milliseconds(),
+		"running":       s.isRunning,
+		"lastLapClient": s.lastLapClient,
+		"lapHistory":    s.recentLaps(),
+		"lapCount":      s.lapCount(),
+		"activeClient":  activeClient,
+		"host":          host,
 		"clients":       clientIDs,
+		"offline":       offlineIDs,
+		"unclaimed":     unclaimedIDs,
+		"claimQueue":    claimQueue,
+		"sittingOut":    sittingOut,
+		"settings":      s.settings.public(),
+		"finished":      s.finished,
+		"readOnly":      s.readOnly,
+		"migrating":     s.migrated,
+		"round":         s.currentRound(),
+		"title":         s.title(),
+		"shortLink":     "/j/" + s.shortCode,
+		"idlePaused":    s.idlePaused,
+		"pauseReason":   s.pauseReason,
+		"pausedBy":      s.pausedBy,
+		"pauses":        s.pauseHistory(),
+		"wallClockMs":   s.wallClockTime().Milliseconds(),
+		"activeMs":      s.activeTime().Milliseconds(),
+		"pausedMs":      s.pausedTime().Milliseconds(),
+		"glanceTokens":  glanceTokens, // personalState keeps only the client's own
+	}
+	if s.summary != nil {
+		msg["summary"] = s.summary
+	}
+	status := s.statusLine(activeClient, upNext, total)
+	msg["statusText"] = status.text(s.settings.Language, true)
+	if s.settings.TimeBankMs > 0 {
+		msg["timeBanks"] = s.timeBankStates(clientIDs, activeClient)
+	}
+	if s.settings.WorkMs > 0 {
+		msg["phase"] = s.phase
+		msg["phaseRemainingMs"] = s.phaseRemaining().Milliseconds()
+	}
+	if s.settings.CountdownMs > 0 {
+		// remainingMs stops at zero for the clients that expect it to, the
+		// signed one goes negative once the countdown has run out and the
+		// turn goes on
+		remaining := time.Duration(s.settings.CountdownMs)*time.Millisecond - total
+		msg["remainingMs"] = max(remaining, 0).Milliseconds()
+		msg["signedRemainingMs"] = remaining.Milliseconds()
+		msg["overtimeMs"] = s.overtimeStates(activeClient, total)
+	}
+	if s.settings.Simultaneous {
+		msg["personalTimers"] = s.personalTimerStates()
+	}
+	if len(s.handicaps) > 0 {
+		msg["handicaps"] = s.handicapStates()
+	}
+	if s.settings.BestOf > 0 {
+		msg["scores"] = s.scoreStates()
+		if s.winners != nil {
+			msg["winners"] = s.winners
+		}
+	}
+	if s.settings.GuessTargetMs > 0 {
+		// personalState strips the clock from the active client's copy
+		msg["hiddenFrom"] = activeClient
+		msg["hiddenStatusText"] = status.text(s.settings.Language, false)
+		if s.ranking != nil {
+			msg["ranking"] = s.ranking
+		}
+	}
+	if s.settings.IndividualTimers {
+		msg["personalTimers"] = s.personalTimerStates()
+		msg["focusPhase"] = s.focusPhase
+		if s.focusSummary != nil {
+			msg["focusSummary"] = s.focusSummary
+		}
+	}
+	if len(s.timers) > 0 {
+		msg["timers"] = s.namedTimerStates()
+	}
+	if len(s.splits) > 0 {
+		msg["splits"] = append([]Split{}, s.splits...)
+	}
+	if readyCheck != nil {
+		msg["readyCheck"] = readyCheck
+	}
+	if skipVotes != nil {
+		msg["skipVotes"] = skipVotes
+	}
+	if !s.autoStartAt.IsZero() {
+		msg["autoStartInMs"] = max(time.Until(s.autoStartAt), 0).Milliseconds()
+	}
+	if s.waiting() {
+		msg["waiting"] = true
+		msg["startAt"] = s.startAt
+		msg["startsInMs"] = max(time.Until(s.startAt), 0).Milliseconds()
+		msg["lobby"] = s.lobby(roster)
+	}
+	if s.handoff != nil {
+		handoff := *s.handoff
+		handoff.ExpiresInMs = time.Until(handoff.expiresAt).Milliseconds()
+		msg["handoff"] = handoff
+	}
+	if s.pending != nil {
+		pending := *s.pending
+		pending.ExpiresInMs = time.Until(pending.expiresAt).Milliseconds()
+		msg["pendingConfirmation"] = pending
+	}
+	if notice := currentServerNotice(); notice != nil {
+		msg["serverNotice"] = notice
+	}
+	// Under stateMux, so the log sees the states in order
+	s.events.observe(msg)
+	return msg
+}
+
+// broadcastState sends the current timer value, active client ID, lap time, and own client ID to all clients in this session
+func (s *Session) broadcastState() {
+	s.broadcasts.Add(1)
+	baseMsg := s.stateMessage()
+
+	s.clientsMux.Lock()
+	currentClients := make(map[string]*Client, len(s.clients))
+	for id, client := range s.clients {
+		if !client.offline {
+			currentClients[id] = client
+		}
+	}
+	s.clientsMux.Unlock()
+
+	for id, c := range currentClients {
+		data, err := json.Marshal(translateState(personalState(baseMsg, id), int(c.protocol.Load())))
+		if err != nil {
+			log.Printf("Session %s: json marshal error for client %s: %v\n", s.ID, id, err)
+			continue
+		}
+
+		s.sendQueued(c, data)
 	}
-	data, err := json.Marshal(msg)
+}
+
+// broadcastEvent sends a one-off event message to every client in this session
+func (s *Session) broadcastEvent(event map[string]interface{}) {
+	s.broadcasts.Add(1)
+	data, err := json.Marshal(s.withCue(event))
+	if err != nil {
+		log.Printf("Session %s: json marshal error for event %v: %v\n", s.ID, event["type"], err)
+		return
+	}
+	s.events.event(event, data)
+
+	s.clientsMux.Lock()
+	currentClients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		if !client.offline {
+			currentClients = append(currentClients, client)
+		}
+	}
+	s.clientsMux.Unlock()
+
+	for _, c := range currentClients {
+		s.sendQueued(c, data)
+	}
+	s.publishMQTTEvent(data)
+	if eventType, _ := event["type"].(string); eventType != "" {
+		s.triggerLights(eventType)
+	}
+}
+
+// sendEvent sends a one-off event message to a single client in this session
+func (s *Session) sendEvent(clientID string, event map[string]interface{}) {
+	s.clientsMux.Lock()
+	c, exists := s.clients[clientID]
+	s.clientsMux.Unlock()
+	if !exists || c.offline {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Session %s: json marshal error for event %v: %v\n", s.ID, event["type"], err)
+		return
+	}
+	if err := c.send(data); err != nil {
+		log.Printf("Session %s: write error for client %s: %v\n", s.ID, clientID, err)
+	}
+}
+
+// sendStateToClient sends the current timer value, active client ID, lap time, and own client ID to a specific client in this session
+func (s *Session) sendStateToClient(c *Client) {
+	data, err := json.Marshal(translateState(personalState(s.stateMessage(), c.id), int(c.protocol.Load())))
 	if err != nil {
 		log.Printf("Session %s: json marshal error for client %s: %v\n", s.ID, c.id, err)
 		return
 	}
 
-	err = c.conn.WriteMessage(websocket.TextMessage, data)
+	err = c.send(data)
 	if err != nil {
 		log.Printf("Session %s: write error for client %s: %v\n", s.ID, c.id, err)
 	}
 }
+
+// send writes a message to the client, serializing concurrent writers
+func (c *Client) send(data []byte) error {
+	if chaos != nil {
+		if err := chaos.outgoing(c); err != nil {
+			return err
+		}
+	}
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// close sends a close frame with the given code before the connection is dropped
+func (c *Client) close(code int, reason string) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	return c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
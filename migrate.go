@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// A binary can be rolled without stopping anyone's clock by migrating its
+// sessions: POST /admin/api/drain with {"migrate": true} freezes every
+// session, answers with their snapshots and exits as the drain does, with
+// nothing left active. POST the migration from that answer to
+// /admin/api/migration on the new instance, running clocks carry on from
+// where they were frozen. Pages reload once their connection drops and find
+// the session again on whichever instance serves it, claiming back their
+// place in the turn order by name.
+//
+// The migration is also written to PASTATIME_MIGRATION_PATH before the
+// answer goes out, so a lost answer doesn't lose the sessions; without it
+// a migration needs persistence to be on. Calling the drain off with DELETE
+// unfreezes the sessions.
+
+// migrationPath is where a migration is written, set with
+// PASTATIME_MIGRATION_PATH
+var migrationPath string
+
+// maxMigrationSize caps the body of a migration, every session of an instance
+const maxMigrationSize = 256 << 20
+
+// Migration is the sessions an instance handed over
+type Migration struct {
+	ExportedAt time.Time         `json:"exportedAt"`
+	Sessions   []MigratedSession `json:"sessions"`
+}
+
+// MigratedSession is a session and whose turn it was
+type MigratedSession struct {
+	Session sessionSnapshot `json:"session"`
+	// Roster is the turn order, participants only, as in SessionExport
+	Roster []string `json:"roster"`
+	// ActiveClient is whose turn a running clock belongs to
+	ActiveClient string `json:"activeClient,omitempty"`
+}
+
+// MigrationResult is what the new instance did with a migration
+type MigrationResult struct {
+	Imported []string `json:"imported"`
+	// Skipped sessions already exist here or couldn't be rebuilt
+	Skipped []string `json:"skipped"`
+}
+
+// migrateSessions freezes every session, telling its clients, and
+// snapshots them. Once frozen they refuse commands and no longer hold up
+// a drain.
+func migrateSessions(deadline time.Time) Migration {
+	migration := Migration{ExportedAt: time.Now(), Sessions: []MigratedSession{}}
+	for _, session := range sessionStore.List() {
+		session.stateMux.Lock()
+		session.migrated = true
+		session.stateMux.Unlock()
+		migrated := MigratedSession{Session: session.snapshot()}
+		session.clientsMux.Lock()
+		migrated.Roster = append([]string{}, session.clientOrder...)
+		migrated.ActiveClient = session.activeClientID
+		session.clientsMux.Unlock()
+		migration.Sessions = append(migration.Sessions, migrated)
+		session.broadcastEvent(map[string]interface{}{
+			"type":     "serverMigrating",
+			"deadline": deadline.UnixMilli(),
+		})
+		session.broadcastState()
+	}
+	log.Printf("Migrating %d sessions\n", len(migration.Sessions))
+	return migration
+}
+
+// writeMigration keeps a copy of the migration at migrationPath
+func writeMigration(migration Migration) error {
+	data, err := json.Marshal(migration)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(migrationPath, data); err != nil {
+		return err
+	}
+	log.Printf("Migration written to %s\n", migrationPath)
+	return nil
+}
+
+// unfreezeSessions takes back the sessions of a migration that was called
+// off, they answer commands again
+func unfreezeSessions() {
+	for _, session := range sessionStore.List() {
+		session.stateMux.Lock()
+		migrated := session.migrated
+		session.migrated = false
+		session.stateMux.Unlock()
+		if !migrated {
+			continue
+		}
+		log.Printf("Session %s: Migration called off\n", session.ID)
+		session.broadcastEvent(map[string]interface{}{"type": "serverMigrationCancelled"})
+		session.broadcastState()
+	}
+}
+
+// importMigration rebuilds the sessions of a migration, resuming the
+// clocks that were running
+func importMigration(migration Migration) MigrationResult {
+	result := MigrationResult{Imported: []string{}, Skipped: []string{}}
+	// An exporting instance with its clock ahead would make time run backwards
+	resumeAt := migration.ExportedAt
+	if now := time.Now(); resumeAt.After(now) {
+		resumeAt = now
+	}
+	for _, migrated := range migration.Sessions {
+		snapshot := migrated.Session
+		// The ID names the session's event log file, so it can't be trusted
+		// any more than an import's
+		if !validSessionID(snapshot.ID) || !validShortCode(snapshot.ShortCode) {
+			log.Printf("Session %q: Not migrated, its ID or short code is invalid\n", snapshot.ID)
+			result.Skipped = append(result.Skipped, snapshot.ID)
+			continue
+		}
+		if _, exists := sessionStore.Get(snapshot.ID); exists {
+			log.Printf("Session %s: Not migrated, it already exists\n", snapshot.ID)
+			result.Skipped = append(result.Skipped, snapshot.ID)
+			continue
+		}
+		session, err := restoreSession(snapshot)
+		if err != nil {
+			log.Printf("Session %s: Migrating failed: %v\n", snapshot.ID, err)
+			result.Skipped = append(result.Skipped, snapshot.ID)
+			continue
+		}
+		if err := session.restoreRoster(migrated.Roster); err != nil {
+			log.Printf("Session %s: Migrating failed: %v\n", snapshot.ID, err)
+			result.Skipped = append(result.Skipped, snapshot.ID)
+			continue
+		}
+		// The clock only carries on with the same person's turn, the time it
+		// took to hand the session over counts as running
+		session.clientsMux.Lock()
+		if slices.Contains(session.clientOrder, migrated.ActiveClient) {
+			session.activeClientID = migrated.ActiveClient
+		}
+		resume := migrated.ActiveClient != "" && session.activeClientID == migrated.ActiveClient
+		session.clientsMux.Unlock()
+		if snapshot.Running && !snapshot.Finished && resume {
+			session.isRunning = true
+			session.startTime = resumeAt
+		}
+		if err := session.registerSession(); err != nil {
+			log.Printf("Session %s: Migrating failed: %v\n", snapshot.ID, err)
+			result.Skipped = append(result.Skipped, snapshot.ID)
+			continue
+		}
+		log.Printf("Session %s: Migrated with %d laps, running: %v\n", session.ID, len(session.lapHistory), session.isRunning)
+		result.Imported = append(result.Imported, session.ID)
+	}
+	return result
+}
+
+// handleAdminMigration serves POST /admin/api/migration with the migration
+// another instance answered its drain with
+func handleAdminMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var migration Migration
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMigrationSize)).Decode(&migration); err != nil {
+		http.Error(w, "Invalid migration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := importMigration(migration)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
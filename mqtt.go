@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The MQTT bridge publishes every session for home automation, laid out the
+// way Home Assistant's MQTT discovery expects:
+//
+//	pastatime/{session}/state    retained JSON, sent when it changes
+//	pastatime/{session}/event    the events clients get, e.g. overtime
+//	pastatime/{session}/command  "start", "pause", "next" or "skip", or
+//	                             {"command": "next"} like a service call
+//	homeassistant/{component}/pastatime_{session}_{entity}/config
+//
+// Only QoS 0 is used, a missed state is replaced by the next one.
+
+const (
+	mqttKeepAlive      = 60 * time.Second
+	mqttReconnectDelay = 5 * time.Second
+	mqttDialTimeout    = 5 * time.Second
+	// mqttWriteTimeout drops a connection the broker stopped reading from
+	mqttWriteTimeout = 5 * time.Second
+	// mqttOutboxSize is how many messages wait for a slow broker before new
+	// ones are dropped, the retained ones still go out on the next connection
+	mqttOutboxSize = 256
+)
+
+// mqttCommands are the commands the bridge accepts, the ones a wall switch
+// or an automation can sensibly press
+var mqttCommands = map[string]bool{
+	"start": true,
+	"pause": true,
+	"next":  true,
+	"skip":  true,
+}
+
+// mqttBridge is a minimal MQTT 3.1.1 client that reconnects on its own
+type mqttBridge struct {
+	broker          string
+	username        string
+	password        string
+	prefix          string
+	discoveryPrefix string
+	clientID        string
+
+	mu       sync.Mutex // guards conn, retained and writes
+	conn     net.Conn
+	retained map[string][]byte // republished after a reconnect
+	outbox   chan mqttMessage  // written by send, so publishing never waits on the broker
+}
+
+// mqttMessage is a PUBLISH waiting in the outbox
+type mqttMessage struct {
+	header byte
+	topic  string
+	body   []byte
+}
+
+var mqtt *mqttBridge
+
+// mqttBridgeFromEnv connects to PASTATIME_MQTT_BROKER (host:port) if set,
+// with optional PASTATIME_MQTT_USERNAME, PASTATIME_MQTT_PASSWORD and
+// PASTATIME_MQTT_PREFIX
+func mqttBridgeFromEnv() *mqttBridge {
+	broker := os.Getenv("PASTATIME_MQTT_BROKER")
+	if broker == "" {
+		return nil
+	}
+	prefix := os.Getenv("PASTATIME_MQTT_PREFIX")
+	if prefix == "" {
+		prefix = "pastatime"
+	}
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	b := &mqttBridge{
+		broker:          broker,
+		username:        os.Getenv("PASTATIME_MQTT_USERNAME"),
+		password:        os.Getenv("PASTATIME_MQTT_PASSWORD"),
+		prefix:          prefix,
+		discoveryPrefix: "homeassistant",
+		clientID:        "pastatime-" + hex.EncodeToString(buf),
+		retained:        make(map[string][]byte),
+		outbox:          make(chan mqttMessage, mqttOutboxSize),
+	}
+	go b.run()
+	go b.send()
+	log.Printf("MQTT bridge publishing to %s under %s/\n", broker, prefix)
+	return b
+}
+
+// run keeps the bridge connected, reading commands until the connection drops
+func (b *mqttBridge) run() {
+	for {
+		conn, r, err := b.connect()
+		if err != nil {
+			log.Printf("MQTT: %v, retrying in %v\n", err, mqttReconnectDelay)
+			time.Sleep(mqttReconnectDelay)
+			continue
+		}
+		done := make(chan struct{})
+		go b.ping(conn, done)
+		err = b.read(conn, r)
+		close(done)
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+		conn.Close()
+		log.Printf("MQTT: connection lost: %v\n", err)
+	}
+}
+
+// connect opens a session with the broker, subscribes to the command topics
+// and republishes the retained messages
+func (b *mqttBridge) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.broker, mqttDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02) // clean session
+	if b.username != "" {
+		flags |= 0x80
+	}
+	if b.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags) // protocol level 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive.Seconds()))
+	body = appendMQTTString(body, b.clientID)
+	if b.username != "" {
+		body = appendMQTTString(body, b.username)
+	}
+	if b.password != "" {
+		body = appendMQTTString(body, b.password)
+	}
+	if err := writeMQTTDeadline(conn, 0x10, body); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	r := bufio.NewReader(conn)
+	kind, ack, err := readMQTTPacket(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if kind>>4 != 2 || len(ack) < 2 || ack[1] != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("broker refused the connection (code %v)", ack)
+	}
+
+	// One wildcard subscription covers the sessions created later too
+	var sub []byte
+	sub = binary.BigEndian.AppendUint16(sub, 1)
+	sub = appendMQTTString(sub, b.prefix+"/+/command")
+	sub = append(sub, 0)
+	if err := writeMQTTDeadline(conn, 0x82, sub); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic, payload := range b.retained {
+		writeMQTTDeadline(conn, 0x31, append(appendMQTTString(nil, topic), payload...))
+	}
+	b.conn = conn
+	log.Printf("MQTT: connected to %s\n", b.broker)
+	return conn, r, nil
+}
+
+// ping keeps an idle connection open
+func (b *mqttBridge) ping(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			writeMQTTDeadline(conn, 0xC0, nil)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// read dispatches the commands published to the bridge
+func (b *mqttBridge) read(conn net.Conn, r *bufio.Reader) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 2))
+		kind, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		if kind>>4 != 3 || len(body) < 2 {
+			continue // SUBACK and PINGRESP need no answer
+		}
+		topicLength := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+topicLength {
+			return errors.New("malformed PUBLISH")
+		}
+		topic := string(body[2 : 2+topicLength])
+		payload := body[2+topicLength:]
+		if qos := (kind >> 1) & 0x03; qos > 0 {
+			payload = payload[min(2, len(payload)):] // skip the packet ID
+		}
+		b.handleCommand(topic, payload)
+	}
+}
+
+// handleCommand runs a command published on pastatime/{session}/command
+func (b *mqttBridge) handleCommand(topic string, payload []byte) {
+	sessionID := strings.TrimSuffix(strings.TrimPrefix(topic, b.prefix+"/"), "/command")
+	command := strings.TrimSpace(string(payload))
+	var call struct {
+		Command string `json:"command"`
+	}
+	if json.Unmarshal(payload, &call) == nil && call.Command != "" {
+		command = call.Command
+	}
+	if !mqttCommands[command] {
+		log.Printf("MQTT: Ignoring command %q for session %s\n", command, sessionID)
+		return
+	}
+
+	session, exists := sessionStore.Get(sessionID)
+	if !exists {
+		log.Printf("MQTT: Command %q for unknown session %s\n", command, sessionID)
+		return
+	}
+
+	session.remoteCommand("MQTT", command)
+}
+
+// publish queues a message for the broker, retained ones are also kept for
+// the next connection. An empty retained payload clears the topic.
+func (b *mqttBridge) publish(topic string, payload []byte, retain bool) {
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+		b.mu.Lock()
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+		b.mu.Unlock()
+	}
+	select {
+	case b.outbox <- mqttMessage{header, topic, payload}:
+	default:
+		log.Printf("MQTT: broker is too slow, dropping a message to %s\n", topic)
+	}
+}
+
+// send writes the queued messages while the bridge is connected, a write
+// that times out drops the connection and run reconnects
+func (b *mqttBridge) send() {
+	for message := range b.outbox {
+		b.mu.Lock()
+		// A retained message that was replaced while it waited went out
+		// with the newer one on a reconnect
+		stale := message.header&0x01 != 0 && !bytes.Equal(b.retained[message.topic], message.body)
+		if b.conn != nil && !stale {
+			if err := writeMQTTDeadline(b.conn, message.header, append(appendMQTTString(nil, message.topic), message.body...)); err != nil {
+				log.Printf("MQTT: publish to %s failed: %v\n", message.topic, err)
+				b.conn.Close()
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// mqttEntity is one Home Assistant entity of a session
+type mqttEntity struct {
+	component string
+	entity    string
+	config    map[string]interface{}
+}
+
+// announceSession publishes the Home Assistant discovery configs of a session
+func (b *mqttBridge) announceSession(s *Session) {
+	device := map[string]interface{}{
+		"identifiers": []string{"pastatime_" + s.ID},
+		"name":        "Pastatime " + s.ID,
+		"model":       "Pastatime session",
+	}
+	for _, e := range b.entities(s.ID) {
+		e.config["unique_id"] = b.uniqueID(s.ID, e)
+		e.config["device"] = device
+		data, err := json.Marshal(e.config)
+		if err != nil {
+			continue
+		}
+		b.publish(b.discoveryTopic(s.ID, e), data, true)
+	}
+}
+
+// forgetSession clears the retained state and discovery configs of a retired
+// session, so Home Assistant drops its entities
+func (b *mqttBridge) forgetSession(s *Session) {
+	for _, e := range b.entities(s.ID) {
+		b.publish(b.discoveryTopic(s.ID, e), nil, true)
+	}
+	b.publish(b.prefix+"/"+s.ID+"/state", nil, true)
+}
+
+func (b *mqttBridge) uniqueID(sessionID string, e mqttEntity) string {
+	return "pastatime_" + sessionID + "_" + e.entity
+}
+
+func (b *mqttBridge) discoveryTopic(sessionID string, e mqttEntity) string {
+	return b.discoveryPrefix + "/" + e.component + "/" + b.uniqueID(sessionID, e) + "/config"
+}
+
+// entities lists what a session shows up as in Home Assistant
+func (b *mqttBridge) entities(sessionID string) []mqttEntity {
+	base := b.prefix + "/" + sessionID
+	return []mqttEntity{
+		{"sensor", "speaker", map[string]interface{}{
+			"name":           "Speaker",
+			"state_topic":    base + "/state",
+			"value_template": "{{ value_json.speaker }}",
+			"icon":           "mdi:account-voice",
+		}},
+		{"binary_sensor", "running", map[string]interface{}{
+			"name":           "Running",
+			"state_topic":    base + "/state",
+			"value_template": "{{ 'ON' if value_json.running else 'OFF' }}",
+			"device_class":   "running",
+		}},
+		{"binary_sensor", "overtime", map[string]interface{}{
+			"name":           "Overtime",
+			"state_topic":    base + "/state",
+			"value_template": "{{ 'ON' if value_json.overtime else 'OFF' }}",
+			"device_class":   "problem",
+		}},
+		{"button", "next", map[string]interface{}{
+			"name":          "Next",
+			"command_topic": base + "/command",
+			"payload_press": "next",
+		}},
+		{"button", "pause", map[string]interface{}{
+			"name":          "Pause",
+			"command_topic": base + "/command",
+			"payload_press": "pause",
+		}},
+	}
+}
+
+// mqttState is the retained state of a session, it leaves the clock out so
+// it only changes when something worth automating happens
+type mqttState struct {
+	Speaker  string `json:"speaker"`
+	Running  bool   `json:"running"`
+	Overtime bool   `json:"overtime"`
+	Finished bool   `json:"finished"`
+}
+
+// publishMQTTState sends the session's state to the bridge when it changed
+func (s *Session) publishMQTTState() {
+	if mqtt == nil {
+		return
+	}
+	s.clientsMux.Lock()
+	state := mqttState{Speaker: s.activeClientID}
+	s.clientsMux.Unlock()
+	s.stateMux.Lock()
+	state.Running = s.isRunning
+	state.Overtime = s.timeExpired || s.targetAlerts == 2
+	state.Finished = s.finished
+	changed := state != s.mqttState
+	s.mqttState = state
+	s.stateMux.Unlock()
+
+	if changed {
+		data, _ := json.Marshal(state)
+		mqtt.publish(mqtt.prefix+"/"+s.ID+"/state", data, true)
+	}
+}
+
+// publishMQTTEvent forwards an event to the bridge
+func (s *Session) publishMQTTEvent(data []byte) {
+	if mqtt == nil {
+		return
+	}
+	mqtt.publish(mqtt.prefix+"/"+s.ID+"/event", data, false)
+}
+
+// appendMQTTString appends s with its 2-byte length prefix
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// writeMQTTPacket writes a control packet with its variable-length size
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// writeMQTTDeadline writes a control packet, giving up after mqttWriteTimeout
+func writeMQTTDeadline(conn net.Conn, header byte, body []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return writeMQTTPacket(conn, header, body)
+}
+
+// readMQTTPacket reads one control packet, returning its header byte and body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
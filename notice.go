@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Operators can put a banner in front of every client of every session,
+// say before a restart, with POST /admin/api/notice. It is broadcast at once
+// and stays in the state clients get, so people joining later see it too,
+// until it is cleared with DELETE or its shutdown time has passed.
+
+const maxNoticeLength = 500
+
+// ServerNotice is the banner shown to every client
+type ServerNotice struct {
+	Message    string     `json:"message"`
+	PostedAt   time.Time  `json:"postedAt"`
+	ShutdownAt *time.Time `json:"shutdownAt,omitempty"`
+	// ShutdownInMs is filled in when the notice is sent out
+	ShutdownInMs int64 `json:"shutdownInMs,omitempty"`
+}
+
+var (
+	serverNoticeMux sync.Mutex
+	serverNotice    *ServerNotice
+)
+
+// currentServerNotice returns a copy of the notice to send out, nil
+// when there is none or its shutdown time has passed
+func currentServerNotice() *ServerNotice {
+	serverNoticeMux.Lock()
+	defer serverNoticeMux.Unlock()
+	if serverNotice == nil {
+		return nil
+	}
+	current := *serverNotice
+	if current.ShutdownAt != nil {
+		current.ShutdownInMs = time.Until(*current.ShutdownAt).Milliseconds()
+		if current.ShutdownInMs <= 0 {
+			return nil
+		}
+	}
+	return &current
+}
+
+// postServerNotice replaces the notice, nil clears it, and tells every
+// session
+func postServerNotice(next *ServerNotice) {
+	serverNoticeMux.Lock()
+	serverNotice = next
+	serverNoticeMux.Unlock()
+
+	event := map[string]interface{}{"type": "serverNoticeCleared"}
+	if current := currentServerNotice(); current != nil {
+		event = map[string]interface{}{"type": "serverNotice", "serverNotice": current}
+	}
+	for _, session := range sessionStore.List() {
+		go session.broadcastEvent(event)
+	}
+}
+
+// handleAdminNotice serves /admin/api/notice: GET for the current one, POST
+// {"message": "...", "shutdownAt": "..."} to post one and DELETE to clear it
+func handleAdminNotice(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Message    string     `json:"message"`
+			ShutdownAt *time.Time `json:"shutdownAt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if body.Message == "" || utf8.RuneCountInString(body.Message) > maxNoticeLength {
+			http.Error(w, "message should be 1 to 500 characters", http.StatusBadRequest)
+			return
+		}
+		if body.ShutdownAt != nil && !body.ShutdownAt.After(time.Now()) {
+			http.Error(w, "shutdownAt is in the past", http.StatusBadRequest)
+			return
+		}
+		postServerNotice(&ServerNotice{Message: body.Message, PostedAt: time.Now(), ShutdownAt: body.ShutdownAt})
+		log.Printf("Server notice posted: %q\n", body.Message)
+	case http.MethodDelete:
+		postServerNotice(nil)
+		log.Println("Server notice cleared")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]*ServerNotice{"serverNotice": currentServerNotice()})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Overlay is what the OBS overlay shows, the glance plus who is up next
+type Overlay struct {
+	Glance
+	Title string `json:"title"`
+	Next  string `json:"next,omitempty"`
+	Round int    `json:"round"`
+}
+
+// handleOverlay serves /s/{id}/overlay, a transparent page meant as an OBS
+// browser source. It reads ?layout=timer|speaker|full, ?color=rrggbb,
+// ?size=px and ?align=left|center|right and polls overlay.json.
+func handleOverlay(w http.ResponseWriter, r *http.Request) {
+	page, err := os.ReadFile("./frontend/overlay.html")
+	if err != nil {
+		log.Println("Error:", err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// handleOverlayJSON serves /s/{id}/overlay.json
+func handleOverlayJSON(w http.ResponseWriter, session *Session) {
+	overlay := Overlay{Glance: session.glance()}
+	session.clientsMux.Lock()
+	overlay.Next = session.upNext()
+	session.clientsMux.Unlock()
+	session.stateMux.Lock()
+	overlay.Title = session.title()
+	overlay.Round = session.currentRound()
+	session.stateMux.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(overlay)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+// countdownOvertime is how far a turn of currentLap ran past the countdown,
+// stateMux must be held
+func (s *Session) countdownOvertime(currentLap time.Duration) time.Duration {
+	countdown := time.Duration(s.settings.CountdownMs) * time.Millisecond
+	if countdown == 0 {
+		return 0
+	}
+	return max(currentLap-countdown, 0)
+}
+
+// overtimeStates sums up each client's time past the countdown over the
+// session, the active client's running turn included. stateMux must be held.
+func (s *Session) overtimeStates(activeClient string, total time.Duration) map[string]int64 {
+	states := make(map[string]int64, len(s.overtime)+1)
+	for client, overtime := range s.overtime {
+		states[client] = overtime.Milliseconds()
+	}
+	if running := s.countdownOvertime(total); running > 0 && activeClient != "" {
+		states[activeClient] += running.Milliseconds()
+	}
+	return states
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sessions can be saved so they survive a restart: every persistInterval the
+// ones that changed are written to a snapshotStore, SQLite or a checkpoint
+// file, and on startup the ones saved within PASTATIME_SESSION_TTL are loaded
+// back under the same ID and short link. Clients reconnect to them as usual.
+
+const persistInterval = 5 * time.Second
+
+// defaultSessionTTL is how long a saved session is kept after its last change
+const defaultSessionTTL = 24 * time.Hour
+
+// snapshotStore keeps one snapshot per session
+type snapshotStore interface {
+	save(sessionID string, data []byte, savedAt time.Time) error
+	// loadSince returns the snapshots saved after cutoff, by session ID
+	loadSince(cutoff time.Time) (map[string][]byte, error)
+	// removeBefore drops the snapshots saved before cutoff
+	removeBefore(cutoff time.Time) error
+	// remove drops one session's snapshot
+	remove(sessionID string) error
+	// ping checks the store can still be reached
+	ping() error
+}
+
+// flushingStore is a snapshotStore that holds on to what it is given until
+// flush, the checkpoint file
+type flushingStore interface {
+	flush() error
+}
+
+// openSQLiteStore is set by builds with the sqlite tag, see store_sqlite.go
+var openSQLiteStore func(path string) (snapshotStore, error)
+
+// sessionSnapshot is what survives a restart: the session's settings, laps
+// and scores. Connected clients and a running clock don't, a restored
+// session is paused.
+type sessionSnapshot struct {
+	ID           string                   `json:"id"`
+	ShortCode    string                   `json:"shortCode"`
+	CreatedAt    time.Time                `json:"createdAt"`
+	Settings     Settings                 `json:"settings"`
+	StartAt      time.Time                `json:"startAt,omitempty"`
+	InLobby      bool                     `json:"inLobby,omitempty"`
+	StartedAt    time.Time                `json:"startedAt,omitempty"`
+	ElapsedMs    int64                    `json:"elapsedMs"` // into the current turn
+	ActiveMs     int64                    `json:"activeMs"`
+	PausedMs     int64                    `json:"pausedMs"`
+	LapHistory   []Lap                    `json:"lapHistory"`
+	LapsDropped  int                      `json:"lapsDropped,omitempty"`
+	Dropped      map[string]LapTotals     `json:"droppedTotals,omitempty"` // of the dropped laps, per client
+	LapEdits     []LapEdit                `json:"lapEdits,omitempty"`
+	Pauses       []Pause                  `json:"pauses,omitempty"`
+	RoundsDone   int                      `json:"roundsDone"`
+	RoundStart   int                      `json:"roundStartLap"`
+	Scores       map[string]int           `json:"scores,omitempty"`
+	ScoredRounds int                      `json:"scoredRounds,omitempty"`
+	Winners      []string                 `json:"winners,omitempty"`
+	Handicaps    map[string]time.Duration `json:"handicaps,omitempty"`
+	Overtime     map[string]time.Duration `json:"overtime,omitempty"`
+	Finished     bool                     `json:"finished,omitempty"`
+	Running      bool                     `json:"running,omitempty"` // restarts restore paused, migrations resume
+	Summary      *SessionSummary          `json:"summary,omitempty"`
+}
+
+// snapshot copies what survives a restart. A pause still going on is left
+// out, so an idle session's snapshot doesn't change and ages out.
+func (s *Session) snapshot() sessionSnapshot {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	elapsed := s.elapsed
+	if s.isRunning {
+		elapsed += time.Since(s.startTime)
+	}
+	return sessionSnapshot{
+		ID:           s.ID,
+		ShortCode:    s.shortCode,
+		CreatedAt:    s.createdAt,
+		Settings:     s.settings,
+		StartAt:      s.startAt,
+		InLobby:      s.inLobby,
+		StartedAt:    s.startedAt,
+		ElapsedMs:    elapsed.Milliseconds(),
+		ActiveMs:     s.activeTime().Milliseconds(),
+		PausedMs:     s.pausedTotal.Milliseconds(),
+		LapHistory:   append([]Lap{}, s.lapHistory...),
+		LapsDropped:  s.lapsDropped,
+		Dropped:      maps.Clone(s.droppedTotals),
+		LapEdits:     append([]LapEdit{}, s.lapEdits...),
+		Pauses:       append([]Pause{}, s.pauses...),
+		RoundsDone:   s.roundsDone,
+		RoundStart:   s.roundStartLap,
+		Scores:       maps.Clone(s.scores),
+		ScoredRounds: s.scoredRounds,
+		Winners:      s.winners,
+		Handicaps:    maps.Clone(s.handicaps),
+		Overtime:     maps.Clone(s.overtime),
+		Finished:     s.finished,
+		Running:      s.isRunning,
+		Summary:      s.summary,
+	}
+}
+
+// restoreSession rebuilds a session from its snapshot, paused
+func restoreSession(snapshot sessionSnapshot) (*Session, error) {
+	session, err := newSession(snapshot.ID, snapshot.ShortCode, snapshot.Settings)
+	if err != nil {
+		return nil, err
+	}
+	session.createdAt = snapshot.CreatedAt
+	session.startAt = snapshot.StartAt
+	session.inLobby = snapshot.InLobby
+	session.startedAt = snapshot.StartedAt
+	session.elapsed = time.Duration(snapshot.ElapsedMs) * time.Millisecond
+	session.activeTotal = time.Duration(snapshot.ActiveMs) * time.Millisecond
+	session.pausedTotal = time.Duration(snapshot.PausedMs) * time.Millisecond
+	session.lapHistory = snapshot.LapHistory
+	session.lapsDropped = snapshot.LapsDropped
+	session.droppedTotals = snapshot.Dropped
+	session.lapEdits = snapshot.LapEdits
+	session.pauses = snapshot.Pauses
+	session.roundsDone = snapshot.RoundsDone
+	session.roundStartLap = snapshot.RoundStart
+	// Saved under a higher PASTATIME_MAX_LAPS maybe
+	session.trimLaps()
+	session.scoredRounds = snapshot.ScoredRounds
+	session.winners = snapshot.Winners
+	session.finished = snapshot.Finished
+	session.summary = snapshot.Summary
+	for client, score := range snapshot.Scores {
+		session.scores[client] = score
+	}
+	for client, handicap := range snapshot.Handicaps {
+		session.handicaps[client] = handicap
+	}
+	for client, overtime := range snapshot.Overtime {
+		session.overtime[client] = overtime
+	}
+	return session, nil
+}
+
+// persistence is nil unless PASTATIME_SQLITE_PATH or
+// PASTATIME_CHECKPOINT_PATH is set
+var persistence *persister
+
+// persister saves sessions to its store while the server runs
+type persister struct {
+	store    snapshotStore
+	ttl      time.Duration
+	interval time.Duration     // between saves
+	mu       sync.Mutex        // held while saving, by run and by a drain
+	saved    map[string][]byte // last snapshot written per session
+}
+
+// errNoSQLite is what opening an SQLite store fails with in a build without
+// the sqlite tag
+var errNoSQLite = errors.New("this build has no SQLite support")
+
+// storeFromEnv opens the store named by PASTATIME_SQLITE_PATH, or else the
+// checkpoint file named by PASTATIME_CHECKPOINT_PATH, and returns its path.
+// The store is nil when neither is set.
+func storeFromEnv() (snapshotStore, string, error) {
+	if path := os.Getenv("PASTATIME_SQLITE_PATH"); path != "" {
+		if openSQLiteStore == nil {
+			return nil, path, errNoSQLite
+		}
+		store, err := openSQLiteStore(path)
+		return store, path, err
+	}
+	if path := os.Getenv("PASTATIME_CHECKPOINT_PATH"); path != "" {
+		store, err := openCheckpointStore(path)
+		if err != nil {
+			return nil, path, err
+		}
+		return store, path, nil
+	}
+	return nil, "", nil
+}
+
+// runMigrateOnly opens the store, which runs the SQLite migrations it hasn't
+// had, and exits
+func runMigrateOnly() {
+	openStoreForCommand("--migrate-only")
+	fmt.Println("The store's schema is up to date")
+}
+
+// persisterFromEnv saves sessions to the store storeFromEnv opens, nil when
+// persistence is off
+func persisterFromEnv() *persister {
+	store, path, err := storeFromEnv()
+	if err != nil {
+		log.Printf("Sessions won't be saved, opening %s failed: %v\n", path, err)
+		return nil
+	}
+	if store == nil {
+		return nil
+	}
+	interval := persistInterval
+	if _, ok := store.(*checkpointStore); ok {
+		interval = checkpointIntervalFromEnv()
+	}
+
+	ttl := defaultSessionTTL
+	if value := os.Getenv("PASTATIME_SESSION_TTL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			ttl = parsed
+		} else {
+			log.Printf("Ignoring PASTATIME_SESSION_TTL=%q, it should be a duration like 24h\n", value)
+		}
+	}
+	log.Printf("Saving sessions to %s every %v, kept for %v\n", path, interval, ttl)
+	return &persister{store: store, ttl: ttl, interval: interval, saved: make(map[string][]byte)}
+}
+
+// restore loads the sessions saved within the TTL and forgets older ones,
+// after archiving those that never finished
+func (p *persister) restore() {
+	cutoff := time.Now().Add(-p.ttl)
+	p.archiveExpired(cutoff)
+	if err := p.store.removeBefore(cutoff); err != nil {
+		log.Printf("Removing expired sessions failed: %v\n", err)
+	}
+	saved, err := p.store.loadSince(cutoff)
+	if err != nil {
+		log.Printf("Loading saved sessions failed: %v\n", err)
+		return
+	}
+
+	for sessionID, data := range saved {
+		var snapshot sessionSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			log.Printf("Session %s: Saved snapshot is unreadable: %v\n", sessionID, err)
+			continue
+		}
+		session, err := restoreSession(snapshot)
+		if err != nil {
+			log.Printf("Session %s: Restoring failed: %v\n", sessionID, err)
+			continue
+		}
+		if err := session.registerSession(); err != nil {
+			log.Printf("Session %s: Restoring failed: %v\n", sessionID, err)
+			continue
+		}
+		p.saved[sessionID] = data
+		log.Printf("Session %s: Restored with %d laps\n", sessionID, len(session.lapHistory))
+	}
+}
+
+// run saves the sessions that changed every interval
+func (p *persister) run() {
+	for range time.Tick(p.interval) {
+		p.saveChanged()
+	}
+}
+
+// saveChanged saves every session that changed since it was last saved, and
+// drops expired snapshots along the way
+func (p *persister) saveChanged() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range sessionStore.List() {
+		data, err := json.Marshal(session.snapshot())
+		if err != nil {
+			log.Printf("Session %s: Snapshot failed: %v\n", session.ID, err)
+			continue
+		}
+		if bytes.Equal(data, p.saved[session.ID]) {
+			continue
+		}
+		if err := p.store.save(session.ID, data, time.Now()); err != nil {
+			log.Printf("Session %s: Saving failed: %v\n", session.ID, err)
+			continue
+		}
+		p.saved[session.ID] = data
+	}
+	if err := p.store.removeBefore(time.Now().Add(-p.ttl)); err != nil {
+		log.Printf("Removing expired sessions failed: %v\n", err)
+	}
+	p.flush()
+}
+
+// flush writes out what a flushingStore holds on to, p.mu must be held
+func (p *persister) flush() {
+	if store, ok := p.store.(flushingStore); ok {
+		if err := store.flush(); err != nil {
+			log.Printf("Writing the checkpoint failed: %v\n", err)
+		}
+	}
+}
+
+// forget drops the snapshot of a session that is gone for good, so it
+// doesn't come back after a restart
+func (p *persister) forget(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.saved, sessionID)
+	if err := p.store.remove(sessionID); err != nil {
+		log.Printf("Session %s: Removing the snapshot failed: %v\n", sessionID, err)
+	}
+	p.flush()
+}
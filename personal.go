@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PersonalTimer is a client's own stopwatch when the session runs individual timers
+type PersonalTimer struct {
+	running   bool
+	startTime time.Time
+	elapsed   time.Duration
+	laps      []time.Duration
+	goal      string
+	target    time.Duration
+	checkIn   string
+}
+
+// personalTimerState is how a PersonalTimer is reported in state updates
+type personalTimerState struct {
+	TimeMs   int64   `json:"timeMs"`
+	Running  bool    `json:"running"`
+	LapsMs   []int64 `json:"lapsMs"`
+	Goal     string  `json:"goal,omitempty"`
+	TargetMs int64   `json:"targetMs,omitempty"`
+	CheckIn  string  `json:"checkIn,omitempty"`
+}
+
+// FocusResult is one client's outcome in a focus block summary
+type FocusResult struct {
+	Client   string `json:"client"`
+	Goal     string `json:"goal"`
+	TargetMs int64  `json:"targetMs"`
+	TimeMs   int64  `json:"timeMs"`
+	CheckIn  string `json:"checkIn"` // empty if they never checked in
+}
+
+// FocusSummary is produced at the end of a focus block, once everyone checked in
+type FocusSummary struct {
+	Results     []FocusResult `json:"results"`
+	Completed   int           `json:"completed"`
+	TotalTimeMs int64         `json:"totalTimeMs"`
+}
+
+// Focus block phases, the block is running when focusPhase is empty
+const focusCheckIn = "checkIn"
+
+// checkInAnswers are the accepted replies to the end-of-block check-in
+var checkInAnswers = map[string]bool{"done": true, "partial": true, "notDone": true}
+
+// current returns the time on the timer, including the running stretch
+func (t *PersonalTimer) current() time.Duration {
+	if t.running {
+		return t.elapsed + time.Since(t.startTime)
+	}
+	return t.elapsed
+}
+
+// handlePersonalCommand runs a command against the sender's own timer
+func (s *Session) handlePersonalCommand(clientID string, cmd string, arg string) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	t, exists := s.personalTimers[clientID]
+	if !exists {
+		t = &PersonalTimer{}
+		s.personalTimers[clientID] = t
+	}
+
+	switch cmd {
+	case "start":
+		if !t.running {
+			t.startTime = time.Now()
+			t.running = true
+		}
+	case "pause":
+		if t.running {
+			t.elapsed += time.Since(t.startTime)
+			t.running = false
+		}
+	case "lap":
+		t.laps = append(t.laps, t.current())
+	case "reset":
+		// Only the client's own timer is affected, no confirmation needed
+		*t = PersonalTimer{}
+	case "goal":
+		if err := t.setGoal(arg); err != nil {
+			log.Printf("Session %s: goal from %s rejected: %v\n", s.ID, clientID, err)
+			return
+		}
+	case "checkIn":
+		if s.focusPhase != focusCheckIn || !checkInAnswers[arg] {
+			log.Printf("Session %s: check-in from %s rejected: %q\n", s.ID, clientID, arg)
+			return
+		}
+		t.checkIn = arg
+		if s.allCheckedIn() {
+			s.summarizeFocusBlock()
+		}
+	default:
+		log.Printf("Session %s: Unknown personal timer command from %s: %s\n", s.ID, clientID, cmd)
+		return
+	}
+	go s.broadcastState()
+}
+
+// setGoal parses "<minutes>:<goal text>" into the timer's goal for this block
+func (t *PersonalTimer) setGoal(arg string) error {
+	minutes, goal, _ := strings.Cut(arg, ":")
+	target, err := strconv.ParseFloat(minutes, 64)
+	if err != nil || target <= 0 {
+		return fmt.Errorf("invalid target minutes %q", minutes)
+	}
+	goal = strings.TrimSpace(goal)
+	if goal == "" {
+		return errors.New("missing goal text")
+	}
+	t.goal = goal
+	t.target = time.Duration(target * float64(time.Minute))
+	return nil
+}
+
+// startFocusBlock clears goals, check-ins and timers for a new block, stateMux must be held
+func (s *Session) startFocusBlock() {
+	for _, t := range s.personalTimers {
+		*t = PersonalTimer{}
+	}
+	s.focusPhase = ""
+	s.focusSummary = nil
+}
+
+// endFocusBlock stops every timer and asks clients to check in, stateMux must be held
+func (s *Session) endFocusBlock() {
+	for _, t := range s.personalTimers {
+		if t.running {
+			t.elapsed += time.Since(t.startTime)
+			t.running = false
+		}
+	}
+	s.focusPhase = focusCheckIn
+	go s.broadcastEvent(map[string]interface{}{"type": "focusCheckIn"})
+	if s.allCheckedIn() {
+		s.summarizeFocusBlock()
+	}
+}
+
+// allCheckedIn reports whether everyone who set a goal has checked in, stateMux must be held
+func (s *Session) allCheckedIn() bool {
+	for _, t := range s.personalTimers {
+		if t.goal != "" && t.checkIn == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeFocusBlock builds the group summary and closes the check-in, stateMux must be held
+func (s *Session) summarizeFocusBlock() {
+	summary := &FocusSummary{Results: []FocusResult{}}
+	for id, t := range s.personalTimers {
+		if t.goal == "" {
+			continue
+		}
+		result := FocusResult{
+			Client:   id,
+			Goal:     t.goal,
+			TargetMs: t.target.Milliseconds(),
+			TimeMs:   t.current().Milliseconds(),
+			CheckIn:  t.checkIn,
+		}
+		if t.checkIn == "done" {
+			summary.Completed++
+		}
+		summary.TotalTimeMs += result.TimeMs
+		summary.Results = append(summary.Results, result)
+	}
+	sort.Slice(summary.Results, func(i, j int) bool {
+		return summary.Results[i].Client < summary.Results[j].Client
+	})
+
+	s.focusPhase = ""
+	s.focusSummary = summary
+	log.Printf("Session %s: Focus block summary: %d of %d goals done\n", s.ID, summary.Completed, len(summary.Results))
+	go s.broadcastEvent(map[string]interface{}{"type": "focusSummary", "summary": summary})
+}
+
+// personalTimerStates reports every client's timer, stateMux must be held
+func (s *Session) personalTimerStates() map[string]personalTimerState {
+	states := make(map[string]personalTimerState, len(s.personalTimers))
+	for id, t := range s.personalTimers {
+		laps := make([]int64, 0, len(t.laps))
+		for _, lap := range t.laps {
+			laps = append(laps, lap.Milliseconds())
+		}
+		states[id] = personalTimerState{
+			TimeMs:   t.current().Milliseconds(),
+			Running:  t.running,
+			LapsMs:   laps,
+			Goal:     t.goal,
+			TargetMs: t.target.Milliseconds(),
+			CheckIn:  t.checkIn,
+		}
+	}
+	return states
+}
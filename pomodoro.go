@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Pomodoro phases, turns only rotate during work
+const (
+	phaseWork  = "work"
+	phaseBreak = "break"
+)
+
+// phaseDuration returns how long the current pomodoro phase lasts, stateMux must be held
+func (s *Session) phaseDuration() time.Duration {
+	if s.phase == phaseBreak {
+		return time.Duration(s.settings.BreakMs) * time.Millisecond
+	}
+	return time.Duration(s.settings.WorkMs) * time.Millisecond
+}
+
+// phaseRemaining returns the time left in the current pomodoro phase, stateMux must be held
+func (s *Session) phaseRemaining() time.Duration {
+	if s.phaseStartedAt.IsZero() {
+		return s.phaseDuration()
+	}
+	return max(s.phaseDuration()-time.Since(s.phaseStartedAt), 0)
+}
+
+// checkPomodoro switches between work and break once the current phase is over.
+// The first work phase begins when the timer first starts.
+func (s *Session) checkPomodoro() {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if s.settings.WorkMs == 0 || s.finished || s.startedAt.IsZero() {
+		return
+	}
+	if s.phaseStartedAt.IsZero() {
+		s.phase = phaseWork
+		s.phaseStartedAt = s.startedAt
+	}
+	if s.phaseRemaining() > 0 {
+		return
+	}
+
+	if s.phase == phaseWork {
+		s.phase = phaseBreak
+		s.pauseTimer("", phaseBreak)
+	} else {
+		s.phase = phaseWork
+		// Pick the turn back up where the break interrupted it
+		if s.pauseReason == phaseBreak {
+			s.endPause()
+			s.startTime = time.Now()
+			s.isRunning = true
+		}
+	}
+	s.phaseStartedAt = time.Now()
+	log.Printf("Session %s: Pomodoro phase: %s\n", s.ID, s.phase)
+
+	go s.broadcastEvent(map[string]interface{}{
+		"type":        "phaseChanged",
+		"phase":       s.phase,
+		"remainingMs": s.phaseDuration().Milliseconds(),
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Session priorities. Under load low-priority sessions tick less often so
+// high-priority ones, e.g. the all-hands timer, keep their full rate.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// loadedTickIntervals are how often sessions tick while the server is
+// under load, by priority. High-priority sessions keep tickInterval.
+var loadedTickIntervals = map[string]time.Duration{
+	priorityHigh:   tickInterval,
+	priorityNormal: 250 * time.Millisecond,
+	priorityLow:    time.Second,
+}
+
+// loadGoroutines is how many goroutines count as the server being under
+// load, set with PASTATIME_LOAD_GOROUTINES. 0 never sheds load.
+var loadGoroutines = 10000
+
+// serverLoaded is updated once a second by watchLoad
+var serverLoaded atomic.Bool
+
+// validatePriority checks a session's priority, empty means normal
+func validatePriority(priority string) error {
+	if _, ok := loadedTickIntervals[priority]; priority != "" && !ok {
+		return fmt.Errorf("priority must be %q, %q or %q", priorityHigh, priorityNormal, priorityLow)
+	}
+	return nil
+}
+
+// loadGoroutinesFromEnv reads PASTATIME_LOAD_GOROUTINES
+func loadGoroutinesFromEnv() int {
+	value := os.Getenv("PASTATIME_LOAD_GOROUTINES")
+	if value == "" {
+		return loadGoroutines
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring PASTATIME_LOAD_GOROUTINES=%q, it should be a number of at least 0\n", value)
+		return loadGoroutines
+	}
+	return n
+}
+
+// watchLoad notes whether the server is under load, for priorityInterval
+func watchLoad() {
+	for range time.Tick(time.Second) {
+		loaded := loadGoroutines > 0 && runtime.NumGoroutine() > loadGoroutines
+		if serverLoaded.Swap(loaded) != loaded {
+			log.Printf("Server under load: %v, %d goroutines\n", loaded, runtime.NumGoroutine())
+		}
+	}
+}
+
+// priority returns the session's priority, stateMux must be held
+func (s *Session) priority() string {
+	if s.settings.Priority == "" {
+		return priorityNormal
+	}
+	return s.settings.Priority
+}
+
+// priorityInterval is how often the session should tick given its priority
+// and the server's load
+func (s *Session) priorityInterval() time.Duration {
+	if !serverLoaded.Load() {
+		return tickInterval
+	}
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	return loadedTickIntervals[s.priority()]
+}
+
+// handleAdminPriority serves PUT /admin/api/sessions/{id}/priority with a
+// body like {"priority": "high"}
+func handleAdminPriority(w http.ResponseWriter, r *http.Request, session *Session) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePriority(body.Priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.stateMux.Lock()
+	session.settings.Priority = body.Priority
+	priority := session.priority()
+	session.stateMux.Unlock()
+	log.Printf("Session %s: Priority set to %s by an admin\n", session.ID, priority)
+	go session.broadcastState()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"priority": priority})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+)
+
+// Protocol versions. A connection starts on v1, the flat state the bundled
+// frontend reads, and can switch to a newer one by sending
+// {"type": "hello", "protocol": 2} and waiting for the welcome reply.
+const (
+	protocolV1     = 1
+	protocolV2     = 2
+	latestProtocol = protocolV2
+)
+
+// ClockState is the v2 form of the flat time, lapTime, lastLapClient and
+// running fields
+type ClockState struct {
+	ElapsedMs     *int64 `json:"elapsedMs,omitempty"` // unset while hidden from a guessing player
+	LastLapMs     int64  `json:"lastLapMs"`
+	LastLapClient string `json:"lastLapClient,omitempty"`
+	Running       bool   `json:"running"`
+}
+
+// ClientState is the v2 form of one entry of the flat clients list, with
+// what v1 spreads over the offline, unclaimed and sittingOut lists
+type ClientState struct {
+	ID         string `json:"id"`
+	Online     bool   `json:"online"`
+	Unclaimed  bool   `json:"unclaimed,omitempty"`
+	SittingOut bool   `json:"sittingOut,omitempty"`
+	Host       bool   `json:"host,omitempty"`
+	Active     bool   `json:"active,omitempty"`
+}
+
+// negotiateProtocol picks the version to speak with a client asking for
+// requested, the newest one both sides know
+func negotiateProtocol(requested int) int {
+	return min(max(requested, protocolV1), latestProtocol)
+}
+
+// translateState turns a client's personal state into the given protocol
+// version. v1 is the state as built, so it is returned untouched.
+func translateState(msg map[string]interface{}, protocol int) map[string]interface{} {
+	if protocol < protocolV2 {
+		return msg
+	}
+
+	clock := ClockState{}
+	if elapsed, ok := msg["time"].(int64); ok {
+		clock.ElapsedMs = &elapsed
+	}
+	clock.LastLapMs, _ = msg["lapTime"].(int64)
+	clock.LastLapClient, _ = msg["lastLapClient"].(string)
+	clock.Running, _ = msg["running"].(bool)
+
+	ids, _ := msg["clients"].([]string)
+	host, _ := msg["host"].(string)
+	active, _ := msg["activeClient"].(string)
+	offline := stringSet(msg["offline"])
+	unclaimed := stringSet(msg["unclaimed"])
+	sittingOut := stringSet(msg["sittingOut"])
+	clients := make([]ClientState, 0, len(ids))
+	for _, id := range ids {
+		clients = append(clients, ClientState{
+			ID:         id,
+			Online:     !offline[id],
+			Unclaimed:  unclaimed[id],
+			SittingOut: sittingOut[id],
+			Host:       id == host,
+			Active:     id == active,
+		})
+	}
+
+	for _, key := range []string{"time", "lapTime", "lastLapClient", "running", "offline", "unclaimed", "sittingOut"} {
+		delete(msg, key)
+	}
+	msg["clock"] = clock
+	msg["clients"] = clients
+	msg["protocol"] = protocol
+	return msg
+}
+
+// stringSet turns one of the state's ID lists into a set
+func stringSet(list interface{}) map[string]bool {
+	ids, _ := list.([]string)
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// hello switches the client to the protocol it asked for, as far as the
+// server knows it, and resends the state in that version
+func (s *Session) hello(c *Client, requested int) {
+	protocol := negotiateProtocol(requested)
+	c.protocol.Store(int32(protocol))
+	log.Printf("Session %s: Client %s speaks protocol v%d\n", s.ID, c.id, protocol)
+	s.sendEvent(c.id, map[string]interface{}{
+		"type":     "welcome",
+		"protocol": protocol,
+		"latest":   latestProtocol,
+	})
+	s.sendStateToClient(c)
+}
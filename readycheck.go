@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// ReadyCheck is who has said they are ready before the first turn
+type ReadyCheck struct {
+	Ready  []string `json:"ready"`
+	Needed int      `json:"needed"` // ready participants required to start
+	Met    bool     `json:"met"`
+}
+
+// readyCheck reports the ready-check, nil once the clock has first run or
+// when the session has none. clientsMux and stateMux must be held.
+func (s *Session) readyCheck() *ReadyCheck {
+	if !s.settings.ReadyCheck || !s.startedAt.IsZero() {
+		return nil
+	}
+	check := &ReadyCheck{Ready: []string{}, Needed: s.settings.ReadyQuorum}
+	participants := 0
+	for id, client := range s.clients {
+		if client.offline || client.device {
+			continue
+		}
+		participants++
+		if s.ready[id] {
+			check.Ready = append(check.Ready, id)
+		}
+	}
+	sort.Strings(check.Ready)
+	if check.Needed == 0 || check.Needed > participants {
+		// Everyone, and a quorum can't ask for more people than are here
+		check.Needed = participants
+	}
+	check.Met = participants > 0 && len(check.Ready) >= check.Needed
+	return check
+}
+
+// inReadyCheck reports whether the session is still waiting on the
+// ready-check, and whether it is met
+func (s *Session) inReadyCheck() (waiting bool, met bool) {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	check := s.readyCheck()
+	if check == nil {
+		return false, true
+	}
+	return true, check.Met
+}
+
+// setReady marks a participant as ready, or not, during the ready-check
+func (s *Session) setReady(clientID string, ready bool) {
+	s.clientsMux.Lock()
+	if ready {
+		s.ready[clientID] = true
+	} else {
+		delete(s.ready, clientID)
+	}
+	s.clientsMux.Unlock()
+	log.Printf("Session %s: %s ready: %v\n", s.ID, clientID, ready)
+	go s.broadcastState()
+}
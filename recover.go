@@ -0,0 +1,156 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// panics counts the panics recovered since the server started, published on
+// /debug/vars and in the admin API
+var panics = expvar.NewInt("panicsRecovered")
+
+// stuckLockWait is how long a session's locks may stay held after a panic
+// before the session is given up on
+var stuckLockWait = 5 * time.Second
+
+// recoverHTTP keeps a panicking handler from taking the server down, it
+// logs the stack and answers 500 if nothing was written yet
+func recoverHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// The handler asked to abort the response, not a bug
+				panic(p)
+			}
+			panics.Add(1)
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safely runs fn for a session and turns a panic into an error, so the
+// caller can close a connection or skip a tick cleanly. what and clientID
+// say where it happened for the log.
+func (s *Session) safely(what string, clientID string, fn func()) (err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		panics.Add(1)
+		log.Printf("Session %s: Panic in %s for client %q: %v\n%s", s.ID, what, clientID, p, debug.Stack())
+		err = fmt.Errorf("%s: %v", what, p)
+		go s.checkLocksAfterPanic()
+	}()
+	fn()
+	return nil
+}
+
+// checkLocksAfterPanic abandons the session if a panic left one of its locks
+// held. Unlocking it blindly could break whoever really holds it, so the
+// session is dropped instead of hanging every client that joins it.
+func (s *Session) checkLocksAfterPanic() {
+	deadline := time.Now().Add(stuckLockWait)
+	var held []*sessionMutex
+	defer func() {
+		for _, mux := range held {
+			mux.Unlock()
+		}
+	}()
+	for _, mux := range []*sessionMutex{&s.clientsMux, &s.stateMux} {
+		for !mux.TryLock() {
+			if time.Now().After(deadline) {
+				log.Printf("Session %s: Still locked %v after a panic, closing the session\n", s.ID, stuckLockWait)
+				s.abandon()
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		held = append(held, mux)
+	}
+}
+
+// abandon drops a session whose locks are stuck: its connections are closed,
+// which the clients see as the server going away, and every goroutine waiting
+// for its locks exits, the timer loop and the connection loops included.
+// Nothing here may wait for the session's locks.
+func (s *Session) abandon() {
+	if s.abandoned.Swap(true) {
+		return
+	}
+	s.clientsMux.abandon()
+	s.stateMux.abandon()
+	s.conns.Range(func(conn, _ interface{}) bool {
+		conn.(clientConn).Close()
+		return true
+	})
+	if current, _ := sessionStore.Get(s.ID); current == s {
+		sessionStore.Delete(s.ID)
+	}
+}
+
+// sessionMutex is a sync.Mutex for a session's state, except that the
+// goroutines waiting for it exit once the session is abandoned. A panic can
+// leave it held for good, and they would otherwise wait forever, holding
+// their connection slots. The zero value is unlocked.
+type sessionMutex struct {
+	once sync.Once
+	held chan struct{} // has a token while locked
+	dead chan struct{} // closed by abandon
+}
+
+func (m *sessionMutex) init() {
+	m.once.Do(func() {
+		m.held = make(chan struct{}, 1)
+		m.dead = make(chan struct{})
+	})
+}
+
+// Lock waits for the mutex. If the session is abandoned meanwhile, the
+// calling goroutine exits with runtime.Goexit, running its deferred calls.
+func (m *sessionMutex) Lock() {
+	m.init()
+	select {
+	case m.held <- struct{}{}:
+	case <-m.dead:
+		runtime.Goexit()
+	}
+}
+
+// TryLock takes the mutex if it is free
+func (m *sessionMutex) TryLock() bool {
+	m.init()
+	select {
+	case m.held <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *sessionMutex) Unlock() {
+	m.init()
+	select {
+	case <-m.held:
+	default:
+		panic("unlock of unlocked sessionMutex")
+	}
+}
+
+// abandon wakes the waiters up to exit, abandon must run once
+func (m *sessionMutex) abandon() {
+	m.init()
+	close(m.dead)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A panic that leaves a session lock held gets the session abandoned: its
+// connections close and every goroutine waiting for the lock exits, handing
+// back its connection slot
+func TestPanicHoldingLockFreesSession(t *testing.T) {
+	defer func(wait time.Duration) { stuckLockWait = wait }(stuckLockWait)
+	stuckLockWait = 200 * time.Millisecond
+
+	for name, lock := range map[string]func(s *Session) *sessionMutex{
+		"clientsMux": func(s *Session) *sessionMutex { return &s.clientsMux },
+		"stateMux":   func(s *Session) *sessionMutex { return &s.stateMux },
+	} {
+		t.Run(name, func(t *testing.T) {
+			connections := openConnections.Load()
+			var session *Session
+			for err := errSessionExists; errors.Is(err, errSessionExists); {
+				session, err = newSession(newSessionSlug(), newShortCode(), Settings{Participants: []string{"ann", "bob"}})
+				if err == nil {
+					err = session.registerSession()
+				}
+				if err != nil && !errors.Is(err, errSessionExists) {
+					t.Fatal(err)
+				}
+			}
+			server := httptest.NewServer(http.HandlerFunc(handleSession))
+			defer server.Close()
+
+			var conns []*websocket.Conn
+			for _, participant := range []string{"ann", "bob"} {
+				url := "ws" + strings.TrimPrefix(server.URL, "http") + "/s/" + session.ID + "/ws?name=" + participant
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatalf("connecting %s: %v", participant, err)
+				}
+				defer conn.Close()
+				var msg map[string]interface{}
+				if err := conn.ReadJSON(&msg); err != nil {
+					t.Fatalf("reading %s's first message: %v", participant, err)
+				}
+				conns = append(conns, conn)
+			}
+
+			session.safely("test", "", func() {
+				lock(session).Lock()
+				panic("stuck")
+			})
+			// Waits for the stuck lock, and exits once the session is abandoned
+			conns[0].WriteJSON(map[string]string{"type": "command", "command": "start"})
+
+			for _, conn := range conns {
+				conn.SetReadDeadline(time.Now().Add(stuckLockWait + 2*time.Second))
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						if errors.Is(err, os.ErrDeadlineExceeded) {
+							t.Fatal("the connection wasn't closed")
+						}
+						break
+					}
+				}
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for session.resources.goroutines.Load() != 0 || openConnections.Load() != connections {
+				if time.Now().After(deadline) {
+					t.Fatalf("%d goroutines and %d connections left, want 0 and %d",
+						session.resources.goroutines.Load(), openConnections.Load(), connections)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if _, ok := sessionStore.Get(session.ID); ok {
+				t.Error("the abandoned session is still stored")
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tickInterval         = 100 * time.Millisecond
+	degradedTickInterval = time.Second
+	// breakerCooldown is how long a degraded session must stay under the
+	// limits before it ticks at full speed again
+	breakerCooldown = 30 * time.Second
+)
+
+// BreakerLimits trip a session's circuit breaker when any of them is
+// exceeded, 0 leaves that one unchecked. They apply to every session and are
+// set with PASTATIME_BREAKER_GOROUTINES, PASTATIME_BREAKER_QUEUED_BYTES and
+// PASTATIME_BREAKER_BROADCASTS (per second).
+type BreakerLimits struct {
+	Goroutines       int64 `json:"goroutines"`
+	QueuedBytes      int64 `json:"queuedBytes"`
+	BroadcastsPerSec int64 `json:"broadcastsPerSec"`
+}
+
+var breakerLimits = BreakerLimits{
+	Goroutines:       2000,
+	QueuedBytes:      16 << 20,
+	BroadcastsPerSec: 100,
+}
+
+// breakerLimitsFromEnv overrides the default limits
+func breakerLimitsFromEnv() BreakerLimits {
+	limits := breakerLimits
+	for name, limit := range map[string]*int64{
+		"PASTATIME_BREAKER_GOROUTINES":   &limits.Goroutines,
+		"PASTATIME_BREAKER_QUEUED_BYTES": &limits.QueuedBytes,
+		"PASTATIME_BREAKER_BROADCASTS":   &limits.BroadcastsPerSec,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring %s=%q, it should be a number of at least 0\n", name, value)
+			continue
+		}
+		*limit = n
+	}
+	return limits
+}
+
+// sessionResources accounts for what a session costs the server. The
+// counters are atomic, the rest is only touched by the session's timer loop.
+type sessionResources struct {
+	// goroutines counts the timer loop, the connection loops and the
+	// sends still in flight
+	goroutines  atomic.Int64
+	queuedBytes atomic.Int64 // written to no client yet
+	degraded    atomic.Bool
+
+	broadcastRate atomic.Int64 // per second, over the last sample
+
+	rateSampledAt   time.Time
+	rateBroadcasts  uint64
+	withinLimitsFor time.Time // since when a degraded session is back under the limits
+}
+
+// Resources is a session's usage as the admin API reports it
+type Resources struct {
+	Goroutines       int64 `json:"goroutines"`
+	QueuedBytes      int64 `json:"queuedBytes"`
+	BroadcastsPerSec int64 `json:"broadcastsPerSec"`
+	Degraded         bool  `json:"degraded,omitempty"` // ticking slower, see checkBreaker
+}
+
+// resourceUsage reads the session's counters
+func (s *Session) resourceUsage() Resources {
+	return Resources{
+		Goroutines:       s.resources.goroutines.Load(),
+		QueuedBytes:      s.resources.queuedBytes.Load(),
+		BroadcastsPerSec: s.resources.broadcastRate.Load(),
+		Degraded:         s.resources.degraded.Load(),
+	}
+}
+
+// sendQueued writes data to a client from its own goroutine, counting it
+// against the session until it is written
+func (s *Session) sendQueued(c *Client, data []byte) {
+	s.resources.goroutines.Add(1)
+	s.resources.queuedBytes.Add(int64(len(data)))
+	go func() {
+		defer s.resources.goroutines.Add(-1)
+		defer s.resources.queuedBytes.Add(-int64(len(data)))
+		c.send(data)
+	}()
+}
+
+// overLimits reports which limit the session exceeds, if any
+func (usage Resources) overLimits(limits BreakerLimits) string {
+	switch {
+	case limits.Goroutines > 0 && usage.Goroutines > limits.Goroutines:
+		return "goroutines"
+	case limits.QueuedBytes > 0 && usage.QueuedBytes > limits.QueuedBytes:
+		return "queuedBytes"
+	case limits.BroadcastsPerSec > 0 && usage.BroadcastsPerSec > limits.BroadcastsPerSec:
+		return "broadcastsPerSec"
+	}
+	return ""
+}
+
+// checkBreaker samples the broadcast rate and trips or resets the circuit
+// breaker, returning the interval the timer loop should tick at. A tripped
+// session ticks once a second, so it sends a tenth of the state updates,
+// until it has stayed under the limits for breakerCooldown.
+func (s *Session) checkBreaker() time.Duration {
+	r := &s.resources
+	now := time.Now()
+	if since := now.Sub(r.rateSampledAt); since >= time.Second {
+		broadcasts := s.broadcasts.Load()
+		if !r.rateSampledAt.IsZero() {
+			r.broadcastRate.Store(int64(math.Round(float64(broadcasts-r.rateBroadcasts) / since.Seconds())))
+		}
+		r.rateSampledAt = now
+		r.rateBroadcasts = broadcasts
+	}
+
+	over := s.resourceUsage().overLimits(breakerLimits)
+	switch {
+	case over != "" && !r.degraded.Load():
+		r.degraded.Store(true)
+		r.withinLimitsFor = time.Time{}
+		log.Printf("Session %s: Over the %s limit, ticking every %v\n", s.ID, over, degradedTickInterval)
+	case over != "":
+		r.withinLimitsFor = time.Time{}
+	case r.degraded.Load() && r.withinLimitsFor.IsZero():
+		r.withinLimitsFor = now
+	case r.degraded.Load() && now.Sub(r.withinLimitsFor) >= breakerCooldown:
+		r.degraded.Store(false)
+		log.Printf("Session %s: Back under the limits for %v, ticking every %v\n", s.ID, breakerCooldown, tickInterval)
+	}
+	if r.degraded.Load() {
+		return degradedTickInterval
+	}
+	return tickInterval
+}
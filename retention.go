@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Detail is kept for a while, summaries for good. The snapshot store only
+// keeps a session's laps for PASTATIME_SESSION_TTL after its last change, and
+// a session that never finished is archived before its snapshot is dropped,
+// see archiveExpired; finished ones were archived when they finished. The
+// event logs in PASTATIME_EVENT_LOG_DIR are the rest of the detail: with
+// PASTATIME_RETENTION set, a log nobody wrote to for that long is removed,
+// unless its session is still here or in the trash.
+
+// retentionInterval is how often old event logs are looked for
+const retentionInterval = time.Hour
+
+// retention is how long an event log is kept after its last line, 0 keeps
+// it forever and is the default
+var retention time.Duration
+
+// retentionFromEnv reads PASTATIME_RETENTION
+func retentionFromEnv() time.Duration {
+	value := os.Getenv("PASTATIME_RETENTION")
+	if value == "" {
+		return retention
+	}
+	keep, err := time.ParseDuration(value)
+	if err != nil || keep < 0 {
+		log.Printf("Ignoring PASTATIME_RETENTION=%q, it should be a duration like 720h or 0 to keep event logs\n", value)
+		return retention
+	}
+	return keep
+}
+
+// purgeEventLogs removes the event logs older than retention every
+// retentionInterval, until the server stops
+func purgeEventLogs() {
+	if retention == 0 || eventLogDir == "" {
+		return
+	}
+	for {
+		purgeEventLogsBefore(time.Now().Add(-retention))
+		time.Sleep(retentionInterval)
+	}
+}
+
+// purgeEventLogsBefore removes the event logs last written before cutoff
+// whose sessions are gone for good
+func purgeEventLogsBefore(cutoff time.Time) {
+	files, err := os.ReadDir(eventLogDir)
+	if err != nil {
+		log.Printf("Reading %s failed: %v\n", eventLogDir, err)
+		return
+	}
+	removed := 0
+	for _, file := range files {
+		sessionID, ok := strings.CutSuffix(file.Name(), ".jsonl")
+		if !ok || file.IsDir() || !validSessionID(sessionID) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if _, ok := sessionStore.Get(sessionID); ok {
+			continue
+		}
+		trashMux.Lock()
+		_, deleted := deletedSession(sessionID)
+		trashMux.Unlock()
+		if deleted >= 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(eventLogDir, file.Name())); err != nil {
+			log.Printf("Session %s: Removing the event log failed: %v\n", sessionID, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d event logs older than %v\n", removed, retention)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Billing and reporting systems count time in their own units, so the CSV
+// exports can round durations to the session's ExportRoundingMs, e.g. 15000
+// for quarter minutes, in its ExportRounding direction.
+
+const (
+	roundNearest = "nearest"
+	roundUp      = "up"
+	roundDown    = "down"
+	// maxExportRounding is the largest unit durations can be rounded to
+	maxExportRounding = time.Hour
+)
+
+// validateRounding checks the export rounding settings
+func validateRounding(s Settings) error {
+	if s.ExportRoundingMs < 0 || time.Duration(s.ExportRoundingMs)*time.Millisecond > maxExportRounding {
+		return errors.New("exportRoundingMs should be between 0 and an hour")
+	}
+	switch s.ExportRounding {
+	case "", roundNearest, roundUp, roundDown:
+		return nil
+	}
+	return errors.New(`exportRounding must be "nearest", "up" or "down"`)
+}
+
+// exportMs rounds d as the settings ask for exports, in milliseconds
+func (s Settings) exportMs(d time.Duration) int64 {
+	unit := time.Duration(s.ExportRoundingMs) * time.Millisecond
+	if unit <= 0 {
+		return d.Milliseconds()
+	}
+	switch s.ExportRounding {
+	case roundUp:
+		rounded := d.Truncate(unit)
+		if rounded < d {
+			rounded += unit
+		}
+		return rounded.Milliseconds()
+	case roundDown:
+		return d.Truncate(unit).Milliseconds()
+	}
+	return d.Round(unit).Milliseconds()
+}
+
+// handleLapsCSV serves /s/{id}/laps.csv, the laps the session keeps with
+// their duration rounded for export, numbered past the ones dropped
+func handleLapsCSV(w http.ResponseWriter, session *Session) {
+	session.stateMux.Lock()
+	settings := session.settings
+	laps := append([]Lap{}, session.lapHistory...)
+	dropped := session.lapsDropped
+	session.stateMux.Unlock()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+session.ID+`-laps.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"lap", "client", "durationMs", "overtimeMs", "skipped", "accidental", "edited"})
+	for i, lap := range laps {
+		out.Write([]string{
+			strconv.Itoa(dropped + i + 1),
+			lap.Client,
+			strconv.FormatInt(settings.exportMs(lap.Time), 10),
+			strconv.FormatInt(settings.exportMs(time.Duration(lap.OvertimeMs)*time.Millisecond), 10),
+			strconv.FormatBool(lap.Skipped),
+			strconv.FormatBool(lap.Accidental),
+			strconv.FormatBool(lap.Edited),
+		})
+	}
+	out.Flush()
+}
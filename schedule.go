@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// maxScheduleAhead is how far ahead a session start can be scheduled
+const maxScheduleAhead = 7 * 24 * time.Hour
+
+// validateStartAt checks a scheduled start, a minute in the past is allowed
+// for clock skew and starts at once
+func validateStartAt(startAt *time.Time) error {
+	if startAt == nil {
+		return nil
+	}
+	if time.Until(*startAt) < -time.Minute {
+		return errors.New("startAt is in the past")
+	}
+	if time.Until(*startAt) > maxScheduleAhead {
+		return errors.New("startAt cannot be more than a week ahead")
+	}
+	return nil
+}
+
+// Lobby is what a scheduled session shows until it starts, so a board can
+// count down to the meeting and show who is expected before anyone acts
+type Lobby struct {
+	Name       string    `json:"name,omitempty"`
+	StartAt    time.Time `json:"startAt"`
+	StartsInMs int64     `json:"startsInMs"`
+	// WaitingForHost is set in the lobby, the session opens when the host says
+	WaitingForHost bool          `json:"waitingForHost,omitempty"`
+	Roster         []LobbyMember `json:"roster"`
+	Present        int           `json:"present"`
+}
+
+// LobbyMember is someone on the roster and whether they are connected yet
+type LobbyMember struct {
+	Name    string `json:"name"`
+	Present bool   `json:"present"`
+}
+
+// lobbyRoster lists the participants in turn order, clientsMux must be held
+func (s *Session) lobbyRoster() []LobbyMember {
+	roster := make([]LobbyMember, 0, len(s.clientOrder))
+	for _, id := range s.clientOrder {
+		if client, ok := s.clients[id]; ok && !client.device {
+			roster = append(roster, LobbyMember{Name: id, Present: !client.offline})
+		}
+	}
+	return roster
+}
+
+// lobby sums up the wait for the scheduled start, stateMux must be held
+func (s *Session) lobby(roster []LobbyMember) Lobby {
+	lobby := Lobby{
+		Name:           s.settings.Name,
+		StartAt:        s.startAt,
+		StartsInMs:     max(time.Until(s.startAt), 0).Milliseconds(),
+		Roster:         roster,
+		WaitingForHost: s.inLobby,
+	}
+	for _, member := range roster {
+		if member.Present {
+			lobby.Present++
+		}
+	}
+	return lobby
+}
+
+// waiting reports whether the session is waiting for its scheduled start
+// or in the lobby, stateMux must be held
+func (s *Session) waiting() bool {
+	return !s.startAt.IsZero() || s.inLobby
+}
+
+// checkScheduledStart opens a scheduled session once its time comes
+func (s *Session) checkScheduledStart() {
+	s.stateMux.Lock()
+	due := !s.startAt.IsZero() && !time.Now().Before(s.startAt)
+	s.stateMux.Unlock()
+	if due {
+		s.openSession("Scheduled start")
+	}
+}
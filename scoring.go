@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// scoreRound gives a point to whoever had the best lap of the round that
+// just ended, the fastest or, in the guessing game, the closest to the
+// target. Ties all score. stateMux must be held and rankRound must have run.
+func (s *Session) scoreRound() {
+	if s.settings.BestOf == 0 || s.winners != nil {
+		return
+	}
+
+	var best []string
+	if s.settings.GuessTargetMs > 0 {
+		for _, result := range s.ranking {
+			if abs(result.DeltaMs) != abs(s.ranking[0].DeltaMs) {
+				break
+			}
+			best = append(best, result.Client)
+		}
+	} else {
+		var fastest int64 = -1
+		for _, lap := range s.lapHistory[min(s.roundStartLap, len(s.lapHistory)):] {
+			if lap.Skipped || lap.Accidental {
+				continue
+			}
+			if fastest == -1 || lap.TimeMs < fastest {
+				fastest = lap.TimeMs
+				best = best[:0]
+			}
+			if lap.TimeMs == fastest {
+				best = append(best, lap.Client)
+			}
+		}
+	}
+
+	for _, client := range best {
+		s.scores[client]++
+	}
+	s.scoredRounds++
+	log.Printf("Session %s: Round %d of %d scored for %v, scores: %v\n", s.ID, s.scoredRounds, s.settings.BestOf, best, s.scores)
+
+	if s.scoredRounds >= s.settings.BestOf {
+		s.declareWinners()
+	}
+}
+
+// declareWinners picks the highest scores and announces them, stateMux must be held
+func (s *Session) declareWinners() {
+	top := 0
+	for _, score := range s.scores {
+		top = max(top, score)
+	}
+	winners := []string{}
+	for client, score := range s.scores {
+		if score == top && top > 0 {
+			winners = append(winners, client)
+		}
+	}
+	sort.Strings(winners)
+	s.winners = winners
+	log.Printf("Session %s: Winners after %d rounds: %v\n", s.ID, s.scoredRounds, winners)
+	go s.broadcastEvent(map[string]interface{}{
+		"type":    "winner",
+		"winners": winners,
+		"scores":  s.scoreStates(),
+	})
+}
+
+// scoreStates copies the scores for a message, stateMux must be held
+func (s *Session) scoreStates() map[string]int {
+	scores := make(map[string]int, len(s.scores))
+	for client, score := range s.scores {
+		scores[client] = score
+	}
+	return scores
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// handleArchiveSearch serves GET /api/archives/search to admins, the archive
+// entries matching every parameter given, newest first and paged like
+// /history:
+//
+//	name         part of the session name, any case
+//	tag          a tag, repeated for entries having them all
+//	participant  someone who took part, any case
+//	from, to     when the session was created, RFC 3339 or a date like
+//	             2026-01-31 (to then includes that whole day)
+func handleArchiveSearch(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	query := ArchiveQuery{
+		Name:        values.Get("name"),
+		Tags:        tagsFromQuery(r),
+		Participant: values.Get("participant"),
+	}
+	var err error
+	if query.From, err = searchTime(values.Get("from"), false); err != nil {
+		http.Error(w, "from should be a date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if query.To, err = searchTime(values.Get("to"), true); err != nil {
+		http.Error(w, "to should be a date or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	serveHistory(w, r, query)
+}
+
+// searchTime parses a bound of the date range, zero when value is empty. A
+// bare date used as the end of the range stands for the end of that day.
+func searchTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
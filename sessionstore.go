@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// errSessionExists is returned by SessionStore.Create when the ID or short
+// code is already taken
+var errSessionExists = errors.New("session ID or short code already in use")
+
+// SessionStore holds the sessions the server knows about and resolves their
+// short links. The handlers only go through this interface, so sessions can
+// live somewhere else than in this process' memory.
+type SessionStore interface {
+	Get(sessionID string) (*Session, bool)
+	// Create adds a session under its ID and short code
+	Create(session *Session) error
+	// Delete drops a session and its short link, unknown IDs are ignored
+	Delete(sessionID string)
+	List() []*Session
+	// Resolve finds the ID of the session a short code was created for
+	Resolve(shortCode string) (string, bool)
+}
+
+// sessionStore is where the server keeps its sessions
+var sessionStore SessionStore = newMemorySessionStore()
+
+// memorySessionStore is the default SessionStore, sessions live as long as
+// the process unless they are persisted, see persist.go
+type memorySessionStore struct {
+	mu         sync.Mutex
+	sessions   map[string]*Session
+	shortLinks map[string]string // short code to session ID
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions:   make(map[string]*Session),
+		shortLinks: make(map[string]string),
+	}
+}
+
+func (m *memorySessionStore) Get(sessionID string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, exists := m.sessions[sessionID]
+	return session, exists
+}
+
+func (m *memorySessionStore) Create(session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, taken := m.sessions[session.ID]; taken {
+		return errSessionExists
+	}
+	if _, taken := m.shortLinks[session.shortCode]; taken {
+		return errSessionExists
+	}
+	m.sessions[session.ID] = session
+	m.shortLinks[session.shortCode] = session.ID
+	return nil
+}
+
+func (m *memorySessionStore) Delete(sessionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, exists := m.sessions[sessionID]; exists {
+		delete(m.shortLinks, session.shortCode)
+		delete(m.sessions, sessionID)
+	}
+}
+
+func (m *memorySessionStore) List() []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	all := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		all = append(all, session)
+	}
+	return all
+}
+
+func (m *memorySessionStore) Resolve(shortCode string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessionID, exists := m.shortLinks[shortCode]
+	return sessionID, exists
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength  = 60
+	maxEmojiLength = 8 // emoji can be several code points long
+)
+
+// Settings are the per-session options chosen when the session is created
+type Settings struct {
+	// Name and Emoji tell sessions apart in page titles, e.g. "🍝 Stand-up"
+	Name  string `json:"sessionName,omitempty"`
+	Emoji string `json:"emoji,omitempty"`
+	// ProxyControl lets only the host drive the timer, whoever's turn it is
+	ProxyControl bool `json:"proxyControl"`
+	// SharedDevice is for a single device passed around the table: connections
+	// don't take turns, they drive the Participants roster instead
+	SharedDevice bool `json:"sharedDevice"`
+	// Participants are added to the turn order when the session is created
+	Participants []string `json:"participants,omitempty"`
+	// SelfOrdering passes the turn to whoever sent claimNext first, falling
+	// back to clientOrder when nobody has claimed it
+	SelfOrdering bool `json:"selfOrdering"`
+	// IndividualTimers gives every client their own stopwatch instead of
+	// passing a shared one around
+	IndividualTimers bool `json:"individualTimers"`
+	// Simultaneous times every client at once: the host starts all clocks,
+	// each client stops their own and the session finishes with the last
+	Simultaneous bool `json:"simultaneous"`
+	// LateJoiners is how someone joining after the rotation started is
+	// fitted in: "insert" (the default) or "skip" until the next round
+	LateJoiners string `json:"lateJoiners,omitempty"`
+	// NextDebounceMs ignores a "next" arriving this soon after the previous one,
+	// 0 (the default) disables it
+	NextDebounceMs int64 `json:"nextDebounceMs"`
+	// MinLapMs flags laps shorter than this as accidental, 0 disables it
+	MinLapMs int64 `json:"minLapMs"`
+	// MaxDurationMs finishes the session this long after the timer first
+	// started, 0 disables it
+	MaxDurationMs int64 `json:"maxDurationMs"`
+	// CountdownMs makes each turn count down from this duration instead of
+	// counting up, 0 counts up
+	CountdownMs int64 `json:"countdownMs"`
+	// AutoAdvance passes the turn on when the countdown reaches zero
+	AutoAdvance bool `json:"autoAdvance"`
+	// TurnLimitMs is a hard turn length: the server passes the turn on when
+	// it runs out and flags the lap as forced, 0 disables it
+	TurnLimitMs int64 `json:"turnLimitMs"`
+	// TargetMs is a soft turn length: clients are warned at 80% and 100%
+	// and laps record how far they ran over, 0 disables it
+	TargetMs int64 `json:"targetMs"`
+	// AutoResume restarts the timer when someone reconnects after it was
+	// paused because everyone left, otherwise it waits for a start
+	AutoResume bool `json:"autoResume"`
+	// TimeBankMs turns the session into a chess clock: each client gets this
+	// much time in total, spent only during their own turns
+	TimeBankMs int64 `json:"timeBankMs"`
+	// IncrementMs is added back to a chess clock after every turn (Fischer)
+	IncrementMs int64 `json:"incrementMs"`
+	// DelayMs is a grace period at the start of each turn before a chess
+	// clock starts running down
+	DelayMs int64 `json:"delayMs"`
+	// PlayerClocks overrides the chess-clock options per participant
+	PlayerClocks map[string]ClockSettings `json:"playerClocks,omitempty"`
+	// Rounds finishes the session once everyone had this many turns, 0 keeps
+	// going until the session is ended some other way
+	Rounds int `json:"rounds"`
+	// WorkMs and BreakMs alternate the session between work and break phases
+	// (pomodoro), 0 disables it
+	WorkMs  int64 `json:"workMs"`
+	BreakMs int64 `json:"breakMs"`
+	// GuessTargetMs turns the session into a game: the clock is hidden from
+	// the active client, who tries to stop it as close to this as they can,
+	// and each round ends with a ranking. 0 disables it.
+	GuessTargetMs int64 `json:"guessTargetMs"`
+	// BestOf scores the rounds: the best lap of each round earns a point,
+	// and the winner is declared after this many rounds. 0 disables it.
+	BestOf int `json:"bestOf"`
+	// AlertSound is the bundled sound played for alerts whose cue doesn't
+	// name one, empty keeps them silent
+	AlertSound string `json:"alertSound,omitempty"`
+	// Cues attach a sound and a color flash to alert and turn-change
+	// events, keyed by event type, e.g. {"timeExpired": {"sound": "buzz"}}
+	Cues map[string]Cue `json:"cues,omitempty"`
+	// Announcements add a spoken "Next up" to turn changes, the audio is
+	// generated by the server's TTS provider if it has one
+	Announcements bool `json:"announcements"`
+	// Language of the statusText sent for screen readers, one of
+	// statusLanguages, empty means English
+	Language string `json:"language,omitempty"`
+	// HandoffConfirmMs holds the clock after "next" until the incoming
+	// client sends "ready". If they don't within this window their turn is
+	// skipped and offered to the one after them. 0 starts the clock at once.
+	HandoffConfirmMs int64 `json:"handoffConfirmMs"`
+	// Timers are named clocks that run alongside the turns, e.g. "sauce",
+	// each with its own start/pause/reset and optional countdown
+	Timers map[string]TimerSettings `json:"timers,omitempty"`
+	// StartAt schedules the session: until then it waits and counts down,
+	// then the first client's clock starts on its own. RFC 3339.
+	StartAt *time.Time `json:"startAt,omitempty"`
+	// Lobby keeps the session waiting until the host opens it, the turn
+	// order can be arranged meanwhile
+	Lobby bool `json:"lobby,omitempty"`
+	// Slug asks for the session ID, e.g. "friday-standup" so a recurring
+	// group keeps its URL. It is taken over from a finished session, a
+	// session still going on keeps it.
+	Slug string `json:"slug,omitempty"`
+	// Template names the saved settings the session started from, see
+	// template.go
+	Template string `json:"template,omitempty"`
+	// Tags label the session, e.g. "team:payments", see tags.go
+	Tags []string `json:"tags,omitempty"`
+	// Integrations drive things outside Pastatime, e.g. smart lights
+	Integrations *Integrations `json:"integrations,omitempty"`
+	// ReadyCheck keeps the clock from starting until the participants have
+	// sent "ready", ReadyQuorum of them or everyone when it is 0
+	ReadyCheck  bool `json:"readyCheck"`
+	ReadyQuorum int  `json:"readyQuorum"`
+	// AutoStartAt starts the clock on its own, after a 3-2-1 countdown, once
+	// this many participants are connected. 0 waits for someone to press start.
+	AutoStartAt int `json:"autoStartAt"`
+	// VoteSkipPercent lets the other participants send "voteSkip", once
+	// this share of them agrees the turn ends. 0 turns voting off.
+	VoteSkipPercent int `json:"voteSkipPercent"`
+	// Priority is "high", "normal" or "low", see priority.go. Only admins
+	// can create high-priority sessions.
+	Priority string `json:"priority,omitempty"`
+	// ExportRoundingMs rounds the durations in CSV exports to this unit,
+	// 0 keeps milliseconds. ExportRounding is "nearest" (the default), "up"
+	// or "down", see rounding.go.
+	ExportRoundingMs int64  `json:"exportRoundingMs"`
+	ExportRounding   string `json:"exportRounding,omitempty"`
+}
+
+// public copies the settings for the state sent to every client, leaving
+// out credentials
+func (s Settings) public() Settings {
+	s.Integrations = s.Integrations.redacted()
+	return s
+}
+
+// reusable copies the settings for another session, leaving out what only
+// made sense for this one: its slug, schedule and integrations, and what
+// names its people: the roster, their clocks, the name and tags. High
+// priority is granted by an admin, so it isn't carried over either.
+func (s Settings) reusable() Settings {
+	s.Template = ""
+	s.Slug = ""
+	s.StartAt = nil
+	s.Integrations = nil
+	s.Name = ""
+	s.Tags = nil
+	s.Participants = nil
+	s.PlayerClocks = nil
+	if s.Priority == priorityHigh {
+		s.Priority = ""
+	}
+	return s
+}
+
+// defaultSettings are used for anything the new-session request leaves out
+func defaultSettings() Settings {
+	return Settings{}
+}
+
+// maxSettingsSize caps the body of a new-session request
+const maxSettingsSize = 1 << 20
+
+// parseSettings reads the optional JSON body of a new-session request. When
+// it names a template, the template's settings replace the defaults.
+func parseSettings(r *http.Request) (Settings, error) {
+	settings := defaultSettings()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSettingsSize))
+	if err != nil {
+		return settings, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// No body, use the defaults
+		return settings, nil
+	}
+	var choice struct {
+		Template string `json:"template"`
+	}
+	if err := json.Unmarshal(body, &choice); err != nil {
+		return settings, err
+	}
+	if choice.Template != "" {
+		if settings, err = templateSettings(choice.Template); err != nil {
+			return settings, err
+		}
+	}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return settings, err
+	}
+	return settings, settings.validate()
+}
+
+// validate checks that the settings can be used together
+func (s Settings) validate() error {
+	if utf8.RuneCountInString(s.Name) > maxNameLength {
+		return fmt.Errorf("sessionName cannot be longer than %d characters", maxNameLength)
+	}
+	if utf8.RuneCountInString(s.Emoji) > maxEmojiLength {
+		return errors.New("emoji should be a single emoji")
+	}
+	if s.SharedDevice && len(s.Participants) == 0 {
+		return errors.New("sharedDevice needs a list of participants")
+	}
+	if s.Simultaneous && (s.IndividualTimers || s.SharedDevice) {
+		return errors.New("simultaneous cannot be combined with individualTimers or sharedDevice")
+	}
+	if s.LateJoiners != "" && s.LateJoiners != lateJoinersInsert && s.LateJoiners != lateJoinersSkip {
+		return fmt.Errorf("lateJoiners must be %q or %q", lateJoinersInsert, lateJoinersSkip)
+	}
+	if s.NextDebounceMs < 0 {
+		return errors.New("nextDebounceMs cannot be negative")
+	}
+	if s.MinLapMs < 0 {
+		return errors.New("minLapMs cannot be negative")
+	}
+	if s.MaxDurationMs < 0 {
+		return errors.New("maxDurationMs cannot be negative")
+	}
+	if s.Rounds < 0 {
+		return errors.New("rounds cannot be negative")
+	}
+	if s.TurnLimitMs < 0 {
+		return errors.New("turnLimitMs cannot be negative")
+	}
+	if s.TargetMs < 0 {
+		return errors.New("targetMs cannot be negative")
+	}
+	if s.CountdownMs < 0 {
+		return errors.New("countdownMs cannot be negative")
+	}
+	if s.TimeBankMs < 0 {
+		return errors.New("timeBankMs cannot be negative")
+	}
+	if s.IncrementMs < 0 || s.DelayMs < 0 {
+		return errors.New("incrementMs and delayMs cannot be negative")
+	}
+	if s.TimeBankMs == 0 && (s.IncrementMs > 0 || s.DelayMs > 0 || len(s.PlayerClocks) > 0) {
+		return errors.New("incrementMs, delayMs and playerClocks need a timeBankMs")
+	}
+	if s.WorkMs < 0 || s.BreakMs < 0 {
+		return errors.New("workMs and breakMs cannot be negative")
+	}
+	if (s.WorkMs == 0) != (s.BreakMs == 0) {
+		return errors.New("workMs and breakMs must be set together")
+	}
+	if s.AutoStartAt < 0 {
+		return errors.New("autoStartAt cannot be negative")
+	}
+	if s.AutoStartAt > 0 && (s.IndividualTimers || s.Simultaneous) {
+		return errors.New("autoStartAt needs turns, it cannot be combined with individualTimers or simultaneous")
+	}
+	if s.ReadyQuorum < 0 {
+		return errors.New("readyQuorum cannot be negative")
+	}
+	if s.ReadyQuorum > 0 && !s.ReadyCheck {
+		return errors.New("readyQuorum needs readyCheck")
+	}
+	if s.ReadyCheck && s.IndividualTimers {
+		return errors.New("readyCheck cannot be combined with individualTimers, there is no shared first turn")
+	}
+	if s.VoteSkipPercent < 0 || s.VoteSkipPercent > 100 {
+		return errors.New("voteSkipPercent must be between 0 and 100")
+	}
+	if s.VoteSkipPercent > 0 && (s.IndividualTimers || s.Simultaneous) {
+		return errors.New("voteSkipPercent needs turns, it cannot be combined with individualTimers or simultaneous")
+	}
+	if s.HandoffConfirmMs < 0 {
+		return errors.New("handoffConfirmMs cannot be negative")
+	}
+	if s.HandoffConfirmMs > 0 && (s.IndividualTimers || s.Simultaneous) {
+		return errors.New("handoffConfirmMs needs turns, it cannot be combined with individualTimers or simultaneous")
+	}
+	if s.BestOf < 0 {
+		return errors.New("bestOf cannot be negative")
+	}
+	if s.GuessTargetMs < 0 {
+		return errors.New("guessTargetMs cannot be negative")
+	}
+	if s.GuessTargetMs > 0 && (s.CountdownMs > 0 || s.TargetMs > 0 || s.TimeBankMs > 0) {
+		// Each of these would give the hidden time away
+		return errors.New("guessTargetMs cannot be combined with countdownMs, targetMs or timeBankMs")
+	}
+	if s.AlertSound != "" && soundFiles[s.AlertSound] == nil {
+		return fmt.Errorf("unknown alertSound %q", s.AlertSound)
+	}
+	if _, ok := statusLanguages[s.Language]; s.Language != "" && !ok {
+		return fmt.Errorf("unsupported language %q", s.Language)
+	}
+	if err := validatePriority(s.Priority); err != nil {
+		return err
+	}
+	if err := validateStartAt(s.StartAt); err != nil {
+		return err
+	}
+	if s.Lobby && s.StartAt != nil {
+		return errors.New("lobby cannot be combined with startAt, the host opens the session")
+	}
+	if err := validateIntegrations(s.Integrations); err != nil {
+		return err
+	}
+	if err := validateTimers(s.Timers); err != nil {
+		return err
+	}
+	if err := validateCues(s.Cues); err != nil {
+		return err
+	}
+	if err := validateRounding(s); err != nil {
+		return err
+	}
+	if err := validateTags(s.Tags); err != nil {
+		return err
+	}
+	if s.Slug != "" && !validSlug(s.Slug) {
+		return errors.New("slug should be 3 to 64 lowercase letters, digits and dashes")
+	}
+	for name, clock := range s.PlayerClocks {
+		if clock.TimeBankMs < 0 || clock.IncrementMs < 0 || clock.DelayMs < 0 {
+			return fmt.Errorf("playerClocks for %q cannot be negative", name)
+		}
+	}
+	if s.AutoAdvance && s.CountdownMs == 0 {
+		return errors.New("autoAdvance needs a countdownMs")
+	}
+	return nil
+}
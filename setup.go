@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A fresh instance, one with neither a config file nor an admin token in
+// its environment, serves a setup page at /setup that writes the config
+// file. The file holds KEY=value lines for the same PASTATIME_* variables
+// docker-compose.yml lists, and variables set in the environment win over
+// it. To keep strangers from claiming an exposed instance, saving needs the
+// one-time code the server logs on startup.
+
+// defaultConfigPath is where the config file lives unless PASTATIME_CONFIG
+// says otherwise
+const defaultConfigPath = "pastatime.env"
+
+// minAdminTokenLength keeps the setup page from accepting a guessable token
+const minAdminTokenLength = 12
+
+// setupVariables are what the setup page can configure
+var setupVariables = []string{"PASTATIME_ADMIN_TOKEN", "PASTATIME_BASE_URL", "PASTATIME_SQLITE_PATH", "PASTATIME_SESSION_TTL"}
+
+// baseURL is the public address of the server, set with PASTATIME_BASE_URL,
+// used for absolute links handed out to other services
+var baseURL string
+
+var (
+	setupMux  sync.Mutex
+	setupPath string // config file the setup page writes, empty once set up
+	setupCode string
+)
+
+// SetupRequest is what the setup page posts
+type SetupRequest struct {
+	SetupCode  string `json:"setupCode"`
+	AdminToken string `json:"adminToken"`
+	BaseURL    string `json:"baseUrl"`
+	SQLitePath string `json:"sqlitePath"`
+	SessionTTL string `json:"sessionTtl"`
+}
+
+// loadConfigFile sets the variables of the config file that the environment
+// doesn't, and turns the setup page on when there is nothing to load
+func loadConfigFile() {
+	path := os.Getenv("PASTATIME_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if os.Getenv("PASTATIME_ADMIN_TOKEN") == "" {
+			enableSetup(path)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Reading config file %s failed: %v\n", path, err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			log.Printf("Ignoring line %q of %s, it should be KEY=value\n", line, path)
+			continue
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	log.Printf("Loaded config file %s\n", path)
+}
+
+// enableSetup serves the setup page until the config file at path is written
+func enableSetup(path string) {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	setupMux.Lock()
+	setupPath = path
+	setupCode = hex.EncodeToString(buf)
+	setupMux.Unlock()
+	log.Printf("No configuration found, open /setup and enter the code %s to set this instance up\n", setupCode)
+}
+
+// baseURLFromEnv reads PASTATIME_BASE_URL
+func baseURLFromEnv() string {
+	value := os.Getenv("PASTATIME_BASE_URL")
+	if err := validateBaseURL(value); err != nil {
+		log.Printf("Ignoring PASTATIME_BASE_URL=%q, %v\n", value, err)
+		return ""
+	}
+	return strings.TrimSuffix(value, "/")
+}
+
+// validateBaseURL checks the server's public address, empty means unknown
+func validateBaseURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("it should be an address like https://pastatime.example.com")
+	}
+	return nil
+}
+
+// validate checks a setup request before anything is written
+func (req SetupRequest) validate() error {
+	if len(req.AdminToken) < minAdminTokenLength {
+		return fmt.Errorf("the admin token needs at least %d characters", minAdminTokenLength)
+	}
+	if err := validateBaseURL(req.BaseURL); err != nil {
+		return fmt.Errorf("base URL: %v", err)
+	}
+	if req.SQLitePath != "" && openSQLiteStore == nil {
+		return errors.New("this build has no SQLite support, rebuild with -tags sqlite or leave the database path empty")
+	}
+	if req.SessionTTL != "" {
+		if ttl, err := time.ParseDuration(req.SessionTTL); err != nil || ttl <= 0 {
+			return errors.New("session TTL should be a duration like 24h")
+		}
+	}
+	for _, value := range []string{req.AdminToken, req.BaseURL, req.SQLitePath, req.SessionTTL} {
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("values can't span lines")
+		}
+	}
+	return nil
+}
+
+// configFile renders the request as the config file's KEY=value lines
+func (req SetupRequest) configFile() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by the Pastatime setup page on %s\n", time.Now().Format(time.RFC3339))
+	for i, value := range []string{req.AdminToken, req.BaseURL, req.SQLitePath, req.SessionTTL} {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", setupVariables[i], value)
+		}
+	}
+	return []byte(b.String())
+}
+
+// handleSetupPage serves /setup while the instance isn't set up
+func handleSetupPage(w http.ResponseWriter, r *http.Request) {
+	setupMux.Lock()
+	pending := setupPath != ""
+	setupMux.Unlock()
+	if !pending {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.ServeFile(w, r, "./frontend/setup.html")
+}
+
+// handleSetupAPI serves /setup/api: GET tells whether setup is still open,
+// POST with a SetupRequest writes the config file
+func handleSetupAPI(w http.ResponseWriter, r *http.Request) {
+	setupMux.Lock()
+	defer setupMux.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"pending": setupPath != ""})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if setupPath == "" {
+		http.Error(w, "This instance is already set up", http.StatusGone)
+		return
+	}
+	var req SetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.SetupCode), []byte(setupCode)) != 1 {
+		log.Println("Setup: Wrong setup code")
+		http.Error(w, "Wrong setup code, it is in the server log", http.StatusForbidden)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// O_EXCL so a config file that appeared meanwhile is never overwritten
+	file, err := os.OpenFile(setupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = file.Write(req.configFile())
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Setup: Writing %s failed: %v\n", setupPath, err)
+		http.Error(w, "Writing the config file failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Setup: Wrote %s, restart the server to apply it\n", setupPath)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"configFile": setupPath, "restartRequired": true})
+	setupPath = ""
+	setupCode = ""
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// shortCodeAlphabet leaves out characters that are easy to misread in a QR
+// caption, and capitals so a code can be read aloud and typed on a phone
+const shortCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// legacyShortCodeAlphabet is what codes were drawn from before they were
+// lowercase, sessions saved or exported back then still use them
+const legacyShortCodeAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// shortCodeLength gives about 29 bits, plenty for the sessions one server holds
+const shortCodeLength = 6
+
+// shortLinkHits counts redirects per code, published on /debug/vars
+var shortLinkHits = expvar.NewMap("shortLinkHits")
+
+// newShortCode returns a random short code, the session store rejects one
+// that is already taken
+func newShortCode() string {
+	buf := make([]byte, shortCodeLength)
+	rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = shortCodeAlphabet[int(b)%len(shortCodeAlphabet)]
+	}
+	return string(buf)
+}
+
+// handleShortLink redirects /j/{shortcode} to the session it was created
+// for. Codes are matched regardless of case, except the mixed-case ones of
+// sessions created before codes were lowercase.
+func handleShortLink(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/j/")
+
+	sessionID, ok := sessionStore.Resolve(code)
+	if !ok {
+		code = strings.ToLower(code)
+		sessionID, ok = sessionStore.Resolve(code)
+	}
+	if !ok {
+		log.Printf("Short link not found: %s\n", code)
+		http.NotFound(w, r)
+		return
+	}
+
+	shortLinkHits.Add(code, 1)
+	target := "/s/" + sessionID
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
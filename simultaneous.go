@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// handleSimultaneousCommand runs a command in a session where everyone is
+// timed at once: the host starts every clock, each client stops their own
+func (s *Session) handleSimultaneousCommand(clientID string, isHost bool, cmd string) {
+	switch cmd {
+	case "start":
+		if !isHost {
+			log.Printf("Session %s: Client %s is not the host. Ignoring command: %s\n", s.ID, clientID, cmd)
+			return
+		}
+		s.clientsMux.Lock()
+		ids := make([]string, 0, len(s.clientOrder))
+		for _, id := range s.clientOrder {
+			if !s.clients[id].offline {
+				ids = append(ids, id)
+			}
+		}
+		s.clientsMux.Unlock()
+
+		s.stateMux.Lock()
+		s.startSimultaneous(ids)
+		s.stateMux.Unlock()
+	case "stop":
+		s.stateMux.Lock()
+		s.stopSimultaneous(clientID)
+		s.stateMux.Unlock()
+	default:
+		log.Printf("Session %s: Unknown simultaneous command from %s: %s\n", s.ID, clientID, cmd)
+		return
+	}
+	go s.broadcastState()
+}
+
+// startSimultaneous starts a clock for each of ids at the same instant, only
+// the clients present now take part. stateMux must be held.
+func (s *Session) startSimultaneous(ids []string) {
+	if len(s.personalTimers) > 0 {
+		log.Printf("Session %s: Simultaneous clocks already started\n", s.ID)
+		return
+	}
+	now := time.Now()
+	for _, id := range ids {
+		s.personalTimers[id] = &PersonalTimer{running: true, startTime: now}
+	}
+	// The shared clock shows how long the whole group has been going
+	s.isRunning = true
+	s.startTime = now
+	if s.startedAt.IsZero() {
+		s.startedAt = now
+	}
+	log.Printf("Session %s: Simultaneous clocks started for %v\n", s.ID, ids)
+}
+
+// stopSimultaneous stops a client's clock and records it as their lap, the
+// session finishes with the last one. stateMux must be held.
+func (s *Session) stopSimultaneous(clientID string) {
+	t := s.personalTimers[clientID]
+	if t == nil || !t.running {
+		return
+	}
+	t.elapsed += time.Since(t.startTime)
+	t.running = false
+	lap := Lap{
+		Client: clientID,
+		Time:   t.elapsed,
+		TimeMs: t.elapsed.Milliseconds(),
+	}
+	s.applyHandicap(&lap)
+	s.recordLap(lap)
+	log.Printf("Session %s: %s stopped at %v\n", s.ID, clientID, t.elapsed)
+	go s.broadcastEvent(map[string]interface{}{
+		"type":   "timerStopped",
+		"client": clientID,
+		"timeMs": t.elapsed.Milliseconds(),
+	})
+
+	for _, other := range s.personalTimers {
+		if other.running {
+			return
+		}
+	}
+	s.finish("allStopped")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+// Session IDs are pasta-flavoured slugs like "salty-penne-42", easy to read
+// aloud and to type on a phone. There are about 90,000 of them, so the
+// session store turns a taken one down and the caller draws another.
+// Sessions can also ask for a slug of their own, see Settings.Slug.
+
+// maxSlugAttempts is how often a requested slug is tried before giving up,
+// the short code drawn with it could be taken too
+const maxSlugAttempts = 5
+
+var slugAdjectives = []string{
+	"al-dente", "baked", "bold", "buttery", "cheesy", "crispy", "fresh", "fried",
+	"garlicky", "golden", "hearty", "herby", "hot", "lemony", "little", "lucky",
+	"mellow", "nutty", "peppery", "plain", "quick", "rich", "rustic", "saucy",
+	"salty", "smoky", "spicy", "sunny", "sweet", "tangy", "tiny", "zesty",
+}
+
+var slugShapes = []string{
+	"bucatini", "cannelloni", "capellini", "conchiglie", "ditalini", "farfalle",
+	"fettuccine", "fusilli", "gemelli", "gnocchi", "lasagne", "linguine",
+	"macaroni", "manicotti", "orecchiette", "orzo", "paccheri", "pappardelle",
+	"penne", "pici", "radiatori", "ravioli", "rigatoni", "rotini", "spaghetti",
+	"tagliatelle", "tortellini", "trofie", "vermicelli", "ziti", "cavatelli",
+	"campanelle",
+}
+
+// newSessionSlug returns a random slug for a new session's ID
+func newSessionSlug() string {
+	return fmt.Sprintf("%s-%s-%d",
+		slugAdjectives[rand.Intn(len(slugAdjectives))],
+		slugShapes[rand.Intn(len(slugShapes))],
+		10+rand.Intn(90))
+}
+
+// validSlug accepts a requested slug: a session ID of at least 3 characters
+// that neither starts nor ends with a dash
+func validSlug(slug string) bool {
+	return len(slug) >= 3 && validSessionID(slug) && !strings.HasPrefix(slug, "-") && !strings.HasSuffix(slug, "-")
+}
+
+// releaseSlug retires the finished session holding slug so a new one can
+// have it, it was archived when it finished. False when a session still
+// going on holds it.
+func releaseSlug(slug string) bool {
+	existing, ok := sessionStore.Get(slug)
+	if !ok {
+		return true
+	}
+	existing.stateMux.Lock()
+	finished := existing.finished
+	existing.stateMux.Unlock()
+	if !finished {
+		return false
+	}
+	log.Printf("Session %s: Finished, its slug goes to a new session\n", slug)
+	existing.retire("replaced")
+	return true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server publishes its goroutine count next to memstats on /debug/vars,
+// which is what "pastatime soak" watches
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// soakSettle is how long the server gets to wind down after a cycle's
+// clients leave, before it is measured
+const soakSettle = 5 * time.Second
+
+// serverVars is the part of /debug/vars the soak test reads
+type serverVars struct {
+	Goroutines int `json:"goroutines"`
+	Memstats   struct {
+		HeapAlloc uint64 `json:"HeapAlloc"`
+	} `json:"memstats"`
+}
+
+// runSoak is the "pastatime soak" subcommand: it keeps a running server
+// busy for hours with clients joining, taking turns and leaving, and fails
+// if goroutines or the heap keep growing from one cycle to the next
+func runSoak(args []string) {
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "address of the Pastatime server")
+	sessionCount := flags.Int("sessions", 10, "sessions to keep busy")
+	clientCount := flags.Int("clients", 4, "clients per session and cycle")
+	cycle := flags.Duration("cycle", time.Minute, "how long the clients of a cycle stay connected")
+	duration := flags.Duration("duration", time.Hour, "how long to soak for")
+	goroutineSlack := flags.Int("goroutine-slack", 20, "goroutines allowed above the first cycle's")
+	heapGrowth := flags.Float64("heap-growth", 0.5, "heap growth allowed over the first cycle's, as a fraction")
+	flags.Parse(args)
+
+	base := strings.TrimSuffix(*baseURL, "/")
+	sessionIDs := make([]string, 0, *sessionCount)
+	for range *sessionCount {
+		resp, err := http.Post(base+"/new-session", "application/json", strings.NewReader(`{"sessionName":"Soak"}`))
+		if err != nil {
+			log.Fatalf("pastatime soak: creating a session: %v", err)
+		}
+		var created struct {
+			SessionID string `json:"sessionId"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&created)
+		resp.Body.Close()
+		if err != nil || created.SessionID == "" {
+			log.Fatalf("pastatime soak: creating a session: %s %v", resp.Status, err)
+		}
+		sessionIDs = append(sessionIDs, created.SessionID)
+	}
+	log.Printf("Soaking %s with %d sessions of %d clients for %v, %v cycles\n", base, len(sessionIDs), *clientCount, *duration, *cycle)
+
+	var baseline serverVars
+	deadline := time.Now().Add(*duration)
+	for n := 1; n == 1 || time.Now().Before(deadline); n++ {
+		soakCycle(base, sessionIDs, *clientCount, *cycle)
+		time.Sleep(soakSettle)
+		vars, err := settledVars(base)
+		if err != nil {
+			log.Fatalf("pastatime soak: reading /debug/vars: %v", err)
+		}
+		log.Printf("Cycle %d: %d goroutines, %d KiB heap\n", n, vars.Goroutines, vars.Memstats.HeapAlloc>>10)
+		if n == 1 {
+			// The first cycle warms the server up and sets the baseline
+			baseline = vars
+			continue
+		}
+		if vars.Goroutines > baseline.Goroutines+*goroutineSlack {
+			fmt.Fprintf(os.Stderr, "FAIL: %d goroutines after cycle %d, %d after the first\n", vars.Goroutines, n, baseline.Goroutines)
+			os.Exit(1)
+		}
+		if float64(vars.Memstats.HeapAlloc) > float64(baseline.Memstats.HeapAlloc)*(1+*heapGrowth) {
+			fmt.Fprintf(os.Stderr, "FAIL: %d KiB heap after cycle %d, %d KiB after the first\n",
+				vars.Memstats.HeapAlloc>>10, n, baseline.Memstats.HeapAlloc>>10)
+			os.Exit(1)
+		}
+	}
+	fmt.Println("PASS: goroutines and heap stayed flat")
+}
+
+// soakCycle connects clients to every session, has them take turns for the
+// length of the cycle, then disconnects them all
+func soakCycle(base string, sessionIDs []string, clientCount int, cycle time.Duration) {
+	wsBase := "ws" + strings.TrimPrefix(base, "http")
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, sessionID := range sessionIDs {
+		for range clientCount {
+			conn, _, err := websocket.DefaultDialer.Dial(wsBase+"/s/"+sessionID+"/ws", nil)
+			if err != nil {
+				log.Printf("Soak: connecting to %s: %v\n", sessionID, err)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				soakClient(conn, stop)
+			}()
+		}
+	}
+	time.Sleep(cycle)
+	close(stop)
+	wg.Wait()
+}
+
+// soakClient presses start or next whenever it has the turn, like a
+// participant who speaks for a second or two
+func soakClient(conn *websocket.Conn, stop chan struct{}) {
+	defer conn.Close()
+	var mu sync.Mutex
+	var yourTurn, running bool
+	go func() {
+		for {
+			var msg struct {
+				Type         string `json:"type"`
+				YourID       string `json:"yourId"`
+				ActiveClient string `json:"activeClient"`
+				Running      bool   `json:"running"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type == "update" {
+				mu.Lock()
+				yourTurn = msg.YourID != "" && msg.YourID == msg.ActiveClient
+				running = msg.Running
+				mu.Unlock()
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		case <-time.After(time.Second + time.Duration(rand.Int63n(int64(time.Second)))):
+		}
+		mu.Lock()
+		command := ""
+		if yourTurn {
+			command = "next"
+			if !running {
+				command = "start"
+			}
+		}
+		mu.Unlock()
+		if command != "" {
+			conn.WriteJSON(map[string]string{"type": "command", "command": command})
+		}
+	}
+}
+
+// settledVars reads /debug/vars a few times and keeps the lowest figures,
+// so a garbage collection that hasn't run yet doesn't look like a leak
+func settledVars(base string) (serverVars, error) {
+	var settled serverVars
+	for i := range 10 {
+		resp, err := http.Get(base + "/debug/vars")
+		if err != nil {
+			return settled, err
+		}
+		var vars serverVars
+		err = json.NewDecoder(resp.Body).Decode(&vars)
+		resp.Body.Close()
+		if err != nil {
+			return settled, err
+		}
+		if i == 0 || vars.Goroutines < settled.Goroutines {
+			settled.Goroutines = vars.Goroutines
+		}
+		if i == 0 || vars.Memstats.HeapAlloc < settled.Memstats.HeapAlloc {
+			settled.Memstats.HeapAlloc = vars.Memstats.HeapAlloc
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return settled, nil
+}
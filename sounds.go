@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tone is one note of a bundled sound
+type tone struct {
+	freq   float64
+	at     time.Duration
+	length time.Duration
+	square bool
+}
+
+// soundTones describe the bundled sounds, named like the cue sounds
+var soundTones = map[string][]tone{
+	"beep": {{freq: 880, length: 150 * time.Millisecond}},
+	"chime": {
+		{freq: 660, length: 200 * time.Millisecond},
+		{freq: 990, at: 200 * time.Millisecond, length: 300 * time.Millisecond},
+	},
+	"buzz": {{freq: 150, length: 400 * time.Millisecond, square: true}},
+}
+
+const soundSampleRate = 22050
+
+var (
+	// soundFiles are rendered once at startup, kiosks on the LAN fetch them
+	// from here instead of from the internet
+	soundFiles = renderSounds()
+	// soundsModTime lets clients revalidate their cached copies
+	soundsModTime = time.Now()
+)
+
+// renderSounds turns every entry of soundTones into a WAV file
+func renderSounds() map[string][]byte {
+	files := make(map[string][]byte, len(soundTones))
+	for name, tones := range soundTones {
+		files[name] = renderWAV(tones)
+	}
+	return files
+}
+
+// wavFormat is the fmt chunk of a WAV file, after its "fmt " tag
+type wavFormat struct {
+	ChunkSize     uint32
+	Format        uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+}
+
+// renderWAV synthesizes tones as 16-bit mono PCM in a WAV container
+func renderWAV(tones []tone) []byte {
+	var end time.Duration
+	for _, t := range tones {
+		end = max(end, t.at+t.length)
+	}
+	samples := make([]int16, int(end.Seconds()*soundSampleRate))
+	for _, t := range tones {
+		first := int(t.at.Seconds() * soundSampleRate)
+		count := int(t.length.Seconds() * soundSampleRate)
+		for i := 0; i < count && first+i < len(samples); i++ {
+			v := math.Sin(2 * math.Pi * t.freq * float64(i) / soundSampleRate)
+			if t.square {
+				v = math.Copysign(1, v)
+			}
+			// Fade out to avoid a click at the end of the note
+			fade := 1 - float64(i)/float64(count)
+			samples[first+i] += int16(v * fade * 0.2 * math.MaxInt16)
+		}
+	}
+
+	var buf bytes.Buffer
+	dataSize := uint32(len(samples) * 2)
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, wavFormat{
+		ChunkSize:     16,
+		Format:        1, // PCM
+		Channels:      1,
+		SampleRate:    soundSampleRate,
+		ByteRate:      soundSampleRate * 2,
+		BlockAlign:    2,
+		BitsPerSample: 16,
+	})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, dataSize)
+	binary.Write(&buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
+// handleSound serves /sounds/{name}.wav, ServeContent takes care of range
+// requests and conditional GETs
+func handleSound(w http.ResponseWriter, r *http.Request) {
+	file := strings.TrimPrefix(r.URL.Path, "/sounds/")
+	data, ok := soundFiles[strings.TrimSuffix(file, ".wav")]
+	if !ok || !strings.HasSuffix(file, ".wav") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, file, soundsModTime, bytes.NewReader(data))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSplits caps the splits of a single turn
+const maxSplits = 50
+
+// Split is an intermediate time within a turn, e.g. one step of a recipe
+type Split struct {
+	TimeMs int64  `json:"timeMs"` // since the turn started
+	Label  string `json:"label,omitempty"`
+}
+
+// recordSplit notes how far into the turn the active client is without
+// ending it. stateMux must be held.
+func (s *Session) recordSplit(clientID string, label string) {
+	if s.startedAt.IsZero() {
+		log.Printf("Session %s: No turn has started, ignoring split from %s\n", s.ID, clientID)
+		return
+	}
+	if len(s.splits) >= maxSplits {
+		log.Printf("Session %s: Turn already has %d splits, ignoring split from %s\n", s.ID, maxSplits, clientID)
+		return
+	}
+	if utf8.RuneCountInString(label) > maxNameLength {
+		label = string([]rune(label)[:maxNameLength])
+	}
+	elapsed := s.elapsed
+	if s.isRunning {
+		elapsed += time.Since(s.startTime)
+	}
+	split := Split{TimeMs: elapsed.Milliseconds(), Label: label}
+	s.splits = append(s.splits, split)
+	log.Printf("Session %s: Split %d for %s at %v\n", s.ID, len(s.splits), clientID, elapsed)
+}
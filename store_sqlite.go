@@ -0,0 +1,250 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps session snapshots in a single SQLite table. Building
+// with -tags sqlite, as the Dockerfile does, includes it and the pure Go
+// modernc.org/sqlite driver
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteMigrations bring the schema up to date one version at a time, the
+// database's user_version is how many of them ran. Only ever append to them.
+var sqliteMigrations = []string{
+	// 1: the tables from before the schema was versioned, which older
+	// databases already have
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id       TEXT PRIMARY KEY,
+		data     TEXT NOT NULL,
+		saved_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS archive (
+		id          TEXT NOT NULL,
+		data        TEXT NOT NULL,
+		archived_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS templates (
+		name TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+	// 2: the archive is paged and trimmed newest first
+	`CREATE INDEX IF NOT EXISTS archive_newest ON archive (archived_at DESC, id DESC)`,
+}
+
+func init() {
+	openSQLiteStore = func(path string) (snapshotStore, error) {
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			return nil, err
+		}
+		from, err := migrateSQLite(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if from < len(sqliteMigrations) {
+			log.Printf("Migrated %s from schema version %d to %d\n", path, from, len(sqliteMigrations))
+		}
+		return &sqliteStore{db: db}, nil
+	}
+}
+
+// migrateSQLite runs the migrations the database hasn't had, each in its own
+// transaction, and returns the version it was at
+func migrateSQLite(db *sql.DB) (int, error) {
+	var from int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&from); err != nil {
+		return 0, err
+	}
+	if from > len(sqliteMigrations) {
+		return from, fmt.Errorf("schema version %d is newer than this build's %d", from, len(sqliteMigrations))
+	}
+	for version := from; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return from, err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return from, fmt.Errorf("migrating to schema version %d: %v", version+1, err)
+		}
+		// The version is in the database header, written with the migration
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return from, err
+		}
+		if err := tx.Commit(); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+func (s *sqliteStore) save(sessionID string, data []byte, savedAt time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (id, data, saved_at) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data, saved_at = excluded.saved_at`,
+		sessionID, string(data), savedAt.UnixMilli())
+	return err
+}
+
+func (s *sqliteStore) loadSince(cutoff time.Time) (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT id, data FROM sessions WHERE saved_at >= ?`, cutoff.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	saved := make(map[string][]byte)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		saved[id] = []byte(data)
+	}
+	return saved, rows.Err()
+}
+
+func (s *sqliteStore) removeBefore(cutoff time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE saved_at < ?`, cutoff.UnixMilli())
+	return err
+}
+
+func (s *sqliteStore) remove(sessionID string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, sessionID)
+	return err
+}
+
+func (s *sqliteStore) ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqliteStore) archive(entry ArchiveEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO archive (id, data, archived_at) VALUES (?, ?, ?)`,
+		entry.ID, string(data), entry.ArchivedAt.UnixMilli())
+	if err != nil {
+		return err
+	}
+	// Only the newest maxStoredArchive entries are kept
+	_, err = s.db.Exec(`DELETE FROM archive WHERE rowid NOT IN (
+		SELECT rowid FROM archive ORDER BY archived_at DESC, rowid DESC LIMIT ?)`, maxStoredArchive)
+	return err
+}
+
+func (s *sqliteStore) history(query ArchiveQuery, offset int, limit int) ([]ArchiveEntry, int, error) {
+	// The entries are JSON, the conditions look into it
+	where := ""
+	args := []interface{}{}
+	if query.Name != "" {
+		where += ` AND instr(lower(json_extract(data, '$.name')), lower(?)) > 0`
+		args = append(args, query.Name)
+	}
+	for _, tag := range query.Tags {
+		where += ` AND EXISTS (SELECT 1 FROM json_each(data, '$.tags') WHERE value = ?)`
+		args = append(args, tag)
+	}
+	if query.Participant != "" {
+		where += ` AND EXISTS (SELECT 1 FROM json_each(data, '$.participants') WHERE lower(value) = lower(?))`
+		args = append(args, query.Participant)
+	}
+	if query.Template != "" {
+		where += ` AND json_extract(data, '$.template') = ?`
+		args = append(args, query.Template)
+	}
+	if query.Before != nil {
+		where += ` AND (archived_at < ? OR (archived_at = ? AND id < ?))`
+		args = append(args, query.Before.ArchivedAt, query.Before.ArchivedAt, query.Before.ID)
+	}
+	if !query.From.IsZero() {
+		where += ` AND julianday(json_extract(data, '$.createdAt')) >= julianday(?)`
+		args = append(args, query.From.UTC().Format(time.RFC3339Nano))
+	}
+	if !query.To.IsZero() {
+		where += ` AND julianday(json_extract(data, '$.createdAt')) < julianday(?)`
+		args = append(args, query.To.UTC().Format(time.RFC3339Nano))
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM archive WHERE 1`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query(`SELECT data FROM archive WHERE 1`+where+` ORDER BY archived_at DESC, id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	entries := []ArchiveEntry{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		var entry ArchiveEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+func (s *sqliteStore) template(name string) ([]byte, bool, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM templates WHERE name = ?`, name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return []byte(data), err == nil, err
+}
+
+func (s *sqliteStore) templates() (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT name, data FROM templates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all := make(map[string][]byte)
+	for rows.Next() {
+		var name, data string
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, err
+		}
+		all[name] = []byte(data)
+	}
+	return all, rows.Err()
+}
+
+func (s *sqliteStore) saveTemplate(name string, data []byte, replace bool) error {
+	if replace {
+		_, err := s.db.Exec(`INSERT INTO templates (name, data) VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET data = excluded.data`, name, string(data))
+		return err
+	}
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO templates (name, data) VALUES (?, ?)`, name, string(data))
+	if err != nil {
+		return err
+	}
+	if added, err := result.RowsAffected(); err == nil && added == 0 {
+		return errTemplateExists
+	}
+	return nil
+}
+
+func (s *sqliteStore) deleteTemplate(name string) error {
+	_, err := s.db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+	return err
+}
@@ -0,0 +1,203 @@
+//go:build sqlite
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLiteStore(t *testing.T, path string) *sqliteStore {
+	t.Helper()
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	t.Cleanup(func() { store.(*sqliteStore).db.Close() })
+	return store.(*sqliteStore)
+}
+
+// A session saved by one instance comes back on the next one, its laps
+// trimmed to a lower PASTATIME_MAX_LAPS
+func TestSQLiteRestoresSessionsAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pastatime.db")
+	defer func(store SessionStore, laps int) { sessionStore, maxLaps = store, laps }(sessionStore, maxLaps)
+
+	sessionStore = newMemorySessionStore()
+	session, err := newSession("saved-penne-1", "abc123", Settings{Name: "Stand-up", Participants: []string{"ann", "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		session.recordLap(Lap{Client: "ann", Time: time.Duration(i) * time.Second, TimeMs: int64(i) * 1000})
+	}
+	if err := session.registerSession(); err != nil {
+		t.Fatal(err)
+	}
+	before := &persister{store: openTestSQLiteStore(t, path), ttl: time.Hour, saved: make(map[string][]byte)}
+	before.saveChanged()
+
+	// The next instance starts with nothing but the database
+	sessionStore = newMemorySessionStore()
+	maxLaps = 3
+	after := &persister{store: openTestSQLiteStore(t, path), ttl: time.Hour, saved: make(map[string][]byte)}
+	after.restore()
+
+	restored, ok := sessionStore.Get("saved-penne-1")
+	if !ok {
+		t.Fatal("the session wasn't restored")
+	}
+	if restored.shortCode != "abc123" || restored.settings.Name != "Stand-up" {
+		t.Errorf("restored %q with name %q, want abc123 and Stand-up", restored.shortCode, restored.settings.Name)
+	}
+	if len(restored.lapHistory) != 3 || restored.lapsDropped != 2 || restored.lapHistory[0].TimeMs != 3000 {
+		t.Errorf("restored %d laps from %v with %d dropped, want the last 3 with 2 dropped",
+			len(restored.lapHistory), restored.lapHistory, restored.lapsDropped)
+	}
+	if restored.isRunning {
+		t.Error("a restored session should be paused")
+	}
+}
+
+func TestSQLiteArchiveSearch(t *testing.T) {
+	store := openTestSQLiteStore(t, filepath.Join(t.TempDir(), "pastatime.db"))
+	day := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	entries := []ArchiveEntry{
+		{ID: "a", Name: "Friday stand-up", Tags: []string{"team-a"}, CreatedAt: day, ArchivedAt: day, Participants: []string{"Alice", "bob"}},
+		{ID: "b", Name: "Retro", Tags: []string{"team-a", "retro"}, Template: "retro", CreatedAt: day.Add(24 * time.Hour), ArchivedAt: day.Add(24 * time.Hour), Participants: []string{"carol"}},
+		{ID: "c", Name: "Monday stand-up", Tags: []string{"team-b"}, CreatedAt: day.Add(48 * time.Hour), ArchivedAt: day.Add(48 * time.Hour), Participants: []string{"alice"}},
+	}
+	for _, entry := range entries {
+		if err := store.archive(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query ArchiveQuery
+		want  []string
+	}{
+		{"everything newest first", ArchiveQuery{}, []string{"c", "b", "a"}},
+		{"name in any case", ArchiveQuery{Name: "STAND-UP"}, []string{"c", "a"}},
+		{"every tag", ArchiveQuery{Tags: []string{"team-a", "retro"}}, []string{"b"}},
+		{"participant in any case", ArchiveQuery{Participant: "ALICE"}, []string{"c", "a"}},
+		{"date range", ArchiveQuery{From: day.Add(time.Hour), To: day.Add(48 * time.Hour)}, []string{"b"}},
+		{"template", ArchiveQuery{Template: "retro"}, []string{"b"}},
+		{"before a cursor", ArchiveQuery{Before: &ArchiveCursor{ArchivedAt: day.Add(48 * time.Hour).UnixMilli(), ID: "c"}}, []string{"b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, total, err := store.history(test.query, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, entry := range found {
+				ids = append(ids, entry.ID)
+			}
+			if total != len(test.want) || len(ids) != len(test.want) {
+				t.Fatalf("found %v of %d, want %v", ids, total, test.want)
+			}
+			for i := range ids {
+				if ids[i] != test.want[i] {
+					t.Fatalf("found %v, want %v", ids, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteTemplates(t *testing.T) {
+	store := openTestSQLiteStore(t, filepath.Join(t.TempDir(), "pastatime.db"))
+	if err := store.saveTemplate("standup", []byte(`{"countdownMs":60000}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.saveTemplate("standup", []byte(`{}`), false); err != errTemplateExists {
+		t.Fatalf("saving over a template gave %v, want errTemplateExists", err)
+	}
+	if err := store.saveTemplate("standup", []byte(`{"countdownMs":90000}`), true); err != nil {
+		t.Fatal(err)
+	}
+	data, ok, err := store.template("standup")
+	if err != nil || !ok || string(data) != `{"countdownMs":90000}` {
+		t.Fatalf("got %s, %v, %v, want the replaced template", data, ok, err)
+	}
+	if err := store.deleteTemplate("standup"); err != nil {
+		t.Fatal(err)
+	}
+	if all, err := store.templates(); err != nil || len(all) != 0 {
+		t.Fatalf("got %v, %v after deleting, want none", all, err)
+	}
+}
+
+// A backup brings the sessions, archive and templates over to another
+// store, keeping what that store already has
+func TestSQLiteBackupRestore(t *testing.T) {
+	from := openTestSQLiteStore(t, filepath.Join(t.TempDir(), "from.db"))
+	day := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	from.save("saved-penne-1", []byte(`{"id":"saved-penne-1","shortCode":"abc123"}`), day)
+	from.archive(ArchiveEntry{ID: "a", CreatedAt: day, ArchivedAt: day})
+	from.archive(ArchiveEntry{ID: "b", CreatedAt: day, ArchivedAt: day.Add(time.Hour)})
+	from.saveTemplate("standup", []byte(`{"countdownMs":60000}`), false)
+	from.saveTemplate("retro", []byte(`{"countdownMs":90000}`), false)
+
+	var backup bytes.Buffer
+	if counts, err := writeBackup(&backup, from); err != nil || counts.Sessions != 1 || counts.Archive != 2 || counts.Templates != 2 {
+		t.Fatalf("backed up %+v, %v, want 1 session, 2 archive entries and 2 templates", counts, err)
+	}
+
+	to := openTestSQLiteStore(t, filepath.Join(t.TempDir(), "to.db"))
+	to.archive(ArchiveEntry{ID: "a", CreatedAt: day, ArchivedAt: day})
+	to.saveTemplate("retro", []byte(`{}`), false)
+	counts, err := readBackup(&backup, to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Sessions != 1 || counts.Archive != 1 || counts.Templates != 1 || len(counts.Skipped) != 1 {
+		t.Errorf("restored %+v, want 1 session, 1 archive entry, 1 template and the existing template skipped", counts)
+	}
+	if entries, total, _ := to.history(ArchiveQuery{}, 0, 10); total != 2 || entries[0].ID != "b" {
+		t.Errorf("archive holds %v, want b then a", entries)
+	}
+	if data, _, _ := to.template("retro"); string(data) != `{}` {
+		t.Errorf("retro is %s, want the template that was there", data)
+	}
+}
+
+// A database from before the schema was versioned is migrated in place, and
+// one from a newer build is refused
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pastatime.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE sessions (id TEXT PRIMARY KEY, data TEXT NOT NULL, saved_at INTEGER NOT NULL);
+		INSERT INTO sessions VALUES ('saved-penne-1', '{}', 1)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openTestSQLiteStore(t, path)
+	var version int
+	if err := store.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Fatalf("schema version %d, %v, want %d", version, err, len(sqliteMigrations))
+	}
+	if saved, err := store.loadSince(time.Time{}); err != nil || len(saved) != 1 {
+		t.Errorf("loaded %v, %v after migrating, want the saved session", saved, err)
+	}
+	if from, err := migrateSQLite(store.db); err != nil || from != len(sqliteMigrations) {
+		t.Errorf("migrating again started from %d, %v, want nothing to run", from, err)
+	}
+
+	store.db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(sqliteMigrations)+1))
+	if _, err := openSQLiteStore(path); err == nil {
+		t.Error("a database from a newer build was opened")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultStreamInterval is how often the time stream is sampled, e-paper
+	// displays can't redraw much faster than once a second anyway
+	defaultStreamInterval = time.Second
+	minStreamInterval     = 100 * time.Millisecond
+	// streamKeepAlive keeps proxies from closing a paused, silent stream
+	streamKeepAlive = 15 * time.Second
+)
+
+// clockReading returns the turn time and whether the clock is running
+func (s *Session) clockReading() (time.Duration, bool) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	if s.isRunning {
+		return s.elapsed + time.Since(s.startTime), true
+	}
+	return s.elapsed, false
+}
+
+// handleTimeStream serves /s/{id}/time, a server-sent event stream for tiny
+// clients like e-paper displays and watch apps. Each event is just the turn
+// time in milliseconds and 1 or 0 for running, e.g. "data: 83400 1", and is
+// only sent when it changed. ?interval=ms samples more often than once a second.
+func handleTimeStream(w http.ResponseWriter, r *http.Request, session *Session) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	session.stateMux.Lock()
+	hidden := session.clockHidden()
+	session.stateMux.Unlock()
+	if hidden {
+		http.Error(w, "The clock is hidden in the guessing game", http.StatusForbidden)
+		return
+	}
+	interval := defaultStreamInterval
+	if ms, err := strconv.Atoi(r.URL.Query().Get("interval")); err == nil {
+		interval = max(time.Duration(ms)*time.Millisecond, minStreamInterval)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	lastSent := time.Now()
+	for {
+		elapsed, running := session.clockReading()
+		runningFlag := 0
+		if running {
+			runningFlag = 1
+		}
+		// Round to the interval so a running clock doesn't send sub-tick noise
+		line := fmt.Sprintf("%d %d", elapsed.Truncate(interval).Milliseconds(), runningFlag)
+		if line != last {
+			fmt.Fprintf(w, "data: %s\n\n", line)
+			last = line
+			lastSent = time.Now()
+			flusher.Flush()
+		} else if time.Since(lastSent) >= streamKeepAlive {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			lastSent = time.Now()
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
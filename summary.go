@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"maps"
+	"sort"
+	"time"
+)
+
+// SessionSummary is built when a session finishes
+type SessionSummary struct {
+	FinishedAt   time.Time         `json:"finishedAt"`
+	DurationMs   int64             `json:"durationMs"` // wall clock since the timer first started
+	ActiveMs     int64             `json:"activeMs"`   // time the clock was running
+	PausedMs     int64             `json:"pausedMs"`   // time spent in explicit pauses
+	Pauses       []Pause           `json:"pauses"`
+	Reason       string            `json:"reason"`
+	Rounds       int               `json:"rounds"`
+	Laps         []Lap             `json:"laps"`
+	LapsDropped  int               `json:"lapsDropped,omitempty"` // before Laps, past PASTATIME_MAX_LAPS, counted in Participants
+	Participants []ParticipantStat `json:"participants"`
+	Attendance   []Attendance      `json:"attendance"`
+	LateArrivals []LateArrival     `json:"lateArrivals"`
+}
+
+// ParticipantStat sums up one participant's laps, dropped ones included, as
+// LapTotals does. The adjusted figures include handicaps and are only set for
+// participants who had one.
+type ParticipantStat struct {
+	Client            string `json:"client"`
+	Laps              int    `json:"laps"`
+	Skips             int    `json:"skips,omitempty"`
+	MissedTurns       int    `json:"missedTurns,omitempty"` // rounds sat out after joining late
+	TotalMs           int64  `json:"totalMs"`
+	AverageMs         int64  `json:"averageMs"`
+	AdjustedTotalMs   int64  `json:"adjustedTotalMs,omitempty"`
+	AdjustedAverageMs int64  `json:"adjustedAverageMs,omitempty"`
+	OvertimeMs        int64  `json:"overtimeMs,omitempty"` // past the countdown, over every turn
+}
+
+// finishWarningLead is how long before the maximum duration clients are warned
+const finishWarningLead = time.Minute
+
+// finish stops the timer for good and builds the summary, stateMux must be held
+func (s *Session) finish(reason string) {
+	if s.finished {
+		return
+	}
+	if s.isRunning {
+		s.closeSegment()
+		s.elapsed += time.Since(s.startTime)
+		s.isRunning = false
+	}
+	s.finished = true
+	s.summary = s.buildSummary(reason)
+	log.Printf("Session %s: Finished (%s) after %v\n", s.ID, reason, time.Duration(s.summary.DurationMs)*time.Millisecond)
+	go archiveSession(s.archiveEntry())
+
+	go s.broadcastEvent(map[string]interface{}{
+		"type":    "sessionFinished",
+		"summary": s.summary,
+	})
+}
+
+// buildSummary collects the lap statistics, stateMux must be held
+func (s *Session) buildSummary(reason string) *SessionSummary {
+	now := time.Now()
+	summary := &SessionSummary{
+		FinishedAt:   now,
+		Reason:       reason,
+		Rounds:       s.roundsDone,
+		Laps:         append([]Lap{}, s.lapHistory...),
+		LapsDropped:  s.lapsDropped,
+		Attendance:   s.attendanceReport(),
+		LateArrivals: append([]LateArrival{}, s.lateArrivals...),
+		Pauses:       s.pauseHistory(),
+	}
+	if !s.startedAt.IsZero() {
+		summary.DurationMs = now.Sub(s.startedAt).Milliseconds()
+		summary.ActiveMs = s.activeTime().Milliseconds()
+		summary.PausedMs = s.pausedTime().Milliseconds()
+	}
+
+	totals := maps.Clone(s.droppedTotals)
+	if totals == nil {
+		totals = make(map[string]LapTotals)
+	}
+	for _, lap := range s.lapHistory {
+		if lap.Accidental {
+			continue
+		}
+		clientTotals := totals[lap.Client]
+		clientTotals.add(lap)
+		totals[lap.Client] = clientTotals
+	}
+	stats := make(map[string]*ParticipantStat)
+	handicapped := make(map[string]bool)
+	for client, clientTotals := range totals {
+		stats[client] = &ParticipantStat{
+			Client:          client,
+			Laps:            clientTotals.Laps,
+			Skips:           clientTotals.Skips,
+			TotalMs:         clientTotals.TotalMs,
+			AdjustedTotalMs: clientTotals.AdjustedTotalMs,
+		}
+		handicapped[client] = clientTotals.Handicapped
+	}
+	for client, missed := range s.missedTurns {
+		stat, exists := stats[client]
+		if !exists {
+			stat = &ParticipantStat{Client: client}
+			stats[client] = stat
+		}
+		stat.MissedTurns = missed
+	}
+	for client, overtime := range s.overtime {
+		if stat, exists := stats[client]; exists {
+			stat.OvertimeMs = overtime.Milliseconds()
+		}
+	}
+	summary.Participants = make([]ParticipantStat, 0, len(stats))
+	for _, stat := range stats {
+		if stat.Laps > 0 {
+			stat.AverageMs = stat.TotalMs / int64(stat.Laps)
+			stat.AdjustedAverageMs = stat.AdjustedTotalMs / int64(stat.Laps)
+		}
+		if !handicapped[stat.Client] {
+			stat.AdjustedTotalMs = 0
+			stat.AdjustedAverageMs = 0
+		}
+		summary.Participants = append(summary.Participants, *stat)
+	}
+	sort.Slice(summary.Participants, func(i, j int) bool {
+		return summary.Participants[i].Client < summary.Participants[j].Client
+	})
+	return summary
+}
+
+// checkMaxDuration warns, then finishes the session once it runs past its maximum duration
+func (s *Session) checkMaxDuration() {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if s.settings.MaxDurationMs == 0 || s.startedAt.IsZero() || s.finished {
+		return
+	}
+	left := time.Duration(s.settings.MaxDurationMs)*time.Millisecond - time.Since(s.startedAt)
+	if left <= 0 {
+		s.finish("maxDuration")
+		go s.broadcastState()
+		return
+	}
+	if left <= finishWarningLead && !s.finishWarned {
+		s.finishWarned = true
+		go s.broadcastEvent(map[string]interface{}{
+			"type":        "finishWarning",
+			"remainingMs": left.Milliseconds(),
+		})
+	}
+}
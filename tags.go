@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// Sessions can carry freeform tags like "team:payments" or "type:standup",
+// kept in the archive and used to filter the admin list and the history
+// with ?tag=..., repeated for sessions having them all.
+
+const maxTags = 10
+
+// validTag is lowercase, without spaces, up to 40 characters
+var validTag = regexp.MustCompile(`^[a-z0-9][a-z0-9:._/-]{0,39}$`)
+
+// validateTags checks the tags of the settings
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("no more than %d tags", maxTags)
+	}
+	for _, tag := range tags {
+		if !validTag.MatchString(tag) {
+			return fmt.Errorf("tag %q should be up to 40 lowercase letters, digits and :._/-", tag)
+		}
+	}
+	return nil
+}
+
+// tagsFromQuery returns the tags a request filters on
+func tagsFromQuery(r *http.Request) []string {
+	return r.URL.Query()["tag"]
+}
+
+// hasTags reports whether tags include every one of wanted
+func hasTags(tags []string, wanted []string) bool {
+	for _, tag := range wanted {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleAdminTags serves PUT /admin/api/sessions/{id}/tags with a body like
+// {"tags": ["team:payments"]}, replacing the session's tags
+func handleAdminTags(w http.ResponseWriter, r *http.Request, session *Session) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(body.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.stateMux.Lock()
+	session.settings.Tags = body.Tags
+	session.stateMux.Unlock()
+	log.Printf("Session %s: Tags set to %v by an admin\n", session.ID, body.Tags)
+	go session.broadcastState()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"tags": body.Tags})
+}
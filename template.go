@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Templates are named settings kept on the server, e.g. "standup". A new
+// session starts from one with {"template": "standup"}, its own settings
+// applying on top. Admins manage them under /admin/api/templates, and
+// they're listed for everyone.
+//
+// Hosts save their session's settings with the saveTemplate:<name>
+// command. Those get a private name with a random code, e.g.
+// "standup.k3x9mp", so nobody can take over a name others rely on. They
+// aren't listed, whoever has the name can start from one.
+
+// errTemplateExists is returned when saving a template under a taken name
+// without replacing it
+var errTemplateExists = errors.New("a template with that name already exists")
+
+// validTemplateName is lowercase letters, digits and dashes, up to 40
+var validTemplateName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// maxTemplates is how many templates the server keeps
+const maxTemplates = 1000
+
+// privateTemplateSeparator comes before the random code of a host's
+// template, admin template names can't contain it
+const privateTemplateSeparator = "."
+
+// templateStore keeps the templates as JSON settings
+type templateStore interface {
+	template(name string) ([]byte, bool, error)
+	templates() (map[string][]byte, error)
+	// saveTemplate stores data under name, failing with errTemplateExists
+	// when the name is taken unless replace is set
+	saveTemplate(name string, data []byte, replace bool) error
+	deleteTemplate(name string) error
+}
+
+// templates is where the templates are kept, see main for the store it uses
+var templates templateStore = &memoryTemplates{saved: make(map[string][]byte)}
+
+// memoryTemplates keeps the templates until the server stops
+type memoryTemplates struct {
+	mu    sync.Mutex
+	saved map[string][]byte
+}
+
+func (t *memoryTemplates) template(name string) ([]byte, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data, ok := t.saved[name]
+	return data, ok, nil
+}
+
+func (t *memoryTemplates) templates() (map[string][]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	all := make(map[string][]byte, len(t.saved))
+	for name, data := range t.saved {
+		all[name] = data
+	}
+	return all, nil
+}
+
+func (t *memoryTemplates) saveTemplate(name string, data []byte, replace bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, taken := t.saved[name]; taken && !replace {
+		return errTemplateExists
+	}
+	t.saved[name] = data
+	return nil
+}
+
+func (t *memoryTemplates) deleteTemplate(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.saved, name)
+	return nil
+}
+
+// templateSettings returns the settings saved as template name
+func templateSettings(name string) (Settings, error) {
+	var settings Settings
+	data, ok, err := templates.template(name)
+	if err != nil {
+		return settings, err
+	}
+	if !ok {
+		return settings, fmt.Errorf("there is no template %q", name)
+	}
+	return settings, json.Unmarshal(data, &settings)
+}
+
+// saveTemplate keeps the reusable part of settings as template name, up to
+// maxTemplates of them
+func saveTemplate(name string, settings Settings, replace bool) error {
+	data, err := json.Marshal(settings.reusable())
+	if err != nil {
+		return err
+	}
+	if _, exists, err := templates.template(name); err != nil {
+		return err
+	} else if !exists {
+		saved, err := templates.templates()
+		if err != nil {
+			return err
+		}
+		if len(saved) >= maxTemplates {
+			return fmt.Errorf("the server keeps at most %d templates", maxTemplates)
+		}
+	}
+	return templates.saveTemplate(name, data, replace)
+}
+
+// checkTemplateName checks a name for a template
+func checkTemplateName(name string) error {
+	if !validTemplateName.MatchString(name) {
+		return errors.New("template names are up to 40 lowercase letters, digits and dashes")
+	}
+	return nil
+}
+
+// allTemplates returns the admins' templates by name, for clients to see
+func allTemplates() (map[string]Settings, error) {
+	saved, err := templates.templates()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]Settings, len(saved))
+	for name, data := range saved {
+		if strings.Contains(name, privateTemplateSeparator) {
+			continue
+		}
+		var settings Settings
+		if err := json.Unmarshal(data, &settings); err != nil {
+			log.Printf("Template %s is unreadable: %v\n", name, err)
+			continue
+		}
+		all[name] = settings.public()
+	}
+	return all, nil
+}
+
+// handleTemplates serves GET /api/templates, the admins' templates by name
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	all, err := allTemplates()
+	if err != nil {
+		log.Printf("Listing templates failed: %v\n", err)
+		http.Error(w, "Could not list the templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(all)
+}
+
+// handleAdminTemplates serves /admin/api/templates: GET lists them, PUT
+// /admin/api/templates/{name} with settings saves one, replacing it, and
+// DELETE removes one
+func handleAdminTemplates(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		handleTemplates(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		settings := defaultSettings()
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(); err != nil {
+			http.Error(w, "Invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkTemplateName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveTemplate(name, settings, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Template %s saved by an admin\n", name)
+	case http.MethodDelete:
+		if err := templates.deleteTemplate(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Template %s deleted by an admin\n", name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveAsTemplate runs the host's saveTemplate:<name> command, saving a
+// private template whose full name goes back in the ack
+func (s *Session) saveAsTemplate(hostID string, name string) {
+	s.stateMux.Lock()
+	settings := s.settings
+	s.stateMux.Unlock()
+
+	ack := map[string]interface{}{"type": "ack", "command": "saveTemplate:" + name, "status": "ok"}
+	name = strings.TrimSpace(name)
+	err := checkTemplateName(name)
+	if err == nil {
+		private := name + privateTemplateSeparator + newShortCode()
+		if err = saveTemplate(private, settings, false); err == nil {
+			log.Printf("Session %s: Settings saved as template %s\n", s.ID, private)
+			ack["template"] = private
+		}
+	}
+	if err != nil {
+		log.Printf("Session %s: saveTemplate rejected: %v\n", s.ID, err)
+		ack["status"], ack["reason"] = "rejected", err.Error()
+	}
+	go s.sendEvent(hostID, ack)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The timeline is the event log boiled down to what a person would tell
+// about the session afterwards: who joined and left, when it started and
+// paused, every lap and the finish. The retrospective view and the replay
+// read it from GET /api/sessions/{id}/timeline.
+
+// TimelineItem is one line of the timeline
+type TimelineItem struct {
+	Seq      uint64    `json:"seq"` // of the log entry it comes from
+	At       time.Time `json:"at"`
+	OffsetMs int64     `json:"offsetMs"` // since the first item
+	Type     string    `json:"type"`     // joined, left, started, paused, lap, reset, lapsEdited or finished
+	Client   string    `json:"client,omitempty"`
+	Text     string    `json:"text"`
+}
+
+// Timeline is what the timeline endpoint returns. Complete is false when the
+// start of the session was already dropped from the log.
+type Timeline struct {
+	Items    []TimelineItem `json:"items"`
+	Complete bool           `json:"complete"`
+}
+
+// timelineItem describes a log entry, false for the ones left out
+func timelineItem(entry LogEntry) (TimelineItem, bool) {
+	item := TimelineItem{Seq: entry.Seq, At: entry.At, Client: entry.Client}
+	switch {
+	case entry.Kind == "event" && (entry.Type == "clientJoined" || entry.Type == "clientLeft"):
+		var membership struct {
+			Client string `json:"client"`
+			Role   string `json:"role"`
+		}
+		data, _ := entry.Data.(json.RawMessage)
+		if json.Unmarshal(data, &membership) != nil {
+			return item, false
+		}
+		item.Client = membership.Client
+		if entry.Type == "clientJoined" {
+			item.Type, item.Text = "joined", membership.Client+" joined"
+		} else {
+			item.Type, item.Text = "left", membership.Client+" left"
+		}
+		if membership.Role == "device" {
+			item.Text += " as a device"
+		}
+
+	case entry.Kind == "transition":
+		item.Type = entry.Type
+		switch entry.Type {
+		case "started":
+			item.Text = "Timer started"
+			if entry.Client != "" {
+				item.Text += " on " + entry.Client + "'s turn"
+			}
+		case "paused":
+			item.Text = "Timer paused"
+		case "lap":
+			lap, _ := entry.Data.(Lap)
+			if lap.Skipped {
+				item.Text = lap.Client + " skipped their turn"
+			} else {
+				item.Text = fmt.Sprintf("%s spoke for %v", lap.Client, lapDuration(lap.Time))
+			}
+		case "reset":
+			item.Text = "Laps reset"
+		case "lapsEdited":
+			laps, _ := entry.Data.(map[string]int)
+			item.Text = fmt.Sprintf("Laps edited, %d left", laps["laps"])
+		case "finished":
+			item.Text = "Session finished"
+		default:
+			return item, false
+		}
+
+	default:
+		return item, false
+	}
+	return item, true
+}
+
+// lapDuration rounds a lap for reading, to the second past a minute
+func lapDuration(d time.Duration) time.Duration {
+	if d >= time.Minute {
+		return d.Round(time.Second)
+	}
+	return d.Round(100 * time.Millisecond)
+}
+
+// timeline assembles the session's timeline from its event log
+func (s *Session) timeline() Timeline {
+	page := s.events.since(0)
+	timeline := Timeline{Items: []TimelineItem{}, Complete: page.Complete}
+	for _, entry := range page.Entries {
+		item, ok := timelineItem(entry)
+		if !ok {
+			continue
+		}
+		if len(timeline.Items) > 0 {
+			item.OffsetMs = item.At.Sub(timeline.Items[0].At).Milliseconds()
+		}
+		timeline.Items = append(timeline.Items, item)
+	}
+	return timeline
+}
+
+// handleTimeline serves /api/sessions/{id}/timeline
+func handleTimeline(w http.ResponseWriter, session *Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(session.timeline())
+}
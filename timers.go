@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxTimers caps the named timers of one session
+	maxTimers = 20
+	// maxTimerIDLength caps a timer ID, e.g. "garlic bread"
+	maxTimerIDLength = 40
+)
+
+// TimerSettings configure a named timer created with the session
+type TimerSettings struct {
+	CountdownMs int64 `json:"countdownMs,omitempty"` // 0 counts up
+}
+
+// NamedTimer is a clock that runs alongside the turn timer, anyone in the
+// session can drive it
+type NamedTimer struct {
+	countdown time.Duration
+	running   bool
+	startTime time.Time
+	elapsed   time.Duration
+	expired   bool
+}
+
+// NamedTimerState is what clients see of a named timer
+type NamedTimerState struct {
+	Running     bool   `json:"running"`
+	ElapsedMs   int64  `json:"elapsedMs"`
+	CountdownMs int64  `json:"countdownMs,omitempty"`
+	RemainingMs *int64 `json:"remainingMs,omitempty"`
+	Expired     bool   `json:"expired,omitempty"`
+}
+
+// total is how long the timer has run
+func (t *NamedTimer) total() time.Duration {
+	if t.running {
+		return t.elapsed + time.Since(t.startTime)
+	}
+	return t.elapsed
+}
+
+// validateTimerID checks the name of a named timer, it is used in commands
+// so it cannot contain a colon
+func validateTimerID(id string) error {
+	switch {
+	case strings.TrimSpace(id) == "":
+		return fmt.Errorf("timer ID cannot be empty")
+	case utf8.RuneCountInString(id) > maxTimerIDLength:
+		return fmt.Errorf("timer ID cannot be longer than %d characters", maxTimerIDLength)
+	case strings.Contains(id, ":"):
+		return fmt.Errorf("timer ID %q cannot contain a colon", id)
+	}
+	return nil
+}
+
+// validateTimers checks the named timers requested in the settings
+func validateTimers(timers map[string]TimerSettings) error {
+	if len(timers) > maxTimers {
+		return fmt.Errorf("timers cannot have more than %d entries", maxTimers)
+	}
+	for id, timer := range timers {
+		if err := validateTimerID(id); err != nil {
+			return fmt.Errorf("timers: %v", err)
+		}
+		if timer.CountdownMs < 0 {
+			return fmt.Errorf("timers: countdownMs for %q cannot be negative", id)
+		}
+	}
+	return nil
+}
+
+// newNamedTimers creates the timers requested in the settings
+func newNamedTimers(timers map[string]TimerSettings) map[string]*NamedTimer {
+	named := make(map[string]*NamedTimer, len(timers))
+	for id, timer := range timers {
+		named[id] = &NamedTimer{countdown: time.Duration(timer.CountdownMs) * time.Millisecond}
+	}
+	return named
+}
+
+// handleTimerCommand runs the named timer commands:
+//
+//	addTimer:sauce[:countdownMs]
+//	removeTimer:sauce
+//	timer:sauce:start, timer:sauce:pause, timer:sauce:reset
+func (s *Session) handleTimerCommand(clientID string, name string, arg string) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	switch name {
+	case "addTimer":
+		id, countdown, _ := strings.Cut(arg, ":")
+		if err := validateTimerID(id); err != nil {
+			log.Printf("Session %s: %s cannot add timer: %v\n", s.ID, clientID, err)
+			return
+		}
+		if _, exists := s.timers[id]; exists || len(s.timers) >= maxTimers {
+			log.Printf("Session %s: %s cannot add timer %q, it exists or there are too many\n", s.ID, clientID, id)
+			return
+		}
+		var countdownMs int64
+		if countdown != "" {
+			ms, err := strconv.ParseInt(countdown, 10, 64)
+			if err != nil || ms < 0 {
+				log.Printf("Session %s: Bad countdown for timer %q: %q\n", s.ID, id, countdown)
+				return
+			}
+			countdownMs = ms
+		}
+		s.timers[id] = &NamedTimer{countdown: time.Duration(countdownMs) * time.Millisecond}
+		log.Printf("Session %s: %s added timer %q\n", s.ID, clientID, id)
+	case "removeTimer":
+		delete(s.timers, arg)
+		log.Printf("Session %s: %s removed timer %q\n", s.ID, clientID, arg)
+	case "timer":
+		id, action, _ := strings.Cut(arg, ":")
+		timer, exists := s.timers[id]
+		if !exists {
+			log.Printf("Session %s: %s sent %q to unknown timer %q\n", s.ID, clientID, action, id)
+			return
+		}
+		switch action {
+		case "start":
+			if !timer.running {
+				timer.running = true
+				timer.startTime = time.Now()
+			}
+		case "pause":
+			timer.elapsed = timer.total()
+			timer.running = false
+		case "reset":
+			timer.running = false
+			timer.elapsed = 0
+			timer.expired = false
+		default:
+			log.Printf("Session %s: Unknown action %q for timer %q\n", s.ID, action, id)
+			return
+		}
+	}
+	go s.broadcastState()
+}
+
+// checkNamedTimers announces named countdowns as they run out, they keep
+// counting so the overrun shows
+func (s *Session) checkNamedTimers() {
+	s.stateMux.Lock()
+	expired := []string{}
+	for id, timer := range s.timers {
+		if timer.countdown > 0 && !timer.expired && timer.total() >= timer.countdown {
+			timer.expired = true
+			expired = append(expired, id)
+		}
+	}
+	s.stateMux.Unlock()
+
+	for _, id := range expired {
+		log.Printf("Session %s: Timer %q ran out\n", s.ID, id)
+		s.broadcastEvent(map[string]interface{}{
+			"type":  "timerExpired",
+			"timer": id,
+		})
+	}
+}
+
+// namedTimerStates reports every named timer, stateMux must be held
+func (s *Session) namedTimerStates() map[string]NamedTimerState {
+	states := make(map[string]NamedTimerState, len(s.timers))
+	for id, timer := range s.timers {
+		total := timer.total()
+		state := NamedTimerState{
+			Running:   timer.running,
+			ElapsedMs: total.Milliseconds(),
+			Expired:   timer.expired,
+		}
+		if timer.countdown > 0 {
+			remaining := max(timer.countdown-total, 0).Milliseconds()
+			state.CountdownMs = timer.countdown.Milliseconds()
+			state.RemainingMs = &remaining
+		}
+		states[id] = state
+	}
+	return states
+}
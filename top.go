@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// runTop is the "pastatime top" subcommand: a live view of an instance's
+// sessions in the terminal, read from the admin API with the token in
+// PASTATIME_ADMIN_TOKEN
+func runTop(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "address of the Pastatime server")
+	interval := flags.Duration("interval", 2*time.Second, "time between refreshes")
+	flags.Parse(args)
+
+	token := adminTokenFromEnv()
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "pastatime top: set PASTATIME_ADMIN_TOKEN to the server's admin token")
+		os.Exit(2)
+	}
+	if *interval < 100*time.Millisecond {
+		*interval = 100 * time.Millisecond
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	url := strings.TrimSuffix(*baseURL, "/") + "/admin/api/sessions"
+	var previous *InstanceInfo
+	for {
+		instance, err := fetchInstance(client, url, token)
+		if err != nil {
+			fmt.Printf("\033[H\033[2J%s\n\npastatime top: %v\n", *baseURL, err)
+		} else {
+			fmt.Print("\033[H\033[2J" + renderTop(*baseURL, instance, previous))
+			previous = instance
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// fetchInstance reads the admin API's session list
+func fetchInstance(client *http.Client, url string, token string) (*InstanceInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API answered %s", resp.Status)
+	}
+	var instance InstanceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// renderTop lays the sessions out as a table, broadcast rates are worked
+// out against the previous refresh
+func renderTop(baseURL string, instance *InstanceInfo, previous *InstanceInfo) string {
+	lastBroadcasts := make(map[string]uint64)
+	var since time.Duration
+	if previous != nil {
+		since = instance.Now.Sub(previous.Now)
+		for _, session := range previous.Sessions {
+			lastBroadcasts[session.ID] = session.Broadcasts
+		}
+	}
+
+	clients, running := 0, 0
+	for _, session := range instance.Sessions {
+		clients += session.Clients
+		if session.Running {
+			running++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "pastatime top - %s - %s\n", baseURL, instance.Now.Local().Format("15:04:05"))
+	load := ""
+	if instance.Loaded {
+		load = ", under load"
+	}
+	fmt.Fprintf(&b, "%d sessions, %d running, %d clients connected, %d panics recovered%s\n\n",
+		len(instance.Sessions), running, clients, instance.Panics, load)
+	fmt.Fprintf(&b, "%-24s %-20s %-6s %7s %-16s %-9s %5s %5s %8s %6s %9s %7s\n",
+		"SESSION", "TITLE", "PRIO", "CLIENTS", "SPEAKER", "STATE", "ROUND", "LAPS", "MSG/S", "GOROUT", "QUEUED", "AGE")
+	for _, session := range instance.Sessions {
+		state := "paused"
+		switch {
+		case session.Finished:
+			state = "finished"
+		case session.Running:
+			state = "running"
+		}
+		if session.Resources.Degraded {
+			// The circuit breaker slowed it down
+			state += "!"
+		}
+		rate := "-"
+		if last, ok := lastBroadcasts[session.ID]; ok && since > 0 {
+			rate = fmt.Sprintf("%.1f", float64(session.Broadcasts-last)/since.Seconds())
+		}
+		age := instance.Now.Sub(session.CreatedAt).Round(time.Second)
+		fmt.Fprintf(&b, "%-24s %-20s %-6s %7d %-16s %-9s %5d %5d %8s %6d %9d %7s\n",
+			truncate(session.ID, 24), truncate(session.Title, 20), session.Priority, session.Clients,
+			truncate(session.ActiveClient, 16), state, session.Round, session.Laps, rate,
+			session.Resources.Goroutines, session.Resources.QueuedBytes, age)
+	}
+	fmt.Fprintf(&b, "\n! over a limit and ticking slower (goroutines %d, queued bytes %d, msg/s %d)\n",
+		instance.Limits.Goroutines, instance.Limits.QueuedBytes, instance.Limits.BroadcastsPerSec)
+	return b.String()
+}
+
+// truncate shortens s to n runes for a table column
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpeechProvider turns announcement text into audio
+type SpeechProvider interface {
+	Synthesize(ctx context.Context, text string) (audio []byte, contentType string, err error)
+}
+
+// commandSpeech runs a local program, e.g. "espeak-ng --stdin --stdout", that
+// reads the text on stdin and writes a WAV file to stdout
+type commandSpeech struct {
+	args []string
+}
+
+func (c commandSpeech) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), "audio/wav", nil
+}
+
+// httpSpeech posts the text to a TTS service and relays the audio it returns
+type httpSpeech struct {
+	url string
+}
+
+func (h httpSpeech) Synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, strings.NewReader(text))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("tts service returned %s", resp.Status)
+	}
+	audio, err := io.ReadAll(io.LimitReader(resp.Body, maxAnnouncementSize))
+	return audio, resp.Header.Get("Content-Type"), err
+}
+
+// speechProviderFromEnv picks the TTS provider configured for this server,
+// PASTATIME_TTS_COMMAND wins over PASTATIME_TTS_URL. It returns nil if
+// neither is set, announcements are then text only.
+func speechProviderFromEnv() SpeechProvider {
+	if command := strings.Fields(os.Getenv("PASTATIME_TTS_COMMAND")); len(command) > 0 {
+		log.Printf("Announcements spoken by %q\n", command[0])
+		return commandSpeech{args: command}
+	}
+	if url := os.Getenv("PASTATIME_TTS_URL"); url != "" {
+		log.Printf("Announcements spoken by %s\n", url)
+		return httpSpeech{url: url}
+	}
+	return nil
+}
+
+const (
+	// maxAnnouncementSize caps the audio kept for one announcement
+	maxAnnouncementSize = 2 << 20
+	// maxAnnouncements bounds the cache, the texts repeat from round to round
+	maxAnnouncements = 512
+	// speechTimeout bounds one synthesis
+	speechTimeout = 10 * time.Second
+)
+
+// announcement is a spoken text, synthesized the first time it is fetched
+type announcement struct {
+	text        string
+	once        sync.Once
+	audio       []byte
+	contentType string
+	err         error
+}
+
+var (
+	speech           SpeechProvider
+	announcements    = make(map[string]*announcement)
+	announcementsMux sync.Mutex
+)
+
+// announce registers text to be spoken and describes it for an event, the
+// audio URL is only set when the server has a TTS provider
+func announce(text string) map[string]interface{} {
+	described := map[string]interface{}{"text": text}
+	if speech == nil {
+		return described
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	key := hex.EncodeToString(sum[:12])
+	announcementsMux.Lock()
+	if _, exists := announcements[key]; !exists {
+		if len(announcements) >= maxAnnouncements {
+			announcements = make(map[string]*announcement)
+		}
+		announcements[key] = &announcement{text: text}
+	}
+	announcementsMux.Unlock()
+
+	described["audioUrl"] = "/tts/" + key
+	return described
+}
+
+// handleTTS serves /tts/{key}, the audio of an announcement
+func handleTTS(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/tts/")
+	announcementsMux.Lock()
+	a, exists := announcements[key]
+	announcementsMux.Unlock()
+	if !exists || speech == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	a.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), speechTimeout)
+		defer cancel()
+		a.audio, a.contentType, a.err = speech.Synthesize(ctx, a.text)
+		if a.err != nil {
+			log.Printf("Speech synthesis failed for %q: %v\n", a.text, a.err)
+		}
+	})
+	if a.err != nil {
+		http.Error(w, "Speech synthesis failed", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", soundsModTime, bytes.NewReader(a.audio))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Twitch bridge joins the chat of every session with a twitch
+// integration and answers commands like "!next" or "!timer" there. The bot
+// account is the server's, set with PASTATIME_TWITCH_NICK and
+// PASTATIME_TWITCH_TOKEN (an oauth: chat token).
+
+const (
+	twitchServer         = "irc.chat.twitch.tv:6697"
+	twitchReconnectDelay = 10 * time.Second
+	// twitchCommandPrefix starts a chat command, e.g. "!next"
+	twitchCommandPrefix = "!"
+)
+
+// twitchRoles rank the chat roles, a command is open to its role and above
+var twitchRoles = map[string]int{
+	"everyone":    0,
+	"subscriber":  1,
+	"vip":         2,
+	"moderator":   3,
+	"broadcaster": 4,
+}
+
+// twitchSessionCommands are the chat commands that drive the session, "timer"
+// only answers in chat
+var twitchSessionCommands = map[string]bool{
+	"start": true,
+	"pause": true,
+	"next":  true,
+	"skip":  true,
+}
+
+// defaultTwitchCommands are used when a session doesn't list its own
+var defaultTwitchCommands = map[string]TwitchCommand{
+	"timer": {Role: "everyone", CooldownMs: 10000},
+	"next":  {Role: "moderator", CooldownMs: 5000},
+}
+
+var twitchChannelName = regexp.MustCompile(`^[a-z0-9_]{3,25}$`)
+
+// TwitchIntegration maps a Twitch channel's chat to the session
+type TwitchIntegration struct {
+	Channel string `json:"channel"`
+	// Commands are the chat commands allowed, without the "!", defaulting
+	// to defaultTwitchCommands
+	Commands map[string]TwitchCommand `json:"commands,omitempty"`
+}
+
+// TwitchCommand restricts who may use a chat command and how often
+type TwitchCommand struct {
+	Role       string `json:"role"`                 // lowest role allowed, see twitchRoles
+	CooldownMs int64  `json:"cooldownMs,omitempty"` // between two uses in the channel
+}
+
+// validateTwitch checks a session's twitch integration
+func validateTwitch(t *TwitchIntegration) error {
+	if t == nil {
+		return nil
+	}
+	if twitch == nil {
+		return errors.New("integrations: twitch is not configured on this server")
+	}
+	if !twitchChannelName.MatchString(t.Channel) {
+		return fmt.Errorf("integrations: %q is not a twitch channel name", t.Channel)
+	}
+	if sessionID := twitch.liveSession(t.Channel); sessionID != "" {
+		return fmt.Errorf("integrations: twitch channel %q already drives another session", t.Channel)
+	}
+	for name, command := range t.Commands {
+		if name != "timer" && !twitchSessionCommands[name] {
+			return fmt.Errorf("integrations: unknown twitch command %q", name)
+		}
+		if _, ok := twitchRoles[command.Role]; !ok {
+			return fmt.Errorf("integrations: unknown role %q for twitch command %q", command.Role, name)
+		}
+		if command.CooldownMs < 0 {
+			return fmt.Errorf("integrations: cooldownMs for twitch command %q cannot be negative", name)
+		}
+	}
+	return nil
+}
+
+// twitchBridge is a minimal Twitch IRC client that reconnects on its own
+type twitchBridge struct {
+	nick  string
+	token string
+
+	mu       sync.Mutex // guards conn, channels and lastUsed
+	conn     net.Conn
+	channels map[string]string    // channel -> session ID, the first live session keeps it
+	lastUsed map[string]time.Time // channel + command -> last use, for the cooldowns
+}
+
+var twitch *twitchBridge
+
+// twitchBridgeFromEnv connects the bot if PASTATIME_TWITCH_NICK and
+// PASTATIME_TWITCH_TOKEN are set
+func twitchBridgeFromEnv() *twitchBridge {
+	nick, token := os.Getenv("PASTATIME_TWITCH_NICK"), os.Getenv("PASTATIME_TWITCH_TOKEN")
+	if nick == "" || token == "" {
+		return nil
+	}
+	if !strings.HasPrefix(token, "oauth:") {
+		token = "oauth:" + token
+	}
+	b := &twitchBridge{
+		nick:     strings.ToLower(nick),
+		token:    token,
+		channels: make(map[string]string),
+		lastUsed: make(map[string]time.Time),
+	}
+	go b.run()
+	log.Printf("Twitch bridge chatting as %s\n", b.nick)
+	return b
+}
+
+// run keeps the bot connected, reading chat until the connection drops
+func (b *twitchBridge) run() {
+	for {
+		conn, err := tls.Dial("tcp", twitchServer, nil)
+		if err != nil {
+			log.Printf("Twitch: %v, retrying in %v\n", err, twitchReconnectDelay)
+			time.Sleep(twitchReconnectDelay)
+			continue
+		}
+		b.mu.Lock()
+		b.conn = conn
+		fmt.Fprintf(conn, "PASS %s\r\nNICK %s\r\nCAP REQ :twitch.tv/tags\r\n", b.token, b.nick)
+		for channel := range b.channels {
+			fmt.Fprintf(conn, "JOIN #%s\r\n", channel)
+		}
+		b.mu.Unlock()
+
+		err = b.read(conn)
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+		conn.Close()
+		log.Printf("Twitch: connection lost: %v\n", err)
+		time.Sleep(twitchReconnectDelay)
+	}
+}
+
+// send writes one IRC line if the bot is connected
+func (b *twitchBridge) send(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		fmt.Fprintf(b.conn, "%s\r\n", line)
+	}
+}
+
+// liveSession is the session a channel drives, or "" if it's free or its
+// session is gone
+func (b *twitchBridge) liveSession(channel string) string {
+	b.mu.Lock()
+	sessionID := b.channels[channel]
+	b.mu.Unlock()
+	if sessionID == "" {
+		return ""
+	}
+	if _, exists := sessionStore.Get(sessionID); !exists {
+		return ""
+	}
+	return sessionID
+}
+
+// join maps a channel to a session and joins its chat, unless the channel
+// already drives another live session
+func (b *twitchBridge) join(channel string, sessionID string) {
+	// The store is checked without b.mu, adopting a session joins too
+	if current := b.liveSession(channel); current != "" && current != sessionID {
+		log.Printf("Twitch: #%s already drives session %s, not joining for %s\n", channel, current, sessionID)
+		return
+	}
+	b.mu.Lock()
+	b.channels[channel] = sessionID
+	b.mu.Unlock()
+	b.send("JOIN #" + channel)
+	log.Printf("Twitch: #%s now drives session %s\n", channel, sessionID)
+}
+
+// leave unmaps a channel from a retired session and parts its chat
+func (b *twitchBridge) leave(channel string, sessionID string) {
+	b.mu.Lock()
+	if b.channels[channel] != sessionID {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.channels, channel)
+	for key := range b.lastUsed {
+		if strings.HasPrefix(key, channel+" ") {
+			delete(b.lastUsed, key)
+		}
+	}
+	b.mu.Unlock()
+	b.send("PART #" + channel)
+	log.Printf("Twitch: #%s left with session %s\n", channel, sessionID)
+}
+
+// read handles chat lines until the connection fails
+func (b *twitchBridge) read(conn net.Conn) error {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "PING") {
+			b.send("PONG" + strings.TrimPrefix(line, "PING"))
+			continue
+		}
+		if message, ok := parseTwitchMessage(line); ok {
+			b.handleMessage(message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("closed by the server")
+}
+
+// twitchMessage is a chat message with the role of its sender
+type twitchMessage struct {
+	channel string
+	user    string
+	role    string
+	text    string
+}
+
+// parseTwitchMessage reads a PRIVMSG line like
+// "@badges=moderator/1;... :nick!nick@nick.tmi.twitch.tv PRIVMSG #channel :!next"
+func parseTwitchMessage(line string) (twitchMessage, bool) {
+	var message twitchMessage
+	tags := ""
+	if strings.HasPrefix(line, "@") {
+		tags, line, _ = strings.Cut(line[1:], " ")
+	}
+	prefix, rest, _ := strings.Cut(strings.TrimPrefix(line, ":"), " ")
+	command, rest, _ := strings.Cut(rest, " ")
+	if command != "PRIVMSG" {
+		return message, false
+	}
+	channel, text, ok := strings.Cut(rest, " :")
+	if !ok {
+		return message, false
+	}
+	message.channel = strings.TrimPrefix(channel, "#")
+	message.user, _, _ = strings.Cut(prefix, "!")
+	message.text = text
+
+	message.role = "everyone"
+	for _, tag := range strings.Split(tags, ";") {
+		key, value, _ := strings.Cut(tag, "=")
+		if key != "badges" {
+			continue
+		}
+		for _, badge := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(badge, "/")
+			if twitchRoles[name] > twitchRoles[message.role] {
+				message.role = name
+			}
+		}
+	}
+	return message, true
+}
+
+// handleMessage runs a chat command if the sender's role and the command's
+// cooldown allow it
+func (b *twitchBridge) handleMessage(message twitchMessage) {
+	if !strings.HasPrefix(message.text, twitchCommandPrefix) {
+		return
+	}
+	name := strings.ToLower(strings.Fields(strings.TrimPrefix(message.text, twitchCommandPrefix) + " ")[0])
+
+	b.mu.Lock()
+	sessionID := b.channels[message.channel]
+	b.mu.Unlock()
+	session, exists := sessionStore.Get(sessionID)
+	if !exists {
+		return
+	}
+
+	session.stateMux.Lock()
+	var commands map[string]TwitchCommand
+	if session.settings.Integrations != nil && session.settings.Integrations.Twitch != nil {
+		commands = session.settings.Integrations.Twitch.Commands
+	}
+	session.stateMux.Unlock()
+	if commands == nil {
+		commands = defaultTwitchCommands
+	}
+	command, allowed := commands[name]
+	if !allowed || twitchRoles[message.role] < twitchRoles[command.Role] {
+		return
+	}
+
+	// The cooldown is per channel, so a busy chat can't spam the session
+	key := message.channel + " " + name
+	b.mu.Lock()
+	if time.Since(b.lastUsed[key]) < time.Duration(command.CooldownMs)*time.Millisecond {
+		b.mu.Unlock()
+		return
+	}
+	b.lastUsed[key] = time.Now()
+	b.mu.Unlock()
+
+	if name == "timer" {
+		b.send(fmt.Sprintf("PRIVMSG #%s :%s", message.channel, session.statusText()))
+		return
+	}
+	session.remoteCommand("Twitch user "+message.user, name)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// SkipVotes is who has voted to skip the active client's turn
+type SkipVotes struct {
+	Client string   `json:"client"` // whose turn the votes are against
+	Votes  []string `json:"votes"`
+	Needed int      `json:"needed"`
+}
+
+// skipVoteTally counts the votes against the active client, nil when the
+// session doesn't vote or nobody has the turn. Only connected participants
+// other than the speaker can vote, VoteSkipPercent of them are needed.
+// clientsMux and stateMux must be held.
+func (s *Session) skipVoteTally() *SkipVotes {
+	if s.settings.VoteSkipPercent == 0 || s.activeClientID == "" {
+		return nil
+	}
+	tally := &SkipVotes{Client: s.activeClientID, Votes: []string{}}
+	voters := 0
+	for id, client := range s.clients {
+		if client.offline || client.device || id == s.activeClientID {
+			continue
+		}
+		voters++
+		if s.skipVotesFor == s.activeClientID && s.skipVotes[id] {
+			tally.Votes = append(tally.Votes, id)
+		}
+	}
+	sort.Strings(tally.Votes)
+	// Rounded up, and always at least one vote
+	tally.Needed = max((voters*s.settings.VoteSkipPercent+99)/100, 1)
+	return tally
+}
+
+// voteSkip records clientID's vote against the active client's turn and
+// skips it once enough participants agree
+func (s *Session) voteSkip(clientID string) {
+	s.clientsMux.Lock()
+	s.stateMux.Lock()
+	if clientID == s.activeClientID || !s.isRunning {
+		s.stateMux.Unlock()
+		s.clientsMux.Unlock()
+		log.Printf("Session %s: %s cannot vote to skip right now\n", s.ID, clientID)
+		return
+	}
+	if s.skipVotesFor != s.activeClientID {
+		// The turn was handed on since the last vote, start over
+		clear(s.skipVotes)
+		s.skipVotesFor = s.activeClientID
+	}
+	s.skipVotes[clientID] = true
+	tally := s.skipVoteTally()
+	passed := tally != nil && len(tally.Votes) >= tally.Needed
+	if passed {
+		// Like a next press, so a late click doesn't end the following turn too
+		s.lastNextAt = time.Now()
+		clear(s.skipVotes)
+	}
+	s.stateMux.Unlock()
+	s.clientsMux.Unlock()
+	if tally == nil {
+		return
+	}
+	log.Printf("Session %s: %s voted to skip %s, %d of %d\n", s.ID, clientID, tally.Client, len(tally.Votes), tally.Needed)
+
+	if !passed {
+		go s.broadcastState()
+		return
+	}
+	go s.broadcastEvent(map[string]interface{}{
+		"type":   "turnSkippedByVote",
+		"client": tally.Client,
+		"votes":  tally.Votes,
+	})
+	s.advanceTurn(tally.Client, "", endVote)
+}
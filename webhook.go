@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A session can call a webhook the moment a speaker runs over their limit,
+// so a facilitator bot can nudge them in the meeting chat while it still
+// matters. The limit is the target turn length, or the countdown without
+// one, and the webhook fires once per turn, MarginMs past it.
+
+// webhookClient calls the webhooks, redirects are not followed so only the
+// allowed hosts are called
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// WebhookIntegration is where a session posts its overtime notifications
+type WebhookIntegration struct {
+	URL      string `json:"url"`
+	MarginMs int64  `json:"marginMs"`
+	// Secret signs the body, sent as "X-Pastatime-Signature: sha256=<hmac>"
+	Secret string `json:"secret,omitempty"`
+}
+
+// OvertimeNotification is the body posted to the webhook
+type OvertimeNotification struct {
+	Type        string    `json:"type"` // "overtime"
+	Session     string    `json:"session"`
+	SessionName string    `json:"sessionName,omitempty"`
+	URL         string    `json:"url,omitempty"` // with PASTATIME_BASE_URL set
+	Client      string    `json:"client"`
+	ElapsedMs   int64     `json:"elapsedMs"`
+	LimitMs     int64     `json:"limitMs"`
+	OverByMs    int64     `json:"overByMs"`
+	At          time.Time `json:"at"`
+}
+
+// webhookHostAllowed reports whether the server lets sessions call webhooks
+// at host, PASTATIME_WEBHOOK_HOSTS lists them separated by commas
+func webhookHostAllowed(host string) bool {
+	for _, allowed := range strings.Split(os.Getenv("PASTATIME_WEBHOOK_HOSTS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == host {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWebhook checks the webhook of the integrations block
+func validateWebhook(webhook *WebhookIntegration) error {
+	if webhook == nil {
+		return nil
+	}
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return errors.New("integrations: webhook url should be an http(s) URL")
+	}
+	if !webhookHostAllowed(target.Host) {
+		return fmt.Errorf("integrations: webhook host %q is not allowed on this server", target.Host)
+	}
+	if webhook.MarginMs < 0 {
+		return errors.New("integrations: webhook marginMs cannot be negative")
+	}
+	return nil
+}
+
+// turnLimit is the turn length past which the speaker is over their limit,
+// 0 without one. stateMux must be held.
+func (s *Session) turnLimit() time.Duration {
+	if s.settings.TargetMs > 0 {
+		return time.Duration(s.settings.TargetMs) * time.Millisecond
+	}
+	return time.Duration(s.settings.CountdownMs) * time.Millisecond
+}
+
+// checkOvertimeWebhook notifies the webhook once the active client is
+// MarginMs over their limit
+func (s *Session) checkOvertimeWebhook() {
+	s.stateMux.Lock()
+	integrations := s.settings.Integrations
+	limit := s.turnLimit()
+	if integrations == nil || integrations.Webhook == nil || limit == 0 || !s.isRunning || s.overtimeHooked {
+		s.stateMux.Unlock()
+		return
+	}
+	webhook := *integrations.Webhook
+	turn := s.currentTurn()
+	if turn < limit+time.Duration(webhook.MarginMs)*time.Millisecond {
+		s.stateMux.Unlock()
+		return
+	}
+	s.overtimeHooked = true
+	notification := OvertimeNotification{
+		Type:        "overtime",
+		Session:     s.ID,
+		SessionName: s.settings.Name,
+		ElapsedMs:   turn.Milliseconds(),
+		LimitMs:     limit.Milliseconds(),
+		OverByMs:    (turn - limit).Milliseconds(),
+		At:          time.Now(),
+	}
+	s.stateMux.Unlock()
+
+	s.clientsMux.Lock()
+	notification.Client = s.activeClientID
+	s.clientsMux.Unlock()
+	if baseURL != "" {
+		notification.URL = baseURL + "/s/" + s.ID
+	}
+	go s.postWebhook(webhook, notification)
+}
+
+// postWebhook posts the notification, signed when the webhook has a secret
+func (s *Session) postWebhook(webhook WebhookIntegration, notification OvertimeNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Session %s: Bad webhook request: %v\n", s.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(webhook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Pastatime-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		log.Printf("Session %s: Webhook unreachable: %v\n", s.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Session %s: Webhook answered %s\n", s.ID, resp.Status)
+	}
+}